@@ -3,16 +3,39 @@ package assertion
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt"
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/log"
 	oer "github.com/lyokato/goidc/oauth_error"
 )
 
+// Options are the optional settings of HandleAssertionError, nil is same as the zero value.
+type Options struct {
+	// receives 'assertion_replayed' event when ReplayCache or RecordAssertionClaims
+	// rejects the assertion
+	AuditSink audit.Sink
+	// nil skips the checks of Policy
+	Policy *Policy
+	// time.Now() when zero
+	Now time.Time
+	// true for client_assertion, whose violations of Policy and replays are invalid_client
+	ClientAuthentication bool
+}
+
 func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 	gt string, c bridge.Client, sdi bridge.DataInterface,
-	logger log.Logger) *oer.OAuthError {
+	logger log.Logger, opts *Options) *oer.OAuthError {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	sink, policy, now := opts.AuditSink, opts.Policy, opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
 
 	if jwt_err != nil {
 
@@ -25,7 +48,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 			// - key func returns err
 			if inner, ok := ve.Inner.(*oer.OAuthError); ok {
 
-				logger.Debug(log.TokenEndpointLog(gt,
+				logger.Debug(log.TokenEndpointEntry(gt,
 					log.AssertionConditionMismatch,
 					map[string]string{"assertion": a},
 					"found OAuthError, so, returns it"))
@@ -34,7 +57,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 			} else {
 
-				logger.Debug(log.TokenEndpointLog(gt,
+				logger.Debug(log.TokenEndpointEntry(gt,
 					log.AssertionConditionMismatch,
 					map[string]string{"assertion": a},
 					"'assertion' unverifiable"))
@@ -46,7 +69,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 		if ve.Errors&jwt.ValidationErrorMalformed == jwt.ValidationErrorMalformed {
 
-			logger.Debug(log.TokenEndpointLog(gt,
+			logger.Debug(log.TokenEndpointEntry(gt,
 				log.AssertionConditionMismatch,
 				map[string]string{"assertion": a, "client_id": c.GetId()},
 				"invalid 'assertion' format"))
@@ -57,7 +80,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 		if ve.Errors&jwt.ValidationErrorSignatureInvalid == jwt.ValidationErrorSignatureInvalid {
 
-			logger.Info(log.TokenEndpointLog(gt,
+			logger.Info(log.TokenEndpointEntry(gt,
 				log.AssertionConditionMismatch,
 				map[string]string{"assertion": a, "client_id": c.GetId()},
 				"invalid 'assertion' signature"))
@@ -69,7 +92,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 		if ve.Errors&jwt.ValidationErrorExpired == jwt.ValidationErrorExpired {
 
-			logger.Info(log.TokenEndpointLog(gt,
+			logger.Info(log.TokenEndpointEntry(gt,
 				log.AssertionConditionMismatch,
 				map[string]string{"assertion": a, "client_id": c.GetId()},
 				"assertion expired"))
@@ -80,7 +103,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 		if ve.Errors&jwt.ValidationErrorNotValidYet == jwt.ValidationErrorNotValidYet {
 
-			logger.Info(log.TokenEndpointLog(gt,
+			logger.Info(log.TokenEndpointEntry(gt,
 				log.AssertionConditionMismatch,
 				map[string]string{"assertion": a, "client_id": c.GetId()},
 				"assertion not valid yet"))
@@ -90,7 +113,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 		}
 
 		// unknown error type
-		logger.Warn(log.TokenEndpointLog(gt,
+		logger.Warn(log.TokenEndpointEntry(gt,
 			log.AssertionConditionMismatch,
 			map[string]string{"assertion": a, "client_id": c.GetId()},
 			"unknown 'assertion' validation failure"))
@@ -102,7 +125,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 	if !t.Valid {
 
 		// must not come here
-		logger.Warn(log.TokenEndpointLog(gt,
+		logger.Warn(log.TokenEndpointEntry(gt,
 			log.AssertionConditionMismatch,
 			map[string]string{"assertion": a, "client_id": c.GetId()},
 			"invalid 'assertion' signature"))
@@ -130,7 +153,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 	if !exp_exists {
 
-		logger.Debug(log.TokenEndpointLog(gt,
+		logger.Debug(log.TokenEndpointEntry(gt,
 			log.MissingParam,
 			map[string]string{"param": "exp", "client_id": c.GetId()},
 			"'exp' not found in assertion"))
@@ -156,11 +179,27 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 		jti = found
 	}
 
-	err := sdi.RecordAssertionClaims(c.GetId(), jti, iat, exp)
+	// ReplayCache is checked before RecordAssertionClaims,
+	// so that the replay doesn't reach the store.
+	if policy != nil {
+		if oerr := checkPolicy(policy, gt, c, logger, opts.ClientAuthentication,
+			jti, iat, exp, now); oerr != nil {
+			return oerr
+		}
+		if oerr := checkReplayCache(policy, a, claims, gt, c, logger, sink,
+			opts.ClientAuthentication, jti, exp, now); oerr != nil {
+			return oerr
+		}
+	}
+
+	var err *bridge.Error
+	if policy == nil || !policy.SkipRecordAssertionClaims {
+		err = sdi.RecordAssertionClaims(c.GetId(), jti, iat, exp)
+	}
 	if err != nil {
 		if err.Type() == bridge.ErrFailed {
 
-			logger.Info(log.TokenEndpointLog(gt,
+			logger.Info(log.TokenEndpointEntry(gt,
 				log.AssertionConditionMismatch,
 				map[string]string{
 					"method":    "RecordAssertionClaims",
@@ -172,11 +211,12 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 				},
 				"failed to check with sub,jti,iat,exp"))
 
-			return oer.NewOAuthSimpleError(oer.ErrInvalidRequest)
+			recordReplay(sink, logger, gt, c, jti, now)
+			return oer.NewOAuthSimpleError(violation(opts.ClientAuthentication, oer.ErrInvalidRequest))
 
 		} else if err.Type() == bridge.ErrUnsupported {
 
-			logger.Error(log.TokenEndpointLog(gt,
+			logger.Error(log.TokenEndpointEntry(gt,
 				log.InterfaceUnsupported,
 				map[string]string{
 					"method":    "RecordAssertionClaims",
@@ -188,7 +228,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 		} else {
 
-			logger.Warn(log.TokenEndpointLog(gt,
+			logger.Warn(log.TokenEndpointEntry(gt,
 				log.InterfaceServerError,
 				map[string]string{
 					"method":    "RecordAssertionClaims",
@@ -198,9 +238,9 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 					"iat":       fmt.Sprintf("%d", iat),
 					"assertion": a,
 				},
-				"interface returned ServerError."))
+				fmt.Sprintf("interface returned error: %s", err)))
 
-			return oer.NewOAuthSimpleError(oer.ErrServerError)
+			return oer.NewInterfaceError(err)
 
 		}
 	}
@@ -208,7 +248,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 	aud, ok := claims["aud"].(string)
 	if !ok {
 
-		logger.Debug(log.TokenEndpointLog(gt,
+		logger.Debug(log.TokenEndpointEntry(gt,
 			log.MissingParam,
 			map[string]string{"param": "aud", "client_id": c.GetId()},
 			"'aud' not found in assertion"))
@@ -220,7 +260,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 	service := sdi.Issuer()
 	if service == "" {
 
-		logger.Error(log.TokenEndpointLog(gt,
+		logger.Error(log.TokenEndpointEntry(gt,
 			log.InterfaceUnsupported,
 			map[string]string{"method": "Issure"},
 			"the method returns 'unsupported' error."))
@@ -230,7 +270,7 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 	if aud != service {
 
-		logger.Info(log.TokenEndpointLog(gt,
+		logger.Info(log.TokenEndpointEntry(gt,
 			log.AssertionConditionMismatch,
 			map[string]string{"assertion": a, "client_id": c.GetId()},
 			"invalid 'aud'"))
@@ -241,3 +281,101 @@ func HandleAssertionError(a string, t *jwt.Token, jwt_err error,
 
 	return nil
 }
+
+func checkPolicy(policy *Policy, gt string, c bridge.Client, logger log.Logger,
+	clientAuthentication bool, jti string, iat, exp int64, now time.Time) *oer.OAuthError {
+
+	if jti == "" && policy.RequireJTI {
+
+		logger.Debug(log.TokenEndpointEntry(gt,
+			log.MissingParam,
+			map[string]string{"param": "jti", "client_id": c.GetId()},
+			"'jti' not found in assertion"))
+
+		return oer.NewOAuthError(violation(clientAuthentication, oer.ErrInvalidRequest),
+			"'jti' parameter not found in assertion")
+	}
+
+	if policy.MaxLifetime > 0 {
+		start := iat
+		if start < 0 {
+			start = now.Unix()
+		}
+		if time.Duration(exp-start)*time.Second > policy.MaxLifetime {
+
+			logger.Info(log.TokenEndpointEntry(gt,
+				log.AssertionConditionMismatch,
+				map[string]string{
+					"client_id": c.GetId(),
+					"exp":       fmt.Sprintf("%d", exp),
+					"iat":       fmt.Sprintf("%d", iat),
+				},
+				"assertion lifetime too long"))
+
+			return oer.NewOAuthError(violation(clientAuthentication, oer.ErrInvalidGrant),
+				fmt.Sprintf("assertion lifetime must not exceed %d seconds",
+					int64(policy.MaxLifetime/time.Second)))
+		}
+	}
+	return nil
+}
+
+func checkReplayCache(policy *Policy, a string, claims jwt.MapClaims,
+	gt string, c bridge.Client, logger log.Logger, sink audit.Sink,
+	clientAuthentication bool, jti string, exp int64, now time.Time) *oer.OAuthError {
+
+	if policy.ReplayCache == nil || jti == "" {
+		return nil
+	}
+
+	iss, _ := claims["iss"].(string)
+	if iss == "" {
+		iss = c.GetId()
+	}
+	fresh, err := policy.ReplayCache.Add(iss, jti, time.Unix(exp, 0), now)
+	if err != nil {
+
+		logger.Warn(log.TokenEndpointEntry(gt,
+			log.InterfaceServerError,
+			map[string]string{"method": "ReplayCache.Add", "client_id": c.GetId()},
+			fmt.Sprintf("replay cache returned error: %s", err)))
+
+		return oer.NewOAuthSimpleError(oer.ErrServerError)
+	}
+	if !fresh {
+
+		logger.Info(log.TokenEndpointEntry(gt,
+			log.AssertionConditionMismatch,
+			map[string]string{
+				"method":    "ReplayCache.Add",
+				"client_id": c.GetId(),
+				"iss":       iss,
+				"jti":       jti,
+				"assertion": a,
+			},
+			"assertion replayed"))
+
+		recordReplay(sink, logger, gt, c, jti, now)
+		return oer.NewOAuthSimpleError(violation(clientAuthentication, oer.ErrInvalidRequest))
+	}
+	return nil
+}
+
+// violation returns invalid_client for client_assertion,
+// because its rejection is the failure of the client authentication.
+func violation(clientAuthentication bool, typ oer.OAuthErrorType) oer.OAuthErrorType {
+	if clientAuthentication {
+		return oer.ErrInvalidClient
+	}
+	return typ
+}
+
+func recordReplay(sink audit.Sink, logger log.Logger,
+	gt string, c bridge.Client, jti string, now time.Time) {
+	e := audit.NewEvent(audit.AssertionReplayed, now, audit.Failure).
+		ByClient(c.GetId())
+	e.ClientId = c.GetId()
+	e.GrantType = gt
+	e.Reason = fmt.Sprintf("jti: %s", jti)
+	audit.Record(sink, logger, e)
+}
@@ -0,0 +1,28 @@
+package assertion
+
+import "time"
+
+// Policy is the additional rules for the assertions,
+// nil keeps the behavior of RecordAssertionClaims only.
+type Policy struct {
+	// checked before RecordAssertionClaims, nil to disable
+	ReplayCache ReplayCache
+	// when true, RecordAssertionClaims isn't called,
+	// and ReplayCache is the only replay protection.
+	SkipRecordAssertionClaims bool
+	// 'exp' minus 'iat' (or the current time when 'iat' is missing)
+	// must not exceed this, 0 for no limit.
+	MaxLifetime time.Duration
+	// rejects the assertion without 'jti'
+	RequireJTI bool
+}
+
+// DefaultPolicy requires 'jti', limits the lifetime to 5 minutes,
+// and checks the replay on the memory before RecordAssertionClaims.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		ReplayCache: NewMemoryReplayCache(time.Minute),
+		MaxLifetime: 5 * time.Minute,
+		RequireJTI:  true,
+	}
+}
@@ -0,0 +1,72 @@
+package assertion
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers the assertions already used,
+// keyed on the pair of 'iss' and 'jti'.
+type ReplayCache interface {
+	// Add records the assertion until expiresAt. It returns false
+	// when the pair is already recorded and hasn't expired yet.
+	Add(issuer, jti string, expiresAt, now time.Time) (bool, error)
+}
+
+type replayKey struct {
+	issuer string
+	jti    string
+}
+
+// MemoryReplayCache is ReplayCache in memory. It's safe for concurrent use,
+// and prunes the expired entries at most once per the interval on Add.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	entries   map[replayKey]time.Time
+	interval  time.Duration
+	lastPrune time.Time
+}
+
+func NewMemoryReplayCache(interval time.Duration) *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries:  make(map[replayKey]time.Time),
+		interval: interval,
+	}
+}
+
+func (c *MemoryReplayCache) Add(issuer, jti string, expiresAt, now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastPrune) >= c.interval {
+		c.prune(now)
+	}
+	key := replayKey{issuer, jti}
+	if exp, exists := c.entries[key]; exists && now.Before(exp) {
+		return false, nil
+	}
+	c.entries[key] = expiresAt
+	return true, nil
+}
+
+// Len returns the number of the entries, including the expired ones not pruned yet.
+func (c *MemoryReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Sweep removes the expired entries.
+func (c *MemoryReplayCache) Sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now)
+}
+
+func (c *MemoryReplayCache) prune(now time.Time) {
+	for key, exp := range c.entries {
+		if !now.Before(exp) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastPrune = now
+}
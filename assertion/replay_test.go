@@ -0,0 +1,35 @@
+package assertion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	c := NewMemoryReplayCache(time.Minute)
+	now := time.Unix(1000, 0)
+
+	if fresh, _ := c.Add("iss01", "jti01", now.Add(time.Minute), now); !fresh {
+		t.Errorf("First:\n - got: %v\n - want: %v\n", fresh, true)
+	}
+	if fresh, _ := c.Add("iss01", "jti01", now.Add(time.Minute), now.Add(time.Second)); fresh {
+		t.Errorf("Replayed:\n - got: %v\n - want: %v\n", fresh, false)
+	}
+	if fresh, _ := c.Add("iss02", "jti01", now.Add(time.Minute), now); !fresh {
+		t.Errorf("Other issuer:\n - got: %v\n - want: %v\n", fresh, true)
+	}
+
+	// expired entries are pruned on Add after the interval
+	later := now.Add(2 * time.Minute)
+	if fresh, _ := c.Add("iss01", "jti01", later.Add(time.Minute), later); !fresh {
+		t.Errorf("After expiry:\n - got: %v\n - want: %v\n", fresh, true)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len:\n - got: %v\n - want: %v\n", c.Len(), 1)
+	}
+
+	c.Sweep(later.Add(time.Hour))
+	if c.Len() != 0 {
+		t.Errorf("Len after Sweep:\n - got: %v\n - want: %v\n", c.Len(), 0)
+	}
+}
@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lyokato/goidc/log"
+)
+
+type EventType string
+
+const (
+	AuthorizationGranted       EventType = "authorization_granted"
+	AuthorizationDenied        EventType = "authorization_denied"
+	ConsentGiven               EventType = "consent_given"
+	CodeIssued                 EventType = "code_issued"
+	CodeRedeemed               EventType = "code_redeemed"
+	TokenIssued                EventType = "token_issued"
+	TokenRefreshed             EventType = "token_refreshed"
+	ClientAuthenticationFailed EventType = "client_authentication_failed"
+	AssertionReplayed          EventType = "assertion_replayed"
+	// the protected resource rejected the access_token
+	AccessDenied EventType = "access_denied"
+)
+
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+)
+
+type (
+	// Event is a security relevant action.
+	// Actor is "user:<id>" when the end-user acts, like giving consent,
+	// or "client:<id>" when the client does, like requesting token.
+	// Subject is the user id of the resource owner.
+	Event struct {
+		Type      EventType `json:"type"`
+		Time      time.Time `json:"time"`
+		Outcome   Outcome   `json:"outcome"`
+		Actor     string    `json:"actor,omitempty"`
+		ClientId  string    `json:"client_id,omitempty"`
+		Subject   string    `json:"subject,omitempty"`
+		Scopes    []string  `json:"scopes,omitempty"`
+		GrantType string    `json:"grant_type,omitempty"`
+		Reason    string    `json:"reason,omitempty"`
+	}
+
+	// Sink receives audit events.
+	// Record is called synchronously while handling the request.
+	Sink interface {
+		Record(e *Event) error
+	}
+)
+
+func NewEvent(typ EventType, now time.Time, outcome Outcome) *Event {
+	return &Event{
+		Type:    typ,
+		Time:    now,
+		Outcome: outcome,
+	}
+}
+
+func (e *Event) ByUser(uid int64) *Event {
+	e.Actor = fmt.Sprintf("user:%d", uid)
+	return e
+}
+
+func (e *Event) ByClient(clientId string) *Event {
+	e.Actor = fmt.Sprintf("client:%s", clientId)
+	return e
+}
+
+func (e *Event) For(clientId string, uid int64, scope string) *Event {
+	e.ClientId = clientId
+	e.Subject = fmt.Sprintf("%d", uid)
+	e.Scopes = strings.Fields(scope)
+	return e
+}
+
+// Record sends e to sink if it's set.
+// Failures can't stop the response, so they are only logged.
+func Record(sink Sink, logger log.Logger, e *Event) {
+	if sink == nil {
+		return
+	}
+	if err := sink.Record(e); err != nil {
+		logger.Error(fmt.Sprintf("failed to record audit event '%s': %s", e.Type, err))
+	}
+}
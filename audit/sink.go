@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// MemorySink keeps events in memory, for testing.
+type MemorySink struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{events: make([]*Event, 0)}
+}
+
+func (s *MemorySink) Record(e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *MemorySink) Events() []*Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]*Event, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// FindByType returns events of typ in recorded order.
+func (s *MemorySink) FindByType(typ EventType) []*Event {
+	found := make([]*Event, 0)
+	for _, e := range s.Events() {
+		if e.Type == typ {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// FileSink appends each event as a line of JSON.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *FileSink) Record(e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(e)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
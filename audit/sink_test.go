@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySink(t *testing.T) {
+	s := NewMemorySink()
+	now := time.Unix(1700000000, 0)
+	Record(s, nil, NewEvent(TokenIssued, now, Success).ByClient("client_id_01"))
+	Record(s, nil, NewEvent(ConsentGiven, now, Success).ByUser(1).For("client_id_01", 1, "openid profile"))
+
+	if len(s.Events()) != 2 {
+		t.Errorf("Events:\n - got: %v\n - want: %v\n", len(s.Events()), 2)
+		return
+	}
+	found := s.FindByType(ConsentGiven)
+	if len(found) != 1 || found[0].Actor != "user:1" || found[0].Subject != "1" ||
+		len(found[0].Scopes) != 2 {
+		t.Errorf("unexpected event: %+v", found)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path)
+	if err != nil {
+		t.Errorf("failed to open sink: %s", err)
+		return
+	}
+	now := time.Unix(1700000000, 0).UTC()
+	s.Record(NewEvent(TokenIssued, now, Success).ByClient("client_id_01"))
+	s.Record(NewEvent(ClientAuthenticationFailed, now, Failure))
+	s.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("failed to open file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	types := make([]EventType, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Errorf("invalid line: %s", err)
+			return
+		}
+		if !e.Time.Equal(now) {
+			t.Errorf("Time:\n - got: %v\n - want: %v\n", e.Time, now)
+		}
+		types = append(types, e.Type)
+	}
+	if len(types) != 2 || types[0] != TokenIssued || types[1] != ClientAuthenticationFailed {
+		t.Errorf("Types:\n - got: %v\n - want: %v\n", types, []EventType{TokenIssued, ClientAuthenticationFailed})
+	}
+}
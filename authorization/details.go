@@ -0,0 +1,109 @@
+package authorization
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// RFC9396 OAuth 2.0 Rich Authorization Requests
+
+type (
+	// Detail is an element of 'authorization_details'.
+	// Common fields are 'type', 'locations', 'actions', 'datatypes',
+	// 'identifier' and 'privileges', and each type can define its own fields.
+	Detail map[string]interface{}
+
+	// DetailValidator checks the fields of a Detail for its type.
+	DetailValidator func(d Detail) error
+
+	// DetailsRegistry holds validators for the supported types.
+	// Detail with unknown type is rejected.
+	DetailsRegistry struct {
+		validators map[string]DetailValidator
+	}
+)
+
+func (d Detail) Type() string {
+	t, _ := d["type"].(string)
+	return t
+}
+
+func NewDetailsRegistry() *DetailsRegistry {
+	return &DetailsRegistry{
+		validators: make(map[string]DetailValidator, 0),
+	}
+}
+
+// Register adds a type. validator can be nil when no check is needed.
+func (reg *DetailsRegistry) Register(typ string, validator DetailValidator) {
+	reg.validators[typ] = validator
+}
+
+func (reg *DetailsRegistry) Supports(typ string) bool {
+	_, exists := reg.validators[typ]
+	return exists
+}
+
+func (reg *DetailsRegistry) Validate(details []Detail) error {
+	for _, d := range details {
+		typ := d.Type()
+		validator, exists := reg.validators[typ]
+		if !exists {
+			return fmt.Errorf("unsupported 'type': '%s'", typ)
+		}
+		if validator != nil {
+			if err := validator(d); err != nil {
+				return fmt.Errorf("invalid '%s' detail: %s", typ, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseDetails parses 'authorization_details' parameter.
+// It must be a JSON array of objects, and each object must have 'type'.
+func ParseDetails(raw string) ([]Detail, error) {
+	var details []Detail
+	if err := json.Unmarshal([]byte(raw), &details); err != nil {
+		return nil, errors.New("'authorization_details' must be a JSON array of objects")
+	}
+	for _, d := range details {
+		if d == nil || d.Type() == "" {
+			return nil, errors.New("'type' not found in 'authorization_details'")
+		}
+	}
+	return details, nil
+}
+
+func EncodeDetails(details []Detail) string {
+	if len(details) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(details)
+	return string(data)
+}
+
+// IncludeAllDetails checks if every target is found in granted details.
+func IncludeAllDetails(details []Detail, targets []Detail) bool {
+	for _, t := range targets {
+		found := false
+		for _, d := range details {
+			if reflect.DeepEqual(d, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func SameDetails(details1, details2 []Detail) bool {
+	return len(details1) == len(details2) &&
+		IncludeAllDetails(details1, details2) &&
+		IncludeAllDetails(details2, details1)
+}
@@ -0,0 +1,63 @@
+package authorization
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseDetails(t *testing.T) {
+	details, err := ParseDetails(`[{"type":"payment_initiation","actions":["initiate"],"instructedAmount":{"currency":"EUR","amount":"123.50"}}]`)
+	if err != nil {
+		t.Errorf("failed to parse: %s", err)
+		return
+	}
+	if len(details) != 1 || details[0].Type() != "payment_initiation" {
+		t.Errorf("ParseDetails:\n - got: %v\n", details)
+	}
+
+	if _, err := ParseDetails(`{"type":"payment_initiation"}`); err == nil {
+		t.Error("JSON object should be rejected")
+	}
+	if _, err := ParseDetails(`[{"actions":["read"]}]`); err == nil {
+		t.Error("detail without 'type' should be rejected")
+	}
+}
+
+func TestDetailsRegistry(t *testing.T) {
+	reg := NewDetailsRegistry()
+	reg.Register("payment_initiation", func(d Detail) error {
+		if _, ok := d["instructedAmount"]; !ok {
+			return errors.New("'instructedAmount' not found")
+		}
+		return nil
+	})
+	reg.Register("account_information", nil)
+
+	valid, _ := ParseDetails(`[{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"1"}},{"type":"account_information"}]`)
+	if err := reg.Validate(valid); err != nil {
+		t.Errorf("valid details should be accepted: %s", err)
+	}
+	invalid, _ := ParseDetails(`[{"type":"payment_initiation"}]`)
+	if err := reg.Validate(invalid); err == nil {
+		t.Error("validator error should be returned")
+	}
+	unknown, _ := ParseDetails(`[{"type":"unknown"}]`)
+	if err := reg.Validate(unknown); err == nil {
+		t.Error("unknown type should be rejected")
+	}
+}
+
+func TestIncludeAllDetails(t *testing.T) {
+	granted, _ := ParseDetails(`[{"type":"a","actions":["read"]},{"type":"b"}]`)
+	requested, _ := ParseDetails(`[{"type":"a","actions":["read"]}]`)
+	if !IncludeAllDetails(granted, requested) {
+		t.Error("IncludeAllDetails should success")
+	}
+	if SameDetails(granted, requested) {
+		t.Error("SameDetails should fail")
+	}
+	other, _ := ParseDetails(`[{"type":"a","actions":["write"]}]`)
+	if IncludeAllDetails(granted, other) {
+		t.Error("IncludeAllDetails should fail")
+	}
+}
@@ -13,6 +13,7 @@ const (
 	ErrMissingRedirectURI
 	ErrInvalidRedirectURI
 	ErrServerError
+	ErrTemporarilyUnavailable
 )
 
 const (
@@ -69,6 +70,9 @@ type (
 		UILocale     string     `json:"ui_locale"`
 		IdTokenHint  string     `json:"id_token_hint"`
 		LoginHint    string     `json:"login_hint"`
+		Resources    []string   `json:"resource,omitempty"`
+		// RFC9396: shown on the consent screen
+		AuthorizationDetails []Detail `json:"authorization_details,omitempty"`
 	}
 
 	Session struct {
@@ -78,6 +82,7 @@ type (
 		CodeVerifier string
 		Nonce        string
 		AuthTime     int64
+		Resources    []string
 	}
 )
 
@@ -118,5 +123,6 @@ func (r *Request) ToSession(code string, expiresIn, authTime int64) *Session {
 		CodeVerifier: r.CodeVerifier,
 		Nonce:        r.Nonce,
 		AuthTime:     authTime,
+		Resources:    r.Resources,
 	}
 }
@@ -5,50 +5,170 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
 	"github.com/lyokato/goidc/flow"
 	"github.com/lyokato/goidc/id_token"
 	"github.com/lyokato/goidc/io"
 	"github.com/lyokato/goidc/log"
+	"github.com/lyokato/goidc/metrics"
+	oer "github.com/lyokato/goidc/oauth_error"
 	"github.com/lyokato/goidc/prompt"
+	"github.com/lyokato/goidc/resource"
 	"github.com/lyokato/goidc/response_mode"
 	"github.com/lyokato/goidc/scope"
+	"github.com/lyokato/goidc/subject"
+	"github.com/lyokato/goidc/tokengen"
+	"github.com/lyokato/goidc/tracing"
 )
 
 type AuthorizationEndpoint struct {
-	di          bridge.DataInterface
-	policy      *authorization.Policy
-	logger      log.Logger
-	currentTime io.TimeBuilder
+	cdi               bridge.ContextDataInterface
+	policy            *authorization.Policy
+	logger            log.Logger
+	currentTime       io.TimeBuilder
+	subjectStrategy   subject.Strategy
+	idTokenClaimsHook id_token.ClaimsHook
+	detailsRegistry   *authorization.DetailsRegistry
+	auditSink         audit.Sink
+	metrics           metrics.Metrics
+	tracer            tracing.Tracer
+	codeGenerator     *tokengen.Generator
 }
 
 func NewAuthorizationEndpoint(di bridge.DataInterface, policy *authorization.Policy) *AuthorizationEndpoint {
+	return NewAuthorizationEndpointContext(bridge.NewContextDataInterface(di), policy)
+}
+
+// NewAuthorizationEndpointContext makes the endpoint pass
+// the context of each request to cdi.
+func NewAuthorizationEndpointContext(cdi bridge.ContextDataInterface,
+	policy *authorization.Policy) *AuthorizationEndpoint {
 	return &AuthorizationEndpoint{
-		di:          di,
-		policy:      policy,
-		logger:      log.NewDefaultLogger(),
-		currentTime: io.NowBuilder(),
+		cdi:             cdi,
+		policy:          policy,
+		logger:          log.Adapt(log.NewDefaultLogger()),
+		currentTime:     io.NowBuilder(),
+		subjectStrategy: subject.Public(),
+		codeGenerator:   tokengen.Default(),
 	}
 }
 
 func (a *AuthorizationEndpoint) SetLogger(l log.Logger) {
-	a.logger = l
+	a.logger = log.Adapt(l)
 }
 
 func (a *AuthorizationEndpoint) SetTimeBuilder(builder io.TimeBuilder) {
 	a.currentTime = builder
 }
 
+// SetCodeGenerator sets the generator for the authorization codes,
+// used when AuthorizationCallbacks.CreateAuthorizationCode returns empty string.
+// It panics when g is nil.
+func (a *AuthorizationEndpoint) SetCodeGenerator(g *tokengen.Generator) {
+	if g == nil {
+		panic("goidc: nil code generator")
+	}
+	a.codeGenerator = g
+}
+
+func (a *AuthorizationEndpoint) SetSubjectStrategy(strategy subject.Strategy) {
+	a.subjectStrategy = strategy
+}
+
+// SetAuditSink makes the endpoint record authorization, consent and code issuance.
+func (a *AuthorizationEndpoint) SetAuditSink(sink audit.Sink) {
+	a.auditSink = sink
+}
+
+// SetMetrics makes the endpoint report requests, DataInterface calls and tokens to m.
+func (a *AuthorizationEndpoint) SetMetrics(m metrics.Metrics) {
+	a.metrics = m
+}
+
+// SetTracer makes the endpoint start a span for each request, and the child
+// spans for DataInterface and AuthorizationCallbacks calls.
+func (a *AuthorizationEndpoint) SetTracer(t tracing.Tracer) {
+	a.tracer = t
+}
+
+func (a *AuthorizationEndpoint) SetIdTokenClaimsHook(hook id_token.ClaimsHook) {
+	a.idTokenClaimsHook = hook
+}
+
+// SetAuthorizationDetailsRegistry enables 'authorization_details' (RFC9396).
+func (a *AuthorizationEndpoint) SetAuthorizationDetailsRegistry(reg *authorization.DetailsRegistry) {
+	a.detailsRegistry = reg
+}
+
+func (a *AuthorizationEndpoint) loggerFor(r *http.Request) log.Logger {
+	return log.ForRequest(a.logger, r)
+}
+
+func (a *AuthorizationEndpoint) di(r *http.Request) bridge.DataInterface {
+	return observeDataInterface(r.Context(),
+		bridge.BindDataInterface(r.Context(), a.cdi), a.metrics, a.tracer)
+}
+
+// observe starts observing the request, see observeRequest.
+func (a *AuthorizationEndpoint) observe(w http.ResponseWriter, r *http.Request,
+	callbacks bridge.AuthorizationCallbacks) (http.ResponseWriter, *http.Request,
+	bridge.AuthorizationCallbacks, func()) {
+	w, r, done := observeRequest(a.metrics, a.tracer, metrics.EndpointAuthorization, w, r)
+	if a.tracer != nil {
+		callbacks = tracing.TraceAuthorizationCallbacks(r.Context(), callbacks, a.tracer)
+	}
+	if a.metrics != nil || a.tracer != nil {
+		callbacks = &observedCallbacks{callbacks, w}
+	}
+	return w, r, callbacks, done
+}
+
+func (a *AuthorizationEndpoint) responseHandler(mode string,
+	w http.ResponseWriter, r *http.Request) authorization.ResponseHandler {
+	rh := authorization.ResponseHandlerForMode(mode, w, r)
+	if a.metrics == nil && a.tracer == nil {
+		return rh
+	}
+	return &observedResponseHandler{rh, w}
+}
+
+// HandleRequestContext is HandleRequest for callbacks
+// which receive the context of the request.
+func (a *AuthorizationEndpoint) HandleRequestContext(w http.ResponseWriter,
+	r *http.Request, callbacks bridge.ContextAuthorizationCallbacks) bool {
+	return a.HandleRequest(w, r, bridge.BindAuthorizationCallbacks(r.Context(), callbacks))
+}
+
+// CancelRequestContext is CancelRequest for callbacks
+// which receive the context of the request.
+func (a *AuthorizationEndpoint) CancelRequestContext(w http.ResponseWriter,
+	r *http.Request, callbacks bridge.ContextAuthorizationCallbacks) bool {
+	return a.CancelRequest(w, r, bridge.BindAuthorizationCallbacks(r.Context(), callbacks))
+}
+
+// CompleteRequestContext is CompleteRequest for callbacks
+// which receive the context of the request.
+func (a *AuthorizationEndpoint) CompleteRequestContext(w http.ResponseWriter,
+	r *http.Request, callbacks bridge.ContextAuthorizationCallbacks) bool {
+	return a.CompleteRequest(w, r, bridge.BindAuthorizationCallbacks(r.Context(), callbacks))
+}
+
 func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	r *http.Request, callbacks bridge.AuthorizationCallbacks) bool {
 
+	w, r, callbacks, done := a.observe(w, r, callbacks)
+	defer done()
+
 	cid := r.FormValue("client_id")
 	if cid == "" {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"param": "client_id",
@@ -62,7 +182,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	ruri := r.FormValue("redirect_uri")
 	if ruri == "" {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"param": "redirect_uri",
@@ -73,11 +193,11 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		return false
 	}
 
-	clnt, serr := a.di.FindClientById(cid)
+	clnt, serr := a.di(r).FindClientById(cid)
 	if serr != nil {
 		if serr.Type() == bridge.ErrFailed {
 
-			a.logger.Info(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Info(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.NoEnabledClient,
 				map[string]string{
 					"method":    "FindClientById",
@@ -90,7 +210,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		} else if serr.Type() == bridge.ErrUnsupported {
 
-			a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InterfaceUnsupported,
 				map[string]string{
 					"method": "FindClientById",
@@ -100,22 +220,26 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			callbacks.ShowErrorScreen(authorization.ErrServerError)
 			return false
 
-		} else if serr.Type() == bridge.ErrServerError {
+		} else {
 
-			a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InterfaceError,
 				map[string]string{
 					"method":    "FindClientById",
 					"client_id": cid,
 				},
-				"this method returns ServerError"))
+				fmt.Sprintf("this method returns error: %s", serr)))
 
-			callbacks.ShowErrorScreen(authorization.ErrServerError)
+			if serr.Type() == bridge.ErrTemporarilyUnavailable {
+				callbacks.ShowErrorScreen(authorization.ErrTemporarilyUnavailable)
+			} else {
+				callbacks.ShowErrorScreen(authorization.ErrServerError)
+			}
 			return false
 		}
 	} else {
 		if clnt == nil {
-			a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InterfaceError,
 				map[string]string{
 					"method":    "FindClientById",
@@ -128,9 +252,11 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		}
 	}
 
+	observeClient(w, cid)
+
 	if !clnt.CanUseRedirectURI(ruri) {
 
-		a.logger.Info(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Info(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.RedirectURIMismatch,
 			map[string]string{
 				"method":       "CanUseRedirectURI",
@@ -149,14 +275,14 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	rt := r.FormValue("response_type")
 	if rt == "" {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"param": "response_type",
 			},
 			"'response_type' not found in request."))
 
-		authorization.ResponseHandlerForMode(rmode, w, r).Error(
+		a.responseHandler(rmode, w, r).Error(
 			ruri, "invalid_request", "missing 'response_type'", state)
 		return false
 	}
@@ -164,20 +290,22 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	f, err := flow.JudgeByResponseType(rt)
 	if err != nil {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidResponseType,
 			map[string]string{
 				"response_type": rt,
 			},
 			"'response_type' is not appropriate."))
 
-		authorization.ResponseHandlerForMode(rmode, w, r).Error(
+		a.responseHandler(rmode, w, r).Error(
 			ruri, "invalid_request",
 			fmt.Sprintf("invalid 'response_type:%s'", rt),
 			state)
 		return false
 	}
 
+	observeFlow(w, f.Type.String())
+
 	var defaultRM string
 	switch f.Type {
 	case flow.AuthorizationCode:
@@ -192,7 +320,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	if rmode == "" {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"response_mode": defaultRM,
@@ -205,7 +333,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			if a.policy.IgnoreInvalidResponseMode {
 
-				a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InvalidResponseMode,
 					map[string]string{
 						"response_mode": rmode,
@@ -217,14 +345,14 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			} else {
 
-				a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InvalidResponseMode,
 					map[string]string{
 						"response_mode": rmode,
 					},
 					"this 'response_mode' is invalid, so return error"))
 
-				authorization.ResponseHandlerForMode(defaultRM, w, r).Error(
+				a.responseHandler(defaultRM, w, r).Error(
 					ruri, "invalid_request",
 					fmt.Sprintf("unknown 'response_mode': '%s'", rmode),
 					state)
@@ -239,7 +367,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			if a.policy.IgnoreInvalidResponseMode {
 
-				a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InvalidResponseMode,
 					map[string]string{
 						"response_mode": rmode,
@@ -250,13 +378,13 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			} else {
 
-				a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InvalidResponseMode,
 					map[string]string{
 						"response_mode": rmode,
 					},
 					"this 'response_mode' is not secure than default, so return error."))
-				authorization.ResponseHandlerForMode(defaultRM, w, r).Error(
+				a.responseHandler(defaultRM, w, r).Error(
 					ruri, "invalid_request",
 					fmt.Sprintf("'response_mode:%s' isn't allowed for 'response_type:%s'", rmode, rt),
 					state)
@@ -265,11 +393,11 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		}
 	}
 
-	rh := authorization.ResponseHandlerForMode(rmode, w, r)
+	rh := a.responseHandler(rmode, w, r)
 
 	if !clnt.CanUseFlow(f.Type) {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidResponseType,
 			map[string]string{
 				"response_type": rt,
@@ -291,7 +419,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			display = d
 		} else {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidDisplay,
 				map[string]string{
 					"display": d,
@@ -311,7 +439,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		ma, err = strconv.Atoi(mas)
 		if err != nil {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidMaxAge,
 				map[string]string{},
 				"'max_age' is not an integer value."))
@@ -324,7 +452,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if ma < a.policy.MinMaxAge {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidMaxAge,
 				map[string]string{
 					"max_age": mas,
@@ -339,7 +467,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if ma > a.policy.MaxMaxAge {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidMaxAge,
 				map[string]string{
 					"max_age": mas,
@@ -360,7 +488,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			prmpt = p
 		} else {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidPrompt,
 				map[string]string{
 					"prompt": p,
@@ -373,7 +501,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			return false
 		}
 	} else {
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"param": "prompt",
@@ -390,7 +518,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			!prompt.IncludeConsent(prmpt) {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidScope,
 				map[string]string{
 					"scope": "offline_access",
@@ -406,7 +534,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			if len(scp_for_check) == 0 {
 
-				a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InvalidScope,
 					map[string]string{
 						"scope": "offline_access",
@@ -423,7 +551,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	if scp == "" && !a.policy.AllowEmptyScope {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidScope,
 			map[string]string{},
 			"'scope' shouldn't be empty"))
@@ -436,7 +564,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	if f.RequireIdToken && !scope.IncludeOpenID(scp) {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidScope,
 			map[string]string{
 				"response_type": rt,
@@ -452,7 +580,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	if !clnt.CanUseScope(f.Type, scp) {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidScope,
 			map[string]string{
 				"scope":     scp,
@@ -464,13 +592,82 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		return false
 	}
 
+	resources := resource.FromRequest(r)
+	for _, rs := range resources {
+
+		if err := resource.Validate(rs); err != nil {
+
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
+				log.InvalidTarget,
+				map[string]string{
+					"resource":  rs,
+					"client_id": cid,
+				},
+				err.Error()))
+
+			rh.Error(ruri, "invalid_target", err.Error(), state)
+			return false
+		}
+
+		if !clnt.CanUseResource(rs) {
+
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
+				log.InvalidTarget,
+				map[string]string{
+					"resource":  rs,
+					"client_id": cid,
+				},
+				"this 'resource' is not allowed for this client"))
+
+			rh.Error(ruri, "invalid_target", "", state)
+			return false
+		}
+	}
+
+	var details []authorization.Detail
+	ad := r.FormValue("authorization_details")
+	if ad != "" {
+
+		if a.detailsRegistry == nil {
+
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
+				log.InvalidAuthorizationDetails,
+				map[string]string{
+					"client_id": cid,
+				},
+				"AuthorizationDetailsRegistry is not set."))
+
+			rh.Error(ruri, "invalid_authorization_details",
+				"'authorization_details' is not supported", state)
+			return false
+		}
+
+		details, err = authorization.ParseDetails(ad)
+		if err == nil {
+			err = a.detailsRegistry.Validate(details)
+		}
+		if err != nil {
+
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
+				log.InvalidAuthorizationDetails,
+				map[string]string{
+					"authorization_details": ad,
+					"client_id":             cid,
+				},
+				err.Error()))
+
+			rh.Error(ruri, "invalid_authorization_details", err.Error(), state)
+			return false
+		}
+	}
+
 	n := r.FormValue("nonce")
 	if f.Type != flow.AuthorizationCode &&
 		scope.IncludeOpenID(scp) &&
 		f.RequireIdToken &&
 		n == "" {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.MissingParam,
 			map[string]string{
 				"param":         "nonce",
@@ -486,7 +683,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	if n != "" && len(n) > a.policy.MaxNonceLength {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidNonce,
 			map[string]string{
 				"nonce": n,
@@ -503,7 +700,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	verifier := r.FormValue("code_verifier")
 	if verifier != "" && len(verifier) > a.policy.MaxCodeVerifierLength {
 
-		a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InvalidCodeVerifier,
 			map[string]string{
 				"code_verifier": verifier,
@@ -517,11 +714,28 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		return false
 	}
 
+	// public clients can't prove the possession of the code by secret,
+	// so that PKCE is mandatory for the flows which issue code.
+	if verifier == "" && f.Type != flow.Implicit && client_auth.IsPublic(clnt) {
+
+		a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
+			log.InvalidCodeVerifier,
+			map[string]string{
+				"client_id": clnt.GetId(),
+			},
+			"'code_verifier' not found for public client."))
+
+		rh.Error(ruri, "invalid_request",
+			"'code_verifier' is required for public clients",
+			state)
+		return false
+	}
+
 	locales := r.FormValue("ui_locales")
 	locale, err := callbacks.ChooseLocale(locales)
 	if err != nil {
 
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "ChooseLocale",
@@ -547,6 +761,9 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		CodeVerifier: verifier,
 		IdTokenHint:  r.FormValue("id_token_hint"),
 		LoginHint:    r.FormValue("login_hint"),
+		Resources:    resources,
+
+		AuthorizationDetails: details,
 	}
 
 	if req.Prompt == prompt.None {
@@ -557,7 +774,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		case prompt.NonePromptPolicyForbidden:
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InvalidPrompt,
 				map[string]string{
 					"prompt": "none",
@@ -575,7 +792,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			if err != nil {
 
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "ConfirmLoginSession",
@@ -594,7 +811,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			uid, err := callbacks.GetLoginUserId()
 
 			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "GetLoginUserId",
@@ -604,13 +821,13 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 				return false
 			}
 
-			info, serr := a.di.FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
+			info, serr := a.di(r).FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
 			if serr != nil {
 				if serr.Type() == bridge.ErrUnsupported {
 					rh.Error(ruri, "server_error", "", state)
 					return false
-				} else if serr.Type() == bridge.ErrServerError {
-					rh.Error(ruri, "server_error", "", state)
+				} else if serr.Type() != bridge.ErrFailed {
+					rh.Error(ruri, a.interfaceError(r, "FindAuthInfoByUserIdAndClientId", serr), "", state)
 					return false
 				} else {
 					// not found auth info
@@ -623,6 +840,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 					return false
 				}
 				if info.IsActive() && scope.Same(info.GetScope(), req.Scope) &&
+					authorization.SameDetails(info.GetAuthorizationDetails(), req.AuthorizationDetails) &&
 					info.GetAuthorizedAt()+int64(a.policy.ConsentOmissionPeriod) > a.currentTime().Unix() {
 					return a.complete(callbacks, r, rh, info, req)
 				} else {
@@ -643,7 +861,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			if err != nil {
 
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "ConfirmLoginSession",
@@ -661,7 +879,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 			matched, err := callbacks.LoginUserIsMatchedToSubject(req.LoginHint)
 			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "LoginUserIsMatchedToHint",
@@ -681,7 +899,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			uid, err := callbacks.GetLoginUserId()
 
 			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "GetLoginUserId",
@@ -691,13 +909,13 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 				return false
 			}
 
-			info, serr := a.di.FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
+			info, serr := a.di(r).FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
 			if serr != nil {
 				if serr.Type() == bridge.ErrUnsupported {
 					rh.Error(ruri, "server_error", "", state)
 					return false
-				} else if serr.Type() == bridge.ErrServerError {
-					rh.Error(ruri, "server_error", "", state)
+				} else if serr.Type() != bridge.ErrFailed {
+					rh.Error(ruri, a.interfaceError(r, "FindAuthInfoByUserIdAndClientId", serr), "", state)
 					return false
 				} else {
 					// not found auth info
@@ -710,6 +928,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 					return false
 				}
 				if info.IsActive() && scope.Same(info.GetScope(), req.Scope) &&
+					authorization.SameDetails(info.GetAuthorizationDetails(), req.AuthorizationDetails) &&
 					info.GetAuthorizedAt()+int64(a.policy.ConsentOmissionPeriod) > a.currentTime().Unix() {
 					return a.complete(callbacks, r, rh, info, req)
 				} else {
@@ -768,29 +987,33 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 				return false
 			}
 
-			matched, err := callbacks.LoginUserIsMatchedToSubject(sub)
-			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
-					log.InterfaceError,
-					map[string]string{
-						"method": "LoginUserIsMatchedToHint",
-					},
-					err.Error()))
-				rh.Error(ruri, "server_error", "", state)
-				return false
-			}
+			// the public subject is known only by the callbacks,
+			// the others are checked with the AuthInfo below.
+			if a.subjectStrategy.Type() == subject.TypePublic {
+				matched, err := callbacks.LoginUserIsMatchedToSubject(sub)
+				if err != nil {
+					a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
+						log.InterfaceError,
+						map[string]string{
+							"method": "LoginUserIsMatchedToSubject",
+						},
+						err.Error()))
+					rh.Error(ruri, "server_error", "", state)
+					return false
+				}
 
-			if !matched {
-				rh.Error(ruri, "invalid_request",
-					"'id_token_hint' doesn't match to current login user",
-					state)
-				return false
+				if !matched {
+					rh.Error(ruri, "invalid_request",
+						"'id_token_hint' doesn't match to current login user",
+						state)
+					return false
+				}
 			}
 
 			uid, err := callbacks.GetLoginUserId()
 
 			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "GetLoginUserId",
@@ -800,13 +1023,13 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 				return false
 			}
 
-			info, serr := a.di.FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
+			info, serr := a.di(r).FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
 			if serr != nil {
 				if serr.Type() == bridge.ErrUnsupported {
 					rh.Error(ruri, "server_error", "", state)
 					return false
-				} else if serr.Type() == bridge.ErrServerError {
-					rh.Error(ruri, "server_error", "", state)
+				} else if serr.Type() != bridge.ErrFailed {
+					rh.Error(ruri, a.interfaceError(r, "FindAuthInfoByUserIdAndClientId", serr), "", state)
 					return false
 				} else {
 					// not found auth info
@@ -818,7 +1041,28 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 					rh.Error(ruri, "server_error", "", state)
 					return false
 				}
+				if a.subjectStrategy.Type() != subject.TypePublic {
+					loginSub, err := a.subjectStrategy.Subject(a.di(r), clnt, info)
+					if err != nil {
+						a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
+							log.InterfaceError,
+							map[string]string{
+								"method":    "Subject",
+								"client_id": cid,
+							},
+							err.Error()))
+						rh.Error(ruri, "server_error", "", state)
+						return false
+					}
+					if loginSub != sub {
+						rh.Error(ruri, "invalid_request",
+							"'id_token_hint' doesn't match to current login user",
+							state)
+						return false
+					}
+				}
 				if info.IsActive() && scope.Same(info.GetScope(), req.Scope) &&
+					authorization.SameDetails(info.GetAuthorizationDetails(), req.AuthorizationDetails) &&
 					info.GetAuthorizedAt()+int64(a.policy.ConsentOmissionPeriod) > a.currentTime().Unix() {
 					return a.complete(callbacks, r, rh, info, req)
 				} else {
@@ -834,7 +1078,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if err != nil {
 
-			a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InterfaceError,
 				map[string]string{
 					"method": "ConfirmLoginSession",
@@ -847,7 +1091,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if !isLoginSession {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.LoginRequired,
 				map[string]string{},
 				"this is non-signed-in-session, so, show login page."))
@@ -855,7 +1099,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 			err = callbacks.ShowLoginScreen(req)
 			if err != nil {
 
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "ShowLoginScreen",
@@ -875,7 +1119,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if err != nil {
 
-			a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.InterfaceError,
 				map[string]string{
 					"method": "RequestIsFromLogin",
@@ -888,7 +1132,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 		if !isFromLogin {
 
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.LoginRequired,
 				map[string]string{
 					"prompt": req.Prompt,
@@ -902,7 +1146,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 	authTime, err := callbacks.GetAuthTime()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "GetAuthTime",
@@ -915,7 +1159,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	if req.MaxAge > 0 {
 		age := a.currentTime().Unix() - authTime
 		if req.MaxAge < age {
-			a.logger.Debug(log.AuthorizationEndpointLog(r.URL.Path,
+			a.loggerFor(r).Debug(log.AuthorizationEndpointEntry(r.URL.Path,
 				log.LoginRequired,
 				map[string]string{
 					"max_age": mas,
@@ -932,7 +1176,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 		case prompt.NoConsentPromptPolicyOmitConsentIfCan:
 			uid, err := callbacks.GetLoginUserId()
 			if err != nil {
-				a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+				a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 					log.InterfaceError,
 					map[string]string{
 						"method": "GetLoginUserId",
@@ -941,13 +1185,13 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 				rh.Error(ruri, "server_error", "", state)
 				return false
 			}
-			info, serr := a.di.FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
+			info, serr := a.di(r).FindAuthInfoByUserIdAndClientId(uid, req.ClientId)
 			if serr != nil {
 				if serr.Type() == bridge.ErrUnsupported {
 					rh.Error(ruri, "server_error", "", state)
 					return false
-				} else if serr.Type() == bridge.ErrServerError {
-					rh.Error(ruri, "server_error", "", state)
+				} else if serr.Type() != bridge.ErrFailed {
+					rh.Error(ruri, a.interfaceError(r, "FindAuthInfoByUserIdAndClientId", serr), "", state)
 					return false
 				}
 			} else {
@@ -956,6 +1200,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 					return false
 				}
 				if info.IsActive() && scope.Same(info.GetScope(), req.Scope) &&
+					authorization.SameDetails(info.GetAuthorizationDetails(), req.AuthorizationDetails) &&
 					info.GetAuthorizedAt()+int64(a.policy.ConsentOmissionPeriod) > a.currentTime().Unix() {
 					return a.complete(callbacks, r, rh, info, req)
 				}
@@ -965,7 +1210,7 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 	}
 	err = callbacks.ShowConsentScreen(clnt, req)
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "ShowConsentScreen",
@@ -979,9 +1224,11 @@ func (a *AuthorizationEndpoint) HandleRequest(w http.ResponseWriter,
 
 func (a *AuthorizationEndpoint) CancelRequest(w http.ResponseWriter, r *http.Request,
 	callbacks bridge.AuthorizationCallbacks) bool {
+	w, r, callbacks, done := a.observe(w, r, callbacks)
+	defer done()
 	req, err := callbacks.Continue()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "Continue",
@@ -989,16 +1236,31 @@ func (a *AuthorizationEndpoint) CancelRequest(w http.ResponseWriter, r *http.Req
 			err.Error()))
 		return false
 	}
-	rh := authorization.ResponseHandlerForMode(req.ResponseMode, w, r)
+	observeClient(w, req.ClientId)
+	if req.Flow != nil {
+		observeFlow(w, req.Flow.Type.String())
+	}
+	e := audit.NewEvent(audit.AuthorizationDenied, a.currentTime(), audit.Failure)
+	if uid, err := callbacks.GetLoginUserId(); err == nil {
+		e.ByUser(uid).For(req.ClientId, uid, req.Scope)
+	} else {
+		e.ClientId = req.ClientId
+	}
+	e.Reason = "access_denied"
+	audit.Record(a.auditSink, a.loggerFor(r), e)
+
+	rh := a.responseHandler(req.ResponseMode, w, r)
 	rh.Error(req.RedirectURI, "access_denied", "", req.State)
 	return true
 }
 
 func (a *AuthorizationEndpoint) CompleteRequest(w http.ResponseWriter, r *http.Request,
 	callbacks bridge.AuthorizationCallbacks) bool {
+	w, r, callbacks, done := a.observe(w, r, callbacks)
+	defer done()
 	req, err := callbacks.Continue()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "Continue",
@@ -1006,10 +1268,14 @@ func (a *AuthorizationEndpoint) CompleteRequest(w http.ResponseWriter, r *http.R
 			err.Error()))
 		return false
 	}
-	rh := authorization.ResponseHandlerForMode(req.ResponseMode, w, r)
+	observeClient(w, req.ClientId)
+	if req.Flow != nil {
+		observeFlow(w, req.Flow.Type.String())
+	}
+	rh := a.responseHandler(req.ResponseMode, w, r)
 	uid, err := callbacks.GetLoginUserId()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "GetLoginUserId",
@@ -1018,28 +1284,79 @@ func (a *AuthorizationEndpoint) CompleteRequest(w http.ResponseWriter, r *http.R
 		rh.Error(req.RedirectURI, "server_error", "", req.State)
 		return false
 	}
-	info, serr := a.di.CreateOrUpdateAuthInfo(uid, req.ClientId, req.Scope)
+	info, serr := a.di(r).CreateOrUpdateAuthInfo(uid, req.ClientId, req.Scope,
+		req.AuthorizationDetails)
 	if serr != nil {
-		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		rh.Error(req.RedirectURI, a.interfaceError(r, "CreateOrUpdateAuthInfo", serr), "", req.State)
 		return false
 	}
+	a.recordAudit(r, audit.ConsentGiven, info, req)
 	return a.complete(callbacks, r, rh, info, req)
 }
 
+func (a *AuthorizationEndpoint) recordAudit(r *http.Request, typ audit.EventType,
+	info bridge.AuthInfo, req *authorization.Request) {
+	e := audit.NewEvent(typ, a.currentTime(), audit.Success).
+		ByUser(info.GetUserId()).
+		For(req.ClientId, info.GetUserId(), req.Scope)
+	audit.Record(a.auditSink, a.loggerFor(r), e)
+}
+
+// interfaceError logs the failure of DataInterface,
+// and returns the error type to redirect with.
+func (a *AuthorizationEndpoint) interfaceError(r *http.Request,
+	method string, serr *bridge.Error) string {
+
+	a.loggerFor(r).Warn(log.AuthorizationEndpointEntry(r.URL.Path,
+		log.InterfaceServerError,
+		map[string]string{"method": method},
+		fmt.Sprintf("this method returns error: %s", serr)))
+
+	return oer.NewInterfaceError(serr).Type.String()
+}
+
 func (a *AuthorizationEndpoint) complete(
 	callbacks bridge.AuthorizationCallbacks,
 	r *http.Request,
 	rh authorization.ResponseHandler,
 	info bridge.AuthInfo, req *authorization.Request) bool {
+	ok := false
 	switch req.Flow.Type {
 	case flow.AuthorizationCode:
-		return a.completeAuthorizationCodeFlowRequest(callbacks, r, rh, info, req)
+		ok = a.completeAuthorizationCodeFlowRequest(callbacks, r, rh, info, req)
 	case flow.Implicit:
-		return a.completeImplicitFlowRequest(callbacks, r, rh, info, req)
+		ok = a.completeImplicitFlowRequest(callbacks, r, rh, info, req)
 	case flow.Hybrid:
-		return a.completeHybridFlowRequest(callbacks, r, rh, info, req)
+		ok = a.completeHybridFlowRequest(callbacks, r, rh, info, req)
+	}
+	if ok {
+		a.recordAudit(r, audit.AuthorizationGranted, info, req)
+	}
+	return ok
+}
+
+// MinAuthorizationCodeLength is the shortest code accepted from
+// AuthorizationCallbacks.CreateAuthorizationCode, tokengen.MinEntropy in base64url.
+const MinAuthorizationCodeLength = 22
+
+var ErrTooShortAuthorizationCode = fmt.Errorf(
+	"goidc: authorization code must be at least %d characters", MinAuthorizationCodeLength)
+
+// createAuthorizationCode asks callbacks for the code,
+// and generates it when callbacks leave it to the endpoint.
+func (a *AuthorizationEndpoint) createAuthorizationCode(
+	callbacks bridge.AuthorizationCallbacks) (string, error) {
+	code, err := callbacks.CreateAuthorizationCode()
+	if err != nil {
+		return "", err
+	}
+	if code == "" {
+		return a.codeGenerator.Generate()
 	}
-	return false
+	if len(code) < MinAuthorizationCodeLength {
+		return "", ErrTooShortAuthorizationCode
+	}
+	return code, nil
 }
 
 func (a *AuthorizationEndpoint) completeAuthorizationCodeFlowRequest(
@@ -1048,9 +1365,9 @@ func (a *AuthorizationEndpoint) completeAuthorizationCodeFlowRequest(
 	rh authorization.ResponseHandler,
 	info bridge.AuthInfo,
 	req *authorization.Request) bool {
-	code, err := callbacks.CreateAuthorizationCode()
+	code, err := a.createAuthorizationCode(callbacks)
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "CreateAuthorizationCode",
@@ -1061,7 +1378,7 @@ func (a *AuthorizationEndpoint) completeAuthorizationCodeFlowRequest(
 	}
 	authTime, err := callbacks.GetAuthTime()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "GetAuthTime",
@@ -1070,12 +1387,13 @@ func (a *AuthorizationEndpoint) completeAuthorizationCodeFlowRequest(
 		rh.Error(req.RedirectURI, "server_error", "", req.State)
 		return false
 	}
-	serr := a.di.CreateAuthSession(info,
+	serr := a.di(r).CreateAuthSession(info,
 		req.ToSession(code, int64(a.policy.AuthSessionExpiresIn), authTime))
 	if serr != nil {
-		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		rh.Error(req.RedirectURI, a.interfaceError(r, "CreateAuthSession", serr), "", req.State)
 		return false
 	}
+	a.recordAudit(r, audit.CodeIssued, info, req)
 	params := make(map[string]string)
 	params["code"] = code
 	if req.State != "" {
@@ -1092,9 +1410,9 @@ func (a *AuthorizationEndpoint) completeImplicitFlowRequest(
 	info bridge.AuthInfo,
 	req *authorization.Request) bool {
 
-	clnt, serr := a.di.FindClientById(req.ClientId)
+	clnt, serr := a.di(r).FindClientById(req.ClientId)
 	if serr != nil {
-		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		rh.Error(req.RedirectURI, a.interfaceError(r, "FindClientById", serr), "", req.State)
 		return false
 	}
 
@@ -1107,11 +1425,15 @@ func (a *AuthorizationEndpoint) completeImplicitFlowRequest(
 	}
 	at := ""
 	if req.Flow.RequireAccessToken {
-		t, serr := a.di.CreateOAuthToken(info, false)
+		t, serr := a.di(r).CreateOAuthToken(info, false, req.Resources,
+			info.GetAuthorizationDetails())
 		if serr != nil {
-			rh.Error(req.RedirectURI, "server_error", "", req.State)
+			rh.Error(req.RedirectURI, a.interfaceError(r, "CreateOAuthToken", serr), "", req.State)
 			return false
 		}
+		if a.metrics != nil {
+			a.metrics.CountToken(metrics.TokenIssued, req.Flow.Type.String(), req.ClientId)
+		}
 		at = t.GetAccessToken()
 		params["access_token"] = at
 		params["token_type"] = "bearer"
@@ -1120,7 +1442,7 @@ func (a *AuthorizationEndpoint) completeImplicitFlowRequest(
 
 	authTime, err := callbacks.GetAuthTime()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "GetAuthTime",
@@ -1131,21 +1453,8 @@ func (a *AuthorizationEndpoint) completeImplicitFlowRequest(
 	}
 
 	if req.Flow.RequireIdToken {
-		idt, err := id_token.GenForImplicit(
-			clnt.GetIdTokenAlg(),             // id_token signing algorithm
-			clnt.GetIdTokenKey(),             // id_token signing key
-			clnt.GetIdTokenKeyId(),           // id_token signing key-id
-			a.di.Issuer(),                    // issuer
-			info.GetClientId(),               // clientId
-			info.GetSubject(),                // subject
-			req.Nonce,                        // nonce
-			int64(a.policy.IdTokenExpiresIn), // expiresIn,
-			authTime, // authTime
-			at,       // access token
-			a.currentTime(),
-		)
-		if err != nil {
-			rh.Error(req.RedirectURI, "server_error", "", req.State)
+		idt, ok := a.issueIdToken(r, rh, clnt, info, req, authTime, at, "")
+		if !ok {
 			return false
 		}
 		params["id_token"] = idt
@@ -1161,10 +1470,10 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 	info bridge.AuthInfo,
 	req *authorization.Request) bool {
 
-	code, err := callbacks.CreateAuthorizationCode()
+	code, err := a.createAuthorizationCode(callbacks)
 
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "CreateAuthorizationCode",
@@ -1176,7 +1485,7 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 
 	authTime, err := callbacks.GetAuthTime()
 	if err != nil {
-		a.logger.Error(log.AuthorizationEndpointLog(r.URL.Path,
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
 			log.InterfaceError,
 			map[string]string{
 				"method": "GetAuthTime",
@@ -1186,16 +1495,17 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 		return false
 	}
 
-	serr := a.di.CreateAuthSession(info,
+	serr := a.di(r).CreateAuthSession(info,
 		req.ToSession(code, int64(a.policy.AuthSessionExpiresIn), authTime))
 	if serr != nil {
-		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		rh.Error(req.RedirectURI, a.interfaceError(r, "CreateAuthSession", serr), "", req.State)
 		return false
 	}
+	a.recordAudit(r, audit.CodeIssued, info, req)
 
-	clnt, serr := a.di.FindClientById(req.ClientId)
+	clnt, serr := a.di(r).FindClientById(req.ClientId)
 	if serr != nil {
-		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		rh.Error(req.RedirectURI, a.interfaceError(r, "FindClientById", serr), "", req.State)
 		return false
 	}
 
@@ -1210,11 +1520,15 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 
 	at := ""
 	if req.Flow.RequireAccessToken {
-		t, serr := a.di.CreateOAuthToken(info, false)
+		t, serr := a.di(r).CreateOAuthToken(info, false, req.Resources,
+			info.GetAuthorizationDetails())
 		if serr != nil {
-			rh.Error(req.RedirectURI, "server_error", "", req.State)
+			rh.Error(req.RedirectURI, a.interfaceError(r, "CreateOAuthToken", serr), "", req.State)
 			return false
 		}
+		if a.metrics != nil {
+			a.metrics.CountToken(metrics.TokenIssued, req.Flow.Type.String(), req.ClientId)
+		}
 		at = t.GetAccessToken()
 		params["access_token"] = at
 		params["token_type"] = "bearer"
@@ -1222,22 +1536,8 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 	}
 
 	if req.Flow.RequireIdToken {
-		idt, err := id_token.GenForHybrid(
-			clnt.GetIdTokenAlg(),             // id_token signing algorithm
-			clnt.GetIdTokenKey(),             // id_token signing key
-			clnt.GetIdTokenKeyId(),           // id_token signing key-id
-			a.di.Issuer(),                    // issuer
-			info.GetClientId(),               // clientId
-			info.GetSubject(),                // subject
-			req.Nonce,                        // nonce
-			int64(a.policy.IdTokenExpiresIn), // expiresIn,
-			authTime, // authTime
-			at,       // access_token
-			code,     // code
-			a.currentTime(),
-		)
-		if err != nil {
-			rh.Error(req.RedirectURI, "server_error", "", req.State)
+		idt, ok := a.issueIdToken(r, rh, clnt, info, req, authTime, at, code)
+		if !ok {
 			return false
 		}
 		params["id_token"] = idt
@@ -1245,3 +1545,42 @@ func (a *AuthorizationEndpoint) completeHybridFlowRequest(
 	rh.Success(req.RedirectURI, params)
 	return true
 }
+
+func (a *AuthorizationEndpoint) issueIdToken(
+	r *http.Request,
+	rh authorization.ResponseHandler,
+	clnt bridge.Client,
+	info bridge.AuthInfo,
+	req *authorization.Request,
+	authTime int64, at, code string) (string, bool) {
+
+	claims := id_token.NewClaims(a.di(r).Issuer(), info.GetClientId(), "",
+		int64(a.policy.IdTokenExpiresIn), a.currentTime()).
+		Nonce(req.Nonce).
+		AuthTime(authTime).
+		AccessToken(at).
+		Code(code)
+
+	idt, ignored, err := id_token.Issue(claims, r, clnt, info, a.di(r),
+		a.subjectStrategy, a.idTokenClaimsHook)
+	if len(ignored) > 0 {
+		a.loggerFor(r).Warn(log.AuthorizationEndpointEntry(r.URL.Path,
+			log.IdTokenGeneration,
+			map[string]string{
+				"client_id": req.ClientId,
+				"claims":    strings.Join(ignored, ","),
+			},
+			"IdTokenClaimsHook tried to overwrite reserved claims, ignored."))
+	}
+	if err != nil {
+		a.loggerFor(r).Error(log.AuthorizationEndpointEntry(r.URL.Path,
+			log.IdTokenGeneration,
+			map[string]string{
+				"client_id": req.ClientId,
+			},
+			err.Error()))
+		rh.Error(req.RedirectURI, "server_error", "", req.State)
+		return "", false
+	}
+	return idt, true
+}
@@ -0,0 +1,59 @@
+package goidc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/tokengen"
+)
+
+type testCodeCallbacks struct {
+	bridge.AuthorizationCallbacks
+	code string
+	err  error
+}
+
+func (c *testCodeCallbacks) CreateAuthorizationCode() (string, error) {
+	return c.code, c.err
+}
+
+func TestAuthorizationEndpointCreateAuthorizationCode(t *testing.T) {
+	a := NewAuthorizationEndpoint(nil, nil)
+
+	code, err := a.createAuthorizationCode(&testCodeCallbacks{code: "code_value_0123456789ab"})
+	if err != nil || code != "code_value_0123456789ab" {
+		t.Errorf("Code from callbacks:\n - got: %v, %v\n - want: %v\n", code, err, "code_value_0123456789ab")
+	}
+
+	if _, err := a.createAuthorizationCode(&testCodeCallbacks{code: "code_value"}); err != ErrTooShortAuthorizationCode {
+		t.Errorf("Short code from callbacks:\n - got: %v\n - want: %v\n", err, ErrTooShortAuthorizationCode)
+	}
+
+	failure := errors.New("failed")
+	if _, err := a.createAuthorizationCode(&testCodeCallbacks{err: failure}); err != failure {
+		t.Errorf("Error from callbacks:\n - got: %v\n - want: %v\n", err, failure)
+	}
+
+	code, err = a.createAuthorizationCode(&testCodeCallbacks{})
+	if err != nil || !tokengen.Default().Verify(code) {
+		t.Errorf("Generated code:\n - got: %v, %v\n - want: %v\n", code, err, "256 bits base64url")
+	}
+
+	g := &tokengen.Generator{Prefix: "code_", Checksum: true}
+	a.SetCodeGenerator(g)
+	code, err = a.createAuthorizationCode(&testCodeCallbacks{})
+	if err != nil || !g.Verify(code) {
+		t.Errorf("Generated code with prefix:\n - got: %v, %v\n - want: %v\n", code, err, "code_...")
+	}
+}
+
+func TestAuthorizationEndpointSetNilCodeGenerator(t *testing.T) {
+	a := NewAuthorizationEndpoint(nil, nil)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SetCodeGenerator(nil):\n - got: %v\n - want: %v\n", "no panic", "panic")
+		}
+	}()
+	a.SetCodeGenerator(nil)
+}
@@ -0,0 +1,399 @@
+package boltstore
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/record"
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeError returns ErrFailed for ErrNotFound, and ErrServerError for the others.
+func storeError(message string, err error) *bridge.Error {
+	if err == ErrNotFound {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	return bridge.WrapError(bridge.ErrServerError, message, err)
+}
+
+func (s *Store) Issuer() string {
+	return s.issuer
+}
+
+func (s *Store) FindClientById(ctx context.Context, clientId string) (bridge.Client, *bridge.Error) {
+	cached, version := s.clients.Get(clientId, s.now())
+	if cached != nil {
+		return cached, nil
+	}
+	c := &record.Client{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return mustGetJSON(tx.Bucket(bucketClients), []byte(clientId), c)
+	})
+	if err != nil {
+		return nil, storeError("failed to find client", err)
+	}
+	if err := c.Init(); err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "broken client", err)
+	}
+	s.clients.Put(c, version, s.now())
+	return c, nil
+}
+
+func (s *Store) FindAuthSessionByCode(ctx context.Context, code string) (bridge.AuthSession, *bridge.Error) {
+	sess := &record.AuthSession{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return mustGetJSON(tx.Bucket(bucketSessions), []byte(code), sess)
+	})
+	if err == nil && sess.ExpiresAt() <= s.now() {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, storeError("failed to find session", err)
+	}
+	return sess, nil
+}
+
+func (s *Store) FindActiveAuthInfoById(ctx context.Context, id int64) (bridge.AuthInfo, *bridge.Error) {
+	i := &record.AuthInfo{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return mustGetJSON(tx.Bucket(bucketAuthInfos), itob(id), i)
+	})
+	if err == nil && !i.Active {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, storeError("failed to find auth info", err)
+	}
+	return i, nil
+}
+
+func authInfoKey(uid int64, clientId string) []byte {
+	return append(itob(uid), clientId...)
+}
+
+func (s *Store) FindAuthInfoByUserIdAndClientId(ctx context.Context, uid int64,
+	clientId string) (bridge.AuthInfo, *bridge.Error) {
+	i := &record.AuthInfo{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketAuthInfoIndex).Get(authInfoKey(uid, clientId))
+		if id == nil {
+			return ErrNotFound
+		}
+		return mustGetJSON(tx.Bucket(bucketAuthInfos), id, i)
+	})
+	if err != nil {
+		return nil, storeError("failed to find auth info", err)
+	}
+	return i, nil
+}
+
+func (s *Store) findToken(index []byte, token string) (bridge.OAuthToken, *bridge.Error) {
+	t := &record.OAuthToken{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(index).Get([]byte(token))
+		if id == nil {
+			return ErrNotFound
+		}
+		return mustGetJSON(tx.Bucket(bucketTokens), id, t)
+	})
+	if err != nil {
+		return nil, storeError("failed to find token", err)
+	}
+	return t, nil
+}
+
+func (s *Store) FindOAuthTokenByAccessToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	return s.findToken(bucketAccessTokens, token)
+}
+
+func (s *Store) FindOAuthTokenByRefreshToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	return s.findToken(bucketRefreshTokens, token)
+}
+
+func putToken(tx *bolt.Tx, id []byte, t *record.OAuthToken) error {
+	if err := putJSON(tx.Bucket(bucketTokens), id, t); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketAccessTokens).Put([]byte(t.AccessToken), id); err != nil {
+		return err
+	}
+	if t.RefreshToken != "" {
+		if err := tx.Bucket(bucketRefreshTokens).Put([]byte(t.RefreshToken), id); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketExpiry).Put(expiryKey(t.ExpiresAt(), expiryToken, id), nil)
+}
+
+// deleteToken removes the token and its indexes, but not the expiry entry.
+func deleteToken(tx *bolt.Tx, id []byte) error {
+	t := &record.OAuthToken{}
+	if found, err := getJSON(tx.Bucket(bucketTokens), id, t); err != nil || !found {
+		return err
+	}
+	if err := tx.Bucket(bucketAccessTokens).Delete([]byte(t.AccessToken)); err != nil {
+		return err
+	}
+	if t.RefreshToken != "" {
+		if err := tx.Bucket(bucketRefreshTokens).Delete([]byte(t.RefreshToken)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketTokens).Delete(id)
+}
+
+func (s *Store) CreateOAuthToken(ctx context.Context, info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	t, err := s.policy.NewOAuthToken(info, onTokenEndpoint, resources, details, s.now())
+	if err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "failed to generate token", err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(bucketTokens).NextSequence()
+		if err != nil {
+			return err
+		}
+		return putToken(tx, itob(int64(seq)), t)
+	})
+	if err != nil {
+		return nil, storeError("failed to create token", err)
+	}
+	return t, nil
+}
+
+func (s *Store) RefreshAccessToken(ctx context.Context, info bridge.AuthInfo, token bridge.OAuthToken,
+	audience []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+
+	var c bridge.Client
+	if found, err := s.FindClientById(ctx, info.GetClientId()); err == nil {
+		c = found
+	} else if err.Type() != bridge.ErrFailed {
+		return nil, err
+	}
+
+	t := &record.OAuthToken{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketAccessTokens).Get([]byte(token.GetAccessToken()))
+		if id == nil {
+			return ErrNotFound
+		}
+		id = append([]byte(nil), id...)
+		if err := mustGetJSON(tx.Bucket(bucketTokens), id, t); err != nil {
+			return err
+		}
+		if t.RefreshToken != token.GetRefreshToken() {
+			return ErrNotFound
+		}
+		oldExpiry := expiryKey(t.ExpiresAt(), expiryToken, id)
+		if err := deleteToken(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketExpiry).Delete(oldExpiry); err != nil {
+			return err
+		}
+		if err := s.policy.Refresh(t, s.policy.ShouldRotate(c), audience, details, s.now()); err != nil {
+			return err
+		}
+		return putToken(tx, id, t)
+	})
+	if err != nil {
+		return nil, storeError("failed to refresh token", err)
+	}
+	return t, nil
+}
+
+func (s *Store) FindUserId(ctx context.Context, username, password string) (int64, *bridge.Error) {
+	u := &record.User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketUsernames).Get([]byte(username))
+		if id == nil {
+			return ErrNotFound
+		}
+		return mustGetJSON(tx.Bucket(bucketUsers), id, u)
+	})
+	if err != nil {
+		return -1, storeError("failed to find user", err)
+	}
+	matched, verr := clientsecret.Verify(u.PasswordHash, password)
+	if verr != nil {
+		return -1, bridge.WrapError(bridge.ErrServerError, "broken password hash", verr)
+	}
+	if !matched {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return u.Id, nil
+}
+
+func (s *Store) CreateOrUpdateAuthInfo(ctx context.Context, uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
+	i := &record.AuthInfo{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		u := &record.User{}
+		if err := mustGetJSON(tx.Bucket(bucketUsers), itob(uid), u); err != nil {
+			return err
+		}
+		infos := tx.Bucket(bucketAuthInfos)
+		index := tx.Bucket(bucketAuthInfoIndex)
+		key := authInfoKey(uid, clientId)
+		if id := index.Get(key); id != nil {
+			if err := mustGetJSON(infos, id, i); err != nil {
+				return err
+			}
+		} else {
+			seq, err := infos.NextSequence()
+			if err != nil {
+				return err
+			}
+			i.Id = int64(seq) - 1
+			i.UserId = uid
+			i.ClientId = clientId
+			if err := index.Put(key, itob(i.Id)); err != nil {
+				return err
+			}
+		}
+		i.Subject = s.policy.Subject(u)
+		i.Scope = scope
+		i.AuthorizationDetails = details
+		i.AuthorizedAt = s.now()
+		i.Active = true
+		return putJSON(infos, itob(i.Id), i)
+	})
+	if err != nil {
+		return nil, storeError("failed to save auth info", err)
+	}
+	return i, nil
+}
+
+func (s *Store) CreateAuthSession(ctx context.Context, info bridge.AuthInfo,
+	session *authorization.Session) *bridge.Error {
+	sess := s.policy.NewAuthSession(info, session, s.now())
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(bucketSessions)
+		if sessions.Get([]byte(sess.Code)) != nil {
+			return ErrDuplicated
+		}
+		if err := putJSON(sessions, []byte(sess.Code), sess); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpiry).Put(
+			expiryKey(sess.ExpiresAt(), expirySession, []byte(sess.Code)), nil)
+	})
+	if err != nil {
+		return bridge.WrapError(bridge.ErrServerError, "failed to create session", err)
+	}
+	return nil
+}
+
+func (s *Store) DisableSession(ctx context.Context, sess bridge.AuthSession) *bridge.Error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(bucketSessions)
+		found := &record.AuthSession{}
+		if err := mustGetJSON(sessions, []byte(sess.GetCode()), found); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketExpiry).Delete(
+			expiryKey(found.ExpiresAt(), expirySession, []byte(found.Code))); err != nil {
+			return err
+		}
+		return sessions.Delete([]byte(sess.GetCode()))
+	})
+	if err != nil {
+		return storeError("failed to disable session", err)
+	}
+	return nil
+}
+
+func (s *Store) FindUserIdBySubject(ctx context.Context, sub string) (int64, *bridge.Error) {
+	u := &record.User{}
+	recorded := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketSubjects).Get([]byte(sub))
+		if id == nil {
+			id = tx.Bucket(bucketRecordedSubjects).Get([]byte(sub))
+			recorded = id != nil
+		}
+		if id == nil {
+			parsed, err := strconv.ParseInt(sub, 10, 64)
+			if err != nil {
+				return ErrNotFound
+			}
+			id = itob(parsed)
+		}
+		return mustGetJSON(tx.Bucket(bucketUsers), id, u)
+	})
+	if err == nil && !recorded && s.policy.Subject(u) != sub {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return -1, storeError("failed to find user", err)
+	}
+	return u.Id, nil
+}
+
+func (s *Store) RecordSubject(ctx context.Context, uid int64, sub string) *bridge.Error {
+	recorded := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		recorded = tx.Bucket(bucketRecordedSubjects).Get([]byte(sub)) != nil
+		return nil
+	})
+	if err != nil {
+		return storeError("failed to record subject", err)
+	}
+	if recorded {
+		return nil
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketUsers).Get(itob(uid)) == nil {
+			return ErrNotFound
+		}
+		if err := tx.Bucket(bucketRecordedSubjects).Put([]byte(sub), itob(uid)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketRecordedSubjectIndex).Put(append(itob(uid), sub...), []byte{})
+	})
+	if err != nil {
+		return storeError("failed to record subject", err)
+	}
+	return nil
+}
+
+func (s *Store) RecordAssertionClaims(ctx context.Context, clientId, jti string,
+	issuedAt, expiredAt int64) *bridge.Error {
+	if jti == "" {
+		return nil
+	}
+	now := s.now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		assertions := tx.Bucket(bucketAssertions)
+		expiry := tx.Bucket(bucketExpiry)
+		key := []byte(clientId + "\x00" + jti)
+		old := &record.AssertionClaims{}
+		if found, err := getJSON(assertions, key, old); err != nil {
+			return err
+		} else if found {
+			if old.ExpiredAt > now {
+				return ErrNotFound
+			}
+			if err := expiry.Delete(expiryKey(old.ExpiredAt, expiryAssertion, key)); err != nil {
+				return err
+			}
+		}
+		a := &record.AssertionClaims{
+			ClientId:  clientId,
+			JTI:       jti,
+			IssuedAt:  issuedAt,
+			ExpiredAt: expiredAt,
+		}
+		if err := putJSON(assertions, key, a); err != nil {
+			return err
+		}
+		return expiry.Put(expiryKey(expiredAt, expiryAssertion, key), nil)
+	})
+	if err != nil {
+		return storeError("failed to record assertion claims", err)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+// Package boltstore provides bridge.ContextDataInterface on bbolt,
+// an embedded key-value database, for single-binary deployments.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	stdio "io"
+	"sync"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ bridge.ContextDataInterface = (*Store)(nil)
+
+var (
+	ErrDuplicated = errors.New("boltstore: already exists")
+	ErrNotFound   = errors.New("boltstore: not found")
+)
+
+var (
+	bucketUsers     = []byte("users")
+	bucketUsernames = []byte("usernames")
+	bucketSubjects  = []byte("subjects")
+	bucketClients   = []byte("clients")
+	bucketAuthInfos = []byte("auth_infos")
+	// 'sub' recorded by RecordSubject to the user ID,
+	// and the user ID and 'sub' to nothing, so that RemoveUser can find them.
+	bucketRecordedSubjects     = []byte("recorded_subjects")
+	bucketRecordedSubjectIndex = []byte("recorded_subject_index")
+	// user ID and client ID to AuthInfo ID
+	bucketAuthInfoIndex = []byte("auth_info_index")
+	bucketSessions      = []byte("auth_sessions")
+	bucketTokens        = []byte("oauth_tokens")
+	// access_token and refresh_token to the token ID
+	bucketAccessTokens  = []byte("access_tokens")
+	bucketRefreshTokens = []byte("refresh_tokens")
+	bucketAssertions    = []byte("assertion_claims")
+	// keyed by expiry time, so that Evict can walk the expired ones in order
+	bucketExpiry = []byte("expiry")
+
+	buckets = [][]byte{
+		bucketUsers, bucketUsernames, bucketSubjects, bucketClients, bucketAuthInfos, bucketAuthInfoIndex,
+		bucketSessions, bucketTokens, bucketAccessTokens, bucketRefreshTokens,
+		bucketAssertions, bucketExpiry, bucketRecordedSubjects, bucketRecordedSubjectIndex,
+	}
+)
+
+// kinds of the entries in the expiry bucket
+const (
+	expirySession byte = iota + 1
+	expiryToken
+	expiryAssertion
+)
+
+type Store struct {
+	db          *bolt.DB
+	issuer      string
+	policy      *record.Policy
+	hasher      clientsecret.Hasher
+	timeBuilder io.TimeBuilder
+	// the database is opened by this process only, so the clients are cached until updated
+	clients record.ClientCache
+
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// Open opens or creates the database file at path.
+func Open(path, issuer string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s, err := New(db, issuer)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// New returns the store on db, creating the buckets if needed.
+func New(db *bolt.DB, issuer string) (*Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		db:          db,
+		issuer:      issuer,
+		policy:      record.DefaultPolicy(),
+		hasher:      clientsecret.Argon2id(),
+		timeBuilder: io.NowBuilder(),
+	}, nil
+}
+
+func (s *Store) SetPolicy(p *record.Policy) {
+	s.policy = p
+}
+
+// SetPasswordHasher sets the hasher for the passwords of the users
+// created after this, clientsecret.Argon2id by default.
+func (s *Store) SetPasswordHasher(h clientsecret.Hasher) {
+	s.hasher = h
+}
+
+func (s *Store) SetTimeBuilder(builder io.TimeBuilder) {
+	s.timeBuilder = builder
+}
+
+func (s *Store) now() int64 {
+	return s.timeBuilder().Unix()
+}
+
+// Close stops the eviction, and closes the database.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	stop, stopped := s.stop, s.stopped
+	s.mu.Unlock()
+	if stop != nil {
+		s.stopOnce.Do(func() { close(stop) })
+		<-stopped
+	}
+	return s.db.Close()
+}
+
+// CreateUser registers the user with the hashed password.
+func (s *Store) CreateUser(username, password string) (*record.User, error) {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := record.NewSubject()
+	if err != nil {
+		return nil, err
+	}
+	u := &record.User{Username: username, Subject: sub, PasswordHash: hash}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(bucketUsernames)
+		if names.Get([]byte(username)) != nil {
+			return ErrDuplicated
+		}
+		users := tx.Bucket(bucketUsers)
+		seq, err := users.NextSequence()
+		if err != nil {
+			return err
+		}
+		// IDs start from 0 as the other stores
+		u.Id = int64(seq) - 1
+		if err := putJSON(users, itob(u.Id), u); err != nil {
+			return err
+		}
+		if err := names.Put([]byte(username), itob(u.Id)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketSubjects).Put([]byte(sub), itob(u.Id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Store) RemoveUser(uid int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		u := &record.User{}
+		if err := mustGetJSON(tx.Bucket(bucketUsers), itob(uid), u); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketUsernames).Delete([]byte(u.Username)); err != nil {
+			return err
+		}
+		if u.Subject != "" {
+			if err := tx.Bucket(bucketSubjects).Delete([]byte(u.Subject)); err != nil {
+				return err
+			}
+		}
+		index := tx.Bucket(bucketRecordedSubjectIndex)
+		prefix := itob(uid)
+		var keys [][]byte
+		cur := index.Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := tx.Bucket(bucketRecordedSubjects).Delete(k[len(prefix):]); err != nil {
+				return err
+			}
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketUsers).Delete(itob(uid))
+	})
+}
+
+// RegisterClient stores c, replacing the one with the same ID.
+func (s *Store) RegisterClient(c *record.Client) error {
+	if err := c.Clone().Init(); err != nil {
+		return err
+	}
+	defer s.clients.Remove(c.Id)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketClients), []byte(c.Id), c)
+	})
+}
+
+func (s *Store) RemoveClient(clientId string) error {
+	defer s.clients.Remove(clientId)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketClients)
+		if b.Get([]byte(clientId)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(clientId))
+	})
+}
+
+// Backup writes the consistent copy of the database to w,
+// while the other transactions keep running.
+func (s *Store) Backup(w stdio.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupFile writes the copy of the database to path, it can be opened by Open.
+func (s *Store) BackupFile(path string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+// StartEviction removes the expired sessions, tokens and assertion claims
+// every interval in background, until Close is called.
+func (s *Store) StartEviction(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	stop, stopped := s.stop, s.stopped
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Evict()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Evict removes the expired records, and returns the number of them.
+func (s *Store) Evict() (int, error) {
+	now := s.now()
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		expiry := tx.Bucket(bucketExpiry)
+		// collect first, deleting while iterating makes the cursor skip entries
+		expired := make([][]byte, 0)
+		c := expiry.Cursor()
+		for k, _ := c.First(); k != nil && btoi(k[:8]) <= now; k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			id := k[9:]
+			var err error
+			switch k[8] {
+			case expirySession:
+				err = tx.Bucket(bucketSessions).Delete(id)
+			case expiryToken:
+				err = deleteToken(tx, id)
+			case expiryAssertion:
+				err = tx.Bucket(bucketAssertions).Delete(id)
+			}
+			if err != nil {
+				return err
+			}
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+func expiryKey(expiresAt int64, kind byte, id []byte) []byte {
+	k := make([]byte, 0, 9+len(id))
+	k = append(k, itob(expiresAt)...)
+	k = append(k, kind)
+	return append(k, id...)
+}
+
+func itob(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func btoi(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// getJSON returns false when key isn't found. The value is decoded
+// within the transaction, as bbolt's memory is valid only there.
+func getJSON(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func mustGetJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	found, err := getJSON(b, key, v)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+	"github.com/lyokato/goidc/record/storetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "goidc.db"), "http://example.org/")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.SetPasswordHasher(clientsecret.Bcrypt(bcrypt.MinCost))
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *storetest.Store {
+		s := newTestStore(t)
+		return &storetest.Store{
+			DataInterface:  bridge.BindDataInterface(context.Background(), s),
+			SetPolicy:      s.SetPolicy,
+			SetTimeBuilder: s.SetTimeBuilder,
+			CreateUser:     s.CreateUser,
+			RemoveUser:     s.RemoveUser,
+			RegisterClient: s.RegisterClient,
+			RemoveClient:   s.RemoveClient,
+			Evict: func() (int64, error) {
+				n, err := s.Evict()
+				return int64(n), err
+			},
+		}
+	})
+}
+
+func TestStoreDisableSessionRemovesExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	s.CreateUser("user01", "pass01")
+	info, _ := s.CreateOrUpdateAuthInfo(ctx, 0, "client_id_01", "openid", nil)
+	s.CreateAuthSession(ctx, info, &authorization.Session{Code: "code_value", ExpiresIn: 60})
+	sess, _ := s.FindAuthSessionByCode(ctx, "code_value")
+	if err := s.DisableSession(ctx, sess); err != nil {
+		t.Fatalf("DisableSession: %s", err)
+	}
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1060))
+	if n, _ := s.Evict(); n != 0 {
+		t.Errorf("Evicted:\n - got: %v\n - want: %v\n", n, 0)
+	}
+}
+
+func TestStoreStartEviction(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	s.RecordAssertionClaims(ctx, "client_id_01", "jti01", 1000, 1060)
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1060))
+	s.StartEviction(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for s.RecordAssertionClaims(ctx, "client_id_01", "jti01", 1060, 1120) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the expired jti is not evicted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoreBackup(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	s.CreateUser("user01", "pass01")
+	s.RegisterClient(&record.Client{Id: "client_id_01"})
+	info, _ := s.CreateOrUpdateAuthInfo(ctx, 0, "client_id_01", "openid offline_access", nil)
+	token, _ := s.CreateOAuthToken(ctx, info, true, nil, nil)
+
+	var buf bytes.Buffer
+	n, err := s.Backup(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("Backup:\n - got: %v, %v\n - want: %v\n", n, err, buf.Len())
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	copyPath := filepath.Join(t.TempDir(), "copy.db")
+	if err := s.BackupFile(copyPath); err != nil {
+		t.Fatalf("BackupFile: %s", err)
+	}
+
+	for _, p := range []string{path, copyPath} {
+		restored, err := Open(p, "http://example.org/")
+		if err != nil {
+			t.Fatalf("Open %s: %s", p, err)
+		}
+		restored.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+		if _, err := restored.FindOAuthTokenByRefreshToken(ctx, token.GetRefreshToken()); err != nil {
+			t.Errorf("Restored token:\n - got: %v\n - want: %v\n", err, nil)
+		}
+		if _, err := restored.FindClientById(ctx, "client_id_01"); err != nil {
+			t.Errorf("Restored client:\n - got: %v\n - want: %v\n", err, nil)
+		}
+		restored.Close()
+	}
+}
+
+func TestStoreClientCache(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	s.RegisterClient(&record.Client{Id: "client_id_01"})
+
+	first, _ := s.FindClientById(ctx, "client_id_01")
+	if c, _ := s.FindClientById(ctx, "client_id_01"); c != first {
+		t.Errorf("Cached client:\n - got: %p\n - want: %p\n", c, first)
+	}
+	s.RegisterClient(&record.Client{Id: "client_id_01"})
+	if c, _ := s.FindClientById(ctx, "client_id_01"); c == first {
+		t.Errorf("Client after RegisterClient:\n - got: %p\n - want: not %p\n", c, first)
+	}
+}
@@ -0,0 +1,324 @@
+package bridge
+
+import (
+	"context"
+
+	"github.com/lyokato/goidc/authorization"
+)
+
+type (
+	// ContextDataInterface is DataInterface which receives the context of
+	// the request, so that cancellation, deadlines and trace information
+	// reach the data layer.
+	ContextDataInterface interface {
+		Issuer() string
+		FindClientById(ctx context.Context, clientId string) (Client, *Error)
+		FindAuthSessionByCode(ctx context.Context, code string) (AuthSession, *Error)
+		FindActiveAuthInfoById(ctx context.Context, id int64) (AuthInfo, *Error)
+		FindAuthInfoByUserIdAndClientId(ctx context.Context, uid int64, clientId string) (AuthInfo, *Error)
+		FindOAuthTokenByAccessToken(ctx context.Context, token string) (OAuthToken, *Error)
+		FindOAuthTokenByRefreshToken(ctx context.Context, token string) (OAuthToken, *Error)
+		CreateOAuthToken(ctx context.Context, info AuthInfo, onTokenEndpoint bool, resources []string,
+			details []authorization.Detail) (OAuthToken, *Error)
+		RefreshAccessToken(ctx context.Context, info AuthInfo, token OAuthToken, audience []string,
+			details []authorization.Detail) (OAuthToken, *Error)
+		FindUserId(ctx context.Context, username, password string) (int64, *Error)
+		CreateOrUpdateAuthInfo(ctx context.Context, uid int64, clientId, scope string, details []authorization.Detail) (AuthInfo, *Error)
+		CreateAuthSession(ctx context.Context, info AuthInfo, session *authorization.Session) *Error
+		DisableSession(ctx context.Context, sess AuthSession) *Error
+		FindUserIdBySubject(ctx context.Context, sub string) (int64, *Error)
+		RecordSubject(ctx context.Context, uid int64, sub string) *Error
+		RecordAssertionClaims(ctx context.Context, clientId, jti string, issuedAt, expiredAt int64) *Error
+	}
+
+	// ContextAuthorizationCallbacks is AuthorizationCallbacks which
+	// receives the context of the request.
+	ContextAuthorizationCallbacks interface {
+		ShowErrorScreen(ctx context.Context, authErrType int)
+		ShowLoginScreen(ctx context.Context, req *authorization.Request) error
+		ShowConsentScreen(ctx context.Context, client Client, req *authorization.Request) error
+		ChooseLocale(ctx context.Context, locales string) (string, error)
+		ConfirmLoginSession(ctx context.Context) (bool, error)
+		RequestIsFromLogin(ctx context.Context) (bool, error)
+		GetAuthTime(ctx context.Context) (int64, error)
+		GetLoginUserId(ctx context.Context) (int64, error)
+		// empty string lets the endpoint generate the code with tokengen
+		CreateAuthorizationCode(ctx context.Context) (string, error)
+		Continue(ctx context.Context) (*authorization.Request, error)
+		LoginUserIsMatchedToSubject(ctx context.Context, sub string) (bool, error)
+	}
+)
+
+// NewContextDataInterface adapts existing DataInterface implementation
+// to ContextDataInterface. The context is just ignored.
+func NewContextDataInterface(di DataInterface) ContextDataInterface {
+	return &contextDataInterface{di}
+}
+
+// BindDataInterface returns DataInterface which calls cdi with ctx.
+// The endpoints use this to pass the context of each request.
+func BindDataInterface(ctx context.Context, cdi ContextDataInterface) DataInterface {
+	if adapted, ok := cdi.(*contextDataInterface); ok {
+		return adapted.di
+	}
+	return &boundDataInterface{ctx, cdi}
+}
+
+// NewContextAuthorizationCallbacks adapts existing AuthorizationCallbacks
+// implementation to ContextAuthorizationCallbacks. The context is just ignored.
+func NewContextAuthorizationCallbacks(callbacks AuthorizationCallbacks) ContextAuthorizationCallbacks {
+	return &contextAuthorizationCallbacks{callbacks}
+}
+
+// BindAuthorizationCallbacks returns AuthorizationCallbacks which calls callbacks with ctx.
+func BindAuthorizationCallbacks(ctx context.Context,
+	callbacks ContextAuthorizationCallbacks) AuthorizationCallbacks {
+	if adapted, ok := callbacks.(*contextAuthorizationCallbacks); ok {
+		return adapted.callbacks
+	}
+	return &boundAuthorizationCallbacks{ctx, callbacks}
+}
+
+type contextDataInterface struct {
+	di DataInterface
+}
+
+func (a *contextDataInterface) Issuer() string {
+	return a.di.Issuer()
+}
+
+func (a *contextDataInterface) FindClientById(_ context.Context, clientId string) (Client, *Error) {
+	return a.di.FindClientById(clientId)
+}
+
+func (a *contextDataInterface) FindAuthSessionByCode(_ context.Context, code string) (AuthSession, *Error) {
+	return a.di.FindAuthSessionByCode(code)
+}
+
+func (a *contextDataInterface) FindActiveAuthInfoById(_ context.Context, id int64) (AuthInfo, *Error) {
+	return a.di.FindActiveAuthInfoById(id)
+}
+
+func (a *contextDataInterface) FindAuthInfoByUserIdAndClientId(_ context.Context,
+	uid int64, clientId string) (AuthInfo, *Error) {
+	return a.di.FindAuthInfoByUserIdAndClientId(uid, clientId)
+}
+
+func (a *contextDataInterface) FindOAuthTokenByAccessToken(_ context.Context, token string) (OAuthToken, *Error) {
+	return a.di.FindOAuthTokenByAccessToken(token)
+}
+
+func (a *contextDataInterface) FindOAuthTokenByRefreshToken(_ context.Context, token string) (OAuthToken, *Error) {
+	return a.di.FindOAuthTokenByRefreshToken(token)
+}
+
+func (a *contextDataInterface) CreateOAuthToken(_ context.Context, info AuthInfo,
+	onTokenEndpoint bool, resources []string, details []authorization.Detail) (OAuthToken, *Error) {
+	return a.di.CreateOAuthToken(info, onTokenEndpoint, resources, details)
+}
+
+func (a *contextDataInterface) RefreshAccessToken(_ context.Context, info AuthInfo,
+	token OAuthToken, audience []string, details []authorization.Detail) (OAuthToken, *Error) {
+	return a.di.RefreshAccessToken(info, token, audience, details)
+}
+
+func (a *contextDataInterface) FindUserId(_ context.Context, username, password string) (int64, *Error) {
+	return a.di.FindUserId(username, password)
+}
+
+func (a *contextDataInterface) CreateOrUpdateAuthInfo(_ context.Context, uid int64,
+	clientId, scope string, details []authorization.Detail) (AuthInfo, *Error) {
+	return a.di.CreateOrUpdateAuthInfo(uid, clientId, scope, details)
+}
+
+func (a *contextDataInterface) CreateAuthSession(_ context.Context, info AuthInfo,
+	session *authorization.Session) *Error {
+	return a.di.CreateAuthSession(info, session)
+}
+
+func (a *contextDataInterface) DisableSession(_ context.Context, sess AuthSession) *Error {
+	return a.di.DisableSession(sess)
+}
+
+func (a *contextDataInterface) FindUserIdBySubject(_ context.Context, sub string) (int64, *Error) {
+	return a.di.FindUserIdBySubject(sub)
+}
+
+func (a *contextDataInterface) RecordSubject(_ context.Context, uid int64, sub string) *Error {
+	return a.di.RecordSubject(uid, sub)
+}
+
+func (a *contextDataInterface) RecordAssertionClaims(_ context.Context, clientId, jti string,
+	issuedAt, expiredAt int64) *Error {
+	return a.di.RecordAssertionClaims(clientId, jti, issuedAt, expiredAt)
+}
+
+type boundDataInterface struct {
+	ctx context.Context
+	cdi ContextDataInterface
+}
+
+func (b *boundDataInterface) Issuer() string {
+	return b.cdi.Issuer()
+}
+
+func (b *boundDataInterface) FindClientById(clientId string) (Client, *Error) {
+	return b.cdi.FindClientById(b.ctx, clientId)
+}
+
+func (b *boundDataInterface) FindAuthSessionByCode(code string) (AuthSession, *Error) {
+	return b.cdi.FindAuthSessionByCode(b.ctx, code)
+}
+
+func (b *boundDataInterface) FindActiveAuthInfoById(id int64) (AuthInfo, *Error) {
+	return b.cdi.FindActiveAuthInfoById(b.ctx, id)
+}
+
+func (b *boundDataInterface) FindAuthInfoByUserIdAndClientId(uid int64, clientId string) (AuthInfo, *Error) {
+	return b.cdi.FindAuthInfoByUserIdAndClientId(b.ctx, uid, clientId)
+}
+
+func (b *boundDataInterface) FindOAuthTokenByAccessToken(token string) (OAuthToken, *Error) {
+	return b.cdi.FindOAuthTokenByAccessToken(b.ctx, token)
+}
+
+func (b *boundDataInterface) FindOAuthTokenByRefreshToken(token string) (OAuthToken, *Error) {
+	return b.cdi.FindOAuthTokenByRefreshToken(b.ctx, token)
+}
+
+func (b *boundDataInterface) CreateOAuthToken(info AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (OAuthToken, *Error) {
+	return b.cdi.CreateOAuthToken(b.ctx, info, onTokenEndpoint, resources, details)
+}
+
+func (b *boundDataInterface) RefreshAccessToken(info AuthInfo, token OAuthToken,
+	audience []string, details []authorization.Detail) (OAuthToken, *Error) {
+	return b.cdi.RefreshAccessToken(b.ctx, info, token, audience, details)
+}
+
+func (b *boundDataInterface) FindUserId(username, password string) (int64, *Error) {
+	return b.cdi.FindUserId(b.ctx, username, password)
+}
+
+func (b *boundDataInterface) CreateOrUpdateAuthInfo(uid int64, clientId, scope string,
+	details []authorization.Detail) (AuthInfo, *Error) {
+	return b.cdi.CreateOrUpdateAuthInfo(b.ctx, uid, clientId, scope, details)
+}
+
+func (b *boundDataInterface) CreateAuthSession(info AuthInfo, session *authorization.Session) *Error {
+	return b.cdi.CreateAuthSession(b.ctx, info, session)
+}
+
+func (b *boundDataInterface) DisableSession(sess AuthSession) *Error {
+	return b.cdi.DisableSession(b.ctx, sess)
+}
+
+func (b *boundDataInterface) FindUserIdBySubject(sub string) (int64, *Error) {
+	return b.cdi.FindUserIdBySubject(b.ctx, sub)
+}
+
+func (b *boundDataInterface) RecordSubject(uid int64, sub string) *Error {
+	return b.cdi.RecordSubject(b.ctx, uid, sub)
+}
+
+func (b *boundDataInterface) RecordAssertionClaims(clientId, jti string, issuedAt, expiredAt int64) *Error {
+	return b.cdi.RecordAssertionClaims(b.ctx, clientId, jti, issuedAt, expiredAt)
+}
+
+type contextAuthorizationCallbacks struct {
+	callbacks AuthorizationCallbacks
+}
+
+func (a *contextAuthorizationCallbacks) ShowErrorScreen(_ context.Context, authErrType int) {
+	a.callbacks.ShowErrorScreen(authErrType)
+}
+
+func (a *contextAuthorizationCallbacks) ShowLoginScreen(_ context.Context, req *authorization.Request) error {
+	return a.callbacks.ShowLoginScreen(req)
+}
+
+func (a *contextAuthorizationCallbacks) ShowConsentScreen(_ context.Context, client Client,
+	req *authorization.Request) error {
+	return a.callbacks.ShowConsentScreen(client, req)
+}
+
+func (a *contextAuthorizationCallbacks) ChooseLocale(_ context.Context, locales string) (string, error) {
+	return a.callbacks.ChooseLocale(locales)
+}
+
+func (a *contextAuthorizationCallbacks) ConfirmLoginSession(_ context.Context) (bool, error) {
+	return a.callbacks.ConfirmLoginSession()
+}
+
+func (a *contextAuthorizationCallbacks) RequestIsFromLogin(_ context.Context) (bool, error) {
+	return a.callbacks.RequestIsFromLogin()
+}
+
+func (a *contextAuthorizationCallbacks) GetAuthTime(_ context.Context) (int64, error) {
+	return a.callbacks.GetAuthTime()
+}
+
+func (a *contextAuthorizationCallbacks) GetLoginUserId(_ context.Context) (int64, error) {
+	return a.callbacks.GetLoginUserId()
+}
+
+func (a *contextAuthorizationCallbacks) CreateAuthorizationCode(_ context.Context) (string, error) {
+	return a.callbacks.CreateAuthorizationCode()
+}
+
+func (a *contextAuthorizationCallbacks) Continue(_ context.Context) (*authorization.Request, error) {
+	return a.callbacks.Continue()
+}
+
+func (a *contextAuthorizationCallbacks) LoginUserIsMatchedToSubject(_ context.Context, sub string) (bool, error) {
+	return a.callbacks.LoginUserIsMatchedToSubject(sub)
+}
+
+type boundAuthorizationCallbacks struct {
+	ctx       context.Context
+	callbacks ContextAuthorizationCallbacks
+}
+
+func (b *boundAuthorizationCallbacks) ShowErrorScreen(authErrType int) {
+	b.callbacks.ShowErrorScreen(b.ctx, authErrType)
+}
+
+func (b *boundAuthorizationCallbacks) ShowLoginScreen(req *authorization.Request) error {
+	return b.callbacks.ShowLoginScreen(b.ctx, req)
+}
+
+func (b *boundAuthorizationCallbacks) ShowConsentScreen(client Client, req *authorization.Request) error {
+	return b.callbacks.ShowConsentScreen(b.ctx, client, req)
+}
+
+func (b *boundAuthorizationCallbacks) ChooseLocale(locales string) (string, error) {
+	return b.callbacks.ChooseLocale(b.ctx, locales)
+}
+
+func (b *boundAuthorizationCallbacks) ConfirmLoginSession() (bool, error) {
+	return b.callbacks.ConfirmLoginSession(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) RequestIsFromLogin() (bool, error) {
+	return b.callbacks.RequestIsFromLogin(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) GetAuthTime() (int64, error) {
+	return b.callbacks.GetAuthTime(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) GetLoginUserId() (int64, error) {
+	return b.callbacks.GetLoginUserId(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) CreateAuthorizationCode() (string, error) {
+	return b.callbacks.CreateAuthorizationCode(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) Continue() (*authorization.Request, error) {
+	return b.callbacks.Continue(b.ctx)
+}
+
+func (b *boundAuthorizationCallbacks) LoginUserIsMatchedToSubject(sub string) (bool, error) {
+	return b.callbacks.LoginUserIsMatchedToSubject(b.ctx, sub)
+}
@@ -1,21 +1,85 @@
 package bridge
 
+import "fmt"
+
 type ErrorType int
 
 const (
 	ErrUnsupported ErrorType = iota
 	ErrServerError
 	ErrFailed
+	// the data layer is overloaded or under maintenance,
+	// clients are asked to retry later.
+	ErrTemporarilyUnavailable
 )
 
+func (t ErrorType) String() string {
+	switch t {
+	case ErrUnsupported:
+		return "unsupported"
+	case ErrServerError:
+		return "server_error"
+	case ErrFailed:
+		return "failed"
+	case ErrTemporarilyUnavailable:
+		return "temporarily_unavailable"
+	}
+	return "unknown"
+}
+
 type Error struct {
-	typ ErrorType
+	typ        ErrorType
+	message    string
+	cause      error
+	retryAfter int64
 }
 
 func NewError(typ ErrorType) *Error {
-	return &Error{typ}
+	return &Error{typ: typ}
+}
+
+// WrapError keeps the underlying error, so that the endpoints can log it,
+// and errors.Is/errors.As can find it.
+func WrapError(typ ErrorType, message string, cause error) *Error {
+	return &Error{typ: typ, message: message, cause: cause}
+}
+
+// NewTemporarilyUnavailableError returns ErrTemporarilyUnavailable error.
+// retryAfter is seconds the client should wait, 0 means unknown.
+func NewTemporarilyUnavailableError(retryAfter int64, cause error) *Error {
+	return &Error{typ: ErrTemporarilyUnavailable, cause: cause, retryAfter: retryAfter}
 }
 
 func (e *Error) Type() ErrorType {
 	return e.typ
 }
+
+func (e *Error) Message() string {
+	return e.message
+}
+
+func (e *Error) RetryAfter() int64 {
+	return e.retryAfter
+}
+
+func (e *Error) Error() string {
+	s := e.typ.String()
+	if e.message != "" {
+		s = fmt.Sprintf("%s: %s", s, e.message)
+	}
+	if e.cause != nil {
+		s = fmt.Sprintf("%s: %s", s, e.cause)
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is *Error with the same type,
+// so errors.Is(err, bridge.NewError(bridge.ErrFailed)) works.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.typ == e.typ
+}
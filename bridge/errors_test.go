@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorWrap(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := WrapError(ErrServerError, "failed to insert token", cause)
+
+	expected := "server_error: failed to insert token: connection refused"
+	if err.Error() != expected {
+		t.Errorf("Error:\n - got: %v\n - want: %v\n", err.Error(), expected)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is should find the cause")
+	}
+	if !errors.Is(err, NewError(ErrServerError)) {
+		t.Error("errors.Is should match the same type")
+	}
+	if errors.Is(err, NewError(ErrFailed)) {
+		t.Error("errors.Is should not match the other type")
+	}
+}
+
+func TestErrorTemporarilyUnavailable(t *testing.T) {
+	err := NewTemporarilyUnavailableError(60, nil)
+	if err.Type() != ErrTemporarilyUnavailable || err.RetryAfter() != 60 {
+		t.Errorf("unexpected error: %s, retry after %d", err, err.RetryAfter())
+	}
+	if err.Unwrap() != nil {
+		t.Error("Unwrap should return nil without cause")
+	}
+	if err.Error() != "temporarily_unavailable" {
+		t.Errorf("Error:\n - got: %v\n - want: %v\n", err.Error(), "temporarily_unavailable")
+	}
+}
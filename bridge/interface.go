@@ -2,6 +2,7 @@ package bridge
 
 import (
 	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/clientsecret"
 	"github.com/lyokato/goidc/flow"
 	"github.com/lyokato/goidc/prompt"
 )
@@ -13,11 +14,24 @@ type (
 		GetIdTokenAlg() string
 		GetIdTokenKeyId() string
 		GetIdTokenKey() interface{}
-		MatchSecret(secret string) bool
+		// id_token_encrypted_response_alg, return empty string if client doesn't require encryption
+		GetIdTokenEncryptedResponseAlg() string
+		// id_token_encrypted_response_enc
+		GetIdTokenEncryptedResponseEnc() string
+		// client's public key used for encryption, *rsa.PublicKey or *ecdsa.PublicKey
+		GetIdTokenEncryptionKey() interface{}
+		// the active and rotated secrets, expired ones are rejected
+		GetClientSecrets() []*clientsecret.Secret
+		// client_secret_basic when empty
+		GetTokenEndpointAuthMethod() string
 		CanUseFlow(flowType flow.FlowType) bool
 		CanUseGrantType(gt string) bool
 		CanUseScope(flowType flow.FlowType, scope string) bool
 		CanUseRedirectURI(uri string) bool
+		// RFC8707: resource is an absolute URI the client requests a token for
+		CanUseResource(resource string) bool
+		GetRedirectURIs() []string
+		GetSectorIdentifierURI() string
 		GetAssertionKey(alg, kid string) interface{}
 		GetNoConsentPromptPolicy() prompt.NoConsentPromptPolicy
 		GetNonePromptPolicy() prompt.NonePromptPolicy
@@ -27,10 +41,15 @@ type (
 		GetId() int64
 		GetClientId() string
 		GetUserId() int64
-		// Subject: If you support PPID, generate unique ID for each client, or not, just return string same as UserId
+		// Subject: If you support PPID, generate unique ID for each client, or not, just return string same as UserId.
+		// This is the 'sub' with the default subject.Public() strategy.
 		GetSubject() string
 		GetScope() string
+		// RFC9396: authorization_details the user granted, nil if not requested
+		GetAuthorizationDetails() []authorization.Detail
 		GetAuthorizedAt() int64
+		// 'acr' the user satisfied when authorized the client, empty if unknown
+		GetACR() string
 		IsActive() bool
 	}
 
@@ -43,6 +62,7 @@ type (
 		GetCodeVerifier() string
 		GetExpiresIn() int64
 		GetNonce() string
+		GetResources() []string
 		GetCreatedAt() int64
 	}
 
@@ -56,6 +76,14 @@ type (
 		GetRefreshToken() string
 		GetRefreshTokenExpiresIn() int64
 		GetCreatedAt() int64
+
+		// RFC8707: resources granted, refresh request can narrow the audience within them
+		GetResources() []string
+		// resources this access_token is issued for, empty means not restricted
+		GetAudience() []string
+		// RFC9396: authorization_details this access_token is issued for,
+		// narrowed from AuthInfo.GetAuthorizationDetails() by the token request
+		GetAuthorizationDetails() []authorization.Detail
 	}
 
 	AuthorizationCallbacks interface {
@@ -67,6 +95,7 @@ type (
 		RequestIsFromLogin() (bool, error)
 		GetAuthTime() (int64, error)
 		GetLoginUserId() (int64, error)
+		// empty string lets the endpoint generate the code with tokengen
 		CreateAuthorizationCode() (string, error)
 		Continue() (*authorization.Request, error)
 		LoginUserIsMatchedToSubject(sub string) (bool, error)
@@ -80,13 +109,28 @@ type (
 		FindAuthInfoByUserIdAndClientId(uid int64, clientId string) (AuthInfo, *Error)
 		FindOAuthTokenByAccessToken(token string) (OAuthToken, *Error)
 		FindOAuthTokenByRefreshToken(token string) (OAuthToken, *Error)
-		CreateOAuthToken(info AuthInfo, onTokenEndpoint bool) (OAuthToken, *Error)
-		RefreshAccessToken(info AuthInfo, token OAuthToken) (OAuthToken, *Error)
+		// resources are used as both of granted resources and audience of the new access_token,
+		// and details are the authorization_details of the new access_token, within the granted ones.
+		CreateOAuthToken(info AuthInfo, onTokenEndpoint bool, resources []string,
+			details []authorization.Detail) (OAuthToken, *Error)
+		// audience is narrowed within token.GetResources(), unless the grant has no resources.
+		// details replace the authorization_details of the new access_token.
+		// For public clients, a new refresh_token must be issued and the old one disabled.
+		// Revoking the grant when the disabled one is used again is up to the implementation.
+		RefreshAccessToken(info AuthInfo, token OAuthToken, audience []string,
+			details []authorization.Detail) (OAuthToken, *Error)
 		FindUserId(username, password string) (int64, *Error)
-		CreateOrUpdateAuthInfo(uid int64, clientId, scope string) (AuthInfo, *Error)
+		CreateOrUpdateAuthInfo(uid int64, clientId, scope string, details []authorization.Detail) (AuthInfo, *Error)
 		CreateAuthSession(info AuthInfo, session *authorization.Session) *Error
+		// called before CreateOAuthToken by the authorization_code grant. It must disable the code
+		// atomically, and return ErrFailed if it's already disabled, so that only one redemption
+		// gets the token. The code stays consumed even if CreateOAuthToken fails after that.
 		DisableSession(sess AuthSession) *Error
+		// resolves the public 'sub', and the ones recorded by RecordSubject
 		FindUserIdBySubject(sub string) (int64, *Error)
+		// records 'sub' generated by a strategy other than the public one, like subject.Pairwise.
+		// It's called each time the 'sub' is issued, so it must ignore the recorded one.
+		RecordSubject(uid int64, sub string) *Error
 		RecordAssertionClaims(clientId, jti string, issuedAt, expiredAt int64) *Error
 	}
 )
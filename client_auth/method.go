@@ -0,0 +1,46 @@
+package client_auth
+
+import (
+	"strings"
+
+	"github.com/lyokato/goidc/bridge"
+)
+
+// token_endpoint_auth_method values (RFC7591, OpenID Connect Core 9.)
+const (
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	ClientSecretJWT   = "client_secret_jwt"
+	PrivateKeyJWT     = "private_key_jwt"
+	None              = "none"
+)
+
+// MethodOf returns the method registered for c.
+// client_secret_basic is the default of RFC7591.
+func MethodOf(c bridge.Client) string {
+	if m := c.GetTokenEndpointAuthMethod(); m != "" {
+		return m
+	}
+	return ClientSecretBasic
+}
+
+// IsHMAC reports whether alg is the HMAC algorithm,
+// which client_secret_jwt signs the assertion with.
+func IsHMAC(alg string) bool {
+	return strings.HasPrefix(alg, "HS")
+}
+
+// MethodForAssertion returns the method which
+// the assertion signed with alg is used for.
+func MethodForAssertion(alg string) string {
+	if IsHMAC(alg) {
+		return ClientSecretJWT
+	}
+	return PrivateKeyJWT
+}
+
+// IsPublic reports whether c can't keep a secret,
+// i.e. it's registered with 'none'.
+func IsPublic(c bridge.Client) bool {
+	return MethodOf(c) == None
+}
@@ -0,0 +1,83 @@
+package clientsecret
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashers(t *testing.T) {
+	for _, h := range []Hasher{
+		&Argon2idHasher{Memory: 1024, Time: 1, Threads: 1, KeyLen: 32},
+		Bcrypt(4),
+		&PBKDF2Hasher{Iterations: 1000, KeyLen: 32},
+	} {
+		encoded, err := h.Hash("client_secret_01")
+		if err != nil {
+			t.Errorf("%T: failed to hash: %s", h, err)
+			continue
+		}
+		if strings.Contains(encoded, "client_secret_01") {
+			t.Errorf("%T: the secret is not hashed: %s", h, encoded)
+		}
+		if ok, err := Verify(encoded, "client_secret_01"); !ok || err != nil {
+			t.Errorf("%T: Verify:\n - got: %v, %v\n - want: %v\n", h, ok, err, true)
+		}
+		if ok, err := Verify(encoded, "client_secret_02"); ok || err != nil {
+			t.Errorf("%T: Verify wrong secret:\n - got: %v, %v\n - want: %v\n", h, ok, err, false)
+		}
+		// salted
+		if another, _ := h.Hash("client_secret_01"); another == encoded {
+			t.Errorf("%T: the same hash for the same secret", h)
+		}
+	}
+
+	for _, broken := range []string{
+		"client_secret_01",
+		"$argon2id$v=19$m=1024,t=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=100000,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=300$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=2147483647$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=abc$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=1000$c2FsdA$",
+	} {
+		if _, err := Verify(broken, "client_secret_01"); err == nil {
+			t.Errorf("Verify(%q) should fail", broken)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	h := Bcrypt(4)
+	now := time.Unix(1700000000, 0)
+	old, _ := New(h, "old_secret", now.Unix())
+	current, _ := New(h, "new_secret", 0)
+	secrets := []*Secret{old, current}
+
+	for secret, expected := range map[string]Result{
+		"new_secret":   Matched,
+		"old_secret":   Expired,
+		"wrong_secret": NotMatched,
+	} {
+		if actual, err := Match(secrets, secret, now); actual != expected || err != nil {
+			t.Errorf("Match(%s):\n - got: %v, %v\n - want: %v\n", secret, actual, err, expected)
+		}
+	}
+
+	// both are active during rotation
+	if actual, _ := Match(secrets, "old_secret", now.Add(-time.Second)); actual != Matched {
+		t.Errorf("Match before expiry:\n - got: %v\n - want: %v\n", actual, Matched)
+	}
+
+	broken := []*Secret{{Hash: "plaintext"}, current}
+	if actual, err := Match(broken, "new_secret", now); actual != Matched || err != nil {
+		t.Errorf("Match skipping broken:\n - got: %v, %v\n - want: %v\n", actual, err, Matched)
+	}
+	if _, err := Match(broken, "wrong_secret", now); err != ErrUnknownFormat {
+		t.Errorf("Match broken:\n - got: %v\n - want: %v\n", err, ErrUnknownFormat)
+	}
+}
@@ -0,0 +1,178 @@
+package clientsecret
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var ErrUnknownFormat = errors.New("clientsecret: unknown hash format")
+
+// Hasher encodes the secret with a random salt and the parameters,
+// so that Verify can check it without knowing which Hasher was used.
+type Hasher interface {
+	Hash(secret string) (string, error)
+}
+
+// Verify checks secret against encoded in constant time.
+// encoded is made by one of the Hashers in this package.
+func Verify(encoded, secret string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return verifyArgon2id(encoded, secret)
+	case strings.HasPrefix(encoded, "$pbkdf2-sha256$"):
+		return verifyPBKDF2(encoded, secret)
+	case strings.HasPrefix(encoded, "$2a$"),
+		strings.HasPrefix(encoded, "$2b$"),
+		strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(secret))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, ErrUnknownFormat
+	}
+}
+
+var b64 = base64.RawStdEncoding
+
+// bounds of the parameters read from the stored hash, so that a broken
+// one can't panic or exhaust the server.
+const (
+	maxArgon2idMemory = 1024 * 1024 // KiB
+	maxArgon2idTime   = 32
+	maxKeyLen         = 128
+	maxPBKDF2Iter     = 10000000
+)
+
+func randomSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Argon2idHasher encodes in PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+type Argon2idHasher struct {
+	// KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+// Argon2id returns Argon2idHasher with the parameters recommended by RFC9106.
+func Argon2id() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64 * 1024, Time: 3, Threads: 4, KeyLen: 32}
+}
+
+func (h *Argon2idHasher) Hash(secret string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(secret), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func verifyArgon2id(encoded, secret string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, ErrUnknownFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnknownFormat
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil ||
+		time < 1 || time > maxArgon2idTime || threads < 1 ||
+		memory < 8*uint32(threads) || memory > maxArgon2idMemory {
+		return false, ErrUnknownFormat
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnknownFormat
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > maxKeyLen {
+		return false, ErrUnknownFormat
+	}
+	actual := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+// BcryptHasher encodes with bcrypt. bcrypt uses the first 72 bytes
+// of the secret, and Hash fails for the longer secret.
+type BcryptHasher struct {
+	Cost int
+}
+
+func Bcrypt(cost int) *BcryptHasher {
+	return &BcryptHasher{cost}
+}
+
+func (h *BcryptHasher) Hash(secret string) (string, error) {
+	encoded, err := bcrypt.GenerateFromPassword([]byte(secret), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// PBKDF2Hasher encodes with PBKDF2-HMAC-SHA256,
+// $pbkdf2-sha256$i=600000$salt$key
+type PBKDF2Hasher struct {
+	Iterations int
+	KeyLen     int
+}
+
+// PBKDF2 returns PBKDF2Hasher with the iterations recommended by OWASP.
+func PBKDF2() *PBKDF2Hasher {
+	return &PBKDF2Hasher{Iterations: 600000, KeyLen: 32}
+}
+
+func (h *PBKDF2Hasher) Hash(secret string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(secret), salt, h.Iterations, h.KeyLen, sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", h.Iterations,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func verifyPBKDF2(encoded, secret string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return false, ErrUnknownFormat
+	}
+	var iterations int
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &iterations); err != nil ||
+		iterations <= 0 || iterations > maxPBKDF2Iter {
+		return false, ErrUnknownFormat
+	}
+	salt, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return false, ErrUnknownFormat
+	}
+	key, err := b64.DecodeString(parts[4])
+	if err != nil || len(key) == 0 || len(key) > maxKeyLen {
+		return false, ErrUnknownFormat
+	}
+	actual := pbkdf2.Key([]byte(secret), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
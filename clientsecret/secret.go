@@ -0,0 +1,59 @@
+package clientsecret
+
+import "time"
+
+// Secret is one of the secrets registered for a client.
+// A client can have several active secrets while rotating them.
+type Secret struct {
+	// encoded by Hasher
+	Hash string
+	// client_secret_expires_at (RFC7591), unix time, 0 means it never expires
+	ExpiresAt int64
+}
+
+func New(h Hasher, secret string, expiresAt int64) (*Secret, error) {
+	encoded, err := h.Hash(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Secret{encoded, expiresAt}, nil
+}
+
+func (s *Secret) IsExpired(now time.Time) bool {
+	return s.ExpiresAt != 0 && now.Unix() >= s.ExpiresAt
+}
+
+type Result int
+
+const (
+	NotMatched Result = iota
+	Matched
+	// the secret is right but no longer valid
+	Expired
+)
+
+// Match checks secret against all the registered secrets.
+// The secrets in unknown format are skipped, and the error is
+// returned only when none of them matched.
+func Match(secrets []*Secret, secret string, now time.Time) (Result, error) {
+	result := NotMatched
+	var lastErr error
+	for _, s := range secrets {
+		ok, err := Verify(s.Hash, secret)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !s.IsExpired(now) {
+			return Matched, nil
+		}
+		result = Expired
+	}
+	if result == NotMatched && lastErr != nil {
+		return NotMatched, lastErr
+	}
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package goidc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lyokato/goidc/basic_auth"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/grant"
+	th "github.com/lyokato/goidc/test_helper"
+)
+
+type testContextKey struct{}
+
+// testContextStore records the context passed to the data layer.
+type testContextStore struct {
+	bridge.ContextDataInterface
+	found []interface{}
+}
+
+func newTestContextStore(sdi bridge.DataInterface) *testContextStore {
+	return &testContextStore{
+		ContextDataInterface: bridge.NewContextDataInterface(sdi),
+		found:                make([]interface{}, 0),
+	}
+}
+
+func (s *testContextStore) FindClientById(ctx context.Context,
+	clientId string) (bridge.Client, *bridge.Error) {
+	s.found = append(s.found, ctx.Value(testContextKey{}))
+	return s.ContextDataInterface.FindClientById(ctx, clientId)
+}
+
+func (s *testContextStore) FindOAuthTokenByAccessToken(ctx context.Context,
+	token string) (bridge.OAuthToken, *bridge.Error) {
+	s.found = append(s.found, ctx.Value(testContextKey{}))
+	return s.ContextDataInterface.FindOAuthTokenByAccessToken(ctx, token)
+}
+
+func TestTokenEndpointHandlerContext(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	cdi := newTestContextStore(sdi)
+
+	r := httptest.NewRequest("POST", "/token",
+		strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", basic_auth.Header("client_id_01", "client_secret_01"))
+	r = r.WithContext(context.WithValue(r.Context(), testContextKey{}, "request_01"))
+
+	w := httptest.NewRecorder()
+	te.HandlerContext(cdi)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code:\n - got: %v\n - want: %v\n", w.Code, http.StatusOK)
+	}
+	if len(cdi.found) == 0 || cdi.found[0] != "request_01" {
+		t.Errorf("Context value:\n - got: %v\n - want: %v\n", cdi.found, "[request_01]")
+	}
+}
+
+func TestResourceProtectorValidateContext(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	cdi := newTestContextStore(sdi)
+
+	rp := NewResourceProtector("api.example.org")
+	h := rp.MiddlewareContext(cdi)(http.HandlerFunc(testProtectedResourceHandler))
+
+	r := httptest.NewRequest("GET", "/userinfo", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.GetAccessToken()))
+	r = r.WithContext(context.WithValue(r.Context(), testContextKey{}, "request_02"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code:\n - got: %v\n - want: %v\n", w.Code, http.StatusOK)
+	}
+	if len(cdi.found) != 1 || cdi.found[0] != "request_02" {
+		t.Errorf("Context value:\n - got: %v\n - want: %v\n", cdi.found, "[request_02]")
+	}
+}
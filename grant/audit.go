@@ -0,0 +1,24 @@
+package grant
+
+import (
+	"time"
+
+	"github.com/lyokato/goidc/audit"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/log"
+)
+
+func recordTokenEvent(typ audit.EventType, gt string, c bridge.Client,
+	info bridge.AuthInfo, res *Response, logger log.Logger,
+	requestedTime time.Time, conf *Config) {
+
+	scp := res.Scope
+	if scp == "" {
+		scp = info.GetScope()
+	}
+	e := audit.NewEvent(typ, requestedTime, audit.Success).
+		ByClient(c.GetId()).
+		For(c.GetId(), info.GetUserId(), scp)
+	e.GrantType = gt
+	audit.Record(conf.AuditSink, logger, e)
+}
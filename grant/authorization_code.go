@@ -5,11 +5,11 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/lyokato/goidc/id_token"
-
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/scope"
 
 	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
 	"github.com/lyokato/goidc/log"
 	oer "github.com/lyokato/goidc/oauth_error"
 	"github.com/lyokato/goidc/pkce"
@@ -21,12 +21,12 @@ func AuthorizationCode() *GrantHandler {
 	return &GrantHandler{
 		TypeAuthorizationCode,
 		func(r *http.Request, c bridge.Client, sdi bridge.DataInterface,
-			logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError) {
+			logger log.Logger, requestedTime time.Time, conf *Config) (*Response, *oer.OAuthError) {
 
 			uri := r.FormValue("redirect_uri")
 			if uri == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+				logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 					log.MissingParam,
 					map[string]string{"param": "redirect_uri", "client_id": c.GetId()},
 					"'redirect_uri' not found"))
@@ -37,7 +37,7 @@ func AuthorizationCode() *GrantHandler {
 			code := r.FormValue("code")
 			if code == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+				logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 					log.MissingParam,
 					map[string]string{"param": "code", "client_id": c.GetId()},
 					"'code' not found"))
@@ -50,7 +50,7 @@ func AuthorizationCode() *GrantHandler {
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Info(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.NoEnabledAuthSession,
 						map[string]string{
 							"method":    "FindAuthSessionByCode",
@@ -63,7 +63,7 @@ func AuthorizationCode() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "FindAuthSessionByCode", "client_id": c.GetId()},
 						"the method returns 'unsupported' error."))
@@ -72,21 +72,21 @@ func AuthorizationCode() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Warn(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "FindAuthSessionByCode",
 							"code":      code,
 							"client_id": c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if sess == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceError,
 						map[string]string{"method": "FindAuthSessionByCode", "client_id": c.GetId()},
 						"the method returns (nil, nil)."))
@@ -98,7 +98,7 @@ func AuthorizationCode() *GrantHandler {
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Info(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.NoEnabledAuthInfo,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
@@ -111,7 +111,7 @@ func AuthorizationCode() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceUnsupported,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
@@ -123,21 +123,21 @@ func AuthorizationCode() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Warn(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
 							"code":      code,
 							"client_id": c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if info == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceError,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
@@ -150,7 +150,7 @@ func AuthorizationCode() *GrantHandler {
 			}
 			if info.GetClientId() != c.GetId() {
 
-				logger.Info(log.TokenEndpointLog(TypeAuthorizationCode,
+				logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
 					log.AuthInfoConditionMismatch,
 					map[string]string{"client_id": c.GetId()},
 					"'client_id' mismatch"))
@@ -159,7 +159,7 @@ func AuthorizationCode() *GrantHandler {
 			}
 			if sess.GetRedirectURI() != uri {
 
-				logger.Info(log.TokenEndpointLog(TypeAuthorizationCode,
+				logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
 					log.AuthInfoConditionMismatch,
 					map[string]string{"client_id": c.GetId()},
 					"'redirect_uri' mismatch"))
@@ -171,12 +171,22 @@ func AuthorizationCode() *GrantHandler {
 			// RFC7636: OAuth PKCE Extension
 			// https://tools.ietf.org/html/rfc7636
 			cv := sess.GetCodeVerifier()
+			if cv == "" && client_auth.IsPublic(c) {
+
+				logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
+					log.CodeChallengeFailed,
+					map[string]string{"client_id": c.GetId()},
+					"public client's code isn't bound to PKCE"))
+
+				return nil, oer.NewOAuthError(oer.ErrInvalidGrant,
+					"PKCE is required for public clients")
+			}
 			if cv != "" {
 
 				cm := r.FormValue("code_challenge_method")
 				if cm == "" {
 
-					logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.MissingParam,
 						map[string]string{
 							"param":     "code_challenge_method",
@@ -190,7 +200,7 @@ func AuthorizationCode() *GrantHandler {
 				cc := r.FormValue("code_challenge")
 				if cc == "" {
 
-					logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.MissingParam,
 						map[string]string{
 							"param":     "code_challenge",
@@ -205,7 +215,7 @@ func AuthorizationCode() *GrantHandler {
 				verifier, err := pkce.FindVerifierByMethod(cm)
 				if err != nil {
 
-					logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.UnsupportedCodeChallengeMethod,
 						map[string]string{
 							"code_challenge_method": cm,
@@ -218,7 +228,7 @@ func AuthorizationCode() *GrantHandler {
 				}
 				if !verifier.Verify(cc, cv) {
 
-					logger.Info(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Info(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.CodeChallengeFailed,
 						map[string]string{
 							"code_challenge_method": cm,
@@ -232,79 +242,99 @@ func AuthorizationCode() *GrantHandler {
 				}
 			}
 
-			token, err := sdi.CreateOAuthToken(info, true)
+			// RFC8707: the token can be narrowed to the resources requested here,
+			// within the ones requested at the authorization endpoint.
+			requested, oerr := requestedResources(TypeAuthorizationCode, r, c, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+			resources, oerr := narrowResources(TypeAuthorizationCode, c, logger,
+				sess.GetResources(), requested)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			details, oerr := grantedDetails(TypeAuthorizationCode, r, c, info, conf, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
 
+			// the code is disabled before the token is created, so that
+			// the concurrent redemptions except one fail without the token.
+			err = sdi.DisableSession(sess)
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
-						log.AccessTokenCreationFailed,
-						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"failed to create access token."))
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
+						log.DisableSessionFailed,
+						map[string]string{"method": "DisableSession", "client_id": c.GetId()},
+						"failed to disable code."))
 
 					return nil, oer.NewOAuthSimpleError(oer.ErrInvalidGrant)
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceUnsupported,
-						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
+						map[string]string{"method": "DisableCode", "client_id": c.GetId()},
 						"the method returns 'unsupported' error."))
 
 					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Warn(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceServerError,
-						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"interface returned ServerError."))
-
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
-				}
-			} else {
-				if token == nil {
-
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode, log.InterfaceError,
-						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"the method returns (nil, nil)."))
+						map[string]string{"method": "DisableCode", "client_id": c.GetId()},
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			}
 
-			err = sdi.DisableSession(sess)
+			token, err := sdi.CreateOAuthToken(info, true, resources, details)
+
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
-						log.DisableSessionFailed,
-						map[string]string{"method": "DisableSession", "client_id": c.GetId()},
-						"failed to disable code."))
+					logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
+						log.AccessTokenCreationFailed,
+						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
+						"failed to create access token."))
 
 					return nil, oer.NewOAuthSimpleError(oer.ErrInvalidGrant)
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceUnsupported,
-						map[string]string{"method": "DisableCode", "client_id": c.GetId()},
+						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
 						"the method returns 'unsupported' error."))
 
 					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeAuthorizationCode,
+					logger.Warn(log.TokenEndpointEntry(TypeAuthorizationCode,
 						log.InterfaceServerError,
-						map[string]string{"method": "DisableCode", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
+						fmt.Sprintf("interface returned error: %s", err)))
+
+					return nil, oer.NewInterfaceError(err)
+				}
+			} else {
+				if token == nil {
+
+					logger.Error(log.TokenEndpointEntry(TypeAuthorizationCode, log.InterfaceError,
+						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
+						"the method returns (nil, nil)."))
 
 					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 				}
 			}
 
 			res := NewResponse(token.GetAccessToken(), token.GetAccessTokenExpiresIn())
+			res.AuthorizationDetails = details
 			scp := info.GetScope()
 			if scp != "" {
 				res.Scope = scp
@@ -317,37 +347,24 @@ func AuthorizationCode() *GrantHandler {
 
 			if scope.IncludeOpenID(scp) {
 
-				logger.Debug(log.TokenEndpointLog(TypeAuthorizationCode,
+				logger.Debug(log.TokenEndpointEntry(TypeAuthorizationCode,
 					log.IdTokenGeneration,
 					map[string]string{"client_id": c.GetId()},
 					"found 'openid' scope, so generate id_token, and attach it to response"))
 
-				idt, err := id_token.Gen(
-					c.GetIdTokenAlg(),
-					c.GetIdTokenKey(),
-					c.GetIdTokenKeyId(),
-					sdi.Issuer(),
-					info.GetClientId(),
-					info.GetSubject(),
-					sess.GetNonce(),
-					sess.GetIdTokenExpiresIn(),
-					sess.GetAuthTime(),
-					requestedTime,
-				)
-
-				if err != nil {
-
-					logger.Warn(log.TokenEndpointLog(TypeAuthorizationCode,
-						log.IdTokenGeneration,
-						map[string]string{"client_id": c.GetId()},
-						fmt.Sprintf("failedd to generate id_token: %s", err)))
-
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
-
-				} else {
-					res.IdToken = idt
+				idt, oerr := issueIdToken(TypeAuthorizationCode, r, c, info, sdi,
+					conf, logger, sess.GetNonce(), sess.GetIdTokenExpiresIn(),
+					sess.GetAuthTime(), requestedTime)
+				if oerr != nil {
+					return nil, oerr
 				}
+				res.IdToken = idt
 			}
+			recordTokenEvent(audit.CodeRedeemed, TypeAuthorizationCode, c, info, res,
+				logger, requestedTime, conf)
+			recordTokenEvent(audit.TokenIssued, TypeAuthorizationCode, c, info, res,
+				logger, requestedTime, conf)
+
 			return res, nil
 		},
 	}
@@ -1,9 +1,11 @@
 package grant
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/flow"
 	"github.com/lyokato/goidc/log"
@@ -16,12 +18,12 @@ func ClientCredentials() *GrantHandler {
 	return &GrantHandler{
 		TypeClientCredentials,
 		func(r *http.Request, c bridge.Client, sdi bridge.DataInterface,
-			logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError) {
+			logger log.Logger, requestedTime time.Time, conf *Config) (*Response, *oer.OAuthError) {
 
 			uid := c.GetOwnerUserId()
 			if uid < 0 {
 
-				logger.Warn(log.TokenEndpointLog(TypeClientCredentials,
+				logger.Warn(log.TokenEndpointEntry(TypeClientCredentials,
 					log.NoEnabledUserId,
 					map[string]string{"method": "OwnerUserId", "client_id": c.GetId()},
 					"client returned no enabled owner's id"))
@@ -32,7 +34,7 @@ func ClientCredentials() *GrantHandler {
 			scp_req := r.FormValue("scope")
 			if scp_req != "" && !c.CanUseScope(flow.DirectGrant, scp_req) {
 
-				logger.Info(log.TokenEndpointLog(TypeClientCredentials,
+				logger.Info(log.TokenEndpointEntry(TypeClientCredentials,
 					log.InvalidScope,
 					map[string]string{"scope": scp_req, "client_id": c.GetId()},
 					"requested scope is not allowed to this client"))
@@ -40,12 +42,22 @@ func ClientCredentials() *GrantHandler {
 				return nil, oer.NewOAuthSimpleError(oer.ErrInvalidScope)
 			}
 
-			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req)
+			resources, oerr := requestedResources(TypeClientCredentials, r, c, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			details, oerr := requestedDetails(TypeClientCredentials, r, c, conf, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req, details)
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Debug(log.TokenEndpointEntry(TypeClientCredentials,
 						log.AuthInfoCreationFailed,
 						map[string]string{"method": "CreateOrUpdateAuthInfo", "client_id": c.GetId()},
 						"failed to create auth info."))
@@ -54,7 +66,7 @@ func ClientCredentials() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Error(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns 'unsupported' error."))
@@ -63,17 +75,17 @@ func ClientCredentials() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Warn(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceServerError,
 						map[string]string{"method": "CreateOrUpdateAuthInfo", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if info == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Error(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns (nil, nil)."))
@@ -82,12 +94,13 @@ func ClientCredentials() *GrantHandler {
 				}
 			}
 
-			token, err := sdi.CreateOAuthToken(info, true)
+			token, err := sdi.CreateOAuthToken(info, true, resources,
+				info.GetAuthorizationDetails())
 
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Debug(log.TokenEndpointEntry(TypeClientCredentials,
 						log.AccessTokenCreationFailed,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
 						"failed to create access token."))
@@ -96,7 +109,7 @@ func ClientCredentials() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Error(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns 'unsupported' error."))
@@ -105,17 +118,17 @@ func ClientCredentials() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Warn(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceServerError,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if token == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeClientCredentials,
+					logger.Error(log.TokenEndpointEntry(TypeClientCredentials,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns (nil, nil)."))
@@ -125,6 +138,7 @@ func ClientCredentials() *GrantHandler {
 			}
 
 			res := NewResponse(token.GetAccessToken(), token.GetAccessTokenExpiresIn())
+			res.AuthorizationDetails = info.GetAuthorizationDetails()
 
 			scp := info.GetScope()
 			if scp != "" {
@@ -134,6 +148,9 @@ func ClientCredentials() *GrantHandler {
 			if rt != "" {
 				res.RefreshToken = rt
 			}
+			recordTokenEvent(audit.TokenIssued, TypeClientCredentials, c, info, res,
+				logger, requestedTime, conf)
+
 			return res, nil
 		},
 	}
@@ -0,0 +1,74 @@
+package grant
+
+import (
+	"net/http"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/log"
+	oer "github.com/lyokato/goidc/oauth_error"
+)
+
+// requestedDetails parses and validates 'authorization_details' in the token request.
+// RFC9396 6. Token Request
+func requestedDetails(gt string, r *http.Request, c bridge.Client,
+	conf *Config, logger log.Logger) ([]authorization.Detail, *oer.OAuthError) {
+
+	raw := r.FormValue("authorization_details")
+	if raw == "" {
+		return nil, nil
+	}
+
+	if conf.AuthorizationDetailsRegistry == nil {
+
+		logger.Debug(log.TokenEndpointEntry(gt,
+			log.InvalidAuthorizationDetails,
+			map[string]string{"client_id": c.GetId()},
+			"AuthorizationDetailsRegistry is not set."))
+
+		return nil, oer.NewOAuthError(oer.ErrInvalidAuthorizationDetails,
+			"'authorization_details' is not supported")
+	}
+
+	details, err := authorization.ParseDetails(raw)
+	if err == nil {
+		err = conf.AuthorizationDetailsRegistry.Validate(details)
+	}
+	if err != nil {
+
+		logger.Debug(log.TokenEndpointEntry(gt,
+			log.InvalidAuthorizationDetails,
+			map[string]string{"client_id": c.GetId()},
+			err.Error()))
+
+		return nil, oer.NewOAuthError(oer.ErrInvalidAuthorizationDetails, err.Error())
+	}
+	return details, nil
+}
+
+// grantedDetails returns authorization_details for the new access_token.
+// When the request has 'authorization_details', all of them must be granted already,
+// and the token is narrowed to them.
+func grantedDetails(gt string, r *http.Request, c bridge.Client,
+	info bridge.AuthInfo, conf *Config, logger log.Logger) ([]authorization.Detail, *oer.OAuthError) {
+
+	requested, oerr := requestedDetails(gt, r, c, conf, logger)
+	if oerr != nil {
+		return nil, oerr
+	}
+	granted := info.GetAuthorizationDetails()
+	if !authorization.IncludeAllDetails(granted, requested) {
+
+		logger.Info(log.TokenEndpointEntry(gt,
+			log.InvalidAuthorizationDetails,
+			map[string]string{"client_id": c.GetId()},
+			"requested 'authorization_details' is not granted."))
+
+		return nil, oer.NewOAuthError(oer.ErrInvalidAuthorizationDetails,
+			"requested 'authorization_details' is not granted")
+	}
+	if len(requested) > 0 {
+		return requested, nil
+	}
+	return granted, nil
+}
@@ -0,0 +1,48 @@
+package grant
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/id_token"
+	"github.com/lyokato/goidc/log"
+	oer "github.com/lyokato/goidc/oauth_error"
+)
+
+// issueIdToken builds claims with SubjectStrategy and IdTokenClaimsHook,
+// and signs them (and encrypts if the client requires).
+func issueIdToken(gt string, r *http.Request, c bridge.Client,
+	info bridge.AuthInfo, sdi bridge.DataInterface, conf *Config,
+	logger log.Logger, nonce string, expiresIn, authTime int64,
+	requestedTime time.Time) (string, *oer.OAuthError) {
+
+	claims := id_token.NewClaims(sdi.Issuer(), info.GetClientId(), "",
+		expiresIn, requestedTime).
+		Nonce(nonce).
+		AuthTime(authTime)
+
+	idt, ignored, err := id_token.Issue(claims, r, c, info, sdi,
+		conf.SubjectStrategy, conf.IdTokenClaimsHook)
+	if len(ignored) > 0 {
+
+		logger.Warn(log.TokenEndpointEntry(gt,
+			log.IdTokenGeneration,
+			map[string]string{
+				"client_id": c.GetId(),
+				"claims":    strings.Join(ignored, ","),
+			},
+			"IdTokenClaimsHook tried to overwrite reserved claims, ignored."))
+	}
+	if err != nil {
+
+		logger.Warn(log.TokenEndpointEntry(gt,
+			log.IdTokenGeneration,
+			map[string]string{"client_id": c.GetId()},
+			err.Error()))
+
+		return "", oer.NewOAuthSimpleError(oer.ErrServerError)
+	}
+	return idt, nil
+}
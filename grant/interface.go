@@ -6,30 +6,64 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/lyokato/goidc/assertion"
+	"github.com/lyokato/goidc/audit"
+	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/id_token"
+	"github.com/lyokato/goidc/limiter"
 	log "github.com/lyokato/goidc/log"
 	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/subject"
 )
 
 type (
 	GrantHandlerFunc func(r *http.Request, c bridge.Client,
-		sdi bridge.DataInterface, logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError)
+		sdi bridge.DataInterface, logger log.Logger, requestedTime time.Time,
+		conf *Config) (*Response, *oer.OAuthError)
 
 	GrantHandler struct {
 		Type string
 		Func GrantHandlerFunc
 	}
 
+	// Config holds provider-wide settings which TokenEndpoint
+	// passes to every GrantHandlerFunc.
+	Config struct {
+		SubjectStrategy   subject.Strategy
+		IdTokenClaimsHook id_token.ClaimsHook
+		// used for id_token issued on refresh, which has no AuthSession
+		IdTokenExpiresIn int64
+		// 'authorization_details' is rejected when this is nil
+		AuthorizationDetailsRegistry *authorization.DetailsRegistry
+		// receives token_issued, code_redeemed and so on, nil to disable
+		AuditSink audit.Sink
+		// throttles client authentication and the password grant, nil to disable
+		Limiter limiter.Limiter
+		// rules for client_assertion and the assertion of the JWT grant, nil to disable
+		ClientAssertionPolicy *assertion.Policy
+		JWTAssertionPolicy    *assertion.Policy
+	}
+
 	Response struct {
 		TokenType    string `json:"token_type"`
 		AccessToken  string `json:"access_token"`
 		ExpiresIn    int64  `json:"expires_in"`
 		RefreshToken string `json:"refresh_token,omitempty"`
-		Scope        string `json:"scope",omitempty`
+		Scope        string `json:"scope,omitempty"`
 		IdToken      string `json:"id_token,omitempty"`
+
+		AuthorizationDetails []authorization.Detail `json:"authorization_details,omitempty"`
 	}
 )
 
+func DefaultConfig() *Config {
+	return &Config{
+		SubjectStrategy:  subject.Public(),
+		IdTokenExpiresIn: authorization.DefaultIdTokenExpiresIn,
+	}
+}
+
 func NewResponse(token string, expiresIn int64) *Response {
 	return &Response{
 		TokenType:   "Bearer",
@@ -8,6 +8,7 @@ import (
 	jwt "github.com/golang-jwt/jwt"
 
 	"github.com/lyokato/goidc/assertion"
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/flow"
 	"github.com/lyokato/goidc/log"
@@ -24,12 +25,12 @@ func JWT() *GrantHandler {
 	return &GrantHandler{
 		TypeJWT,
 		func(r *http.Request, c bridge.Client, sdi bridge.DataInterface,
-			logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError) {
+			logger log.Logger, requestedTime time.Time, conf *Config) (*Response, *oer.OAuthError) {
 
 			a := r.FormValue("assertion")
 			if a == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypeJWT,
+				logger.Debug(log.TokenEndpointEntry(TypeJWT,
 					log.MissingParam,
 					map[string]string{"param": "assertion", "client_id": c.GetId()},
 					"'assertion' not found"))
@@ -59,7 +60,12 @@ func JWT() *GrantHandler {
 				}
 			})
 
-			oerr := assertion.HandleAssertionError(a, t, jwt_err, TypeJWT, c, sdi, logger)
+			oerr := assertion.HandleAssertionError(a, t, jwt_err, TypeJWT, c, sdi, logger,
+				&assertion.Options{
+					AuditSink: conf.AuditSink,
+					Policy:    conf.JWTAssertionPolicy,
+					Now:       requestedTime,
+				})
 			if oerr != nil {
 				return nil, oerr
 			}
@@ -67,7 +73,7 @@ func JWT() *GrantHandler {
 			sub, ok := claims["sub"].(string)
 			if !ok {
 
-				logger.Debug(log.TokenEndpointLog(TypeJWT,
+				logger.Debug(log.TokenEndpointEntry(TypeJWT,
 					log.MissingParam,
 					map[string]string{"param": "sub", "client_id": c.GetId()},
 					"'sub' not found in assertion"))
@@ -76,11 +82,11 @@ func JWT() *GrantHandler {
 					"'sub' parameter not found")
 			}
 
-			uid, err := sdi.FindUserIdBySubject(sub)
+			uid, err := conf.SubjectStrategy.FindUserId(sdi, c, sub)
 			if err != nil {
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeJWT,
+					logger.Debug(log.TokenEndpointEntry(TypeJWT,
 						log.NoEnabledUserId,
 						map[string]string{
 							"method":    "FindUserIdBySubject",
@@ -94,7 +100,7 @@ func JWT() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeJWT,
+					logger.Error(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "FindUserIdBySubject"},
 						"the method returns 'unsupported' error."))
@@ -103,19 +109,19 @@ func JWT() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeJWT,
+					logger.Warn(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceServerError,
 						map[string]string{"method": "FindUserIdBySubject", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			}
 
 			scp_req := r.FormValue("scope")
 			if scp_req != "" && !c.CanUseScope(flow.DirectGrant, scp_req) {
 
-				logger.Info(log.TokenEndpointLog(TypeJWT,
+				logger.Info(log.TokenEndpointEntry(TypeJWT,
 					log.InvalidScope,
 					map[string]string{"scope": scp_req, "client_id": c.GetId()},
 					"requested scope is not allowed to this client"))
@@ -123,12 +129,22 @@ func JWT() *GrantHandler {
 				return nil, oer.NewOAuthSimpleError(oer.ErrInvalidScope)
 			}
 
-			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req)
+			resources, oerr := requestedResources(TypeJWT, r, c, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			details, oerr := requestedDetails(TypeJWT, r, c, conf, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req, details)
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeJWT,
+					logger.Debug(log.TokenEndpointEntry(TypeJWT,
 						log.AuthInfoCreationFailed,
 						map[string]string{"method": "CreateOrUpdateAuthInfo", "client_id": c.GetId()},
 						"failed to create auth info."))
@@ -137,7 +153,7 @@ func JWT() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeJWT,
+					logger.Error(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns 'unsupported' error."))
@@ -146,17 +162,17 @@ func JWT() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeJWT,
+					logger.Warn(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceServerError,
 						map[string]string{"method": "CreateOrUpdateAuthInfo", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if info == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeJWT,
+					logger.Error(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns (nil, nil)."))
@@ -165,13 +181,14 @@ func JWT() *GrantHandler {
 				}
 			}
 
-			token, err := sdi.CreateOAuthToken(info, true)
+			token, err := sdi.CreateOAuthToken(info, true, resources,
+				info.GetAuthorizationDetails())
 
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeJWT,
+					logger.Debug(log.TokenEndpointEntry(TypeJWT,
 						log.AccessTokenCreationFailed,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
 						"failed to create access token."))
@@ -180,7 +197,7 @@ func JWT() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeJWT,
+					logger.Error(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns 'unsupported' error."))
@@ -189,18 +206,18 @@ func JWT() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeJWT,
+					logger.Warn(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceServerError,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 
 				}
 			} else {
 				if token == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeJWT,
+					logger.Error(log.TokenEndpointEntry(TypeJWT,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns (nil, nil)."))
@@ -210,6 +227,7 @@ func JWT() *GrantHandler {
 			}
 
 			res := NewResponse(token.GetAccessToken(), token.GetAccessTokenExpiresIn())
+			res.AuthorizationDetails = info.GetAuthorizationDetails()
 
 			scp := info.GetScope()
 			if scp != "" {
@@ -219,6 +237,9 @@ func JWT() *GrantHandler {
 			if rt != "" {
 				res.RefreshToken = rt
 			}
+			recordTokenEvent(audit.TokenIssued, TypeJWT, c, info, res,
+				logger, requestedTime, conf)
+
 			return res, nil
 		},
 	}
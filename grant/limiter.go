@@ -0,0 +1,64 @@
+package grant
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lyokato/goidc/limiter"
+	"github.com/lyokato/goidc/log"
+	oer "github.com/lyokato/goidc/oauth_error"
+)
+
+// CheckLockout returns the remaining lockout of keys.
+// The failure of Limiter is logged and ignored,
+// so that the backend doesn't stop the authentication.
+func CheckLockout(gt string, conf *Config, logger log.Logger,
+	now time.Time, keys ...string) time.Duration {
+	if conf.Limiter == nil {
+		return 0
+	}
+	d, err := conf.Limiter.Check(now, keys...)
+	if err != nil {
+		logger.Warn(log.TokenEndpointEntry(gt, log.InterfaceServerError,
+			map[string]string{"method": "Limiter.Check"},
+			fmt.Sprintf("limiter returned error: %s", err)))
+		return 0
+	}
+	return d
+}
+
+// RecordFailure records the failure of keys,
+// and returns the lockout started by it.
+func RecordFailure(gt string, conf *Config, logger log.Logger,
+	now time.Time, keys ...string) time.Duration {
+	if conf.Limiter == nil {
+		return 0
+	}
+	d, err := conf.Limiter.Fail(now, keys...)
+	if err != nil {
+		logger.Warn(log.TokenEndpointEntry(gt, log.InterfaceServerError,
+			map[string]string{"method": "Limiter.Fail"},
+			fmt.Sprintf("limiter returned error: %s", err)))
+		return 0
+	}
+	return d
+}
+
+// RecordSuccess clears the failures of keys.
+func RecordSuccess(gt string, conf *Config, logger log.Logger, keys ...string) {
+	if conf.Limiter == nil {
+		return
+	}
+	if err := conf.Limiter.Succeed(keys...); err != nil {
+		logger.Warn(log.TokenEndpointEntry(gt, log.InterfaceServerError,
+			map[string]string{"method": "Limiter.Succeed"},
+			fmt.Sprintf("limiter returned error: %s", err)))
+	}
+}
+
+// LockoutError returns typ with 'Retry-After' for the lockout.
+func LockoutError(typ oer.OAuthErrorType, d time.Duration) *oer.OAuthError {
+	err := oer.NewOAuthError(typ, "too many failures, retry later")
+	err.RetryAfter = limiter.RetryAfter(d)
+	return err
+}
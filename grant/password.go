@@ -1,11 +1,14 @@
 package grant
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/flow"
+	"github.com/lyokato/goidc/limiter"
 	"github.com/lyokato/goidc/log"
 	oer "github.com/lyokato/goidc/oauth_error"
 )
@@ -16,12 +19,12 @@ func Password() *GrantHandler {
 	return &GrantHandler{
 		TypePassword,
 		func(r *http.Request, c bridge.Client, sdi bridge.DataInterface,
-			logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError) {
+			logger log.Logger, requestedTime time.Time, conf *Config) (*Response, *oer.OAuthError) {
 
 			username := r.FormValue("username")
 			if username == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypePassword,
+				logger.Debug(log.TokenEndpointEntry(TypePassword,
 					log.MissingParam,
 					map[string]string{"param": "username", "client_id": c.GetId()},
 					"'username' not found"))
@@ -33,7 +36,7 @@ func Password() *GrantHandler {
 			password := r.FormValue("password")
 			if password == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypePassword,
+				logger.Debug(log.TokenEndpointEntry(TypePassword,
 					log.MissingParam,
 					map[string]string{"param": "password", "client_id": c.GetId()},
 					"'password' not found"))
@@ -45,33 +48,46 @@ func Password() *GrantHandler {
 			scp_req := r.FormValue("scope")
 			if scp_req != "" && !c.CanUseScope(flow.DirectGrant, scp_req) {
 
-				logger.Info(log.TokenEndpointLog(TypePassword, log.InvalidScope,
+				logger.Info(log.TokenEndpointEntry(TypePassword, log.InvalidScope,
 					map[string]string{"scope": scp_req, "client_id": c.GetId()},
 					"requested scope is not allowed to this client"))
 
 				return nil, oer.NewOAuthSimpleError(oer.ErrInvalidScope)
 			}
 
+			keys := []string{limiter.UsernameKey(username), limiter.UserIPKey(limiter.SourceIP(r))}
+			if d := CheckLockout(TypePassword, conf, logger, requestedTime, keys...); d > 0 {
+
+				logger.Info(log.TokenEndpointEntry(TypePassword,
+					log.TooManyFailures,
+					map[string]string{"client_id": c.GetId(), "username": username},
+					"the user is locked out."))
+
+				return nil, LockoutError(oer.ErrInvalidGrant, d)
+			}
+
 			uid, err := sdi.FindUserId(username, password)
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypePassword,
+					logger.Debug(log.TokenEndpointEntry(TypePassword,
 						log.NoEnabledUserId,
 						map[string]string{
 							"method":    "FindUserId",
 							"client_id": c.GetId(),
 							"username":  username,
-							"password":  password,
 						},
 						"user id not found."))
 
+					if d := RecordFailure(TypePassword, conf, logger, requestedTime, keys...); d > 0 {
+						return nil, LockoutError(oer.ErrInvalidGrant, d)
+					}
 					return nil, oer.NewOAuthSimpleError(oer.ErrInvalidGrant)
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypePassword,
+					logger.Error(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "FindUserId"},
 						"the method returns 'unsupported' error."))
@@ -80,26 +96,36 @@ func Password() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypePassword,
+					logger.Warn(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "FindUserId",
 							"client_id": c.GetId(),
 							"username":  username,
-							"password":  password,
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			}
+			RecordSuccess(TypePassword, conf, logger, limiter.UsernameKey(username))
+
+			resources, oerr := requestedResources(TypePassword, r, c, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
 
-			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req)
+			details, oerr := requestedDetails(TypePassword, r, c, conf, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			info, err := sdi.CreateOrUpdateAuthInfo(uid, c.GetId(), scp_req, details)
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypePassword,
+					logger.Debug(log.TokenEndpointEntry(TypePassword,
 						log.AuthInfoCreationFailed,
 						map[string]string{
 							"method":    "CreateOrUpdateAuthInfo",
@@ -111,7 +137,7 @@ func Password() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypePassword,
+					logger.Error(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns 'unsupported' error."))
@@ -120,20 +146,20 @@ func Password() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypePassword,
+					logger.Warn(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "CreateOrUpdateAuthInfo",
 							"client_id": c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if info == nil {
 
-					logger.Error(log.TokenEndpointLog(TypePassword,
+					logger.Error(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOrUpdateAuthInfo"},
 						"the method returns (nil, nil)."))
@@ -142,13 +168,14 @@ func Password() *GrantHandler {
 				}
 			}
 
-			token, err := sdi.CreateOAuthToken(info, true)
+			token, err := sdi.CreateOAuthToken(info, true, resources,
+				info.GetAuthorizationDetails())
 
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypePassword,
+					logger.Debug(log.TokenEndpointEntry(TypePassword,
 						log.AccessTokenCreationFailed,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
 						"failed to create access token."))
@@ -157,7 +184,7 @@ func Password() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypePassword,
+					logger.Error(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns 'unsupported' error."))
@@ -166,17 +193,17 @@ func Password() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypePassword,
+					logger.Warn(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceServerError,
 						map[string]string{"method": "CreateOAuthToken", "client_id": c.GetId()},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 				}
 			} else {
 				if token == nil {
 
-					logger.Error(log.TokenEndpointLog(TypePassword,
+					logger.Error(log.TokenEndpointEntry(TypePassword,
 						log.InterfaceError,
 						map[string]string{"method": "CreateOAuthToken"},
 						"the method returns (nil, nil)."))
@@ -186,6 +213,8 @@ func Password() *GrantHandler {
 			}
 
 			res := NewResponse(token.GetAccessToken(), token.GetAccessTokenExpiresIn())
+			res.AuthorizationDetails = info.GetAuthorizationDetails()
+
 			scp := info.GetScope()
 			if scp != "" {
 				res.Scope = scp
@@ -196,6 +225,9 @@ func Password() *GrantHandler {
 				res.RefreshToken = rt
 			}
 
+			recordTokenEvent(audit.TokenIssued, TypePassword, c, info, res,
+				logger, requestedTime, conf)
+
 			return res, nil
 		},
 	}
@@ -0,0 +1,15 @@
+package grant
+
+// RFC8628: OAuth 2.0 Device Authorization Grant
+const TypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// AllowedForPublicClient reports whether the clients authenticated with
+// 'none' can use gt. Those grants are bound to the end-user by
+// code_verifier, device_code, or rotated refresh_token instead of secret.
+func AllowedForPublicClient(gt string) bool {
+	switch gt {
+	case TypeAuthorizationCode, TypeRefreshToken, TypeDeviceCode:
+		return true
+	}
+	return false
+}
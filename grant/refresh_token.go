@@ -1,10 +1,13 @@
 package grant
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
 	"github.com/lyokato/goidc/log"
 	oer "github.com/lyokato/goidc/oauth_error"
 	"github.com/lyokato/goidc/scope"
@@ -16,12 +19,12 @@ func RefreshToken() *GrantHandler {
 	return &GrantHandler{
 		TypeRefreshToken,
 		func(r *http.Request, c bridge.Client, sdi bridge.DataInterface,
-			logger log.Logger, requestedTime time.Time) (*Response, *oer.OAuthError) {
+			logger log.Logger, requestedTime time.Time, conf *Config) (*Response, *oer.OAuthError) {
 
 			rt := r.FormValue("refresh_token")
 			if rt == "" {
 
-				logger.Debug(log.TokenEndpointLog(TypeRefreshToken,
+				logger.Debug(log.TokenEndpointEntry(TypeRefreshToken,
 					log.MissingParam,
 					map[string]string{
 						"param":     "refresh_token",
@@ -38,7 +41,7 @@ func RefreshToken() *GrantHandler {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Debug(log.TokenEndpointEntry(TypeRefreshToken,
 						log.NoEnabledAccessToken,
 						map[string]string{
 							"method":        "FindAccessTokenByRefreshToken",
@@ -51,7 +54,7 @@ func RefreshToken() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "FindAccessTokenByRefreshToken"},
 						"the method returns 'unsupported' error."))
@@ -60,22 +63,22 @@ func RefreshToken() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Warn(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":        "FindAccessTokenByRefreshToken",
 							"refresh_token": rt,
 							"client_id":     c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 
 				}
 			} else {
 				if old == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceError,
 						map[string]string{"method": "FindAccessTokenByRefreshToken"},
 						"the method returns (nil, nil)."))
@@ -86,7 +89,7 @@ func RefreshToken() *GrantHandler {
 
 			if old.GetRefreshTokenExpiresIn()+old.GetCreatedAt() < requestedTime.Unix() {
 
-				logger.Info(log.TokenEndpointLog(TypeRefreshToken,
+				logger.Info(log.TokenEndpointEntry(TypeRefreshToken,
 					log.RefreshTokenConditionMismatch,
 					map[string]string{"client_id": c.GetId()},
 					"expired refresh_token"))
@@ -100,7 +103,7 @@ func RefreshToken() *GrantHandler {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Debug(log.TokenEndpointEntry(TypeRefreshToken,
 						log.NoEnabledAuthInfo,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
@@ -112,7 +115,7 @@ func RefreshToken() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "FindActiveAuthInfoById"},
 						"the method returns 'unsupported' error."))
@@ -121,21 +124,21 @@ func RefreshToken() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Warn(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "FindActiveAuthInfoById",
 							"client_id": c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 
 				}
 			} else {
 				if info == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceError,
 						map[string]string{"method": "FindActiveAuthInfoById"},
 						"the method returns (nil, nil)."))
@@ -145,7 +148,7 @@ func RefreshToken() *GrantHandler {
 			}
 			if info.GetClientId() != c.GetId() {
 
-				logger.Info(log.TokenEndpointLog(TypeRefreshToken,
+				logger.Info(log.TokenEndpointEntry(TypeRefreshToken,
 					log.AuthInfoConditionMismatch,
 					map[string]string{"client_id": c.GetId()},
 					"'client_id' mismatch"))
@@ -155,7 +158,7 @@ func RefreshToken() *GrantHandler {
 			scp := info.GetScope()
 			if !scope.IncludeOfflineAccess(scp) {
 
-				logger.Info(log.TokenEndpointLog(TypeRefreshToken,
+				logger.Info(log.TokenEndpointEntry(TypeRefreshToken,
 					log.ScopeConditionMismatch,
 					map[string]string{"client_id": c.GetId()},
 					"'offline_access' not found"))
@@ -163,12 +166,47 @@ func RefreshToken() *GrantHandler {
 				return nil, oer.NewOAuthSimpleError(oer.ErrInvalidGrant)
 			}
 
-			token, err := sdi.RefreshAccessToken(info, old)
+			// RFC8707: refresh request can narrow the audience of the new access_token
+			requested, oerr := requestedResources(TypeRefreshToken, r, c, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+			audience, oerr := narrowResources(TypeRefreshToken, c, logger,
+				old.GetResources(), requested)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			details, oerr := grantedDetails(TypeRefreshToken, r, c, info, conf, logger)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			// OAuth 2.0 Security BCP 4.14.2: refresh_token of public clients
+			// isn't bound to the sender, so it must be used only once.
+			// It's checked before RefreshAccessToken, so that the rejected
+			// request doesn't leave the new token.
+			// Detecting the reuse of the rotated one is left to DataInterface,
+			// which keeps the rotated tokens.
+			if client_auth.IsPublic(c) && old.GetRefreshToken() != rt {
+
+				logger.Info(log.TokenEndpointEntry(TypeRefreshToken,
+					log.RefreshTokenConditionMismatch,
+					map[string]string{
+						"method":    "FindOAuthTokenByRefreshToken",
+						"client_id": c.GetId(),
+					},
+					"the refresh_token of the public client is already rotated."))
+
+				return nil, oer.NewOAuthSimpleError(oer.ErrInvalidGrant)
+			}
+
+			token, err := sdi.RefreshAccessToken(info, old, audience, details)
 			if err != nil {
 
 				if err.Type() == bridge.ErrFailed {
 
-					logger.Debug(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Debug(log.TokenEndpointEntry(TypeRefreshToken,
 						log.AccessTokenRefreshFailed,
 						map[string]string{
 							"method":    "RefreshAccessToken",
@@ -180,7 +218,7 @@ func RefreshToken() *GrantHandler {
 
 				} else if err.Type() == bridge.ErrUnsupported {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceUnsupported,
 						map[string]string{"method": "RefreshAccessToken"},
 						"the method returns 'unsupported' error."))
@@ -189,21 +227,21 @@ func RefreshToken() *GrantHandler {
 
 				} else {
 
-					logger.Warn(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Warn(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceServerError,
 						map[string]string{
 							"method":    "RefreshAccessToken",
 							"client_id": c.GetId(),
 						},
-						"interface returned ServerError."))
+						fmt.Sprintf("interface returned error: %s", err)))
 
-					return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+					return nil, oer.NewInterfaceError(err)
 
 				}
 			} else {
 				if token == nil {
 
-					logger.Error(log.TokenEndpointLog(TypeRefreshToken,
+					logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
 						log.InterfaceError,
 						map[string]string{"method": "RefreshAccessToken"},
 						"the method returns (nil, nil)."))
@@ -213,14 +251,49 @@ func RefreshToken() *GrantHandler {
 			}
 
 			res := NewResponse(token.GetAccessToken(), token.GetAccessTokenExpiresIn())
+			res.AuthorizationDetails = details
 			if scp != "" {
 				res.Scope = scp
 			}
 
 			newRt := token.GetRefreshToken()
+
+			// the DataInterface breaking the contract of RefreshAccessToken
+			if client_auth.IsPublic(c) && (newRt == "" || newRt == rt) {
+
+				logger.Error(log.TokenEndpointEntry(TypeRefreshToken,
+					log.InterfaceError,
+					map[string]string{
+						"method":    "RefreshAccessToken",
+						"client_id": c.GetId(),
+					},
+					"the method didn't rotate refresh_token of the public client."))
+
+				return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+			}
+
 			if newRt != "" {
 				res.RefreshToken = newRt
 			}
+
+			// OpenID Connect Core 1.0 12.2. Successful Refresh Response
+			if scope.IncludeOpenID(scp) {
+
+				logger.Debug(log.TokenEndpointEntry(TypeRefreshToken,
+					log.IdTokenGeneration,
+					map[string]string{"client_id": c.GetId()},
+					"found 'openid' scope, so generate id_token, and attach it to response"))
+
+				idt, oerr := issueIdToken(TypeRefreshToken, r, c, info, sdi,
+					conf, logger, "", conf.IdTokenExpiresIn, -1, requestedTime)
+				if oerr != nil {
+					return nil, oerr
+				}
+				res.IdToken = idt
+			}
+			recordTokenEvent(audit.TokenRefreshed, TypeRefreshToken, c, info, res,
+				logger, requestedTime, conf)
+
 			return res, nil
 		},
 	}
@@ -0,0 +1,67 @@
+package grant
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/log"
+	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/resource"
+)
+
+// requestedResources validates 'resource' parameters in the token request.
+// RFC8707 2.2. Access Token Request
+func requestedResources(gt string, r *http.Request, c bridge.Client,
+	logger log.Logger) ([]string, *oer.OAuthError) {
+
+	resources := resource.FromRequest(r)
+	for _, rs := range resources {
+
+		if err := resource.Validate(rs); err != nil {
+
+			logger.Debug(log.TokenEndpointEntry(gt,
+				log.InvalidTarget,
+				map[string]string{"resource": rs, "client_id": c.GetId()},
+				err.Error()))
+
+			return nil, oer.NewOAuthError(oer.ErrInvalidTarget, err.Error())
+		}
+
+		if !c.CanUseResource(rs) {
+
+			logger.Info(log.TokenEndpointEntry(gt,
+				log.InvalidTarget,
+				map[string]string{"resource": rs, "client_id": c.GetId()},
+				"requested resource is not allowed to this client"))
+
+			return nil, oer.NewOAuthError(oer.ErrInvalidTarget,
+				fmt.Sprintf("'%s' is not allowed to this client", rs))
+		}
+	}
+	return resources, nil
+}
+
+// narrowResources returns the audience for the new access_token.
+// When the grant isn't restricted to any resource, requested ones are used as they are.
+func narrowResources(gt string, c bridge.Client, logger log.Logger,
+	granted, requested []string) ([]string, *oer.OAuthError) {
+
+	if len(requested) == 0 {
+		return granted, nil
+	}
+	if len(granted) == 0 {
+		return requested, nil
+	}
+	if ok, notFound := resource.IncludeAll(granted, requested); !ok {
+
+		logger.Info(log.TokenEndpointEntry(gt,
+			log.InvalidTarget,
+			map[string]string{"resource": notFound, "client_id": c.GetId()},
+			"requested resource is not granted"))
+
+		return nil, oer.NewOAuthError(oer.ErrInvalidTarget,
+			fmt.Sprintf("'%s' is not granted", notFound))
+	}
+	return requested, nil
+}
@@ -0,0 +1,137 @@
+package id_token
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/jwe"
+)
+
+// ClaimsHook returns additional claims like 'azp', 'sid', 'acr',
+// profile claims or tenant specific ones.
+// Claims which the library is responsible for are never overwritten.
+type ClaimsHook func(c bridge.Client, info bridge.AuthInfo,
+	r *http.Request) map[string]interface{}
+
+var reservedClaims = map[string]bool{
+	"iss":       true,
+	"sub":       true,
+	"aud":       true,
+	"exp":       true,
+	"iat":       true,
+	"auth_time": true,
+	"nonce":     true,
+	"at_hash":   true,
+	"c_hash":    true,
+}
+
+func IsReservedClaim(name string) bool {
+	_, exists := reservedClaims[name]
+	return exists
+}
+
+type Claims struct {
+	values      map[string]interface{}
+	accessToken string
+	code        string
+}
+
+func NewClaims(issuer, clientId, subject string,
+	expiresIn int64, now time.Time) *Claims {
+	return &Claims{
+		values: map[string]interface{}{
+			"iss": issuer,
+			"aud": clientId,
+			"sub": subject,
+			"exp": now.Unix() + expiresIn,
+			"iat": now.Unix(),
+		},
+	}
+}
+
+func (c *Claims) Nonce(nonce string) *Claims {
+	if nonce != "" {
+		c.values["nonce"] = nonce
+	}
+	return c
+}
+
+func (c *Claims) AuthTime(authTime int64) *Claims {
+	if authTime >= 0 {
+		c.values["auth_time"] = authTime
+	}
+	return c
+}
+
+// AccessToken is hashed into 'at_hash' when signed
+func (c *Claims) AccessToken(token string) *Claims {
+	c.accessToken = token
+	return c
+}
+
+// Code is hashed into 'c_hash' when signed
+func (c *Claims) Code(code string) *Claims {
+	c.code = code
+	return c
+}
+
+func (c *Claims) Set(name string, value interface{}) error {
+	if IsReservedClaim(name) {
+		return fmt.Errorf("'%s' is reserved claim", name)
+	}
+	c.values[name] = value
+	return nil
+}
+
+// Merge copies extra claims, and returns names of
+// the reserved ones which are ignored.
+func (c *Claims) Merge(extra map[string]interface{}) []string {
+	ignored := make([]string, 0)
+	for name, value := range extra {
+		if err := c.Set(name, value); err != nil {
+			ignored = append(ignored, name)
+		}
+	}
+	return ignored
+}
+
+func (c *Claims) Get(name string) (interface{}, bool) {
+	v, exists := c.values[name]
+	return v, exists
+}
+
+func (c *Claims) Sign(alg string, key interface{}, keyId string,
+	encryption *jwe.Settings) (string, error) {
+
+	meth := jwt.GetSigningMethod(alg)
+	if meth == nil {
+		return "", fmt.Errorf("unknown jwt signing algorithm: %s", alg)
+	}
+
+	token := jwt.New(meth)
+	claims := token.Claims.(jwt.MapClaims)
+	for k, v := range c.values {
+		claims[k] = v
+	}
+	if c.accessToken != "" {
+		atHash, err := Hash(alg, c.accessToken)
+		if err != nil {
+			return "", err
+		}
+		claims["at_hash"] = atHash
+	}
+	if c.code != "" {
+		cHash, err := Hash(alg, c.code)
+		if err != nil {
+			return "", err
+		}
+		claims["c_hash"] = cHash
+	}
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+	return encryption.Seal(token.SignedString(key))
+}
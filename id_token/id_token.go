@@ -5,11 +5,8 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"strings"
 	"time"
-
-	jwt "github.com/golang-jwt/jwt"
 )
 
 func Hash(alg string, token string) (string, error) {
@@ -31,90 +28,31 @@ func Gen(alg string, key interface{}, keyId,
 	issuer, clientId, subject, nonce string,
 	expiresIn, authTime int64, now time.Time) (string, error) {
 
-	exp := now.Unix() + expiresIn
-	iat := now.Unix()
-
-	return rawGen(alg, key, keyId,
-		issuer, clientId, subject,
-		nonce, exp, authTime, iat,
-		"", "")
+	return NewClaims(issuer, clientId, subject, expiresIn, now).
+		Nonce(nonce).
+		AuthTime(authTime).
+		Sign(alg, key, keyId, nil)
 }
 
 func GenForImplicit(alg string, key interface{}, keyId,
 	issuer, clientId, subject, nonce string,
 	expiresIn, authTime int64, accessToken string, now time.Time) (string, error) {
 
-	exp := now.Unix() + expiresIn
-	iat := now.Unix()
-
-	atHash := ""
-	var err error
-	if accessToken != "" {
-		atHash, err = Hash(alg, accessToken)
-		if err != nil {
-			return "", err
-		}
-	}
-	return rawGen(alg, key, keyId,
-		issuer, clientId, subject,
-		nonce, exp, authTime, iat, atHash, "")
+	return NewClaims(issuer, clientId, subject, expiresIn, now).
+		Nonce(nonce).
+		AuthTime(authTime).
+		AccessToken(accessToken).
+		Sign(alg, key, keyId, nil)
 }
 
 func GenForHybrid(alg string, key interface{}, keyId,
 	issuer, clientId, subject, nonce string,
 	expiresIn, authTime int64, accessToken, code string, now time.Time) (string, error) {
 
-	exp := now.Unix() + expiresIn
-	iat := now.Unix()
-	atHash := ""
-	var err error
-	if accessToken != "" {
-		atHash, err = Hash(alg, accessToken)
-		if err != nil {
-			return "", err
-		}
-	}
-	cHash, err := Hash(alg, code)
-	if err != nil {
-		return "", err
-	}
-	return rawGen(alg, key, keyId,
-		issuer, clientId, subject,
-		nonce, exp, authTime, iat, atHash, cHash)
-}
-
-func rawGen(alg string, key interface{}, keyId,
-	issuer, clientId, subject, nonce string,
-	expiredAt, authTime, issuedAt int64, atHash, cHash string) (string, error) {
-
-	meth := jwt.GetSigningMethod(alg)
-	if meth == nil {
-		return "", fmt.Errorf("unknown jwt signing algorithm: %s", alg)
-	}
-
-	token := jwt.New(meth)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["iss"] = issuer
-	claims["aud"] = clientId
-	claims["sub"] = subject
-	claims["exp"] = expiredAt
-	if nonce != "" {
-		claims["nonce"] = nonce
-	}
-	if issuedAt >= 0 {
-		claims["iat"] = issuedAt
-	}
-	if authTime >= 0 {
-		claims["auth_time"] = authTime
-	}
-	if atHash != "" {
-		claims["at_hash"] = atHash
-	}
-	if cHash != "" {
-		claims["c_hash"] = cHash
-	}
-	if keyId != "" {
-		token.Header["kid"] = keyId
-	}
-	return token.SignedString(key)
+	return NewClaims(issuer, clientId, subject, expiresIn, now).
+		Nonce(nonce).
+		AuthTime(authTime).
+		AccessToken(accessToken).
+		Code(code).
+		Sign(alg, key, keyId, nil)
 }
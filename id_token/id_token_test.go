@@ -1,9 +1,15 @@
 package id_token
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/crypto"
+	"github.com/lyokato/goidc/subject"
+	th "github.com/lyokato/goidc/test_helper"
 )
 
 func TestHash(t *testing.T) {
@@ -52,13 +58,14 @@ tpgdYZY2kFpD7Nv0TxlmCsXf4JL/+Vd7pFtUuZVdNpfy
 		iat := time.Now().Unix()
 	*/
 
-	exp := 1461934922
 	iat := 1461848522
 	auth_time := 1461848462
 
-	actual_idt, err := rawGen("RS256", privkey, "my_key_id",
-		"org.example", clientId, userPPID,
-		nonce, int64(exp), int64(auth_time), int64(iat), "", "")
+	actual_idt, err := NewClaims("org.example", clientId, userPPID,
+		int64(60*60*24), time.Unix(int64(iat), 0)).
+		Nonce(nonce).
+		AuthTime(int64(auth_time)).
+		Sign("RS256", privkey, "my_key_id", nil)
 	if err != nil {
 		t.Errorf("Failed to generate id_token: %v", err)
 		return
@@ -70,3 +77,54 @@ tpgdYZY2kFpD7Nv0TxlmCsXf4JL/+Vd7pFtUuZVdNpfy
 	}
 
 }
+
+func TestClaimsMerge(t *testing.T) {
+	c := NewClaims("org.example", "001", "001", int64(60), time.Unix(1461848522, 0))
+	ignored := c.Merge(map[string]interface{}{
+		"azp": "001",
+		"acr": "urn:mace:incommon:iap:silver",
+		"sub": "002",
+		"iss": "evil.example",
+	})
+	if len(ignored) != 2 {
+		t.Errorf("reserved claims should be ignored: %v", ignored)
+	}
+	if v, _ := c.Get("sub"); v != "001" {
+		t.Errorf("sub:\n - got: %v\n - want: %v\n", v, "001")
+	}
+	if v, _ := c.Get("iss"); v != "org.example" {
+		t.Errorf("iss:\n - got: %v\n - want: %v\n", v, "org.example")
+	}
+	if v, _ := c.Get("acr"); v != "urn:mace:incommon:iap:silver" {
+		t.Errorf("acr:\n - got: %v\n - want: %v\n", v, "urn:mace:incommon:iap:silver")
+	}
+	if err := c.Set("nonce", "foobar"); err == nil {
+		t.Error("'nonce' should be reserved")
+	}
+}
+
+func TestIssue(t *testing.T) {
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid", nil)
+
+	claims := NewClaims(sdi.Issuer(), client.GetId(), "", int64(60), time.Unix(1461848522, 0))
+	hook := func(c bridge.Client, info bridge.AuthInfo, r *http.Request) map[string]interface{} {
+		return map[string]interface{}{"azp": c.GetId(), "sub": "evil"}
+	}
+	r := httptest.NewRequest("GET", "/authorize", nil)
+	idt, ignored, err := Issue(claims, r, client, info, sdi, subject.UserId(), hook)
+	if err != nil || idt == "" {
+		t.Fatalf("Issue:\n - got: %v, %v\n - want: %v\n", idt, err, nil)
+	}
+	if len(ignored) != 1 || ignored[0] != "sub" {
+		t.Errorf("ignored:\n - got: %v\n - want: %v\n", ignored, []string{"sub"})
+	}
+	if v, _ := claims.Get("sub"); v != "0" {
+		t.Errorf("sub:\n - got: %v\n - want: %v\n", v, "0")
+	}
+	if v, _ := claims.Get("azp"); v != "client_id_01" {
+		t.Errorf("azp:\n - got: %v\n - want: %v\n", v, "client_id_01")
+	}
+}
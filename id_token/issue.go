@@ -0,0 +1,41 @@
+package id_token
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/jwe"
+	"github.com/lyokato/goidc/subject"
+)
+
+// Issue sets 'sub' generated by strategy on claims, merges the ones returned by hook,
+// and signs them with the key of c (and encrypts if c requires).
+// ignored are the names of the reserved claims hook tried to overwrite.
+func Issue(claims *Claims, r *http.Request, c bridge.Client, info bridge.AuthInfo,
+	sdi bridge.DataInterface, strategy subject.Strategy,
+	hook ClaimsHook) (idt string, ignored []string, err error) {
+
+	sub, err := strategy.Subject(sdi, c, info)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate subject: %s", err)
+	}
+	claims.values["sub"] = sub
+
+	if hook != nil {
+		ignored = claims.Merge(hook(c, info, r))
+	}
+
+	idt, err = claims.Sign(
+		c.GetIdTokenAlg(),
+		c.GetIdTokenKey(),
+		c.GetIdTokenKeyId(),
+		jwe.NewSettings(
+			c.GetIdTokenEncryptedResponseAlg(),
+			c.GetIdTokenEncryptedResponseEnc(),
+			c.GetIdTokenEncryptionKey(), ""))
+	if err != nil {
+		return "", ignored, fmt.Errorf("failed to generate id_token: %s", err)
+	}
+	return idt, ignored, nil
+}
@@ -0,0 +1,480 @@
+package jwe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+// RFC7516 JSON Web Encryption
+// only compact serialization is supported.
+
+const (
+	AlgRSAOAEP    = "RSA-OAEP"
+	AlgRSAOAEP256 = "RSA-OAEP-256"
+	AlgECDHES     = "ECDH-ES"
+
+	EncA128GCM      = "A128GCM"
+	EncA256GCM      = "A256GCM"
+	EncA128CBCHS256 = "A128CBC-HS256"
+	EncA256CBCHS512 = "A256CBC-HS512"
+
+	// DefaultEnc is used when the client registers
+	// id_token_encrypted_response_alg without enc.
+	// OpenID Connect Dynamic Client Registration 1.0 2.
+	DefaultEnc = EncA128CBCHS256
+
+	ContentTypeJWT = "JWT"
+)
+
+type (
+	Header struct {
+		Alg         string       `json:"alg"`
+		Enc         string       `json:"enc"`
+		KeyId       string       `json:"kid,omitempty"`
+		ContentType string       `json:"cty,omitempty"`
+		EPK         *ecPublicJWK `json:"epk,omitempty"`
+	}
+
+	ecPublicJWK struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	// Settings describes how the provider encrypts id_token for a client.
+	Settings struct {
+		Alg   string
+		Enc   string
+		Key   interface{}
+		KeyId string
+	}
+)
+
+// NewSettings returns nil when alg is empty,
+// that means the client doesn't require encryption.
+// Empty enc means DefaultEnc.
+func NewSettings(alg, enc string, key interface{}, keyId string) *Settings {
+	if alg == "" {
+		return nil
+	}
+	if enc == "" {
+		enc = DefaultEnc
+	}
+	return &Settings{
+		Alg:   alg,
+		Enc:   enc,
+		Key:   key,
+		KeyId: keyId,
+	}
+}
+
+// EncryptJWT wraps signed JWT into JWE, as a Nested JWT.
+// Empty Enc means DefaultEnc.
+func (s *Settings) EncryptJWT(signed string) (string, error) {
+	enc := s.Enc
+	if enc == "" {
+		enc = DefaultEnc
+	}
+	return Encrypt([]byte(signed), s.Alg, enc, s.Key, s.KeyId, ContentTypeJWT)
+}
+
+// Seal takes the result of signing and returns Nested JWT.
+// When s is nil, signed JWT is returned as it is.
+// OpenID Connect Core 1.0 10.2. Signing and Encryption Order
+func (s *Settings) Seal(signed string, err error) (string, error) {
+	if err != nil || s == nil {
+		return signed, err
+	}
+	return s.EncryptJWT(signed)
+}
+
+func Encrypt(payload []byte, alg, enc string, key interface{},
+	keyId, contentType string) (string, error) {
+
+	keySize, err := contentKeySize(enc)
+	if err != nil {
+		return "", err
+	}
+
+	header := &Header{
+		Alg:         alg,
+		Enc:         enc,
+		KeyId:       keyId,
+		ContentType: contentType,
+	}
+
+	var cek, encryptedKey []byte
+
+	switch alg {
+	case AlgRSAOAEP, AlgRSAOAEP256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return "", fmt.Errorf("'%s' requires *rsa.PublicKey", alg)
+		}
+		cek = make([]byte, keySize)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		encryptedKey, err = rsa.EncryptOAEP(oaepHash(alg), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt content encryption key: %s", err)
+		}
+	case AlgECDHES:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return "", fmt.Errorf("'%s' requires *ecdsa.PublicKey", alg)
+		}
+		epk, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		header.EPK, err = newECPublicJWK(&epk.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		cek, err = deriveECDHESKey(epk, pub, enc, keySize)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported key management algorithm: %s", alg)
+	}
+
+	hj, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(hj)
+
+	iv, ciphertext, tag, err := sealContent(enc, cek, payload, []byte(protected))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// Decrypt is for clients, and for testing.
+func Decrypt(token string, key interface{}) ([]byte, *Header, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, nil, errors.New("invalid JWE compact serialization")
+	}
+
+	decoded := make([][]byte, 5)
+	for i, p := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JWE segment: %s", err)
+		}
+		decoded[i] = b
+	}
+
+	var header Header
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("invalid JWE header: %s", err)
+	}
+
+	keySize, err := contentKeySize(header.Enc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cek []byte
+	switch header.Alg {
+	case AlgRSAOAEP, AlgRSAOAEP256:
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("'%s' requires *rsa.PrivateKey", header.Alg)
+		}
+		cek, err = rsa.DecryptOAEP(oaepHash(header.Alg), rand.Reader, priv, decoded[1], nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt content encryption key: %s", err)
+		}
+	case AlgECDHES:
+		priv, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("'%s' requires *ecdsa.PrivateKey", header.Alg)
+		}
+		if header.EPK == nil {
+			return nil, nil, errors.New("'epk' not found in JWE header")
+		}
+		epk, err := header.EPK.publicKey(priv.Curve)
+		if err != nil {
+			return nil, nil, err
+		}
+		cek, err = deriveECDHESKey(priv, epk, header.Enc, keySize)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported key management algorithm: %s", header.Alg)
+	}
+
+	payload, err := openContent(header.Enc, cek,
+		decoded[2], decoded[3], decoded[4], []byte(parts[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, &header, nil
+}
+
+func contentKeySize(enc string) (int, error) {
+	switch enc {
+	case EncA128GCM:
+		return 16, nil
+	case EncA256GCM:
+		return 32, nil
+	case EncA128CBCHS256:
+		return 32, nil
+	case EncA256CBCHS512:
+		return 64, nil
+	default:
+		return 0, fmt.Errorf("unsupported content encryption algorithm: %s", enc)
+	}
+}
+
+func oaepHash(alg string) hash.Hash {
+	if alg == AlgRSAOAEP256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+func newGCM(cek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealContent(enc string, cek, payload, aad []byte) (iv, ciphertext, tag []byte, err error) {
+	if isCBCHMAC(enc) {
+		return sealCBCHMAC(enc, cek, payload, aad)
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, nil, err
+	}
+	sealed := gcm.Seal(nil, iv, payload, aad)
+	tagPos := len(sealed) - gcm.Overhead()
+	return iv, sealed[:tagPos], sealed[tagPos:], nil
+}
+
+func openContent(enc string, cek, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	if isCBCHMAC(enc) {
+		return openCBCHMAC(enc, cek, iv, ciphertext, tag, aad)
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, errors.New("invalid initialization vector")
+	}
+	payload, err := gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content: %s", err)
+	}
+	return payload, nil
+}
+
+func isCBCHMAC(enc string) bool {
+	return enc == EncA128CBCHS256 || enc == EncA256CBCHS512
+}
+
+// RFC7518 5.2 AES_CBC_HMAC_SHA2 Algorithms
+// the first half of cek is MAC_KEY, and the second half is ENC_KEY.
+func sealCBCHMAC(enc string, cek, payload, aad []byte) (iv, ciphertext, tag []byte, err error) {
+	macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, nil, err
+	}
+	pad := aes.BlockSize - len(payload)%aes.BlockSize
+	ciphertext = make([]byte, len(payload)+pad)
+	copy(ciphertext, payload)
+	for i := len(payload); i < len(ciphertext); i++ {
+		ciphertext[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	return iv, ciphertext, cbcHMACTag(enc, macKey, aad, iv, ciphertext), nil
+}
+
+func openCBCHMAC(enc string, cek, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid initialization vector")
+	}
+	if !hmac.Equal(tag, cbcHMACTag(enc, macKey, aad, iv, ciphertext)) {
+		return nil, errors.New("failed to decrypt content: authentication tag mismatch")
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("failed to decrypt content: invalid ciphertext length")
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(payload, ciphertext)
+	pad := int(payload[len(payload)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		subtle.ConstantTimeCompare(payload[len(payload)-pad:],
+			bytes.Repeat([]byte{byte(pad)}, pad)) != 1 {
+		return nil, errors.New("failed to decrypt content: invalid padding")
+	}
+	return payload[:len(payload)-pad], nil
+}
+
+// the tag is the first half of HMAC over AAD || IV || ciphertext || AL,
+// AL is the bit length of AAD as 64 bit big endian.
+func cbcHMACTag(enc string, macKey, aad, iv, ciphertext []byte) []byte {
+	h := sha256.New
+	if enc == EncA256CBCHS512 {
+		h = sha512.New
+	}
+	al := make([]byte, 8)
+	binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+	mac := hmac.New(h, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write(al)
+	return mac.Sum(nil)[:len(macKey)]
+}
+
+// RFC7518 4.6 Key Agreement with Elliptic Curve Diffie-Hellman Ephemeral Static
+// in Direct Key Agreement mode, 'enc' is used as AlgorithmID.
+func deriveECDHESKey(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey,
+	enc string, keySize int) ([]byte, error) {
+
+	ep, err := priv.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	pp, err := pub.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	z, err := ep.ECDH(pp)
+	if err != nil {
+		return nil, fmt.Errorf("failed ECDH key agreement: %s", err)
+	}
+	return concatKDF(z, enc, nil, nil, keySize), nil
+}
+
+// NIST SP 800-56A Concat KDF with SHA-256
+func concatKDF(z []byte, algId string, apu, apv []byte, keySize int) []byte {
+
+	otherInfo := make([]byte, 0)
+	otherInfo = append(otherInfo, lengthPrefixed([]byte(algId))...)
+	otherInfo = append(otherInfo, lengthPrefixed(apu)...)
+	otherInfo = append(otherInfo, lengthPrefixed(apv)...)
+	otherInfo = append(otherInfo, uint32Bytes(uint32(keySize*8))...)
+
+	derived := make([]byte, 0)
+	for counter := uint32(1); len(derived) < keySize; counter++ {
+		h := sha256.New()
+		h.Write(uint32Bytes(counter))
+		h.Write(z)
+		h.Write(otherInfo)
+		derived = h.Sum(derived)
+	}
+	return derived[:keySize]
+}
+
+func lengthPrefixed(data []byte) []byte {
+	return append(uint32Bytes(uint32(len(data))), data...)
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func curveName(c elliptic.Curve) (string, error) {
+	switch c {
+	case elliptic.P256():
+		return "P-256", nil
+	case elliptic.P384():
+		return "P-384", nil
+	case elliptic.P521():
+		return "P-521", nil
+	default:
+		return "", errors.New("unsupported elliptic curve")
+	}
+}
+
+func newECPublicJWK(pub *ecdsa.PublicKey) (*ecPublicJWK, error) {
+	crv, err := curveName(pub.Curve)
+	if err != nil {
+		return nil, err
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	return &ecPublicJWK{
+		Kty: "EC",
+		Crv: crv,
+		X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+	}, nil
+}
+
+func (k *ecPublicJWK) publicKey(curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	crv, err := curveName(curve)
+	if err != nil {
+		return nil, err
+	}
+	if k.Kty != "EC" || k.Crv != crv {
+		return nil, errors.New("'epk' doesn't match to the recipient's curve")
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'epk': %s", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'epk': %s", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
@@ -0,0 +1,146 @@
+package jwe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRSAOAEP(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Errorf("failed to prepare key: %s", err)
+		return
+	}
+	for _, alg := range []string{AlgRSAOAEP, AlgRSAOAEP256} {
+		for _, enc := range []string{EncA128GCM, EncA256GCM, EncA128CBCHS256, EncA256CBCHS512} {
+			testRoundTrip(t, alg, enc, &priv.PublicKey, priv)
+		}
+	}
+}
+
+func TestECDHES(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Errorf("failed to prepare key: %s", err)
+			return
+		}
+		for _, enc := range []string{EncA128GCM, EncA256GCM, EncA128CBCHS256, EncA256CBCHS512} {
+			testRoundTrip(t, AlgECDHES, enc, &priv.PublicKey, priv)
+		}
+	}
+}
+
+func TestConcatKDF(t *testing.T) {
+	// RFC7518 Appendix C. Example ECDH-ES Key Agreement Computation
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132,
+		38, 156, 251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121,
+		140, 254, 144, 196}
+	derived := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	expected := "VqqN6vgjbSBcIijNcacQGg"
+	actual := base64.RawURLEncoding.EncodeToString(derived)
+	if actual != expected {
+		t.Errorf("ConcatKDF:\n - got: %v\n - want: %v\n", actual, expected)
+	}
+}
+
+func TestCBCHMAC(t *testing.T) {
+	// RFC7518 Appendix B.1 Test Cases for AES_128_CBC_HMAC_SHA_256
+	cek, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	iv, _ := hex.DecodeString("1af38c2dc2b96ffdd86694092341bc04")
+	plain := []byte("A cipher system must not be required to be secret, " +
+		"and it must be able to fall into the hands of the enemy without inconvenience")
+	aad := []byte("The second principle of Auguste Kerckhoffs")
+
+	block, _ := aes.NewCipher(cek[16:])
+	padded := append(append([]byte{}, plain...), []byte(strings.Repeat("\x10", 16))...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	tag := hex.EncodeToString(cbcHMACTag(EncA128CBCHS256, cek[:16], aad, iv, ciphertext))
+	if tag != "652c3fa36b0a7c5b3219fab3a30bc1c4" {
+		t.Errorf("Authentication Tag:\n - got: %v\n - want: %v\n", tag, "652c3fa36b0a7c5b3219fab3a30bc1c4")
+	}
+	payload, err := openCBCHMAC(EncA128CBCHS256, cek, iv, ciphertext,
+		cbcHMACTag(EncA128CBCHS256, cek[:16], aad, iv, ciphertext), aad)
+	if err != nil || string(payload) != string(plain) {
+		t.Errorf("Payload:\n - got: %v, %v\n - want: %v\n", string(payload), err, string(plain))
+	}
+}
+
+func TestDefaultEnc(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for _, s := range []*Settings{
+		NewSettings(AlgRSAOAEP, "", &priv.PublicKey, ""),
+		{Alg: AlgRSAOAEP, Key: &priv.PublicKey},
+	} {
+		token, err := s.Seal("header.payload.signature", nil)
+		if err != nil {
+			t.Errorf("failed to encrypt: %s", err)
+			return
+		}
+		if _, header, err := Decrypt(token, priv); err != nil || header.Enc != EncA128CBCHS256 {
+			t.Errorf("Enc:\n - got: %v, %v\n - want: %v\n", header, err, EncA128CBCHS256)
+		}
+	}
+}
+
+func TestDecryptWithTamperedToken(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token, err := Encrypt([]byte("payload"), AlgRSAOAEP, EncA128GCM,
+		&priv.PublicKey, "", "")
+	if err != nil {
+		t.Errorf("failed to encrypt: %s", err)
+		return
+	}
+	parts := strings.Split(token, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A128GCM","kid":"x"}`))
+	if _, _, err := Decrypt(strings.Join(parts, "."), priv); err == nil {
+		t.Error("tampered header should be detected")
+	}
+}
+
+func TestUnsupportedAlgorithm(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := Encrypt([]byte("payload"), "RSA1_5", EncA128GCM,
+		&priv.PublicKey, "", ""); err == nil {
+		t.Error("RSA1_5 should be rejected")
+	}
+	if _, err := Encrypt([]byte("payload"), AlgRSAOAEP, "A192GCM",
+		&priv.PublicKey, "", ""); err == nil {
+		t.Error("A192GCM should be rejected")
+	}
+	if _, err := Encrypt([]byte("payload"), AlgECDHES, EncA128GCM,
+		&priv.PublicKey, "", ""); err == nil {
+		t.Error("ECDH-ES with RSA key should be rejected")
+	}
+}
+
+func testRoundTrip(t *testing.T, alg, enc string, pub, priv interface{}) {
+	s := NewSettings(alg, enc, pub, "enc_key_id")
+	token, err := s.EncryptJWT("header.payload.signature")
+	if err != nil {
+		t.Errorf("failed to encrypt with %s/%s: %s", alg, enc, err)
+		return
+	}
+	payload, header, err := Decrypt(token, priv)
+	if err != nil {
+		t.Errorf("failed to decrypt with %s/%s: %s", alg, enc, err)
+		return
+	}
+	if string(payload) != "header.payload.signature" {
+		t.Errorf("Payload:\n - got: %v\n - want: %v\n", string(payload), "header.payload.signature")
+	}
+	if header.ContentType != ContentTypeJWT || header.KeyId != "enc_key_id" ||
+		header.Alg != alg || header.Enc != enc {
+		t.Errorf("unexpected header: %+v", header)
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"net/http"
 
 	"github.com/lyokato/goidc/crypto"
+	"github.com/lyokato/goidc/metrics"
+	"github.com/lyokato/goidc/tracing"
 )
 
 type JWKEndpoint struct {
-	keys map[string]*rsa.PublicKey
+	keys    map[string]*rsa.PublicKey
+	metrics metrics.Metrics
+	tracer  tracing.Tracer
 }
 
 func NewJWKEndpoint() *JWKEndpoint {
@@ -33,9 +37,19 @@ func (e *JWKEndpoint) AddFromText(kid, pem string) {
 	e.keys[kid] = k
 }
 
+func (e *JWKEndpoint) SetMetrics(m metrics.Metrics) {
+	e.metrics = m
+}
+
+func (e *JWKEndpoint) SetTracer(t tracing.Tracer) {
+	e.tracer = t
+}
+
 func (e *JWKEndpoint) Handler() http.HandlerFunc {
 	json, _ := crypto.PublicKeysJWK(e.keys)
 	return func(w http.ResponseWriter, r *http.Request) {
+		w, _, done := observeRequest(e.metrics, e.tracer, metrics.EndpointJWK, w, r)
+		defer done()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(json)
@@ -0,0 +1,160 @@
+package limiter
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Limiter tracks authentication failures, and tells how long
+// the key is locked out. TokenEndpoint checks the client_id and the source IP
+// before client authentication, and the username and the source IP before
+// calling FindUserId.
+type Limiter interface {
+	// Check returns the remaining lockout of the most restricted key, 0 means allowed.
+	Check(now time.Time, keys ...string) (time.Duration, error)
+	// Fail records a failure for each key, and returns the lockout started by it.
+	Fail(now time.Time, keys ...string) (time.Duration, error)
+	// Succeed clears the failures of the keys.
+	Succeed(keys ...string) error
+}
+
+func UsernameKey(username string) string {
+	return "username:" + username
+}
+
+func ClientKey(clientId string) string {
+	return "client_id:" + clientId
+}
+
+// ClientIPKey is the source IP for client authentication.
+func ClientIPKey(ip string) string {
+	return "client_ip:" + ip
+}
+
+// UserIPKey is the source IP for user authentication, counted apart
+// from ClientIPKey so that the lockout is answered with the right error.
+func UserIPKey(ip string) string {
+	return "user_ip:" + ip
+}
+
+// SourceIP returns the host part of r.RemoteAddr.
+// Put a middleware which rewrites RemoteAddr, when the provider is behind proxies.
+func SourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Policy decides the lockout by the count of failures.
+type Policy struct {
+	// failures allowed before the first lockout
+	Threshold int
+	// the first lockout, doubled for each following failure
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// failures are forgotten when no failure happens for this period
+	Window time.Duration
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Threshold:   5,
+		BaseLockout: 1 * time.Second,
+		MaxLockout:  15 * time.Minute,
+		Window:      1 * time.Hour,
+	}
+}
+
+// Lockout returns the lockout after count failures.
+func (p *Policy) Lockout(count int) time.Duration {
+	if count < p.Threshold {
+		return 0
+	}
+	d := p.BaseLockout
+	for i := p.Threshold; i < count; i++ {
+		d *= 2
+		if d >= p.MaxLockout {
+			return p.MaxLockout
+		}
+	}
+	if d > p.MaxLockout {
+		return p.MaxLockout
+	}
+	return d
+}
+
+// Store keeps the failures. Implement it on a shared backend
+// such as Redis or a database, when you run multiple providers.
+type Store interface {
+	// AddFailure increments the count of key, and returns the new count.
+	// The count expires when no failure is added within window.
+	AddFailure(key string, now time.Time, window time.Duration) (int, error)
+	// Get returns the count and the time of the last failure, 0 when not found.
+	Get(key string, now time.Time) (int, time.Time, error)
+	Reset(key string) error
+}
+
+// BackoffLimiter is Limiter with exponential backoff on Store.
+type BackoffLimiter struct {
+	policy *Policy
+	store  Store
+}
+
+func NewBackoffLimiter(policy *Policy, store Store) *BackoffLimiter {
+	return &BackoffLimiter{policy, store}
+}
+
+// NewMemoryLimiter returns BackoffLimiter on MemoryStore,
+// for a single process.
+func NewMemoryLimiter(policy *Policy) *BackoffLimiter {
+	return NewBackoffLimiter(policy, NewMemoryStore())
+}
+
+func (l *BackoffLimiter) Check(now time.Time, keys ...string) (time.Duration, error) {
+	var remaining time.Duration
+	for _, key := range keys {
+		count, last, err := l.store.Get(key, now)
+		if err != nil {
+			return 0, err
+		}
+		if d := last.Add(l.policy.Lockout(count)).Sub(now); d > remaining {
+			remaining = d
+		}
+	}
+	return remaining, nil
+}
+
+func (l *BackoffLimiter) Fail(now time.Time, keys ...string) (time.Duration, error) {
+	var lockout time.Duration
+	for _, key := range keys {
+		count, err := l.store.AddFailure(key, now, l.policy.Window)
+		if err != nil {
+			return 0, err
+		}
+		if d := l.policy.Lockout(count); d > lockout {
+			lockout = d
+		}
+	}
+	return lockout, nil
+}
+
+func (l *BackoffLimiter) Succeed(keys ...string) error {
+	for _, key := range keys {
+		if err := l.store.Reset(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetryAfter returns d in seconds for 'Retry-After', rounded up.
+func RetryAfter(d time.Duration) int64 {
+	secs := int64(d / time.Second)
+	if d%time.Second > 0 {
+		secs++
+	}
+	return secs
+}
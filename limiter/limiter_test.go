@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyLockout(t *testing.T) {
+	p := &Policy{Threshold: 3, BaseLockout: time.Second, MaxLockout: 10 * time.Second, Window: time.Hour}
+	for count, expected := range map[int]time.Duration{
+		0:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		6:  8 * time.Second,
+		7:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		if actual := p.Lockout(count); actual != expected {
+			t.Errorf("Lockout(%d):\n - got: %v\n - want: %v\n", count, actual, expected)
+		}
+	}
+}
+
+func TestBackoffLimiter(t *testing.T) {
+	p := &Policy{Threshold: 2, BaseLockout: 10 * time.Second, MaxLockout: time.Minute, Window: time.Hour}
+	l := NewMemoryLimiter(p)
+	now := time.Unix(1700000000, 0)
+	user, ip := UsernameKey("user01"), UserIPKey("192.0.2.1")
+
+	if d, _ := l.Fail(now, user, ip); d != 0 {
+		t.Errorf("first failure:\n - got: %v\n - want: %v\n", d, 0)
+	}
+	if d, _ := l.Fail(now, user, ip); d != 10*time.Second {
+		t.Errorf("second failure:\n - got: %v\n - want: %v\n", d, 10*time.Second)
+	}
+	if d, _ := l.Check(now.Add(4*time.Second), user); d != 6*time.Second {
+		t.Errorf("Check:\n - got: %v\n - want: %v\n", d, 6*time.Second)
+	}
+	if d, _ := l.Check(now.Add(10*time.Second), user, ip); d != 0 {
+		t.Errorf("Check after lockout:\n - got: %v\n - want: %v\n", d, 0)
+	}
+	if d, _ := l.Fail(now.Add(10*time.Second), user); d != 20*time.Second {
+		t.Errorf("third failure:\n - got: %v\n - want: %v\n", d, 20*time.Second)
+	}
+
+	// the other keys are still locked out after success of the user
+	l.Succeed(user)
+	if d, _ := l.Check(now.Add(5*time.Second), user); d != 0 {
+		t.Errorf("Check after success:\n - got: %v\n - want: %v\n", d, 0)
+	}
+	if d, _ := l.Check(now.Add(5*time.Second), user, ip); d != 5*time.Second {
+		t.Errorf("Check the IP:\n - got: %v\n - want: %v\n", d, 5*time.Second)
+	}
+
+	// failures are forgotten after the window
+	if d, _ := l.Fail(now.Add(2*time.Hour), ip); d != 0 {
+		t.Errorf("failure after window:\n - got: %v\n - want: %v\n", d, 0)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Unix(1700000000, 0)
+	s.AddFailure("a", now, time.Minute)
+	s.AddFailure("b", now.Add(time.Minute), time.Minute)
+	s.Sweep(now.Add(time.Minute))
+	if len(s.entries) != 1 {
+		t.Errorf("entries:\n - got: %v\n - want: %v\n", len(s.entries), 1)
+	}
+}
+
+func TestSourceIPAndRetryAfter(t *testing.T) {
+	r := httptest.NewRequest("POST", "/token", nil)
+	r.RemoteAddr = "192.0.2.1:54321"
+	if SourceIP(r) != "192.0.2.1" {
+		t.Errorf("SourceIP:\n - got: %v\n - want: %v\n", SourceIP(r), "192.0.2.1")
+	}
+	if RetryAfter(1500*time.Millisecond) != 2 || RetryAfter(3*time.Second) != 3 {
+		t.Errorf("RetryAfter should round up")
+	}
+}
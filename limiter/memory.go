@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+type failures struct {
+	count   int
+	last    time.Time
+	expires time.Time
+}
+
+// MemoryStore is Store in memory. Expired entries are removed
+// on access, and by Sweep.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*failures
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*failures)}
+}
+
+func (s *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.entries[key]
+	if !exists || !now.Before(f.expires) {
+		f = &failures{}
+		s.entries[key] = f
+	}
+	f.count++
+	f.last = now
+	f.expires = now.Add(window)
+	return f.count, nil
+}
+
+func (s *MemoryStore) Get(key string, now time.Time) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, exists := s.entries[key]
+	if !exists {
+		return 0, time.Time{}, nil
+	}
+	if !now.Before(f.expires) {
+		delete(s.entries, key)
+		return 0, time.Time{}, nil
+	}
+	return f.count, f.last, nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Sweep removes the expired entries, call it periodically
+// to bound the memory for the keys never seen again.
+func (s *MemoryStore) Sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, f := range s.entries {
+		if !now.Before(f.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
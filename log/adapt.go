@@ -0,0 +1,82 @@
+package log
+
+// EntryLogger is implemented by the loggers which receive *Entry as is,
+// like SlogLogger. The other loggers receive the text of Entry.
+type EntryLogger interface {
+	LogEntry(level LogLevel, e *Entry)
+}
+
+// entryAdapter passes *Entry only to EntryLogger, so that the loggers
+// which expect a string in args keep working.
+type entryAdapter struct {
+	logger Logger
+}
+
+// Adapt returns the logger the endpoints use for l.
+func Adapt(l Logger) Logger {
+	if _, ok := l.(*entryAdapter); ok {
+		return l
+	}
+	return &entryAdapter{l}
+}
+
+func (a *entryAdapter) WithRequestId(id string) Logger {
+	if sl, ok := a.logger.(RequestScopedLogger); ok {
+		return Adapt(sl.WithRequestId(id))
+	}
+	return a
+}
+
+func (a *entryAdapter) log(level LogLevel, f func(...interface{}), args []interface{}) {
+	if len(args) == 1 {
+		if e, ok := args[0].(*Entry); ok {
+			if el, ok := a.logger.(EntryLogger); ok {
+				el.LogEntry(level, e)
+			} else {
+				f(e.String())
+			}
+			return
+		}
+	}
+	f(args...)
+}
+
+func (a *entryAdapter) Debug(args ...interface{}) {
+	a.log(LogLevelDebug, a.logger.Debug, args)
+}
+
+func (a *entryAdapter) Info(args ...interface{}) {
+	a.log(LogLevelInfo, a.logger.Info, args)
+}
+
+func (a *entryAdapter) Warn(args ...interface{}) {
+	a.log(LogLevelWarn, a.logger.Warn, args)
+}
+
+func (a *entryAdapter) Error(args ...interface{}) {
+	a.log(LogLevelError, a.logger.Error, args)
+}
+
+func (a *entryAdapter) Fatal(args ...interface{}) {
+	a.log(LogLevelFatal, a.logger.Fatal, args)
+}
+
+func (a *entryAdapter) Debugf(format string, args ...interface{}) {
+	a.logger.Debugf(format, args...)
+}
+
+func (a *entryAdapter) Infof(format string, args ...interface{}) {
+	a.logger.Infof(format, args...)
+}
+
+func (a *entryAdapter) Warnf(format string, args ...interface{}) {
+	a.logger.Warnf(format, args...)
+}
+
+func (a *entryAdapter) Errorf(format string, args ...interface{}) {
+	a.logger.Errorf(format, args...)
+}
+
+func (a *entryAdapter) Fatalf(format string, args ...interface{}) {
+	a.logger.Fatalf(format, args...)
+}
@@ -42,9 +42,9 @@ func (level LogLevel) String() string {
 	case LogLevelWarn:
 		return "WARN"
 	case LogLevelError:
-		return "DEBUG"
+		return "ERROR"
 	case LogLevelFatal:
-		return "DEBUG"
+		return "FATAL"
 	default:
 		return ""
 	}
@@ -77,35 +77,35 @@ func (l *defaultLogger) insertLevelLabel(level LogLevel, msg string) string {
 
 func (l *defaultLogger) Debug(args ...interface{}) {
 	if defaultLoggerLevel <= LogLevelDebug {
-		msg := l.insertLevelLabel(LogLevelDebug, args[0].(string))
+		msg := l.insertLevelLabel(LogLevelDebug, fmt.Sprint(args...))
 		fmt.Println(msg)
 	}
 }
 
 func (l *defaultLogger) Info(args ...interface{}) {
 	if defaultLoggerLevel <= LogLevelInfo {
-		msg := l.insertLevelLabel(LogLevelInfo, args[0].(string))
+		msg := l.insertLevelLabel(LogLevelInfo, fmt.Sprint(args...))
 		fmt.Println(msg)
 	}
 }
 
 func (l *defaultLogger) Warn(args ...interface{}) {
 	if defaultLoggerLevel <= LogLevelWarn {
-		msg := l.insertLevelLabel(LogLevelWarn, args[0].(string))
+		msg := l.insertLevelLabel(LogLevelWarn, fmt.Sprint(args...))
 		fmt.Println(msg)
 	}
 }
 
 func (l *defaultLogger) Error(args ...interface{}) {
 	if defaultLoggerLevel <= LogLevelError {
-		msg := l.insertLevelLabel(LogLevelError, args[0].(string))
+		msg := l.insertLevelLabel(LogLevelError, fmt.Sprint(args...))
 		fmt.Println(msg)
 	}
 }
 
 func (l *defaultLogger) Fatal(args ...interface{}) {
 	if defaultLoggerLevel <= LogLevelFatal {
-		msg := l.insertLevelLabel(LogLevelFatal, args[0].(string))
+		msg := l.insertLevelLabel(LogLevelFatal, fmt.Sprint(args...))
 		fmt.Println(msg)
 	}
 }
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type RedactionMode int
+
+const (
+	// RedactHash replaces the value with a part of its SHA-256,
+	// so the same credential can still be correlated across logs.
+	RedactHash RedactionMode = iota
+	// RedactTruncate keeps only the first few characters.
+	RedactTruncate
+	// RedactNone logs values as they are, except the masked keys,
+	// only for local debugging.
+	RedactNone
+)
+
+const (
+	truncatedLength = 4
+	maskedValue     = "[REDACTED]"
+)
+
+var ErrInvalidRedactionMode = errors.New("log: invalid redaction mode")
+
+// redaction settings can be changed while the endpoints are logging
+var (
+	redactionMu   sync.RWMutex
+	redactionMode = RedactHash
+)
+
+var sensitiveKeys = map[string]bool{
+	"access_token":     true,
+	"refresh_token":    true,
+	"assertion":        true,
+	"client_assertion": true,
+	"code":             true,
+	"code_verifier":    true,
+	"client_secret":    true,
+	"password":         true,
+}
+
+// values of these keys are always masked whatever the mode is,
+// because a hash of a password is reversible by a dictionary.
+var maskedKeys = map[string]bool{
+	"client_secret": true,
+	"password":      true,
+}
+
+// SetRedactionMode changes how *Log and *Entry helpers write sensitive values.
+func SetRedactionMode(mode RedactionMode) error {
+	if mode < RedactHash || mode > RedactNone {
+		return ErrInvalidRedactionMode
+	}
+	redactionMu.Lock()
+	defer redactionMu.Unlock()
+	redactionMode = mode
+	return nil
+}
+
+// AddSensitiveKey makes *Log and *Entry helpers redact values of the key.
+// Use AddMaskedKey for low-entropy secrets.
+func AddSensitiveKey(key string) {
+	redactionMu.Lock()
+	defer redactionMu.Unlock()
+	sensitiveKeys[key] = true
+}
+
+// AddMaskedKey makes *Log and *Entry helpers always mask values of the key,
+// even with RedactNone.
+func AddMaskedKey(key string) {
+	redactionMu.Lock()
+	defer redactionMu.Unlock()
+	maskedKeys[key] = true
+}
+
+func IsSensitiveKey(key string) bool {
+	redactionMu.RLock()
+	defer redactionMu.RUnlock()
+	_, exists := sensitiveKeys[key]
+	return exists
+}
+
+// Redact returns the value to be logged for the key.
+func Redact(key, value string) string {
+	redactionMu.RLock()
+	_, sensitive := sensitiveKeys[key]
+	_, masked := maskedKeys[key]
+	mode := redactionMode
+	redactionMu.RUnlock()
+	if value == "" {
+		return value
+	}
+	if masked {
+		return maskedValue
+	}
+	if !sensitive {
+		return value
+	}
+	switch mode {
+	case RedactNone:
+		return value
+	case RedactTruncate:
+		if len(value) <= truncatedLength {
+			return "..."
+		}
+		return fmt.Sprintf("%s...", value[:truncatedLength])
+	default:
+		sum := sha256.Sum256([]byte(value))
+		return fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:])[:16])
+	}
+}
+
+func redactParams(params map[string]string) map[string]string {
+	redacted := make(map[string]string, len(params))
+	for k, v := range params {
+		redacted[k] = Redact(k, v)
+	}
+	return redacted
+}
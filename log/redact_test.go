@@ -0,0 +1,91 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedactByDefault(t *testing.T) {
+	e := ProtectedResourceEntry("/userinfo", AuthenticationFailed, map[string]string{
+		"access_token": "ACCESS_TOKEN_0",
+		"client_id":    "client_id_01",
+	}, "'access_token' not found.")
+
+	if e.Params["client_id"] != "client_id_01" {
+		t.Errorf("client_id:\n - got: %v\n - want: %v\n", e.Params["client_id"], "client_id_01")
+	}
+	if !strings.HasPrefix(e.Params["access_token"], "sha256:") ||
+		strings.Contains(e.String(), "ACCESS_TOKEN_0") {
+		t.Errorf("access_token is not redacted: %s", e.String())
+	}
+	if Redact("access_token", "ACCESS_TOKEN_0") != e.Params["access_token"] {
+		t.Error("same value should be redacted to same string")
+	}
+}
+
+func TestRedactionMode(t *testing.T) {
+	defer SetRedactionMode(RedactHash)
+
+	SetRedactionMode(RedactTruncate)
+	if actual := Redact("assertion", "eyJhbGciOiJSUzI1NiJ9.payload.sig"); actual != "eyJh..." {
+		t.Errorf("Redact:\n - got: %v\n - want: %v\n", actual, "eyJh...")
+	}
+	if actual := Redact("code", "abc"); actual != "..." {
+		t.Errorf("Redact:\n - got: %v\n - want: %v\n", actual, "...")
+	}
+
+	SetRedactionMode(RedactNone)
+	if actual := Redact("code", "code01"); actual != "code01" {
+		t.Errorf("Redact:\n - got: %v\n - want: %v\n", actual, "code01")
+	}
+
+	if err := SetRedactionMode(RedactionMode(100)); err != ErrInvalidRedactionMode {
+		t.Errorf("Invalid mode:\n - got: %v\n - want: %v\n", err, ErrInvalidRedactionMode)
+	}
+	if actual := Redact("code", "code01"); actual != "code01" {
+		t.Errorf("Redact after invalid mode:\n - got: %v\n - want: %v\n", actual, "code01")
+	}
+}
+
+func TestRedactMaskedKeys(t *testing.T) {
+	defer SetRedactionMode(RedactHash)
+
+	for _, mode := range []RedactionMode{RedactHash, RedactTruncate, RedactNone} {
+		SetRedactionMode(mode)
+		for _, key := range []string{"password", "client_secret"} {
+			if actual := Redact(key, "pass01"); actual != "[REDACTED]" {
+				t.Errorf("Redact(%s) in mode %d:\n - got: %v\n - want: %v\n",
+					key, mode, actual, "[REDACTED]")
+			}
+		}
+	}
+
+	AddMaskedKey("pin")
+	if actual := Redact("pin", "1234"); actual != "[REDACTED]" {
+		t.Errorf("Redact(pin):\n - got: %v\n - want: %v\n", actual, "[REDACTED]")
+	}
+}
+
+func TestRedactConcurrently(t *testing.T) {
+	defer SetRedactionMode(RedactHash)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			AddSensitiveKey(fmt.Sprintf("secret_%d", i))
+			SetRedactionMode(RedactionMode(i % 3))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			Redact(fmt.Sprintf("secret_%d", i), "value")
+		}(i)
+	}
+	wg.Wait()
+	if !IsSensitiveKey("secret_9") {
+		t.Errorf("IsSensitiveKey:\n - got: %v\n - want: %v\n", false, true)
+	}
+}
@@ -0,0 +1,154 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// LevelFatal is the slog level for LogLevelFatal, above slog.LevelError.
+const LevelFatal = slog.Level(12)
+
+// RequestIdHeader is the header the endpoints read request ID from.
+const RequestIdHeader = "X-Request-Id"
+
+func (level LogLevel) SlogLevel() slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelError:
+		return slog.LevelError
+	default:
+		return LevelFatal
+	}
+}
+
+// Attrs returns the fields of the entry. 'client_id' is lifted from
+// the params, and the others are grouped under 'params'.
+func (e *Entry) Attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("endpoint", e.Endpoint),
+		slog.String("event", e.Event.String()),
+	}
+	if e.Endpoint == "token_endpoint" {
+		attrs = append(attrs, slog.String("grant_type", e.Realm))
+	} else {
+		attrs = append(attrs, slog.String("path", e.Realm))
+	}
+	params := make([]interface{}, 0, len(e.Params))
+	for k, v := range e.Params {
+		if k == "client_id" {
+			attrs = append(attrs, slog.String("client_id", v))
+		} else {
+			params = append(params, slog.String(k, v))
+		}
+	}
+	if len(params) > 0 {
+		attrs = append(attrs, slog.Group("params", params...))
+	}
+	return attrs
+}
+
+// RequestScopedLogger is implemented by loggers which can
+// attach request ID to the following logs.
+type RequestScopedLogger interface {
+	WithRequestId(id string) Logger
+}
+
+// ForRequest returns the logger for r. When l supports it and
+// r has RequestIdHeader, the logs carry the request ID.
+func ForRequest(l Logger, r *http.Request) Logger {
+	return WithRequestId(l, r.Header.Get(RequestIdHeader))
+}
+
+func WithRequestId(l Logger, id string) Logger {
+	if id == "" {
+		return l
+	}
+	if sl, ok := l.(RequestScopedLogger); ok {
+		return sl.WithRequestId(id)
+	}
+	return l
+}
+
+// SlogLogger is Logger which wraps slog.Handler.
+// Entry built by TokenEndpointEntry and others is emitted as typed attributes.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+func NewSlogLogger(h slog.Handler) *SlogLogger {
+	return &SlogLogger{slog.New(h)}
+}
+
+func (l *SlogLogger) WithRequestId(id string) Logger {
+	return &SlogLogger{l.logger.With(slog.String("request_id", id))}
+}
+
+// LogEntry emits e with its fields as attributes.
+func (l *SlogLogger) LogEntry(level LogLevel, e *Entry) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level.SlogLevel()) {
+		return
+	}
+	l.logger.LogAttrs(ctx, level.SlogLevel(), e.Message, e.Attrs()...)
+}
+
+func (l *SlogLogger) log(level LogLevel, args []interface{}) {
+	if len(args) == 1 {
+		if e, ok := args[0].(*Entry); ok {
+			l.LogEntry(level, e)
+			return
+		}
+	}
+	l.logger.Log(context.Background(), level.SlogLevel(), fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) logf(level LogLevel, format string, args []interface{}) {
+	l.logger.Log(context.Background(), level.SlogLevel(), fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Debug(args ...interface{}) {
+	l.log(LogLevelDebug, args)
+}
+
+func (l *SlogLogger) Info(args ...interface{}) {
+	l.log(LogLevelInfo, args)
+}
+
+func (l *SlogLogger) Warn(args ...interface{}) {
+	l.log(LogLevelWarn, args)
+}
+
+func (l *SlogLogger) Error(args ...interface{}) {
+	l.log(LogLevelError, args)
+}
+
+func (l *SlogLogger) Fatal(args ...interface{}) {
+	l.log(LogLevelFatal, args)
+}
+
+func (l *SlogLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args)
+}
+
+func (l *SlogLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args)
+}
+
+func (l *SlogLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args)
+}
+
+func (l *SlogLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args)
+}
+
+func (l *SlogLogger) Fatalf(format string, args ...interface{}) {
+	l.logf(LogLevelFatal, format, args)
+}
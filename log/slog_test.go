@@ -0,0 +1,97 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogLevelString(t *testing.T) {
+	for level, expected := range map[LogLevel]string{
+		LogLevelDebug: "DEBUG",
+		LogLevelInfo:  "INFO",
+		LogLevelWarn:  "WARN",
+		LogLevelError: "ERROR",
+		LogLevelFatal: "FATAL",
+	} {
+		if level.String() != expected {
+			t.Errorf("String:\n - got: %v\n - want: %v\n", level.String(), expected)
+		}
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	r := httptest.NewRequest("POST", "/token", nil)
+	r.Header.Set(RequestIdHeader, "req_01")
+
+	// as the endpoints do
+	ForRequest(Adapt(l), r).Error(TokenEndpointEntry("password", InterfaceServerError,
+		map[string]string{"method": "FindUserId", "client_id": "client_id_01"},
+		"interface returned error"))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Errorf("failed to parse record: %s", err)
+		return
+	}
+	for key, expected := range map[string]interface{}{
+		"level":      "ERROR",
+		"msg":        "interface returned error",
+		"endpoint":   "token_endpoint",
+		"event":      "interface_server_error",
+		"grant_type": "password",
+		"client_id":  "client_id_01",
+		"request_id": "req_01",
+	} {
+		if record[key] != expected {
+			t.Errorf("%s:\n - got: %v\n - want: %v\n", key, record[key], expected)
+		}
+	}
+	params, _ := record["params"].(map[string]interface{})
+	if params["method"] != "FindUserId" {
+		t.Errorf("params.method:\n - got: %v\n - want: %v\n", params["method"], "FindUserId")
+	}
+
+	buf.Reset()
+	l.Fatalf("failed: %d", 1)
+	record = map[string]interface{}{}
+	json.Unmarshal(buf.Bytes(), &record)
+	if record["level"] != "ERROR+4" || record["msg"] != "failed: 1" {
+		t.Errorf("unexpected record: %v", record)
+	}
+}
+
+// stringLogger expects a string, as the loggers written before Entry.
+type stringLogger struct {
+	Logger
+	logged []string
+}
+
+func (l *stringLogger) Warn(args ...interface{}) {
+	l.logged = append(l.logged, args[0].(string))
+}
+
+func TestAdaptStringLogger(t *testing.T) {
+	l := &stringLogger{Logger: NewDefaultLogger()}
+	a := Adapt(l)
+	if Adapt(a) != a {
+		t.Errorf("Adapt twice:\n - got: %v\n - want: %v\n", Adapt(a), a)
+	}
+
+	r := httptest.NewRequest("POST", "/token", nil)
+	r.Header.Set(RequestIdHeader, "req_01")
+	e := TokenEndpointEntry("password", InterfaceServerError,
+		map[string]string{"method": "FindUserId"}, "interface returned error")
+	ForRequest(a, r).Warn(e)
+	a.Warn("plain text")
+
+	expected := []string{e.String(), "plain text"}
+	if len(l.logged) != 2 || l.logged[0] != expected[0] || l.logged[1] != expected[1] {
+		t.Errorf("Logged:\n - got: %v\n - want: %v\n", l.logged, expected)
+	}
+}
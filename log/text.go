@@ -21,6 +21,8 @@ const (
 	InterfaceServerError
 	InterfaceError
 	InvalidScope
+	InvalidTarget
+	InvalidAuthorizationDetails
 	InvalidDisplay
 	InvalidMaxAge
 	InvalidResponseType
@@ -34,6 +36,7 @@ const (
 	UnsupportedGrantType
 	UnsupportedCodeChallengeMethod
 	NoCredential
+	InvalidCredential
 	NoEnabledClient
 	NoEnabledAuthInfo
 	NoEnabledAuthSession
@@ -45,6 +48,7 @@ const (
 	AuthInfoCreationFailed
 	IdTokenGeneration
 	LoginRequired
+	TooManyFailures
 )
 
 func (e LogEvent) String() string {
@@ -75,6 +79,10 @@ func (e LogEvent) String() string {
 		return "interface_error"
 	case InvalidScope:
 		return "invalid_scope"
+	case InvalidTarget:
+		return "invalid_target"
+	case InvalidAuthorizationDetails:
+		return "invalid_authorization_details"
 	case InvalidDisplay:
 		return "invalid_display"
 	case InvalidMaxAge:
@@ -109,6 +117,8 @@ func (e LogEvent) String() string {
 		return "unsupported_code_challenge_method"
 	case NoCredential:
 		return "no_credential"
+	case InvalidCredential:
+		return "invalid_credential"
 	case NoEnabledClient:
 		return "no_enabled_client"
 	case NoEnabledUserId:
@@ -123,11 +133,31 @@ func (e LogEvent) String() string {
 		return "id_token_generation"
 	case LoginRequired:
 		return "login_required"
+	case TooManyFailures:
+		return "too_many_failures"
 	default:
 		return ""
 	}
 }
 
+// Entry is a log event of the endpoints. It reaches only EntryLogger like SlogLogger,
+// which emits the fields as attributes. The other loggers get String(), see Adapt.
+type Entry struct {
+	Endpoint string
+	// grant type for token endpoint, path for others
+	Realm   string
+	Event   LogEvent
+	Params  map[string]string
+	Message string
+}
+
+func (e *Entry) String() string {
+	attributes, _ := json.Marshal(e.Params)
+	return fmt.Sprintf("[goidc:%s:%s:%s] %s %s", e.Endpoint,
+		lightPaint(e.Realm, Blue), paint(e.Event.String(), Cyan), e.Message,
+		lightPaint(string(attributes), Red))
+}
+
 func AuthorizationEndpointLog(path string, ev LogEvent,
 	params map[string]string, msg string) string {
 	return EndpointLog("authorization_endpoint", path, ev, params, msg)
@@ -143,9 +173,37 @@ func ProtectedResourceLog(path string, ev LogEvent,
 	return EndpointLog("protected_resource", path, ev, params, msg)
 }
 
+// EndpointLog redacts values of sensitive keys in params. See SetRedactionMode.
 func EndpointLog(endpoint, realm string, ev LogEvent,
 	params map[string]string, msg string) string {
-	attributes, _ := json.Marshal(params)
-	return fmt.Sprintf("[goidc:%s:%s:%s] %s %s", endpoint,
-		lightPaint(realm, Blue), paint(ev.String(), Cyan), msg, lightPaint(string(attributes), Red))
+	return EndpointEntry(endpoint, realm, ev, params, msg).String()
+}
+
+// AuthorizationEndpointEntry is AuthorizationEndpointLog which keeps the fields,
+// so that EntryLogger can write them as structured attributes.
+func AuthorizationEndpointEntry(path string, ev LogEvent,
+	params map[string]string, msg string) *Entry {
+	return EndpointEntry("authorization_endpoint", path, ev, params, msg)
+}
+
+func TokenEndpointEntry(grantType string, ev LogEvent,
+	params map[string]string, msg string) *Entry {
+	return EndpointEntry("token_endpoint", grantType, ev, params, msg)
+}
+
+func ProtectedResourceEntry(path string, ev LogEvent,
+	params map[string]string, msg string) *Entry {
+	return EndpointEntry("protected_resource", path, ev, params, msg)
+}
+
+// EndpointEntry redacts values of sensitive keys in params, like EndpointLog.
+func EndpointEntry(endpoint, realm string, ev LogEvent,
+	params map[string]string, msg string) *Entry {
+	return &Entry{
+		Endpoint: endpoint,
+		Realm:    realm,
+		Event:    ev,
+		Params:   redactParams(params),
+		Message:  msg,
+	}
 }
@@ -0,0 +1,242 @@
+package memstore
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/record"
+)
+
+func (s *Store) Issuer() string {
+	return s.issuer
+}
+
+func (s *Store) FindClientById(ctx context.Context, clientId string) (bridge.Client, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, exists := s.clients[clientId]
+	if !exists {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	// registered clients are never modified, RegisterClient replaces them
+	return c, nil
+}
+
+func (s *Store) FindAuthSessionByCode(ctx context.Context, code string) (bridge.AuthSession, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, exists := s.sessions[code]
+	if !exists || sess.ExpiresAt() <= s.now() {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	return sess.Clone(), nil
+}
+
+func (s *Store) FindActiveAuthInfoById(ctx context.Context, id int64) (bridge.AuthInfo, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, exists := s.infos[id]
+	if !exists || !i.Active {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	return i.Clone(), nil
+}
+
+func (s *Store) FindAuthInfoByUserIdAndClientId(ctx context.Context, uid int64,
+	clientId string) (bridge.AuthInfo, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, exists := s.infoIds[infoKey{uid, clientId}]
+	if !exists {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	return s.infos[id].Clone(), nil
+}
+
+func (s *Store) FindOAuthTokenByAccessToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists := s.accessTokens[token]
+	if !exists {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	return t.Clone(), nil
+}
+
+func (s *Store) FindOAuthTokenByRefreshToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists := s.refreshTokens[token]
+	if !exists {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	return t.Clone(), nil
+}
+
+func (s *Store) CreateOAuthToken(ctx context.Context, info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, err := s.policy.NewOAuthToken(info, onTokenEndpoint, resources, details, s.now())
+	if err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "failed to generate token", err)
+	}
+	s.accessTokens[t.AccessToken] = t
+	if t.RefreshToken != "" {
+		s.refreshTokens[t.RefreshToken] = t
+	}
+	return t.Clone(), nil
+}
+
+func (s *Store) RefreshAccessToken(ctx context.Context, info bridge.AuthInfo, token bridge.OAuthToken,
+	audience []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.accessTokens[token.GetAccessToken()]
+	if !exists || old.RefreshToken != token.GetRefreshToken() {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	var c bridge.Client
+	if found, exists := s.clients[info.GetClientId()]; exists {
+		c = found
+	}
+	t := old.Clone()
+	if err := s.policy.Refresh(t, s.policy.ShouldRotate(c), audience, details, s.now()); err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "failed to generate token", err)
+	}
+	delete(s.accessTokens, old.AccessToken)
+	delete(s.refreshTokens, old.RefreshToken)
+	s.accessTokens[t.AccessToken] = t
+	if t.RefreshToken != "" {
+		s.refreshTokens[t.RefreshToken] = t
+	}
+	return t.Clone(), nil
+}
+
+func (s *Store) FindUserId(ctx context.Context, username, password string) (int64, *bridge.Error) {
+	s.mu.RLock()
+	uid, exists := s.usernames[username]
+	hash := ""
+	if exists {
+		hash = s.users[uid].PasswordHash
+	}
+	s.mu.RUnlock()
+
+	if !exists {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	matched, err := clientsecret.Verify(hash, password)
+	if err != nil {
+		return -1, bridge.WrapError(bridge.ErrServerError, "broken password hash", err)
+	}
+	if !matched {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return uid, nil
+}
+
+func (s *Store) CreateOrUpdateAuthInfo(ctx context.Context, uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, exists := s.users[uid]
+	if !exists {
+		return nil, bridge.NewError(bridge.ErrFailed)
+	}
+	key := infoKey{uid, clientId}
+	var i *record.AuthInfo
+	if id, exists := s.infoIds[key]; exists {
+		// replace the stored one, the returned ones are not shared
+		i = s.infos[id].Clone()
+	} else {
+		i = &record.AuthInfo{Id: s.infoSeq, UserId: uid, ClientId: clientId}
+		s.infoSeq++
+	}
+	i.Subject = s.policy.Subject(u)
+	i.Scope = scope
+	i.AuthorizationDetails = details
+	i.AuthorizedAt = s.now()
+	i.Active = true
+	s.infos[i.Id] = i.Clone()
+	s.infoIds[key] = i.Id
+	return i, nil
+}
+
+func (s *Store) CreateAuthSession(ctx context.Context, info bridge.AuthInfo,
+	session *authorization.Session) *bridge.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[session.Code]; exists {
+		return bridge.WrapError(bridge.ErrServerError, "duplicated code", nil)
+	}
+	s.sessions[session.Code] = s.policy.NewAuthSession(info, session, s.now())
+	return nil
+}
+
+func (s *Store) DisableSession(ctx context.Context, sess bridge.AuthSession) *bridge.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[sess.GetCode()]; !exists {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	delete(s.sessions, sess.GetCode())
+	return nil
+}
+
+func (s *Store) FindUserIdBySubject(ctx context.Context, sub string) (int64, *bridge.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uid, exists := s.subjects[sub]
+	if !exists {
+		uid = -1
+		if id, err := strconv.ParseInt(sub, 10, 64); err == nil {
+			uid = id
+		}
+	}
+	if u, exists := s.users[uid]; exists && s.policy.Subject(u) == sub {
+		return uid, nil
+	}
+	if uid, exists := s.recordedSubjects[sub]; exists {
+		return uid, nil
+	}
+	return -1, bridge.NewError(bridge.ErrFailed)
+}
+
+func (s *Store) RecordSubject(ctx context.Context, uid int64, sub string) *bridge.Error {
+	s.mu.RLock()
+	_, recorded := s.recordedSubjects[sub]
+	s.mu.RUnlock()
+	if recorded {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[uid]; !exists {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	s.recordedSubjects[sub] = uid
+	return nil
+}
+
+func (s *Store) RecordAssertionClaims(ctx context.Context, clientId, jti string,
+	issuedAt, expiredAt int64) *bridge.Error {
+	if jti == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := assertionKey{clientId, jti}
+	if a, exists := s.assertions[key]; exists && a.ExpiredAt > s.now() {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	s.assertions[key] = &record.AssertionClaims{
+		ClientId:  clientId,
+		JTI:       jti,
+		IssuedAt:  issuedAt,
+		ExpiredAt: expiredAt,
+	}
+	return nil
+}
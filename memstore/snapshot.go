@@ -0,0 +1,153 @@
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lyokato/goidc/record"
+)
+
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version         int                       `json:"version"`
+	UserSeq         int64                     `json:"user_seq"`
+	InfoSeq         int64                     `json:"info_seq"`
+	Users           []*record.User            `json:"users"`
+	Subjects        map[string]int64          `json:"subjects,omitempty"`
+	Clients         []*record.Client          `json:"clients"`
+	AuthInfos       []*record.AuthInfo        `json:"auth_infos"`
+	AuthSessions    []*record.AuthSession     `json:"auth_sessions"`
+	OAuthTokens     []*record.OAuthToken      `json:"oauth_tokens"`
+	AssertionClaims []*record.AssertionClaims `json:"assertion_claims"`
+}
+
+// Snapshot writes all the records in JSON. It contains the hashed secrets
+// and the tokens, so that the output must be protected as the store itself.
+func (s *Store) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	snap := &snapshot{
+		Version:         snapshotVersion,
+		UserSeq:         s.userSeq,
+		InfoSeq:         s.infoSeq,
+		Users:           make([]*record.User, 0, len(s.users)),
+		Subjects:        make(map[string]int64, len(s.recordedSubjects)),
+		Clients:         make([]*record.Client, 0, len(s.clients)),
+		AuthInfos:       make([]*record.AuthInfo, 0, len(s.infos)),
+		AuthSessions:    make([]*record.AuthSession, 0, len(s.sessions)),
+		OAuthTokens:     make([]*record.OAuthToken, 0, len(s.accessTokens)),
+		AssertionClaims: make([]*record.AssertionClaims, 0, len(s.assertions)),
+	}
+	for _, u := range s.users {
+		copied := *u
+		snap.Users = append(snap.Users, &copied)
+	}
+	for sub, uid := range s.recordedSubjects {
+		snap.Subjects[sub] = uid
+	}
+	for _, c := range s.clients {
+		snap.Clients = append(snap.Clients, c.Clone())
+	}
+	for _, i := range s.infos {
+		snap.AuthInfos = append(snap.AuthInfos, i.Clone())
+	}
+	for _, sess := range s.sessions {
+		snap.AuthSessions = append(snap.AuthSessions, sess.Clone())
+	}
+	for _, t := range s.accessTokens {
+		snap.OAuthTokens = append(snap.OAuthTokens, t.Clone())
+	}
+	for _, a := range s.assertions {
+		copied := *a
+		snap.AssertionClaims = append(snap.AssertionClaims, &copied)
+	}
+	s.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore replaces all the records with the snapshot.
+func (s *Store) Restore(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("memstore: broken snapshot: %s", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("memstore: unsupported snapshot version: %d", snap.Version)
+	}
+	for _, c := range snap.Clients {
+		if err := c.Init(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	s.userSeq = snap.UserSeq
+	s.infoSeq = snap.InfoSeq
+	for _, u := range snap.Users {
+		s.users[u.Id] = u
+		s.usernames[u.Username] = u.Id
+		if u.Subject != "" {
+			s.subjects[u.Subject] = u.Id
+		}
+	}
+	for sub, uid := range snap.Subjects {
+		s.recordedSubjects[sub] = uid
+	}
+	for _, c := range snap.Clients {
+		s.clients[c.Id] = c
+	}
+	for _, i := range snap.AuthInfos {
+		s.infos[i.Id] = i
+		s.infoIds[infoKey{i.UserId, i.ClientId}] = i.Id
+	}
+	for _, sess := range snap.AuthSessions {
+		s.sessions[sess.Code] = sess
+	}
+	for _, t := range snap.OAuthTokens {
+		s.accessTokens[t.AccessToken] = t
+		if t.RefreshToken != "" {
+			s.refreshTokens[t.RefreshToken] = t
+		}
+	}
+	for _, a := range snap.AssertionClaims {
+		s.assertions[assertionKey{a.ClientId, a.JTI}] = a
+	}
+	return nil
+}
+
+// SaveFile writes the snapshot to the temporary file and renames it to path,
+// so that the existing file is never left half-written.
+func (s *Store) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err = s.Snapshot(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Store) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
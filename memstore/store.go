@@ -0,0 +1,252 @@
+// Package memstore provides bridge.ContextDataInterface in memory,
+// for local development, single-node deployments and integration tests.
+package memstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+)
+
+var _ bridge.ContextDataInterface = (*Store)(nil)
+
+var (
+	ErrDuplicated = errors.New("memstore: already exists")
+	ErrNotFound   = errors.New("memstore: not found")
+)
+
+type (
+	infoKey struct {
+		uid      int64
+		clientId string
+	}
+
+	assertionKey struct {
+		clientId string
+		jti      string
+	}
+
+	// Store is safe for concurrent use. The records are copied on
+	// both of read and write, so that callers can't modify the stored ones.
+	Store struct {
+		mu          sync.RWMutex
+		issuer      string
+		policy      *record.Policy
+		hasher      clientsecret.Hasher
+		timeBuilder io.TimeBuilder
+
+		userSeq       int64
+		infoSeq       int64
+		users         map[int64]*record.User
+		usernames     map[string]int64
+		subjects      map[string]int64
+		clients       map[string]*record.Client
+		infos         map[int64]*record.AuthInfo
+		infoIds       map[infoKey]int64
+		sessions      map[string]*record.AuthSession
+		accessTokens  map[string]*record.OAuthToken
+		refreshTokens map[string]*record.OAuthToken
+		assertions    map[assertionKey]*record.AssertionClaims
+		// 'sub' recorded by RecordSubject
+		recordedSubjects map[string]int64
+
+		stop     chan struct{}
+		stopped  chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+func New(issuer string) *Store {
+	s := &Store{
+		issuer:      issuer,
+		policy:      record.DefaultPolicy(),
+		hasher:      clientsecret.Argon2id(),
+		timeBuilder: io.NowBuilder(),
+	}
+	s.reset()
+	return s
+}
+
+func (s *Store) reset() {
+	s.userSeq = 0
+	s.infoSeq = 0
+	s.users = make(map[int64]*record.User)
+	s.usernames = make(map[string]int64)
+	s.subjects = make(map[string]int64)
+	s.recordedSubjects = make(map[string]int64)
+	s.clients = make(map[string]*record.Client)
+	s.infos = make(map[int64]*record.AuthInfo)
+	s.infoIds = make(map[infoKey]int64)
+	s.sessions = make(map[string]*record.AuthSession)
+	s.accessTokens = make(map[string]*record.OAuthToken)
+	s.refreshTokens = make(map[string]*record.OAuthToken)
+	s.assertions = make(map[assertionKey]*record.AssertionClaims)
+}
+
+func (s *Store) SetPolicy(p *record.Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = p
+}
+
+// SetPasswordHasher sets the hasher for the passwords of the users
+// created after this, clientsecret.Argon2id by default.
+func (s *Store) SetPasswordHasher(h clientsecret.Hasher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hasher = h
+}
+
+func (s *Store) SetTimeBuilder(builder io.TimeBuilder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeBuilder = builder
+}
+
+func (s *Store) now() int64 {
+	return s.timeBuilder().Unix()
+}
+
+// CreateUser registers the user with the hashed password.
+func (s *Store) CreateUser(username, password string) (*record.User, error) {
+	s.mu.RLock()
+	h := s.hasher
+	s.mu.RUnlock()
+
+	hash, err := h.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := record.NewSubject()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.usernames[username]; exists {
+		return nil, ErrDuplicated
+	}
+	u := &record.User{Id: s.userSeq, Username: username, Subject: sub, PasswordHash: hash}
+	s.userSeq++
+	s.users[u.Id] = u
+	s.usernames[username] = u.Id
+	s.subjects[sub] = u.Id
+	copied := *u
+	return &copied, nil
+}
+
+func (s *Store) RemoveUser(uid int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, exists := s.users[uid]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.users, uid)
+	delete(s.usernames, u.Username)
+	delete(s.subjects, u.Subject)
+	for sub, id := range s.recordedSubjects {
+		if id == uid {
+			delete(s.recordedSubjects, sub)
+		}
+	}
+	return nil
+}
+
+// RegisterClient stores the copy of c, replacing the one with the same ID.
+func (s *Store) RegisterClient(c *record.Client) error {
+	n := c.Clone()
+	if err := n.Init(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[n.Id] = n
+	return nil
+}
+
+func (s *Store) RemoveClient(clientId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.clients[clientId]; !exists {
+		return ErrNotFound
+	}
+	delete(s.clients, clientId)
+	return nil
+}
+
+// StartEviction removes the expired sessions, tokens and assertion claims
+// every interval in background, until Close is called.
+func (s *Store) StartEviction(interval time.Duration) {
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	stop, stopped := s.stop, s.stopped
+	s.mu.Unlock()
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Evict()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the eviction started by StartEviction.
+func (s *Store) Close() {
+	s.mu.RLock()
+	stop, stopped := s.stop, s.stopped
+	s.mu.RUnlock()
+	if stop == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(stop) })
+	<-stopped
+}
+
+// Evict removes the expired records, and returns the number of them.
+func (s *Store) Evict() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	n := 0
+	for code, sess := range s.sessions {
+		if sess.ExpiresAt() <= now {
+			delete(s.sessions, code)
+			n++
+		}
+	}
+	for at, t := range s.accessTokens {
+		if t.ExpiresAt() <= now {
+			delete(s.accessTokens, at)
+			if t.RefreshToken != "" {
+				delete(s.refreshTokens, t.RefreshToken)
+			}
+			n++
+		}
+	}
+	for key, a := range s.assertions {
+		if a.ExpiredAt <= now {
+			delete(s.assertions, key)
+			n++
+		}
+	}
+	return n
+}
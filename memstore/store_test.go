@@ -0,0 +1,101 @@
+package memstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+	"github.com/lyokato/goidc/record/storetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestStore() *Store {
+	s := New("http://example.org/")
+	s.SetPasswordHasher(clientsecret.Bcrypt(bcrypt.MinCost))
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *storetest.Store {
+		s := newTestStore()
+		t.Cleanup(s.Close)
+		return &storetest.Store{
+			DataInterface:  bridge.BindDataInterface(context.Background(), s),
+			SetPolicy:      s.SetPolicy,
+			SetTimeBuilder: s.SetTimeBuilder,
+			CreateUser:     s.CreateUser,
+			RemoveUser:     s.RemoveUser,
+			RegisterClient: s.RegisterClient,
+			RemoveClient:   s.RemoveClient,
+			Evict:          func() (int64, error) { return int64(s.Evict()), nil },
+		}
+	})
+}
+
+func TestStoreStartEviction(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore()
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	s.RecordAssertionClaims(ctx, "client_id_01", "jti01", 1000, 1060)
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1060))
+	s.StartEviction(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for s.RecordAssertionClaims(ctx, "client_id_01", "jti01", 1060, 1120) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the expired jti is not evicted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+	// closing twice is safe
+	s.Close()
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore()
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	s.CreateUser("user01", "pass01")
+	s.RegisterClient(&record.Client{Id: "client_id_01"})
+	info, _ := s.CreateOrUpdateAuthInfo(ctx, 0, "client_id_01", "openid offline_access", nil)
+	token, _ := s.CreateOAuthToken(ctx, info, true, nil, nil)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	if err := s.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %s", err)
+	}
+
+	restored := New("http://example.org/")
+	restored.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %s", err)
+	}
+	if _, err := restored.FindUserId(ctx, "user01", "pass01"); err != nil {
+		t.Errorf("FindUserId:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	if _, err := restored.FindUserIdBySubject(ctx, info.GetSubject()); err != nil {
+		t.Errorf("FindUserIdBySubject:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	if _, err := restored.FindClientById(ctx, "client_id_01"); err != nil {
+		t.Errorf("FindClientById:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	if _, err := restored.FindOAuthTokenByRefreshToken(ctx, token.GetRefreshToken()); err != nil {
+		t.Errorf("FindOAuthTokenByRefreshToken:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	found, _ := restored.FindAuthInfoByUserIdAndClientId(ctx, 0, "client_id_01")
+	if found == nil || found.GetId() != info.GetId() {
+		t.Errorf("FindAuthInfoByUserIdAndClientId:\n - got: %v\n - want: %v\n", found, info)
+	}
+
+	// sequence is restored too
+	other, _ := restored.CreateOrUpdateAuthInfo(ctx, 0, "client_id_02", "openid", nil)
+	if other.GetId() != info.GetId()+1 {
+		t.Errorf("AuthInfo ID:\n - got: %v\n - want: %v\n", other.GetId(), info.GetId()+1)
+	}
+}
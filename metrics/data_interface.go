@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+)
+
+// InstrumentDataInterface returns DataInterface which
+// reports the latency of each method call to m.
+func InstrumentDataInterface(di bridge.DataInterface, m Metrics) bridge.DataInterface {
+	return &instrumentedDataInterface{di, m}
+}
+
+type instrumentedDataInterface struct {
+	di bridge.DataInterface
+	m  Metrics
+}
+
+func (i *instrumentedDataInterface) observe(method string, start time.Time, err *bridge.Error) {
+	i.m.ObserveInterfaceCall(method, interfaceErrorType(err), time.Since(start))
+}
+
+func (i *instrumentedDataInterface) Issuer() string {
+	return i.di.Issuer()
+}
+
+func (i *instrumentedDataInterface) FindClientById(clientId string) (bridge.Client, *bridge.Error) {
+	start := time.Now()
+	c, err := i.di.FindClientById(clientId)
+	i.observe("FindClientById", start, err)
+	return c, err
+}
+
+func (i *instrumentedDataInterface) FindAuthSessionByCode(code string) (bridge.AuthSession, *bridge.Error) {
+	start := time.Now()
+	sess, err := i.di.FindAuthSessionByCode(code)
+	i.observe("FindAuthSessionByCode", start, err)
+	return sess, err
+}
+
+func (i *instrumentedDataInterface) FindActiveAuthInfoById(id int64) (bridge.AuthInfo, *bridge.Error) {
+	start := time.Now()
+	info, err := i.di.FindActiveAuthInfoById(id)
+	i.observe("FindActiveAuthInfoById", start, err)
+	return info, err
+}
+
+func (i *instrumentedDataInterface) FindAuthInfoByUserIdAndClientId(uid int64,
+	clientId string) (bridge.AuthInfo, *bridge.Error) {
+	start := time.Now()
+	info, err := i.di.FindAuthInfoByUserIdAndClientId(uid, clientId)
+	i.observe("FindAuthInfoByUserIdAndClientId", start, err)
+	return info, err
+}
+
+func (i *instrumentedDataInterface) FindOAuthTokenByAccessToken(token string) (bridge.OAuthToken, *bridge.Error) {
+	start := time.Now()
+	t, err := i.di.FindOAuthTokenByAccessToken(token)
+	i.observe("FindOAuthTokenByAccessToken", start, err)
+	return t, err
+}
+
+func (i *instrumentedDataInterface) FindOAuthTokenByRefreshToken(token string) (bridge.OAuthToken, *bridge.Error) {
+	start := time.Now()
+	t, err := i.di.FindOAuthTokenByRefreshToken(token)
+	i.observe("FindOAuthTokenByRefreshToken", start, err)
+	return t, err
+}
+
+func (i *instrumentedDataInterface) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	start := time.Now()
+	t, err := i.di.CreateOAuthToken(info, onTokenEndpoint, resources, details)
+	i.observe("CreateOAuthToken", start, err)
+	return t, err
+}
+
+func (i *instrumentedDataInterface) RefreshAccessToken(info bridge.AuthInfo, token bridge.OAuthToken,
+	audience []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	start := time.Now()
+	t, err := i.di.RefreshAccessToken(info, token, audience, details)
+	i.observe("RefreshAccessToken", start, err)
+	return t, err
+}
+
+func (i *instrumentedDataInterface) FindUserId(username, password string) (int64, *bridge.Error) {
+	start := time.Now()
+	uid, err := i.di.FindUserId(username, password)
+	i.observe("FindUserId", start, err)
+	return uid, err
+}
+
+func (i *instrumentedDataInterface) CreateOrUpdateAuthInfo(uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
+	start := time.Now()
+	info, err := i.di.CreateOrUpdateAuthInfo(uid, clientId, scope, details)
+	i.observe("CreateOrUpdateAuthInfo", start, err)
+	return info, err
+}
+
+func (i *instrumentedDataInterface) CreateAuthSession(info bridge.AuthInfo,
+	session *authorization.Session) *bridge.Error {
+	start := time.Now()
+	err := i.di.CreateAuthSession(info, session)
+	i.observe("CreateAuthSession", start, err)
+	return err
+}
+
+func (i *instrumentedDataInterface) DisableSession(sess bridge.AuthSession) *bridge.Error {
+	start := time.Now()
+	err := i.di.DisableSession(sess)
+	i.observe("DisableSession", start, err)
+	return err
+}
+
+func (i *instrumentedDataInterface) FindUserIdBySubject(sub string) (int64, *bridge.Error) {
+	start := time.Now()
+	uid, err := i.di.FindUserIdBySubject(sub)
+	i.observe("FindUserIdBySubject", start, err)
+	return uid, err
+}
+
+func (i *instrumentedDataInterface) RecordSubject(uid int64, sub string) *bridge.Error {
+	start := time.Now()
+	err := i.di.RecordSubject(uid, sub)
+	i.observe("RecordSubject", start, err)
+	return err
+}
+
+func (i *instrumentedDataInterface) RecordAssertionClaims(clientId, jti string,
+	issuedAt, expiredAt int64) *bridge.Error {
+	start := time.Now()
+	err := i.di.RecordAssertionClaims(clientId, jti, issuedAt, expiredAt)
+	i.observe("RecordAssertionClaims", start, err)
+	return err
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+)
+
+const (
+	EndpointToken             = "token_endpoint"
+	EndpointAuthorization     = "authorization_endpoint"
+	EndpointProtectedResource = "protected_resource"
+	EndpointJWK               = "jwk_endpoint"
+
+	TokenIssued    = "issued"
+	TokenRefreshed = "refreshed"
+)
+
+// Metrics receives measurements from the endpoints.
+// Labels are bounded by the endpoints: grantType is one of the supported
+// grant types, and clientId is set only after the client is identified.
+type Metrics interface {
+	// ObserveRequest records a request, errorType is the OAuth error type, empty on success.
+	ObserveRequest(endpoint, grantType, clientId, errorType string, elapsed time.Duration)
+	// ObserveInterfaceCall records a call of DataInterface method,
+	// errorType is the type of bridge.Error, empty on success.
+	ObserveInterfaceCall(method, errorType string, elapsed time.Duration)
+	// CountToken records an access token issued or refreshed.
+	CountToken(event, grantType, clientId string)
+}
+
+func interfaceErrorType(err *bridge.Error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Type().String()
+}
@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are upper bounds in seconds of the latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is the built-in Metrics, which keeps the values in memory
+// and serves them in the Prometheus text exposition format.
+type Registry struct {
+	mu              sync.Mutex
+	namespace       string
+	requests        *counterVec
+	requestDuration *histogramVec
+	interfaceCalls  *histogramVec
+	tokens          *counterVec
+}
+
+// NewRegistry returns Registry. Metric names are prefixed with namespace,
+// "goidc" is used when it's empty.
+func NewRegistry(namespace string) *Registry {
+	if namespace == "" {
+		namespace = "goidc"
+	}
+	return &Registry{
+		namespace: namespace,
+		requests: newCounterVec(namespace+"_requests_total",
+			"Number of requests handled by the endpoints.",
+			"endpoint", "grant_type", "client_id", "error"),
+		requestDuration: newHistogramVec(namespace+"_request_duration_seconds",
+			"Latency of the requests handled by the endpoints.", DefaultBuckets,
+			"endpoint", "grant_type"),
+		interfaceCalls: newHistogramVec(namespace+"_data_interface_duration_seconds",
+			"Latency of the DataInterface calls.", DefaultBuckets,
+			"method", "error"),
+		tokens: newCounterVec(namespace+"_tokens_total",
+			"Number of access tokens issued or refreshed.",
+			"event", "grant_type", "client_id"),
+	}
+}
+
+func (reg *Registry) ObserveRequest(endpoint, grantType, clientId, errorType string,
+	elapsed time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests.inc(endpoint, grantType, clientId, errorType)
+	reg.requestDuration.observe(elapsed.Seconds(), endpoint, grantType)
+}
+
+func (reg *Registry) ObserveInterfaceCall(method, errorType string, elapsed time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.interfaceCalls.observe(elapsed.Seconds(), method, errorType)
+}
+
+func (reg *Registry) CountToken(event, grantType, clientId string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.tokens.inc(event, grantType, clientId)
+}
+
+// WriteText writes all the metrics in the text exposition format.
+func (reg *Registry) WriteText(w io.Writer) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	reg.requests.write(bw)
+	reg.requestDuration.write(bw)
+	reg.interfaceCalls.write(bw)
+	reg.tokens.write(bw)
+	return bw.Flush()
+}
+
+// Handler returns http.Handler for the scraper.
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		reg.WriteText(w)
+	})
+}
+
+type series struct {
+	values  []string
+	count   float64
+	sum     float64
+	buckets []uint64
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*series
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name, help, labels, make(map[string]*series)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	s, exists := c.series[key]
+	if !exists {
+		s = &series{values: values}
+		c.series[key] = s
+	}
+	s.count++
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, s := range sortedSeries(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelText(c.labels, s.values, ""),
+			formatFloat(s.count))
+	}
+}
+
+type histogramVec struct {
+	name   string
+	help   string
+	bounds []float64
+	labels []string
+	series map[string]*series
+}
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) *histogramVec {
+	return &histogramVec{name, help, bounds, labels, make(map[string]*series)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	s, exists := h.series[key]
+	if !exists {
+		s = &series{values: values, buckets: make([]uint64, len(h.bounds))}
+		h.series[key] = s
+	}
+	s.count++
+	s.sum += v
+	for i, b := range h.bounds {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, s := range sortedSeries(h.series) {
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				labelText(h.labels, s.values, formatFloat(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", h.name,
+			labelText(h.labels, s.values, "+Inf"), formatFloat(s.count))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			labelText(h.labels, s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", h.name,
+			labelText(h.labels, s.values, ""), formatFloat(s.count))
+	}
+}
+
+func sortedSeries(m map[string]*series) []*series {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = m[k]
+	}
+	return list
+}
+
+// labelText builds {name="value",...}, le is added for histogram buckets.
+func labelText(names, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	reg := NewRegistry("")
+	reg.ObserveRequest(EndpointToken, "client_credentials", "client_id_01", "", 20*time.Millisecond)
+	reg.ObserveRequest(EndpointToken, "client_credentials", "", "invalid_client", 3*time.Millisecond)
+	reg.ObserveInterfaceCall("FindClientById", "", 2*time.Millisecond)
+	reg.CountToken(TokenIssued, "client_credentials", "client_id_01")
+
+	var buf bytes.Buffer
+	if err := reg.WriteText(&buf); err != nil {
+		t.Errorf("failed to write: %s", err)
+		return
+	}
+	actual := buf.String()
+	for _, expected := range []string{
+		"# TYPE goidc_requests_total counter\n",
+		`goidc_requests_total{endpoint="token_endpoint",grant_type="client_credentials",client_id="client_id_01",error=""} 1`,
+		`goidc_requests_total{endpoint="token_endpoint",grant_type="client_credentials",client_id="",error="invalid_client"} 1`,
+		"# TYPE goidc_request_duration_seconds histogram\n",
+		`goidc_request_duration_seconds_bucket{endpoint="token_endpoint",grant_type="client_credentials",le="0.005"} 1`,
+		`goidc_request_duration_seconds_bucket{endpoint="token_endpoint",grant_type="client_credentials",le="0.025"} 2`,
+		`goidc_request_duration_seconds_bucket{endpoint="token_endpoint",grant_type="client_credentials",le="+Inf"} 2`,
+		`goidc_request_duration_seconds_count{endpoint="token_endpoint",grant_type="client_credentials"} 2`,
+		`goidc_data_interface_duration_seconds_count{method="FindClientById",error=""} 1`,
+		`goidc_tokens_total{event="issued",grant_type="client_credentials",client_id="client_id_01"} 1`,
+	} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("Exposition:\n - got: %v\n - want: %v\n", actual, expected)
+		}
+	}
+}
+
+func TestRegistryEscapeLabelValue(t *testing.T) {
+	reg := NewRegistry("idp")
+	reg.CountToken(TokenIssued, "password", "a\"b\\c\nd")
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+	expected := `idp_tokens_total{event="issued",grant_type="password",client_id="a\"b\\c\nd"} 1`
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("Exposition:\n - got: %v\n - want: %v\n", buf.String(), expected)
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	reg := NewRegistry("")
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != 200 {
+		t.Errorf("Status code:\n - got: %v\n - want: %v\n", w.Code, 200)
+	}
+	ct := w.Header().Get("Content-Type")
+	if !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type:\n - got: %v\n - want: %v\n", ct, "text/plain; version=0.0.4")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/google/go-querystring/query"
+	"github.com/lyokato/goidc/bridge"
 )
 
 type OAuthErrorType int
@@ -38,20 +39,30 @@ const (
 	ErrRequestNotSupported
 	ErrRequestURINotSupported
 	ErrRegistrationNotSupported
+	// RFC8707 Resource Indicators
+	ErrInvalidTarget
+	// RFC9396 Rich Authorization Requests
+	ErrInvalidAuthorizationDetails
+	// RFC9470 Step-up Authentication Challenge
+	ErrInsufficientUserAuthentication
 )
 
 var errStatusCodeMap = map[OAuthErrorType]int{
-	ErrAccessDenied:            http.StatusForbidden,
-	ErrInvalidClient:           http.StatusBadRequest,
-	ErrInvalidGrant:            http.StatusBadRequest,
-	ErrInvalidRequest:          http.StatusBadRequest,
-	ErrInvalidScope:            http.StatusBadRequest,
-	ErrUnauthorizedClient:      http.StatusBadRequest,
-	ErrUnsupportedGrantType:    http.StatusBadRequest,
-	ErrUnsupportedResponseType: http.StatusBadRequest,
-	ErrServerError:             http.StatusInternalServerError,
-	ErrInvalidToken:            http.StatusUnauthorized,
-	ErrInsufficientScope:       http.StatusForbidden,
+	ErrAccessDenied:                   http.StatusForbidden,
+	ErrInvalidClient:                  http.StatusBadRequest,
+	ErrInvalidGrant:                   http.StatusBadRequest,
+	ErrInvalidRequest:                 http.StatusBadRequest,
+	ErrInvalidScope:                   http.StatusBadRequest,
+	ErrUnauthorizedClient:             http.StatusBadRequest,
+	ErrUnsupportedGrantType:           http.StatusBadRequest,
+	ErrUnsupportedResponseType:        http.StatusBadRequest,
+	ErrServerError:                    http.StatusInternalServerError,
+	ErrTemporarilyUnavailable:         http.StatusServiceUnavailable,
+	ErrInvalidToken:                   http.StatusUnauthorized,
+	ErrInsufficientScope:              http.StatusForbidden,
+	ErrInvalidTarget:                  http.StatusBadRequest,
+	ErrInvalidAuthorizationDetails:    http.StatusBadRequest,
+	ErrInsufficientUserAuthentication: http.StatusUnauthorized,
 }
 
 func (t OAuthErrorType) String() string {
@@ -101,6 +112,18 @@ func (t OAuthErrorType) String() string {
 		return "request_uri_not_supported"
 	case ErrRegistrationNotSupported:
 		return "registration_not_supported"
+
+	// RFC8707 Resource Indicators
+	case ErrInvalidTarget:
+		return "invalid_target"
+
+	// RFC9396 Rich Authorization Requests
+	case ErrInvalidAuthorizationDetails:
+		return "invalid_authorization_details"
+
+	// RFC9470 Step-up Authentication Challenge
+	case ErrInsufficientUserAuthentication:
+		return "insufficient_user_authentication"
 	}
 	return ""
 }
@@ -109,6 +132,12 @@ type OAuthError struct {
 	Type        OAuthErrorType
 	Description string
 	URI         string
+	// RFC6750 3. 'scope' attribute of WWW-Authenticate
+	Scope string
+	// RFC9470 3. 'acr_values' attribute of WWW-Authenticate
+	ACRValues string
+	// seconds for 'Retry-After' header, only for 'temporarily_unavailable'
+	RetryAfter int64
 }
 
 type OAuthErrorJSON struct {
@@ -142,15 +171,56 @@ func (e *OAuthError) StatusCode() int {
 }
 
 func NewOAuthError(typeName OAuthErrorType, description string) *OAuthError {
-	return &OAuthError{typeName, description, ""}
+	return &OAuthError{Type: typeName, Description: description}
 }
 
 func NewOAuthSimpleError(typeName OAuthErrorType) *OAuthError {
-	return &OAuthError{typeName, "", ""}
+	return &OAuthError{Type: typeName}
 }
 
 func NewOAuthDetailedError(typeName OAuthErrorType, description, uri string) *OAuthError {
-	return &OAuthError{typeName, description, uri}
+	return &OAuthError{Type: typeName, Description: description, URI: uri}
+}
+
+// NewInsufficientScopeError returns 'insufficient_scope' error,
+// scope is the scope necessary to access the resource.
+func NewInsufficientScopeError(description, scope string) *OAuthError {
+	return &OAuthError{Type: ErrInsufficientScope, Description: description, Scope: scope}
+}
+
+// NewInsufficientUserAuthenticationError returns 'insufficient_user_authentication' error,
+// acrValues is the space-delimited ACRs the resource accepts.
+func NewInsufficientUserAuthenticationError(description, acrValues string) *OAuthError {
+	return &OAuthError{Type: ErrInsufficientUserAuthentication, Description: description, ACRValues: acrValues}
+}
+
+// DefaultRetryAfter is used when DataInterface doesn't tell when to retry.
+const DefaultRetryAfter int64 = 30
+
+// NewTemporarilyUnavailableError returns 'temporarily_unavailable' error,
+// retryAfter is seconds the client should wait.
+func NewTemporarilyUnavailableError(description string, retryAfter int64) *OAuthError {
+	return &OAuthError{Type: ErrTemporarilyUnavailable, Description: description, RetryAfter: retryAfter}
+}
+
+// NewInterfaceError maps the failure of DataInterface to the error
+// returned to the client, 'temporarily_unavailable' or 'server_error'.
+func NewInterfaceError(err *bridge.Error) *OAuthError {
+	if err.Type() == bridge.ErrTemporarilyUnavailable {
+		retryAfter := err.RetryAfter()
+		if retryAfter <= 0 {
+			retryAfter = DefaultRetryAfter
+		}
+		return NewTemporarilyUnavailableError("", retryAfter)
+	}
+	return NewOAuthSimpleError(ErrServerError)
+}
+
+// SetRetryAfter sets 'Retry-After' header when RetryAfter is given.
+func (e *OAuthError) SetRetryAfter(header http.Header) {
+	if e.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.FormatInt(e.RetryAfter, 10))
+	}
 }
 
 func (e *OAuthError) JSON() []byte {
@@ -179,6 +249,12 @@ func (e *OAuthError) Header(realm string) string {
 	if e.URI != "" {
 		params = append(params, fmt.Sprintf("error_uri=%s", strconv.Quote(e.URI)))
 	}
+	if e.Scope != "" {
+		params = append(params, fmt.Sprintf("scope=%s", strconv.Quote(e.Scope)))
+	}
+	if e.ACRValues != "" {
+		params = append(params, fmt.Sprintf("acr_values=%s", strconv.Quote(e.ACRValues)))
+	}
 	return "Bearer " + strings.Join(params, ", ")
 }
 
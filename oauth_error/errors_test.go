@@ -3,6 +3,8 @@ package oauth_error
 import (
 	"net/http"
 	"testing"
+
+	"github.com/lyokato/goidc/bridge"
 )
 
 func TestErrorBasic(t *testing.T) {
@@ -102,3 +104,42 @@ func TestErrorSimple(t *testing.T) {
 		t.Errorf("Query:\n - got: %v\n - want: %v\n", actual_query, expected_query)
 	}
 }
+
+func TestErrorInsufficientScope(t *testing.T) {
+	oe := NewInsufficientScopeError("this endpoint requires 'write' scope", "write")
+	actual_header := oe.Header("example.org")
+	expected_header := "Bearer realm=\"example.org\", error=\"insufficient_scope\", error_description=\"this endpoint requires 'write' scope\", scope=\"write\""
+	if actual_header != expected_header {
+		t.Errorf("Header:\n - got: %v\n - want: %v\n", actual_header, expected_header)
+	}
+	if oe.StatusCode() != http.StatusForbidden {
+		t.Errorf("StatusCode:\n - got: %d\n - want: %d\n", oe.StatusCode(), http.StatusForbidden)
+	}
+
+	oe = NewInsufficientUserAuthenticationError("", "urn:example:mfa")
+	actual_header = oe.Header("example.org")
+	expected_header = "Bearer realm=\"example.org\", error=\"insufficient_user_authentication\", acr_values=\"urn:example:mfa\""
+	if actual_header != expected_header {
+		t.Errorf("Header:\n - got: %v\n - want: %v\n", actual_header, expected_header)
+	}
+}
+
+func TestErrorFromInterface(t *testing.T) {
+	oe := NewInterfaceError(bridge.NewTemporarilyUnavailableError(0, nil))
+	if oe.Type != ErrTemporarilyUnavailable || oe.RetryAfter != DefaultRetryAfter {
+		t.Errorf("unexpected error: %s, retry after %d", oe, oe.RetryAfter)
+	}
+	if oe.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("StatusCode:\n - got: %d\n - want: %d\n", oe.StatusCode(), http.StatusServiceUnavailable)
+	}
+	header := http.Header{}
+	oe.SetRetryAfter(header)
+	if header.Get("Retry-After") != "30" {
+		t.Errorf("Retry-After:\n - got: %v\n - want: %v\n", header.Get("Retry-After"), "30")
+	}
+
+	oe = NewInterfaceError(bridge.NewError(bridge.ErrServerError))
+	if oe.Type != ErrServerError {
+		t.Errorf("Type:\n - got: %v\n - want: %v\n", oe.Type, ErrServerError)
+	}
+}
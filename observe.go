@@ -0,0 +1,150 @@
+package goidc
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/metrics"
+	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/tracing"
+)
+
+// This file has the plumbing shared by metrics.Metrics and tracing.Tracer,
+// so that each endpoint wraps the request only once for both of them.
+
+// observedResponseWriter collects the labels of the request
+// while the endpoint handles it.
+type observedResponseWriter struct {
+	http.ResponseWriter
+	grantType string
+	clientId  string
+	flowType  string
+	errorType string
+}
+
+func observeError(w http.ResponseWriter, err *oer.OAuthError) {
+	if ow, ok := w.(*observedResponseWriter); ok {
+		ow.errorType = err.Type.String()
+	}
+}
+
+func observeGrant(w http.ResponseWriter, gt, clientId string) {
+	if ow, ok := w.(*observedResponseWriter); ok {
+		ow.grantType = gt
+		ow.clientId = clientId
+	}
+}
+
+// observeRequest wraps w when m or t is set, and returns the function
+// to call when the request is done. With t, the returned request carries
+// the endpoint span, whose parent is taken from 'traceparent' header.
+func observeRequest(m metrics.Metrics, t tracing.Tracer, endpoint string,
+	w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	if m == nil && t == nil {
+		return w, r, func() {}
+	}
+	start := time.Now()
+	ow := &observedResponseWriter{ResponseWriter: w}
+	var span tracing.Span
+	if t != nil {
+		var ctx context.Context
+		ctx, span = t.Start(tracing.Extract(r.Context(), r.Header),
+			"goidc."+endpoint, tracing.String(tracing.AttrEndpoint, endpoint))
+		// the caller may keep reading the form with the original request
+		r.ParseForm()
+		r = r.WithContext(ctx)
+	}
+	return ow, r, func() {
+		if m != nil {
+			m.ObserveRequest(endpoint, ow.grantType, ow.clientId, ow.errorType,
+				time.Since(start))
+		}
+		if span != nil {
+			endRequestSpan(span, ow.grantType, ow.clientId, ow.flowType, ow.errorType)
+		}
+	}
+}
+
+func endRequestSpan(span tracing.Span, grantType, clientId, flowType, errorType string) {
+	if grantType != "" {
+		span.SetAttributes(tracing.String(tracing.AttrGrantType, grantType))
+	}
+	if clientId != "" {
+		span.SetAttributes(tracing.String(tracing.AttrClientId, clientId))
+	}
+	if flowType != "" {
+		span.SetAttributes(tracing.String(tracing.AttrFlowType, flowType))
+	}
+	if errorType == "" {
+		span.SetAttributes(tracing.String(tracing.AttrOutcome, tracing.OutcomeSuccess))
+	} else {
+		span.SetAttributes(tracing.String(tracing.AttrOutcome, errorType))
+		// errors of the client are the expected outcome
+		if errorType == oer.ErrServerError.String() ||
+			errorType == oer.ErrTemporarilyUnavailable.String() {
+			span.Fail(errorType)
+		}
+	}
+	span.End()
+}
+
+func observeDataInterface(ctx context.Context, sdi bridge.DataInterface,
+	m metrics.Metrics, t tracing.Tracer) bridge.DataInterface {
+	if t != nil {
+		sdi = tracing.TraceDataInterface(ctx, sdi, t)
+	}
+	if m != nil {
+		sdi = metrics.InstrumentDataInterface(sdi, m)
+	}
+	return sdi
+}
+
+func observeErrorType(w http.ResponseWriter, typ string) {
+	if ow, ok := w.(*observedResponseWriter); ok {
+		ow.errorType = typ
+	}
+}
+
+func observeFlow(w http.ResponseWriter, flowType string) {
+	if ow, ok := w.(*observedResponseWriter); ok {
+		ow.flowType = flowType
+	}
+}
+
+func observeClient(w http.ResponseWriter, clientId string) {
+	if ow, ok := w.(*observedResponseWriter); ok {
+		ow.clientId = clientId
+	}
+}
+
+// observedResponseHandler takes the error type redirected with.
+type observedResponseHandler struct {
+	authorization.ResponseHandler
+	w http.ResponseWriter
+}
+
+func (h *observedResponseHandler) Error(uri, typ, desc, state string) {
+	observeErrorType(h.w, typ)
+	h.ResponseHandler.Error(uri, typ, desc, state)
+}
+
+// observedCallbacks takes the error shown on the screen.
+type observedCallbacks struct {
+	bridge.AuthorizationCallbacks
+	w http.ResponseWriter
+}
+
+func (c *observedCallbacks) ShowErrorScreen(authErrType int) {
+	switch authErrType {
+	case authorization.ErrServerError:
+		observeErrorType(c.w, oer.ErrServerError.String())
+	case authorization.ErrTemporarilyUnavailable:
+		observeErrorType(c.w, oer.ErrTemporarilyUnavailable.String())
+	default:
+		observeErrorType(c.w, oer.ErrInvalidRequest.String())
+	}
+	c.AuthorizationCallbacks.ShowErrorScreen(authErrType)
+}
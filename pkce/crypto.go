@@ -3,18 +3,22 @@ package pkce
 import (
 	"crypto/sha256"
 	"encoding/base64"
-	"math/rand"
 	"strings"
-	"time"
+
+	"github.com/lyokato/goidc/tokengen"
 )
 
+// 43 characters of base64url, the shortest RFC7636 allows.
+var codeVerifierGenerator = &tokengen.Generator{Entropy: 32, Encoding: tokengen.Base64URL}
+
+// GenRandomCodeVerifier returns 256 bits code_verifier from crypto/rand.
+// It panics when crypto/rand fails, as the callers have no way to recover.
 func GenRandomCodeVerifier() string {
-	rand.Seed(time.Now().UnixNano())
-	var data [32]byte
-	for i := 0; i < 32; i++ {
-		data[i] = byte(rand.Intn(256))
+	v, err := codeVerifierGenerator.Generate()
+	if err != nil {
+		panic(err)
 	}
-	return EncodeBase64WithoutPadding(data[:])
+	return v
 }
 
 func EncodeBase64WithoutPadding(origin []byte) string {
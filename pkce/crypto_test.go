@@ -22,3 +22,14 @@ func TestEncodePKCES256(t *testing.T) {
 		t.Errorf("S64Encode:\n - got: %v\n - want: %v\n", actual_encoded, expected_encoded)
 	}
 }
+
+func TestGenRandomCodeVerifier(t *testing.T) {
+	v1 := GenRandomCodeVerifier()
+	v2 := GenRandomCodeVerifier()
+	if len(v1) != 43 {
+		t.Errorf("Length:\n - got: %v\n - want: %v\n", len(v1), 43)
+	}
+	if v1 == v2 {
+		t.Errorf("Generated twice:\n - got: %v\n - want: different values\n", v1)
+	}
+}
@@ -0,0 +1,49 @@
+package goidc
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/scope"
+)
+
+// Principal is the identity ResourceProtector authenticated
+// with the access_token.
+type Principal struct {
+	UserId   int64
+	Subject  string
+	ClientId string
+	// space-delimited, same as AuthInfo.GetScope()
+	Scope string
+	// RFC8707, empty if the token isn't restricted
+	Audience []string
+	// RFC9396
+	AuthorizationDetails []authorization.Detail
+	// unix time the access_token expires
+	ExpiresAt int64
+	// unix time the user authorized the client
+	AuthTime int64
+	// Authentication Context Class Reference
+	ACR string
+}
+
+func (p *Principal) HasScope(s string) bool {
+	return scope.Include(p.Scope, s)
+}
+
+type principalContextKey struct{}
+
+func NewContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// PrincipalFromRequest is a shortcut for PrincipalFromContext(r.Context())
+func PrincipalFromRequest(r *http.Request) (*Principal, bool) {
+	return PrincipalFromContext(r.Context())
+}
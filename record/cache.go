@@ -0,0 +1,65 @@
+package record
+
+import "sync"
+
+// ClientCache keeps the clients initialized by Init, for the stores
+// which decode the client on each lookup. The zero value is ready to use,
+// and nil caches nothing.
+type ClientCache struct {
+	// seconds to keep the client, 0 keeps it until removed
+	TTL int64
+
+	mu      sync.RWMutex
+	clients map[string]*cachedClient
+	version uint64
+}
+
+type cachedClient struct {
+	client    *Client
+	expiresAt int64
+}
+
+// Get returns the cached client, or nil with the version to pass to Put.
+func (cc *ClientCache) Get(clientId string, now int64) (*Client, uint64) {
+	if cc == nil {
+		return nil, 0
+	}
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if e, exists := cc.clients[clientId]; exists && (e.expiresAt == 0 || now < e.expiresAt) {
+		return e.client, cc.version
+	}
+	return nil, cc.version
+}
+
+// Put caches c, unless Remove is called after Get returned version,
+// so that the client loaded before the update is never cached.
+func (cc *ClientCache) Put(c *Client, version uint64, now int64) {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if version != cc.version {
+		return
+	}
+	if cc.clients == nil {
+		cc.clients = make(map[string]*cachedClient)
+	}
+	e := &cachedClient{client: c}
+	if cc.TTL > 0 {
+		e.expiresAt = now + cc.TTL
+	}
+	cc.clients[c.Id] = e
+}
+
+// Remove drops the client, the stores call it when the client is registered or removed.
+func (cc *ClientCache) Remove(clientId string) {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.clients, clientId)
+	cc.version++
+}
@@ -0,0 +1,258 @@
+package record
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/lyokato/goidc/client_auth"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/crypto"
+	"github.com/lyokato/goidc/flow"
+	"github.com/lyokato/goidc/prompt"
+)
+
+// Client is a registered client. The keys are kept in PEM,
+// so that the record can be serialized as it is.
+type Client struct {
+	Id                      string                 `json:"id"`
+	OwnerUserId             int64                  `json:"owner_user_id"`
+	Secrets                 []*clientsecret.Secret `json:"secrets,omitempty"`
+	TokenEndpointAuthMethod string                 `json:"token_endpoint_auth_method,omitempty"`
+	RedirectURIs            []string               `json:"redirect_uris"`
+	SectorIdentifierURI     string                 `json:"sector_identifier_uri,omitempty"`
+	// authorization code flow only when empty
+	Flows      []flow.FlowType `json:"flows,omitempty"`
+	GrantTypes []string        `json:"grant_types,omitempty"`
+	// any scope is allowed when empty
+	Scopes    []string `json:"scopes,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+
+	IdTokenAlg   string `json:"id_token_alg"`
+	IdTokenKeyId string `json:"id_token_key_id,omitempty"`
+	// RSA private key in PEM
+	IdTokenKey                  string `json:"id_token_key"`
+	IdTokenEncryptedResponseAlg string `json:"id_token_encrypted_response_alg,omitempty"`
+	IdTokenEncryptedResponseEnc string `json:"id_token_encrypted_response_enc,omitempty"`
+	// RSA public key in PEM
+	IdTokenEncryptionKey string `json:"id_token_encryption_key,omitempty"`
+
+	// shared secret for client_secret_jwt
+	AssertionSecret string `json:"assertion_secret,omitempty"`
+	// RSA public keys in PEM for private_key_jwt, keyed by kid
+	AssertionKeys map[string]string `json:"assertion_keys,omitempty"`
+
+	NoConsentPromptPolicy prompt.NoConsentPromptPolicy `json:"no_consent_prompt_policy"`
+	NonePromptPolicy      prompt.NonePromptPolicy      `json:"none_prompt_policy"`
+
+	keys *clientKeys
+}
+
+type clientKeys struct {
+	idToken    *rsa.PrivateKey
+	encryption *rsa.PublicKey
+	assertion  map[string]*rsa.PublicKey
+}
+
+// AddSecret hashes secret with h and appends it.
+func (c *Client) AddSecret(h clientsecret.Hasher, secret string, expiresAt int64) error {
+	s, err := clientsecret.New(h, secret, expiresAt)
+	if err != nil {
+		return err
+	}
+	c.Secrets = append(c.Secrets, s)
+	return nil
+}
+
+// Init parses the keys, and returns the error of the broken one.
+// The stores call it when the client is registered or restored,
+// and the getters of the keys return nil until it's called.
+func (c *Client) Init() error {
+	keys, err := c.parseKeys()
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	return nil
+}
+
+func (c *Client) parseKeys() (*clientKeys, error) {
+	keys := &clientKeys{assertion: make(map[string]*rsa.PublicKey)}
+	var err error
+	if c.IdTokenKey != "" {
+		if keys.idToken, err = crypto.LoadPrivateKeyFromText(c.IdTokenKey); err != nil {
+			return nil, fmt.Errorf("client %s: id_token key: %s", c.Id, err)
+		}
+		keys.idToken.Precompute()
+	}
+	if c.IdTokenEncryptionKey != "" {
+		if keys.encryption, err = crypto.LoadPublicKeyFromText(c.IdTokenEncryptionKey); err != nil {
+			return nil, fmt.Errorf("client %s: encryption key: %s", c.Id, err)
+		}
+	}
+	for kid, text := range c.AssertionKeys {
+		k, err := crypto.LoadPublicKeyFromText(text)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: assertion key %s: %s", c.Id, kid, err)
+		}
+		keys.assertion[kid] = k
+	}
+	return keys, nil
+}
+
+// parsedKeys doesn't parse the keys itself, so that the broken one is
+// reported by Init, not ignored here on each request.
+func (c *Client) parsedKeys() *clientKeys {
+	if c.keys != nil {
+		return c.keys
+	}
+	return &clientKeys{}
+}
+
+// Clone returns the deep copy, sharing the parsed keys.
+func (c *Client) Clone() *Client {
+	n := *c
+	n.Secrets = make([]*clientsecret.Secret, len(c.Secrets))
+	for i, s := range c.Secrets {
+		copied := *s
+		n.Secrets[i] = &copied
+	}
+	n.RedirectURIs = cloneStrings(c.RedirectURIs)
+	n.Flows = append([]flow.FlowType(nil), c.Flows...)
+	n.GrantTypes = cloneStrings(c.GrantTypes)
+	n.Scopes = cloneStrings(c.Scopes)
+	n.Resources = cloneStrings(c.Resources)
+	if c.AssertionKeys != nil {
+		n.AssertionKeys = make(map[string]string, len(c.AssertionKeys))
+		for kid, k := range c.AssertionKeys {
+			n.AssertionKeys[kid] = k
+		}
+	}
+	return &n
+}
+
+func (c *Client) GetId() string {
+	return c.Id
+}
+
+func (c *Client) GetOwnerUserId() int64 {
+	return c.OwnerUserId
+}
+
+func (c *Client) GetIdTokenAlg() string {
+	return c.IdTokenAlg
+}
+
+func (c *Client) GetIdTokenKeyId() string {
+	return c.IdTokenKeyId
+}
+
+func (c *Client) GetIdTokenKey() interface{} {
+	if k := c.parsedKeys().idToken; k != nil {
+		return k
+	}
+	return nil
+}
+
+func (c *Client) GetIdTokenEncryptedResponseAlg() string {
+	return c.IdTokenEncryptedResponseAlg
+}
+
+func (c *Client) GetIdTokenEncryptedResponseEnc() string {
+	return c.IdTokenEncryptedResponseEnc
+}
+
+func (c *Client) GetIdTokenEncryptionKey() interface{} {
+	if k := c.parsedKeys().encryption; k != nil {
+		return k
+	}
+	return nil
+}
+
+func (c *Client) GetClientSecrets() []*clientsecret.Secret {
+	return c.Secrets
+}
+
+func (c *Client) GetTokenEndpointAuthMethod() string {
+	return c.TokenEndpointAuthMethod
+}
+
+func (c *Client) CanUseFlow(flowType flow.FlowType) bool {
+	if len(c.Flows) == 0 {
+		return flowType == flow.AuthorizationCode
+	}
+	for _, f := range c.Flows {
+		if f == flowType {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) CanUseGrantType(gt string) bool {
+	return contains(c.GrantTypes, gt)
+}
+
+func (c *Client) CanUseScope(flowType flow.FlowType, scope string) bool {
+	return len(c.Scopes) == 0 || contains(c.Scopes, scope)
+}
+
+func (c *Client) CanUseRedirectURI(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+func (c *Client) CanUseResource(resource string) bool {
+	return contains(c.Resources, resource)
+}
+
+func (c *Client) GetRedirectURIs() []string {
+	return c.RedirectURIs
+}
+
+func (c *Client) GetSectorIdentifierURI() string {
+	return c.SectorIdentifierURI
+}
+
+// GetAssertionKey returns AssertionSecret for HMAC, or the public key for kid.
+// kid can be omitted when the client has only one key.
+func (c *Client) GetAssertionKey(alg, kid string) interface{} {
+	if client_auth.IsHMAC(alg) {
+		if c.AssertionSecret == "" {
+			return nil
+		}
+		return []byte(c.AssertionSecret)
+	}
+	keys := c.parsedKeys().assertion
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k
+		}
+	}
+	if k, exists := keys[kid]; exists {
+		return k
+	}
+	return nil
+}
+
+func (c *Client) GetNoConsentPromptPolicy() prompt.NoConsentPromptPolicy {
+	return c.NoConsentPromptPolicy
+}
+
+func (c *Client) GetNonePromptPolicy() prompt.NonePromptPolicy {
+	return c.NonePromptPolicy
+}
+
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneStrings(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string(nil), list...)
+}
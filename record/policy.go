@@ -0,0 +1,146 @@
+package record
+
+import (
+	"strconv"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
+	"github.com/lyokato/goidc/scope"
+	"github.com/lyokato/goidc/tokengen"
+)
+
+const (
+	DefaultAccessTokenExpiresIn  = 60 * 60
+	DefaultRefreshTokenExpiresIn = 60 * 60 * 24 * 30
+)
+
+// Policy is the lifetime of the records the stores create.
+type Policy struct {
+	AccessTokenExpiresIn  int64
+	RefreshTokenExpiresIn int64
+	IdTokenExpiresIn      int64
+	// rotates refresh_token on every refresh,
+	// it's always rotated for public clients.
+	RotateRefreshToken bool
+	// nil means tokengen.Default(), set Prefix to let
+	// secret scanning tools find the leaked tokens.
+	AccessTokenGenerator  *tokengen.Generator
+	RefreshTokenGenerator *tokengen.Generator
+	// uses the decimal user ID as 'sub' instead of the random one.
+	// Opt in only when the IDs are never reused, and can be exposed to the clients.
+	NumericSubject bool
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		AccessTokenExpiresIn:  DefaultAccessTokenExpiresIn,
+		RefreshTokenExpiresIn: DefaultRefreshTokenExpiresIn,
+		IdTokenExpiresIn:      authorization.DefaultIdTokenExpiresIn,
+	}
+}
+
+// NewTokenValue returns 256 bits random string by tokengen.Default().
+func NewTokenValue() (string, error) {
+	return tokengen.Default().Generate()
+}
+
+func (p *Policy) newAccessToken() (string, error) {
+	if p.AccessTokenGenerator == nil {
+		return NewTokenValue()
+	}
+	return p.AccessTokenGenerator.Generate()
+}
+
+func (p *Policy) newRefreshToken() (string, error) {
+	if p.RefreshTokenGenerator == nil {
+		return NewTokenValue()
+	}
+	return p.RefreshTokenGenerator.Generate()
+}
+
+var subjectGenerator = &tokengen.Generator{Entropy: tokengen.MinEntropy}
+
+// NewSubject returns the random 'sub' for a new user.
+func NewSubject() (string, error) {
+	return subjectGenerator.Generate()
+}
+
+// Subject returns 'sub' of u, the random one given on creation.
+// The decimal user ID is used when NumericSubject is set,
+// and for the users stored before User.Subject was introduced.
+func (p *Policy) Subject(u *User) string {
+	if p.NumericSubject || u.Subject == "" {
+		return strconv.FormatInt(u.Id, 10)
+	}
+	return u.Subject
+}
+
+// NewOAuthToken builds the token for info. refresh_token is issued
+// only on the token endpoint, and only when offline_access is granted.
+func (p *Policy) NewOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail, now int64) (*OAuthToken, error) {
+	at, err := p.newAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	t := &OAuthToken{
+		AuthId:               info.GetId(),
+		AccessToken:          at,
+		AccessTokenExpiresIn: p.AccessTokenExpiresIn,
+		RefreshedAt:          now,
+		CreatedAt:            now,
+		Resources:            cloneStrings(resources),
+		Audience:             cloneStrings(resources),
+		AuthorizationDetails: cloneDetails(details),
+	}
+	if onTokenEndpoint && scope.IncludeOfflineAccess(info.GetScope()) {
+		if t.RefreshToken, err = p.newRefreshToken(); err != nil {
+			return nil, err
+		}
+		t.RefreshTokenExpiresIn = p.RefreshTokenExpiresIn
+	}
+	return t, nil
+}
+
+// Refresh issues new access_token on t, and new refresh_token when rotate is true.
+// The rotated refresh_token keeps the original expiry.
+func (p *Policy) Refresh(t *OAuthToken, rotate bool, audience []string,
+	details []authorization.Detail, now int64) error {
+	at, err := p.newAccessToken()
+	if err != nil {
+		return err
+	}
+	t.AccessToken = at
+	t.AccessTokenExpiresIn = p.AccessTokenExpiresIn
+	t.RefreshedAt = now
+	t.Audience = cloneStrings(audience)
+	t.AuthorizationDetails = cloneDetails(details)
+	if rotate && t.RefreshToken != "" {
+		if t.RefreshToken, err = p.newRefreshToken(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShouldRotate reports whether refresh_token of c must be rotated.
+func (p *Policy) ShouldRotate(c bridge.Client) bool {
+	return p.RotateRefreshToken || (c != nil && client_auth.IsPublic(c))
+}
+
+func (p *Policy) NewAuthSession(info bridge.AuthInfo,
+	s *authorization.Session, now int64) *AuthSession {
+	return &AuthSession{
+		Code:             s.Code,
+		AuthId:           info.GetId(),
+		AuthTime:         s.AuthTime,
+		IdTokenExpiresIn: p.IdTokenExpiresIn,
+		RedirectURI:      s.RedirectURI,
+		CodeVerifier:     s.CodeVerifier,
+		ExpiresIn:        s.ExpiresIn,
+		Nonce:            s.Nonce,
+		Resources:        cloneStrings(s.Resources),
+		CreatedAt:        now,
+	}
+}
@@ -0,0 +1,241 @@
+// Package record provides the plain records which implement the bridge
+// interfaces, and the rules shared by the stores built on them.
+package record
+
+import (
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+)
+
+var (
+	_ bridge.Client      = (*Client)(nil)
+	_ bridge.AuthInfo    = (*AuthInfo)(nil)
+	_ bridge.AuthSession = (*AuthSession)(nil)
+	_ bridge.OAuthToken  = (*OAuthToken)(nil)
+)
+
+type (
+	User struct {
+		Id       int64  `json:"id"`
+		Username string `json:"username"`
+		// random 'sub' given on creation, see Policy.Subject
+		Subject string `json:"subject,omitempty"`
+		// encoded by clientsecret.Hasher
+		PasswordHash string `json:"password_hash"`
+	}
+
+	AuthInfo struct {
+		Id                   int64                  `json:"id"`
+		ClientId             string                 `json:"client_id"`
+		UserId               int64                  `json:"user_id"`
+		Subject              string                 `json:"subject"`
+		Scope                string                 `json:"scope"`
+		AuthorizationDetails []authorization.Detail `json:"authorization_details,omitempty"`
+		AuthorizedAt         int64                  `json:"authorized_at"`
+		ACR                  string                 `json:"acr,omitempty"`
+		Active               bool                   `json:"active"`
+	}
+
+	AuthSession struct {
+		Code             string   `json:"code"`
+		AuthId           int64    `json:"auth_id"`
+		AuthTime         int64    `json:"auth_time"`
+		IdTokenExpiresIn int64    `json:"id_token_expires_in"`
+		RedirectURI      string   `json:"redirect_uri"`
+		CodeVerifier     string   `json:"code_verifier,omitempty"`
+		ExpiresIn        int64    `json:"expires_in"`
+		Nonce            string   `json:"nonce,omitempty"`
+		Resources        []string `json:"resources,omitempty"`
+		CreatedAt        int64    `json:"created_at"`
+	}
+
+	OAuthToken struct {
+		AuthId                int64    `json:"auth_id"`
+		AccessToken           string   `json:"access_token"`
+		AccessTokenExpiresIn  int64    `json:"access_token_expires_in"`
+		RefreshedAt           int64    `json:"refreshed_at"`
+		RefreshToken          string   `json:"refresh_token,omitempty"`
+		RefreshTokenExpiresIn int64    `json:"refresh_token_expires_in,omitempty"`
+		CreatedAt             int64    `json:"created_at"`
+		Resources             []string `json:"resources,omitempty"`
+		Audience              []string `json:"audience,omitempty"`
+		// narrowed from the AuthInfo's by the token request
+		AuthorizationDetails []authorization.Detail `json:"authorization_details,omitempty"`
+	}
+
+	// AssertionClaims is recorded by RecordAssertionClaims to reject the replay.
+	AssertionClaims struct {
+		ClientId  string `json:"client_id"`
+		JTI       string `json:"jti"`
+		IssuedAt  int64  `json:"issued_at"`
+		ExpiredAt int64  `json:"expired_at"`
+	}
+)
+
+func (i *AuthInfo) Clone() *AuthInfo {
+	n := *i
+	n.AuthorizationDetails = cloneDetails(i.AuthorizationDetails)
+	return &n
+}
+
+func cloneDetails(details []authorization.Detail) []authorization.Detail {
+	if details == nil {
+		return nil
+	}
+	copied := make([]authorization.Detail, len(details))
+	for idx, d := range details {
+		c := make(authorization.Detail, len(d))
+		for k, v := range d {
+			c[k] = v
+		}
+		copied[idx] = c
+	}
+	return copied
+}
+
+func (i *AuthInfo) GetId() int64 {
+	return i.Id
+}
+
+func (i *AuthInfo) GetClientId() string {
+	return i.ClientId
+}
+
+func (i *AuthInfo) GetUserId() int64 {
+	return i.UserId
+}
+
+func (i *AuthInfo) GetSubject() string {
+	return i.Subject
+}
+
+func (i *AuthInfo) GetScope() string {
+	return i.Scope
+}
+
+func (i *AuthInfo) GetAuthorizationDetails() []authorization.Detail {
+	return i.AuthorizationDetails
+}
+
+func (i *AuthInfo) GetAuthorizedAt() int64 {
+	return i.AuthorizedAt
+}
+
+func (i *AuthInfo) GetACR() string {
+	return i.ACR
+}
+
+func (i *AuthInfo) IsActive() bool {
+	return i.Active
+}
+
+func (s *AuthSession) Clone() *AuthSession {
+	n := *s
+	n.Resources = cloneStrings(s.Resources)
+	return &n
+}
+
+// ExpiresAt returns the unix time the code expires at.
+func (s *AuthSession) ExpiresAt() int64 {
+	return s.CreatedAt + s.ExpiresIn
+}
+
+func (s *AuthSession) GetCode() string {
+	return s.Code
+}
+
+func (s *AuthSession) GetAuthId() int64 {
+	return s.AuthId
+}
+
+func (s *AuthSession) GetAuthTime() int64 {
+	return s.AuthTime
+}
+
+func (s *AuthSession) GetIdTokenExpiresIn() int64 {
+	return s.IdTokenExpiresIn
+}
+
+func (s *AuthSession) GetRedirectURI() string {
+	return s.RedirectURI
+}
+
+func (s *AuthSession) GetCodeVerifier() string {
+	return s.CodeVerifier
+}
+
+func (s *AuthSession) GetExpiresIn() int64 {
+	return s.ExpiresIn
+}
+
+func (s *AuthSession) GetNonce() string {
+	return s.Nonce
+}
+
+func (s *AuthSession) GetResources() []string {
+	return s.Resources
+}
+
+func (s *AuthSession) GetCreatedAt() int64 {
+	return s.CreatedAt
+}
+
+func (t *OAuthToken) Clone() *OAuthToken {
+	n := *t
+	n.Resources = cloneStrings(t.Resources)
+	n.Audience = cloneStrings(t.Audience)
+	n.AuthorizationDetails = cloneDetails(t.AuthorizationDetails)
+	return &n
+}
+
+// ExpiresAt returns the unix time both of the tokens expire at,
+// the record can be removed after that.
+func (t *OAuthToken) ExpiresAt() int64 {
+	at := t.RefreshedAt + t.AccessTokenExpiresIn
+	if t.RefreshToken != "" {
+		if rt := t.CreatedAt + t.RefreshTokenExpiresIn; rt > at {
+			return rt
+		}
+	}
+	return at
+}
+
+func (t *OAuthToken) GetAuthId() int64 {
+	return t.AuthId
+}
+
+func (t *OAuthToken) GetAccessToken() string {
+	return t.AccessToken
+}
+
+func (t *OAuthToken) GetAccessTokenExpiresIn() int64 {
+	return t.AccessTokenExpiresIn
+}
+
+func (t *OAuthToken) GetRefreshedAt() int64 {
+	return t.RefreshedAt
+}
+
+func (t *OAuthToken) GetRefreshToken() string {
+	return t.RefreshToken
+}
+
+func (t *OAuthToken) GetRefreshTokenExpiresIn() int64 {
+	return t.RefreshTokenExpiresIn
+}
+
+func (t *OAuthToken) GetCreatedAt() int64 {
+	return t.CreatedAt
+}
+
+func (t *OAuthToken) GetResources() []string {
+	return t.Resources
+}
+
+func (t *OAuthToken) GetAudience() []string {
+	return t.Audience
+}
+
+func (t *OAuthToken) GetAuthorizationDetails() []authorization.Detail {
+	return t.AuthorizationDetails
+}
@@ -0,0 +1,470 @@
+// Package storetest is the conformance suite for the stores built on the
+// record package, like memstore, sqlstore and boltstore.
+//
+// A store passes it when:
+//   - FindUserIdBySubject resolves the random 'sub' given on creation,
+//     or the decimal user ID with record.Policy.NumericSubject,
+//     and the 'sub' recorded by RecordSubject until the user is removed.
+//   - FindAuthSessionByCode doesn't return the expired session.
+//   - DisableSession fails with ErrFailed when the session has already been
+//     disabled, so that the code is redeemed only once.
+//   - RefreshAccessToken fails when the token has already been refreshed,
+//     so that only one of the concurrent requests succeeds.
+//   - RecordAssertionClaims rejects jti used by the client until the assertion
+//     expires. The assertion without jti is accepted, see assertion.Policy to require it.
+//   - Evict removes the expired sessions, tokens and assertion claims.
+//     The token is kept until its refresh_token expires.
+package storetest
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc"
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/basic_auth"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+	"github.com/lyokato/goidc/subject"
+	th "github.com/lyokato/goidc/test_helper"
+	"github.com/lyokato/goidc/tokengen"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Store is the store under test. The management methods differ in each store,
+// so they are passed as functions.
+type Store struct {
+	bridge.DataInterface
+	SetPolicy      func(p *record.Policy)
+	SetTimeBuilder func(builder io.TimeBuilder)
+	CreateUser     func(username, password string) (*record.User, error)
+	RemoveUser     func(uid int64) error
+	RegisterClient func(c *record.Client) error
+	RemoveClient   func(clientId string) error
+	// Evict returns the number of the removed records
+	Evict func() (int64, error)
+}
+
+// Factory returns an empty store, which is closed by t.Cleanup.
+// Set a cheap password hasher to keep the suite fast.
+type Factory func(t *testing.T) *Store
+
+// Run runs the suite on the stores newStore returns.
+func Run(t *testing.T, newStore Factory) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, s *Store, uid int64)
+	}{
+		{"User", testUser},
+		{"RecordSubject", testRecordSubject},
+		{"Client", testClient},
+		{"AuthInfo", testAuthInfo},
+		{"AuthSession", testAuthSession},
+		{"RefreshAccessToken", testRefreshAccessToken},
+		{"RecordAssertionClaimsAndEvict", testRecordAssertionClaimsAndEvict},
+		{"TokenEndpoint", testTokenEndpoint},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStore(t)
+			tc.test(t, s, prepare(t, s))
+		})
+	}
+}
+
+// prepare creates user01 and client_id_01, and returns the user ID.
+func prepare(t *testing.T, s *Store) int64 {
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	u, err := s.CreateUser("user01", "pass01")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	c := &record.Client{
+		Id:           "client_id_01",
+		RedirectURIs: []string{"http://example.org/callback"},
+		GrantTypes:   []string{grant.TypeAuthorizationCode, grant.TypePassword, grant.TypeRefreshToken},
+	}
+	c.AddSecret(clientsecret.Bcrypt(bcrypt.MinCost), "client_secret_01", 0)
+	if err := s.RegisterClient(c); err != nil {
+		t.Fatalf("RegisterClient: %s", err)
+	}
+	return u.Id
+}
+
+func testUser(t *testing.T, s *Store, uid int64) {
+	if _, err := s.CreateUser("user01", "pass02"); err == nil {
+		t.Errorf("Duplicated user:\n - got: %v\n - want: %v\n", err, "error")
+	}
+	if found, err := s.FindUserId("user01", "pass01"); err != nil || found != uid {
+		t.Errorf("FindUserId:\n - got: %v, %v\n - want: %v\n", found, err, uid)
+	}
+	if _, err := s.FindUserId("user01", "wrong"); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("FindUserId with wrong password:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid", nil)
+	if info.GetSubject() == strconv.FormatInt(uid, 10) {
+		t.Errorf("Subject:\n - got: %v\n - want: %v\n", info.GetSubject(), "random one")
+	}
+	if found, err := s.FindUserIdBySubject(info.GetSubject()); err != nil || found != uid {
+		t.Errorf("FindUserIdBySubject:\n - got: %v, %v\n - want: %v\n", found, err, uid)
+	}
+	for _, sub := range []string{strconv.FormatInt(uid, 10), "user01"} {
+		if _, err := s.FindUserIdBySubject(sub); err == nil {
+			t.Errorf("FindUserIdBySubject %s:\n - got: %v\n - want: %v\n", sub, err, bridge.ErrFailed)
+		}
+	}
+	s.SetPolicy(&record.Policy{NumericSubject: true})
+	if found, err := s.FindUserIdBySubject(strconv.FormatInt(uid, 10)); err != nil || found != uid {
+		t.Errorf("FindUserIdBySubject with NumericSubject:\n - got: %v, %v\n - want: %v\n", found, err, uid)
+	}
+
+	if err := s.RemoveUser(uid); err != nil {
+		t.Fatalf("RemoveUser: %s", err)
+	}
+	if _, err := s.FindUserId("user01", "pass01"); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("FindUserId after removed:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+}
+
+func testRecordSubject(t *testing.T, s *Store, uid int64) {
+	c, _ := s.FindClientById("client_id_01")
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid", nil)
+	strategy := subject.Pairwise("salt")
+	sub, err := strategy.Subject(s, c, info)
+	if err != nil {
+		t.Fatalf("Subject: %s", err)
+	}
+	// recorded on each issue
+	if again, err := strategy.Subject(s, c, info); err != nil || again != sub {
+		t.Errorf("Subject again:\n - got: %v, %v\n - want: %v\n", again, err, sub)
+	}
+	if found, err := strategy.FindUserId(s, c, sub); err != nil || found != uid {
+		t.Errorf("FindUserId:\n - got: %v, %v\n - want: %v\n", found, err, uid)
+	}
+	if err := s.RecordSubject(uid+1, "unknown_user_subject"); err == nil {
+		if _, err := s.FindUserIdBySubject("unknown_user_subject"); err == nil {
+			t.Errorf("Subject of unknown user:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+		}
+	}
+
+	if err := s.RemoveUser(uid); err != nil {
+		t.Fatalf("RemoveUser: %s", err)
+	}
+	if _, err := s.FindUserIdBySubject(sub); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("FindUserIdBySubject after removed:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+}
+
+func testClient(t *testing.T, s *Store, uid int64) {
+	c, err := s.FindClientById("client_id_01")
+	if err != nil || !c.CanUseRedirectURI("http://example.org/callback") {
+		t.Fatalf("FindClientById:\n - got: %v, %v\n - want: %v\n", c, err, "client_id_01")
+	}
+	if _, err := s.FindClientById("client_id_02"); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("FindClientById unknown:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+
+	// the update is seen on the next lookup
+	if err := s.RegisterClient(&record.Client{
+		Id:           "client_id_01",
+		RedirectURIs: []string{"http://example.org/callback2"},
+	}); err != nil {
+		t.Fatalf("RegisterClient: %s", err)
+	}
+	c, _ = s.FindClientById("client_id_01")
+	if c == nil || c.CanUseRedirectURI("http://example.org/callback") ||
+		!c.CanUseRedirectURI("http://example.org/callback2") {
+		t.Errorf("Updated client:\n - got: %v\n - want: %v\n", c, "http://example.org/callback2")
+	}
+
+	if err := s.RegisterClient(&record.Client{Id: "client_id_02", IdTokenKey: "broken"}); err == nil {
+		t.Errorf("RegisterClient with broken key:\n - got: %v\n - want: %v\n", err, "error")
+	}
+
+	if err := s.RemoveClient("client_id_01"); err != nil {
+		t.Fatalf("RemoveClient: %s", err)
+	}
+	if _, err := s.FindClientById("client_id_01"); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("FindClientById after removed:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+}
+
+func testAuthInfo(t *testing.T, s *Store, uid int64) {
+	details := []authorization.Detail{{"type": "payment_initiation", "amount": "10"}}
+	info, err := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid", details)
+	if err != nil {
+		t.Fatalf("CreateOrUpdateAuthInfo: %s", err)
+	}
+	if len(info.GetAuthorizationDetails()) != 1 {
+		t.Errorf("AuthorizationDetails:\n - got: %v\n - want: %v\n", info.GetAuthorizationDetails(), details)
+	}
+	updated, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid profile", nil)
+	if updated.GetId() != info.GetId() || updated.GetScope() != "openid profile" {
+		t.Errorf("Updated:\n - got: %v, %v\n - want: %v, %v\n",
+			updated.GetId(), updated.GetScope(), info.GetId(), "openid profile")
+	}
+	if _, err := s.CreateOrUpdateAuthInfo(uid+100, "client_id_01", "openid", nil); err == nil {
+		t.Errorf("Unknown user:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+
+	u, _ := s.CreateUser("user02", "pass02")
+	other, _ := s.CreateOrUpdateAuthInfo(u.Id, "client_id_01", "openid", nil)
+	if other.GetId() == info.GetId() {
+		t.Errorf("Other user's ID:\n - got: %v\n - want: not %v\n", other.GetId(), info.GetId())
+	}
+	found, _ := s.FindAuthInfoByUserIdAndClientId(uid, "client_id_01")
+	if found == nil || found.GetId() != info.GetId() {
+		t.Errorf("FindAuthInfoByUserIdAndClientId:\n - got: %v\n - want: %v\n", found, info)
+	}
+	if _, err := s.FindActiveAuthInfoById(info.GetId()); err != nil {
+		t.Errorf("FindActiveAuthInfoById:\n - got: %v\n - want: %v\n", err, nil)
+	}
+}
+
+func testAuthSession(t *testing.T, s *Store, uid int64) {
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid", nil)
+	session := &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   60,
+		AuthTime:    1000,
+		Resources:   []string{"https://api.example.org/"},
+	}
+	if err := s.CreateAuthSession(info, session); err != nil {
+		t.Fatalf("CreateAuthSession: %s", err)
+	}
+	if err := s.CreateAuthSession(info, session); err == nil {
+		t.Errorf("Duplicated code:\n - got: %v\n - want: %v\n", err, bridge.ErrServerError)
+	}
+
+	sess, err := s.FindAuthSessionByCode("code_value")
+	if err != nil {
+		t.Fatalf("FindAuthSessionByCode: %s", err)
+	}
+	if len(sess.GetResources()) != 1 || sess.GetAuthTime() != 1000 {
+		t.Errorf("Session:\n - got: %v, %v\n - want: %v, %v\n",
+			sess.GetResources(), sess.GetAuthTime(), session.Resources, 1000)
+	}
+
+	// only one of the concurrent redemptions succeeds
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	disabled := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.DisableSession(sess); err == nil {
+				mu.Lock()
+				disabled++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if disabled != 1 {
+		t.Errorf("Disabled:\n - got: %v\n - want: %v\n", disabled, 1)
+	}
+	if err := s.DisableSession(sess); err == nil || err.Type() != bridge.ErrFailed {
+		t.Errorf("DisableSession twice:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+
+	s.CreateAuthSession(info, &authorization.Session{Code: "expired", ExpiresIn: 60})
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1060))
+	if _, err := s.FindAuthSessionByCode("expired"); err == nil {
+		t.Errorf("FindAuthSessionByCode after expiry:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+}
+
+func testRefreshAccessToken(t *testing.T, s *Store, uid int64) {
+	s.SetPolicy(&record.Policy{
+		AccessTokenExpiresIn:  60,
+		RefreshTokenExpiresIn: 600,
+		RotateRefreshToken:    true,
+		AccessTokenGenerator:  &tokengen.Generator{Prefix: "at_", Checksum: true},
+		RefreshTokenGenerator: &tokengen.Generator{Prefix: "rt_", Checksum: true},
+	})
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid offline_access", nil)
+	token, err := s.CreateOAuthToken(info, true, []string{"https://api.example.org/"}, nil)
+	if err != nil || token.GetRefreshToken() == "" {
+		t.Fatalf("CreateOAuthToken: %v, %v", token, err)
+	}
+
+	// only one of the concurrent refreshes succeeds
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	refreshed := make([]bridge.OAuthToken, 0)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rt, err := s.RefreshAccessToken(info, token, nil, nil); err == nil {
+				mu.Lock()
+				refreshed = append(refreshed, rt)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(refreshed) != 1 {
+		t.Fatalf("Refreshed:\n - got: %v\n - want: %v\n", len(refreshed), 1)
+	}
+
+	if _, err := s.FindOAuthTokenByAccessToken(token.GetAccessToken()); err == nil {
+		t.Errorf("Old access_token:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+	if _, err := s.FindOAuthTokenByRefreshToken(token.GetRefreshToken()); err == nil {
+		t.Errorf("Old refresh_token:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+	found, err := s.FindOAuthTokenByRefreshToken(refreshed[0].GetRefreshToken())
+	if err != nil {
+		t.Fatalf("New refresh_token:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	if found.GetAccessToken() != refreshed[0].GetAccessToken() || len(found.GetResources()) != 1 {
+		t.Errorf("Refreshed token:\n - got: %v\n - want: %v\n", found, refreshed[0])
+	}
+
+	// authorization_details are kept on each token
+	details := []authorization.Detail{{"type": "account_information"}}
+	detailed, err := s.CreateOAuthToken(info, true, nil, details)
+	if err != nil {
+		t.Fatalf("CreateOAuthToken:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	found, err = s.FindOAuthTokenByAccessToken(detailed.GetAccessToken())
+	if err != nil || !authorization.SameDetails(found.GetAuthorizationDetails(), details) {
+		t.Errorf("authorization_details:\n - got: %v, %v\n - want: %v\n",
+			found, err, details)
+	}
+	detailed, err = s.RefreshAccessToken(info, detailed, nil, nil)
+	if err != nil {
+		t.Fatalf("RefreshAccessToken:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	found, err = s.FindOAuthTokenByAccessToken(detailed.GetAccessToken())
+	if err != nil || len(found.GetAuthorizationDetails()) != 0 {
+		t.Errorf("Refreshed authorization_details:\n - got: %v, %v\n - want: %v\n",
+			found, err, nil)
+	}
+	for _, v := range []string{token.GetAccessToken(), refreshed[0].GetAccessToken()} {
+		if !strings.HasPrefix(v, "at_") {
+			t.Errorf("access_token:\n - got: %v\n - want: %v\n", v, "at_...")
+		}
+	}
+	for _, v := range []string{token.GetRefreshToken(), refreshed[0].GetRefreshToken()} {
+		if !strings.HasPrefix(v, "rt_") {
+			t.Errorf("refresh_token:\n - got: %v\n - want: %v\n", v, "rt_...")
+		}
+	}
+}
+
+func testRecordAssertionClaimsAndEvict(t *testing.T, s *Store, uid int64) {
+	s.SetPolicy(&record.Policy{AccessTokenExpiresIn: 60, RefreshTokenExpiresIn: 600})
+
+	if err := s.RecordAssertionClaims("client_id_01", "jti01", 1000, 1060); err != nil {
+		t.Errorf("RecordAssertionClaims:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	if err := s.RecordAssertionClaims("client_id_01", "jti01", 1000, 1060); err == nil ||
+		err.Type() != bridge.ErrFailed {
+		t.Errorf("Replayed:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+	if err := s.RecordAssertionClaims("client_id_02", "jti01", 1000, 1060); err != nil {
+		t.Errorf("RecordAssertionClaims by other client:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.RecordAssertionClaims("client_id_01", "", 1000, 1060); err != nil {
+			t.Errorf("RecordAssertionClaims without jti:\n - got: %v\n - want: %v\n", err, nil)
+		}
+	}
+
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "openid offline_access", nil)
+	long, _ := s.CreateOAuthToken(info, true, nil, nil)
+	short, _ := s.CreateOAuthToken(info, false, nil, nil)
+	s.CreateAuthSession(info, &authorization.Session{Code: "code_value", ExpiresIn: 60})
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1059))
+	if n, err := s.Evict(); err != nil || n != 0 {
+		t.Errorf("Evicted before expiry:\n - got: %v, %v\n - want: %v\n", n, err, 0)
+	}
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1060))
+	if n, err := s.Evict(); err != nil || n != 4 {
+		t.Errorf("Evicted:\n - got: %v, %v\n - want: %v\n", n, err, 4)
+	}
+	if _, err := s.FindOAuthTokenByAccessToken(short.GetAccessToken()); err == nil {
+		t.Errorf("Evicted token:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+	// the refresh_token keeps the token until it expires
+	if _, err := s.FindOAuthTokenByRefreshToken(long.GetRefreshToken()); err != nil {
+		t.Errorf("Token with refresh_token:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	// jti can be used again after expiry
+	if err := s.RecordAssertionClaims("client_id_01", "jti01", 1060, 1120); err != nil {
+		t.Errorf("RecordAssertionClaims after expiry:\n - got: %v\n - want: %v\n", err, nil)
+	}
+
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1600))
+	if n, err := s.Evict(); err != nil || n != 2 {
+		t.Errorf("Evicted with refresh_token:\n - got: %v, %v\n - want: %v\n", n, err, 2)
+	}
+}
+
+func testTokenEndpoint(t *testing.T, s *Store, uid int64) {
+	s.SetTimeBuilder(io.NowBuilder())
+	info, _ := s.CreateOrUpdateAuthInfo(uid, "client_id_01", "offline_access", nil)
+	s.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   60,
+		AuthTime:    time.Now().Unix(),
+	})
+
+	te := goidc.NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+	te.Support(grant.Password())
+	te.Support(grant.RefreshToken())
+
+	ts := httptest.NewServer(te.Handler(s))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+		"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+	}
+	values := map[string]string{
+		"grant_type":   "authorization_code",
+		"code":         "code_value",
+		"redirect_uri": "http://example.org/callback",
+	}
+
+	res := th.PostFormValueRequestWithJSONResponse(t, ts, values, headers, 200,
+		map[string]th.Matcher{})
+	rt, _ := res["refresh_token"].(string)
+	if rt == "" {
+		t.Fatalf("refresh_token not found: %v", res)
+	}
+
+	// the code is redeemed only once
+	th.TokenEndpointErrorTest(t, ts, values, headers, 400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{"error": th.NewStrMatcher("invalid_grant")})
+
+	th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": rt,
+		}, headers, 200, map[string]th.Matcher{})
+
+	th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type": "password",
+			"scope":      "offline_access",
+			"username":   "user01",
+			"password":   "pass01",
+		}, headers, 200, map[string]th.Matcher{})
+}
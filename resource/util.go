@@ -0,0 +1,61 @@
+package resource
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RFC8707 Resource Indicators for OAuth 2.0
+
+// FromRequest returns all the 'resource' parameters in the request.
+// The parameter can be repeated to indicate multiple resources.
+func FromRequest(r *http.Request) []string {
+	r.ParseForm()
+	list := make([]string, 0)
+	for _, v := range r.Form["resource"] {
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Validate checks if the value is an absolute URI without fragment.
+// RFC8707 2. Resource Parameter
+func Validate(resource string) error {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() {
+		return errors.New("'resource' must be an absolute URI")
+	}
+	if u.Fragment != "" || strings.Contains(resource, "#") {
+		return errors.New("'resource' must not include a fragment component")
+	}
+	return nil
+}
+
+func Include(resources []string, target string) bool {
+	for _, r := range resources {
+		if r == target {
+			return true
+		}
+	}
+	return false
+}
+
+func IncludeAll(resources []string, targets []string) (bool, string) {
+	for _, t := range targets {
+		if !Include(resources, t) {
+			return false, t
+		}
+	}
+	return true, ""
+}
+
+func Join(resources []string) string {
+	return strings.Join(resources, " ")
+}
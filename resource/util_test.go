@@ -0,0 +1,48 @@
+package resource
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if err := Validate("https://api.example.org/"); err != nil {
+		t.Errorf("absolute URI should be accepted: %s", err)
+	}
+	if err := Validate("/relative"); err == nil {
+		t.Error("relative URI should be rejected")
+	}
+	if err := Validate("https://api.example.org/#frag"); err == nil {
+		t.Error("URI with fragment should be rejected")
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	form := url.Values{}
+	form.Add("resource", "https://api1.example.org/")
+	form.Add("resource", "https://api2.example.org/")
+	r, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	actual := FromRequest(r)
+	if len(actual) != 2 || actual[0] != "https://api1.example.org/" ||
+		actual[1] != "https://api2.example.org/" {
+		t.Errorf("FromRequest:\n - got: %v\n", actual)
+	}
+}
+
+func TestIncludeAll(t *testing.T) {
+	granted := []string{"https://api1.example.org/", "https://api2.example.org/"}
+	if ok, _ := IncludeAll(granted, []string{"https://api2.example.org/"}); !ok {
+		t.Error("IncludeAll should success")
+	}
+	ok, notFound := IncludeAll(granted, []string{"https://api3.example.org/"})
+	if ok {
+		t.Error("IncludeAll should fail")
+	}
+	if notFound != "https://api3.example.org/" {
+		t.Errorf("IncludeAll:\n - got: %v\n - want: %v\n", notFound, "https://api3.example.org/")
+	}
+}
@@ -1,41 +1,130 @@
 package goidc
 
 import (
+	"context"
 	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lyokato/goidc/audit"
+	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/bridge"
 	"github.com/lyokato/goidc/io"
 	"github.com/lyokato/goidc/log"
+	"github.com/lyokato/goidc/metrics"
 	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/resource"
 	"github.com/lyokato/goidc/scope"
+	"github.com/lyokato/goidc/subject"
+	"github.com/lyokato/goidc/tracing"
 )
 
+// headers set by ResourceProtector when legacy headers are enabled.
+// They are always removed from incoming requests.
+var legacyPrincipalHeaders = []string{
+	"X-OAUTH-USER-ID",
+	"X-OAUTH-CLIENT-ID",
+	"X-OAUTH-SCOPE",
+	"X-OAUTH-AUDIENCE",
+	"X-OAUTH-AUTHORIZATION-DETAILS",
+}
+
 type ResourceProtector struct {
 	realm                 string
+	resource              string
 	logger                log.Logger
 	errorURIBuilder       oer.OAuthErrorURIBuilder
 	tokenAcceptanceMethod CredentialAcceptanceMethod
 	currentTime           io.TimeBuilder
+	subjectStrategy       subject.Strategy
+	scopeRules            *ScopeRules
+	legacyHeaders         bool
+	auditSink             audit.Sink
+	metrics               metrics.Metrics
+	tracer                tracing.Tracer
 }
 
 func NewResourceProtector(realm string) *ResourceProtector {
 	return &ResourceProtector{
 		realm:                 realm,
-		logger:                log.NewDefaultLogger(),
+		logger:                log.Adapt(log.NewDefaultLogger()),
 		tokenAcceptanceMethod: FromHeader,
 		currentTime:           io.NowBuilder(),
+		subjectStrategy:       subject.Public(),
+	}
+}
+
+// Middleware returns a handler wrapper, which calls next only when
+// the access_token is valid. next can get the Principal with PrincipalFromRequest.
+func (rp *ResourceProtector) Middleware(sdi bridge.DataInterface) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := rp.validate(w, r, &TokenValidationOptions{DataInterface: sdi}); ok {
+				next.ServeHTTP(w, r.WithContext(NewContextWithPrincipal(r.Context(), p)))
+			}
+		})
+	}
+}
+
+// MiddlewareContext is Middleware which passes the context of each request to cdi.
+func (rp *ResourceProtector) MiddlewareContext(cdi bridge.ContextDataInterface) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := rp.validate(w, r, &TokenValidationOptions{ContextDataInterface: cdi}); ok {
+				next.ServeHTTP(w, r.WithContext(NewContextWithPrincipal(r.Context(), p)))
+			}
+		})
 	}
 }
 
+// EnableLegacyHeaders makes Validate set X-OAUTH-USER-ID, X-OAUTH-CLIENT-ID
+// and so on to the request, for handlers which haven't moved to Principal yet.
+// The values sent by the client are removed in any case.
+func (rp *ResourceProtector) EnableLegacyHeaders(enabled bool) {
+	rp.legacyHeaders = enabled
+}
+
+// SetAuditSink makes the protector record rejected access tokens.
+func (rp *ResourceProtector) SetAuditSink(sink audit.Sink) {
+	rp.auditSink = sink
+}
+
+// SetMetrics makes the protector report validations and DataInterface calls to m.
+func (rp *ResourceProtector) SetMetrics(m metrics.Metrics) {
+	rp.metrics = m
+}
+
+// SetTracer makes the protector start a span for each validation,
+// and the child spans for DataInterface calls.
+func (rp *ResourceProtector) SetTracer(t tracing.Tracer) {
+	rp.tracer = t
+}
+
+// SetScopeRules makes Validate check the scope and ACR required
+// for the request's method and path.
+func (rp *ResourceProtector) SetScopeRules(rules *ScopeRules) {
+	rp.scopeRules = rules
+}
+
+func (rp *ResourceProtector) SetSubjectStrategy(strategy subject.Strategy) {
+	rp.subjectStrategy = strategy
+}
+
 func (rp *ResourceProtector) AcceptAccessToken(meth CredentialAcceptanceMethod) {
 	rp.tokenAcceptanceMethod = meth
 }
 
+// SetResource sets the URI which identifies this resource server (RFC8707).
+// Access tokens restricted to other resources are rejected.
+func (rp *ResourceProtector) SetResource(uri string) {
+	rp.resource = uri
+}
+
 func (rp *ResourceProtector) SetLogger(l log.Logger) {
-	rp.logger = l
+	rp.logger = log.Adapt(l)
 }
 
 func (rp *ResourceProtector) SetTimeBuilder(builder io.TimeBuilder) {
@@ -50,50 +139,82 @@ func (rp *ResourceProtector) SetErrorURIBulder(builder oer.OAuthErrorURIBuilder)
 	rp.errorURIBuilder = builder
 }
 
-func (rp *ResourceProtector) findTokenFromRequest(r *http.Request) string {
-	header := r.Header.Get("Authorization")
-	if header == "" {
-		return ""
+// findTokenFromRequest reads access_token with the methods
+// allowed by AcceptAccessToken. RFC6750 2. Authenticated Requests
+func (rp *ResourceProtector) findTokenFromRequest(r *http.Request) (string, *oer.OAuthError) {
+
+	found := make([]string, 0)
+
+	// 2.1. Authorization Request Header Field
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, oerr := BearerTokenFromAuthorization(header)
+		if oerr != nil {
+			return "", oerr
+		}
+		if token != "" {
+			found = append(found, token)
+		}
 	}
-	parts := strings.Split(header, " ")
-	if len(parts) < 2 {
-		return ""
+
+	// 2.2. Form-Encoded Body Parameter
+	if rp.tokenAcceptanceMethod == FromHeaderAndPostBody ||
+		rp.tokenAcceptanceMethod == FromAll {
+		if r.Method != "GET" && isFormURLEncoded(r) {
+			r.ParseForm()
+			values := r.PostForm["access_token"]
+			if len(values) > 1 {
+				return "", oer.NewOAuthError(oer.ErrInvalidRequest,
+					"multiple 'access_token' parameters in request body")
+			}
+			if len(values) == 1 && values[0] != "" {
+				found = append(found, values[0])
+			}
+		}
 	}
-	if strings.ToLower(parts[0]) != "bearer" {
-		return ""
+
+	// 2.3. URI Query Parameter
+	if rp.tokenAcceptanceMethod == FromAll {
+		values := r.URL.Query()["access_token"]
+		if len(values) > 1 {
+			return "", oer.NewOAuthError(oer.ErrInvalidRequest,
+				"multiple 'access_token' parameters in query")
+		}
+		if len(values) == 1 && values[0] != "" {
+			found = append(found, values[0])
+		}
 	}
-	token := parts[1]
-	if token != "" {
-		return token
+
+	if len(found) > 1 {
+		return "", oer.NewOAuthError(oer.ErrInvalidRequest,
+			"access_token must not be sent with more than one method")
 	}
-	switch rp.tokenAcceptanceMethod {
-	case FromHeader:
-		return ""
-	case FromHeaderAndPostBody:
-		return r.PostFormValue("access_token")
-	case FromAll:
-		return r.FormValue("access_token")
-	default:
-		return ""
+	if len(found) == 0 {
+		return "", nil
 	}
+	return found[0], nil
+}
+
+func isFormURLEncoded(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/x-www-form-urlencoded"
 }
 
 func (rp *ResourceProtector) ValidateWithScopes(w http.ResponseWriter, r *http.Request,
 	sdi bridge.DataInterface, scopeMap map[string][]string) bool {
 
-	if !rp.Validate(w, r, sdi) {
+	p, ok := rp.validate(w, r, &TokenValidationOptions{DataInterface: sdi})
+	if !ok {
 		return false
 	}
 
 	if scopes, exists := scopeMap[r.URL.Path]; exists {
-		s := r.Header.Get("X-OAUTH-SCOPE")
-		ok, not_found := scope.IncludeAll(s, scopes)
+		ok, not_found := scope.IncludeAll(p.Scope, scopes)
 		if ok {
 			return true
 		} else {
-			rp.unauthorize(w, oer.NewOAuthError(oer.ErrInsufficientScope,
+			rp.unauthorize(w, oer.NewInsufficientScopeError(
 				fmt.Sprintf("this endpoint requires %s scope, but the access_token was't issued for.",
-					strconv.Quote(not_found))))
+					strconv.Quote(not_found)), strings.Join(scopes, " ")))
 			return false
 		}
 	} else {
@@ -101,148 +222,398 @@ func (rp *ResourceProtector) ValidateWithScopes(w http.ResponseWriter, r *http.R
 	}
 }
 
+// Validate checks the access_token, and returns the Principal,
+// or writes the error response when it's invalid.
+// It's a thin adapter of ValidateToken for net/http, and doesn't modify the context of r,
+// use NewContextWithPrincipal or Middleware to pass Principal to the handler.
 func (rp *ResourceProtector) Validate(w http.ResponseWriter, r *http.Request,
-	sdi bridge.DataInterface) bool {
+	sdi bridge.DataInterface) (*Principal, bool) {
+	return rp.validate(w, r, &TokenValidationOptions{DataInterface: sdi})
+}
+
+// ValidateContext is Validate which passes the context of r to cdi.
+func (rp *ResourceProtector) ValidateContext(w http.ResponseWriter, r *http.Request,
+	cdi bridge.ContextDataInterface) (*Principal, bool) {
+	return rp.validate(w, r, &TokenValidationOptions{ContextDataInterface: cdi})
+}
+
+func (rp *ResourceProtector) validate(w http.ResponseWriter, r *http.Request,
+	opts *TokenValidationOptions) (*Principal, bool) {
+
+	start := time.Now()
+	logger := log.ForRequest(rp.logger, r)
 
-	rt := rp.findTokenFromRequest(r)
+	for _, h := range legacyPrincipalHeaders {
+		r.Header.Del(h)
+	}
+
+	rt, oerr := rp.findTokenFromRequest(r)
+	if oerr != nil {
+
+		logger.Debug(log.ProtectedResourceEntry(r.URL.Path,
+			log.InvalidCredential,
+			map[string]string{},
+			oerr.Description))
+
+		_, span := rp.startSpan(tracing.Extract(r.Context(), r.Header))
+		rp.observe(start, span, nil, oerr)
+		rp.unauthorize(w, oerr)
+		return nil, false
+	}
 
 	if rt == "" {
 
-		rp.logger.Debug(log.TokenEndpointLog(r.URL.Path,
+		logger.Debug(log.ProtectedResourceEntry(r.URL.Path,
 			log.NoCredential,
 			map[string]string{},
 			"access_token not found in request."))
 
-		rp.unauthorize(w, oer.NewOAuthSimpleError(oer.ErrInvalidRequest))
-		return false
+		oerr = oer.NewOAuthSimpleError(oer.ErrInvalidRequest)
+		_, span := rp.startSpan(tracing.Extract(r.Context(), r.Header))
+		rp.observe(start, span, nil, oerr)
+		rp.unauthorize(w, oerr)
+		return nil, false
+	}
+
+	opts.Method = r.Method
+	opts.Path = r.URL.Path
+	opts.RequestId = r.Header.Get(log.RequestIdHeader)
+	p, oerr := rp.ValidateToken(tracing.Extract(r.Context(), r.Header), rt, opts)
+	if oerr != nil {
+		rp.unauthorize(w, oerr)
+		return nil, false
+	}
+
+	if rp.legacyHeaders {
+		r.Header.Set("X-OAUTH-USER-ID", fmt.Sprintf("%d", p.UserId))
+		r.Header.Set("X-OAUTH-CLIENT-ID", p.ClientId)
+		r.Header.Set("X-OAUTH-SCOPE", p.Scope)
+		r.Header.Set("X-OAUTH-AUDIENCE", resource.Join(p.Audience))
+		r.Header.Set("X-OAUTH-AUTHORIZATION-DETAILS",
+			authorization.EncodeDetails(p.AuthorizationDetails))
+	}
+
+	return p, true
+}
+
+// TokenValidationOptions describes where the access_token comes from.
+// ContextDataInterface is preferred to DataInterface when both are set.
+// Method and Path are matched against ScopeRules, and the rules are
+// skipped when Path is empty.
+type TokenValidationOptions struct {
+	DataInterface        bridge.DataInterface
+	ContextDataInterface bridge.ContextDataInterface
+	Method               string
+	Path                 string
+	// attached to the logs when the logger supports it
+	RequestId string
+}
+
+// ValidateToken checks the access_token without depending on net/http,
+// for gRPC metadata, WebSocket upgrades, message-queue consumers and so on.
+// The returned error is ErrServerError or ErrTemporarilyUnavailable
+// when DataInterface fails, and it should not be rendered as a challenge.
+// nil opts is the zero TokenValidationOptions, and the one without
+// any DataInterface results in ErrServerError.
+func (rp *ResourceProtector) ValidateToken(ctx context.Context, token string,
+	opts *TokenValidationOptions) (*Principal, *oer.OAuthError) {
+
+	if opts == nil {
+		opts = &TokenValidationOptions{}
+	}
+	start := time.Now()
+	ctx, span := rp.startSpan(ctx)
+	logger := log.WithRequestId(rp.logger, opts.RequestId)
+
+	sdi := opts.DataInterface
+	if opts.ContextDataInterface != nil {
+		sdi = bridge.BindDataInterface(ctx, opts.ContextDataInterface)
+	}
+
+	var p *Principal
+	var oerr *oer.OAuthError
+	if sdi == nil {
+		logger.Error(log.ProtectedResourceEntry(opts.Path,
+			log.InterfaceError,
+			map[string]string{},
+			"no DataInterface in TokenValidationOptions."))
+		oerr = oer.NewOAuthSimpleError(oer.ErrServerError)
+	} else {
+		p, oerr = rp.validateToken(logger,
+			observeDataInterface(ctx, sdi, rp.metrics, rp.tracer), token, opts)
 	}
+	rp.observe(start, span, p, oerr)
+	if oerr != nil && oerr.Type != oer.ErrServerError &&
+		oerr.Type != oer.ErrTemporarilyUnavailable {
+		e := audit.NewEvent(audit.AccessDenied, rp.currentTime(), audit.Failure)
+		if p != nil {
+			e.ByClient(p.ClientId).For(p.ClientId, p.UserId, p.Scope)
+		}
+		e.Reason = oerr.Error()
+		audit.Record(rp.auditSink, logger, e)
+	}
+	if oerr != nil {
+		return nil, oerr
+	}
+	return p, nil
+}
+
+func (rp *ResourceProtector) startSpan(ctx context.Context) (context.Context, tracing.Span) {
+	if rp.tracer == nil {
+		return ctx, nil
+	}
+	return rp.tracer.Start(ctx, "goidc."+metrics.EndpointProtectedResource,
+		tracing.String(tracing.AttrEndpoint, metrics.EndpointProtectedResource))
+}
+
+func (rp *ResourceProtector) observe(start time.Time, span tracing.Span,
+	p *Principal, oerr *oer.OAuthError) {
+	cid := ""
+	if p != nil {
+		cid = p.ClientId
+	}
+	errType := ""
+	if oerr != nil {
+		errType = oerr.Type.String()
+	}
+	if rp.metrics != nil {
+		rp.metrics.ObserveRequest(metrics.EndpointProtectedResource, "", cid, errType,
+			time.Since(start))
+	}
+	if span != nil {
+		endRequestSpan(span, "", cid, "", errType)
+	}
+}
+
+// validateToken returns Principal with the error
+// when the token is valid but the scope rules aren't satisfied.
+func (rp *ResourceProtector) validateToken(logger log.Logger, sdi bridge.DataInterface,
+	token string, opts *TokenValidationOptions) (*Principal, *oer.OAuthError) {
 
-	at, err := sdi.FindOAuthTokenByAccessToken(rt)
+	at, err := sdi.FindOAuthTokenByAccessToken(token)
 	if err != nil {
 		if err.Type() == bridge.ErrFailed {
 
-			rp.logger.Info(log.ProtectedResourceLog(r.URL.Path,
+			logger.Info(log.ProtectedResourceEntry(opts.Path,
 				log.AuthenticationFailed,
-				map[string]string{
-					"access_token":    rt,
-					"remote_addr":     r.Header.Get("REMOTE_ADDR"),
-					"x-forwarded-for": r.Header.Get("X-FORWARDED-FOR"),
-				}, "'access_token' not found."))
+				map[string]string{"access_token": token},
+				"'access_token' not found."))
 
-			rp.unauthorize(w, oer.NewOAuthSimpleError(oer.ErrInvalidToken))
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrInvalidToken)
 
 		} else if err.Type() == bridge.ErrUnsupported {
 
-			rp.logger.Error(log.ProtectedResourceLog(r.URL.Path,
+			logger.Error(log.ProtectedResourceEntry(opts.Path,
 				log.InterfaceUnsupported,
 				map[string]string{"method": "FindOAuthTokenByAccessToken"},
 				"the method returns 'unsupported' error."))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 
 		} else {
 
-			rp.logger.Warn(log.ProtectedResourceLog(r.URL.Path,
+			logger.Warn(log.ProtectedResourceEntry(opts.Path,
 				log.InterfaceServerError,
 				map[string]string{
 					"method":       "FindOAuthTokenByAccessToken",
-					"access_token": rt,
+					"access_token": token,
 				},
-				"interface returned ServerError."))
+				fmt.Sprintf("interface returned error: %s", err)))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewInterfaceError(err)
 		}
 	} else {
 		if at == nil {
 
-			rp.logger.Error(log.ProtectedResourceLog(r.URL.Path, log.InterfaceError,
+			logger.Error(log.ProtectedResourceEntry(opts.Path, log.InterfaceError,
 				map[string]string{"method": "FindOAuthTokenByAccessToken"},
 				"the method returns (nil, nil)."))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 		}
 	}
 
 	if at.GetRefreshedAt()+at.GetAccessTokenExpiresIn() < rp.currentTime().Unix() {
-		rp.logger.Info(log.TokenEndpointLog(r.URL.Path,
+		logger.Info(log.ProtectedResourceEntry(opts.Path,
 			log.NoEnabledAuthInfo,
 			map[string]string{
-				"access_token":            rt,
+				"access_token":            token,
 				"refreshed_at":            fmt.Sprintf("%d", at.GetRefreshedAt()),
 				"access_token_expires_in": fmt.Sprintf("%d", at.GetAccessTokenExpiresIn()),
 				"current_time":            fmt.Sprintf("%d", rp.currentTime().Unix()),
 			}, "your access_token is expired."))
 
-		rp.unauthorize(w, oer.NewOAuthError(oer.ErrInvalidToken,
-			"your access_token is expired"))
-		return false
+		return nil, oer.NewOAuthError(oer.ErrInvalidToken,
+			"your access_token is expired")
+	}
+
+	aud := at.GetAudience()
+	if rp.resource != "" && len(aud) > 0 && !resource.Include(aud, rp.resource) {
+		logger.Info(log.ProtectedResourceEntry(opts.Path,
+			log.InvalidTarget,
+			map[string]string{
+				"access_token": token,
+				"audience":     resource.Join(aud),
+				"resource":     rp.resource,
+			}, "access_token is issued for other resources."))
+
+		return nil, oer.NewOAuthError(oer.ErrInvalidToken,
+			"your access_token is not issued for this resource")
 	}
 
 	info, err := sdi.FindActiveAuthInfoById(at.GetAuthId())
 	if err != nil {
 		if err.Type() == bridge.ErrFailed {
 
-			rp.logger.Info(log.TokenEndpointLog(r.URL.Path,
+			logger.Info(log.ProtectedResourceEntry(opts.Path,
 				log.NoEnabledAuthInfo,
 				map[string]string{
 					"method":       "FindActiveAuthInfoById",
-					"access_token": rt,
+					"access_token": token,
 				},
 				"no enabled auth info associated with this access_token."))
 
-			rp.unauthorize(w, oer.NewOAuthSimpleError(oer.ErrInvalidToken))
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrInvalidToken)
 
 		} else if err.Type() == bridge.ErrUnsupported {
 
-			rp.logger.Error(log.ProtectedResourceLog(r.URL.Path,
+			logger.Error(log.ProtectedResourceEntry(opts.Path,
 				log.InterfaceUnsupported,
 				map[string]string{"method": "FindActiveAuthInfoById"},
 				"the method returns 'unsupported' error."))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
 
 		} else {
 
-			rp.logger.Warn(log.TokenEndpointLog(r.URL.Path,
+			logger.Warn(log.ProtectedResourceEntry(opts.Path,
 				log.InterfaceServerError,
 				map[string]string{
 					"method":       "FindActiveAuthInfoById",
-					"access_token": rt,
+					"access_token": token,
 				},
-				"interface returned ServerError"))
+				fmt.Sprintf("interface returned error: %s", err)))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewInterfaceError(err)
 		}
 	} else {
-		if at == nil {
+		if info == nil {
 
-			rp.logger.Error(log.ProtectedResourceLog(r.URL.Path, log.InterfaceError,
+			logger.Error(log.ProtectedResourceEntry(opts.Path, log.InterfaceError,
 				map[string]string{"method": "FindActiveAuthInfoById"},
 				"the method returns (nil, nil)."))
 
-			w.WriteHeader(http.StatusInternalServerError)
-			return false
+			return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+		}
+	}
+
+	sub, oerr := rp.findSubject(logger, opts.Path, sdi, info)
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	p := &Principal{
+		UserId:               info.GetUserId(),
+		Subject:              sub,
+		ClientId:             info.GetClientId(),
+		Scope:                info.GetScope(),
+		Audience:             aud,
+		AuthorizationDetails: at.GetAuthorizationDetails(),
+		ExpiresAt:            at.GetRefreshedAt() + at.GetAccessTokenExpiresIn(),
+		AuthTime:             info.GetAuthorizedAt(),
+		ACR:                  info.GetACR(),
+	}
+	if rp.scopeRules != nil && opts.Path != "" {
+		if oerr := rp.scopeRules.Check(opts.Method, opts.Path, p); oerr != nil {
+
+			logger.Info(log.ProtectedResourceEntry(opts.Path,
+				log.ScopeConditionMismatch,
+				map[string]string{
+					"method":    opts.Method,
+					"client_id": p.ClientId,
+					"scope":     p.Scope,
+				}, oerr.Error()))
+
+			return p, oerr
 		}
 	}
 
-	r.Header.Set("X-OAUTH-USER-ID", fmt.Sprintf("%d", info.GetUserId()))
-	r.Header.Set("X-OAUTH-CLIENT-ID", info.GetClientId())
-	r.Header.Set("X-OAUTH-SCOPE", info.GetScope())
+	return p, nil
+}
+
+// findSubject looks up the client only when the strategy needs it.
+func (rp *ResourceProtector) findSubject(logger log.Logger, path string, sdi bridge.DataInterface,
+	info bridge.AuthInfo) (string, *oer.OAuthError) {
+
+	var clnt bridge.Client
+	if rp.subjectStrategy.Type() != subject.TypePublic {
+		c, serr := sdi.FindClientById(info.GetClientId())
+		if serr != nil || c == nil {
+
+			logger.Warn(log.ProtectedResourceEntry(path,
+				log.InterfaceError,
+				map[string]string{
+					"method":    "FindClientById",
+					"client_id": info.GetClientId(),
+				},
+				"client associated with the access_token not found."))
+
+			return "", oer.NewOAuthSimpleError(oer.ErrServerError)
+		}
+		clnt = c
+	}
 
-	return true
+	sub, err := rp.subjectStrategy.Subject(sdi, clnt, info)
+	if err != nil {
+
+		logger.Warn(log.ProtectedResourceEntry(path,
+			log.InterfaceError,
+			map[string]string{
+				"method":    "Subject",
+				"client_id": info.GetClientId(),
+			},
+			err.Error()))
+
+		return "", oer.NewOAuthSimpleError(oer.ErrServerError)
+	}
+	return sub, nil
 }
 
-func (rp *ResourceProtector) unauthorize(w http.ResponseWriter, err *oer.OAuthError) {
+// Challenge returns the value of 'WWW-Authenticate' and the status code for err,
+// for transports which render the error by themselves.
+// The value is empty for ErrServerError and ErrTemporarilyUnavailable,
+// and err.RetryAfter is set for the latter.
+func (rp *ResourceProtector) Challenge(err *oer.OAuthError) (string, int) {
+	if err.Type == oer.ErrServerError || err.Type == oer.ErrTemporarilyUnavailable {
+		return "", err.StatusCode()
+	}
 	if err.URI == "" && rp.errorURIBuilder != nil {
 		err.URI = rp.errorURIBuilder(err.Type)
 	}
-	w.Header().Set("WWW-Authenticate", err.Header(rp.realm))
-	w.WriteHeader(err.StatusCode())
+	return err.Header(rp.realm), err.StatusCode()
+}
+
+func (rp *ResourceProtector) unauthorize(w http.ResponseWriter, err *oer.OAuthError) {
+	challenge, code := rp.Challenge(err)
+	if challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	err.SetRetryAfter(w.Header())
+	w.WriteHeader(code)
+}
+
+// BearerTokenFromAuthorization extracts the token from the value formatted
+// like 'Authorization' header, such as gRPC 'authorization' metadata.
+// It returns empty string when the scheme isn't 'Bearer'.
+func BearerTokenFromAuthorization(value string) (string, *oer.OAuthError) {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return "", nil
+	}
+	token := strings.TrimSpace(parts[1])
+	if token == "" {
+		return "", oer.NewOAuthError(oer.ErrInvalidRequest,
+			"empty bearer token in 'Authorization' header")
+	}
+	return token, nil
 }
@@ -1,34 +1,43 @@
 package goidc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/lyokato/goidc/audit"
 	"github.com/lyokato/goidc/bridge"
+	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/subject"
 	th "github.com/lyokato/goidc/test_helper"
 )
 
 func testProtectedResourceMiddleware(rp *ResourceProtector,
 	sdi bridge.DataInterface, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if rp.Validate(w, r, sdi) {
-			next.ServeHTTP(w, r)
-		}
-	})
+	return rp.Middleware(sdi)(next)
 }
 
 func testProtectedResourceHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	body, _ := json.Marshal(struct {
 		ClientId string `json:"client_id"`
 		Scope    string `json:"scope"`
 		UserId   string `json:"user_id"`
+		Subject  string `json:"sub"`
 	}{
-		r.Header.Get("X-OAUTH-CLIENT-ID"),
-		r.Header.Get("X-OAUTH-SCOPE"),
-		r.Header.Get("X-OAUTH-USER-ID"),
+		p.ClientId,
+		p.Scope,
+		fmt.Sprintf("%d", p.UserId),
+		p.Subject,
 	})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -40,8 +49,8 @@ func TestResourceProtector(t *testing.T) {
 	sdi := th.NewTestStore()
 	user := sdi.CreateNewUser("user01", "pass01")
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
-	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
-	token, _ := sdi.CreateOAuthToken(ai, true)
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
 
 	rp := NewResourceProtector("api.example.org")
 	ts := httptest.NewServer(testProtectedResourceMiddleware(
@@ -62,6 +71,7 @@ func TestResourceProtector(t *testing.T) {
 			"client_id": th.NewStrMatcher("client_id_01"),
 			"scope":     th.NewStrMatcher("openid profile offline_access"),
 			"user_id":   th.NewStrMatcher("0"),
+			"sub":       th.NewStrMatcher("0"),
 		})
 
 	th.ProtectedResourceErrorTest(t, ts, "POST",
@@ -82,3 +92,379 @@ func TestResourceProtector(t *testing.T) {
 			"WWW-Authenticate": th.NewStrMatcher("Bearer realm=\"api.example.org\", error=\"invalid_token\""),
 		})
 }
+
+func TestResourceProtectorWithAudience(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, []string{"https://api1.example.org/"}, nil)
+
+	rp := NewResourceProtector("api.example.org")
+	rp.SetResource("https://api2.example.org/")
+	ts := httptest.NewServer(testProtectedResourceMiddleware(
+		rp, sdi, http.HandlerFunc(testProtectedResourceHandler)))
+	defer ts.Close()
+
+	th.ProtectedResourceErrorTest(t, ts, "POST",
+		map[string]string{},
+		map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token.GetAccessToken()),
+		},
+		401,
+		map[string]th.Matcher{
+			"WWW-Authenticate": th.NewStrMatcher("Bearer realm=\"api.example.org\", error=\"invalid_token\", error_description=\"your access_token is not issued for this resource\""),
+		})
+
+	rp.SetResource("https://api1.example.org/")
+	th.ProtectedResourceSuccessTest(t, ts, "POST",
+		map[string]string{},
+		map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token.GetAccessToken()),
+		},
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json"),
+		},
+		map[string]th.Matcher{
+			"client_id": th.NewStrMatcher("client_id_01"),
+		})
+}
+
+func testLegacyHeadersHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(struct {
+		ClientId string `json:"client_id"`
+		Scope    string `json:"scope"`
+		UserId   string `json:"user_id"`
+	}{
+		r.Header.Get("X-OAUTH-CLIENT-ID"),
+		r.Header.Get("X-OAUTH-SCOPE"),
+		r.Header.Get("X-OAUTH-USER-ID"),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func TestResourceProtectorLegacyHeaders(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	rp := NewResourceProtector("api.example.org")
+	ts := httptest.NewServer(testProtectedResourceMiddleware(
+		rp, sdi, http.HandlerFunc(testLegacyHeadersHandler)))
+	defer ts.Close()
+
+	spoofed := map[string]string{
+		"Authorization":     fmt.Sprintf("Bearer %s", token.GetAccessToken()),
+		"X-OAUTH-USER-ID":   "999",
+		"X-OAUTH-CLIENT-ID": "spoofed_client",
+		"X-OAUTH-SCOPE":     "admin",
+	}
+
+	// disabled by default, and incoming values are removed
+	th.ProtectedResourceSuccessTest(t, ts, "POST",
+		map[string]string{},
+		spoofed,
+		200,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"client_id": th.NewStrMatcher(""),
+			"scope":     th.NewStrMatcher(""),
+			"user_id":   th.NewStrMatcher(""),
+		})
+
+	rp.EnableLegacyHeaders(true)
+	th.ProtectedResourceSuccessTest(t, ts, "POST",
+		map[string]string{},
+		spoofed,
+		200,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"client_id": th.NewStrMatcher("client_id_01"),
+			"scope":     th.NewStrMatcher("openid profile"),
+			"user_id":   th.NewStrMatcher("0"),
+		})
+}
+
+func TestResourceProtectorValidateKeepsRequest(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	rp := NewResourceProtector("api.example.org")
+	r := httptest.NewRequest("GET", "/userinfo", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.GetAccessToken()))
+	ctx := r.Context()
+
+	p, ok := rp.Validate(httptest.NewRecorder(), r, sdi)
+	if !ok {
+		t.Fatalf("Validate:\n - got: %v\n - want: %v\n", false, true)
+	}
+	if p.ClientId != "client_id_01" || p.AuthTime != ai.GetAuthorizedAt() {
+		t.Errorf("Principal:\n - got: %v\n - want: %v\n", p, "client_id_01")
+	}
+	if r.Context() != ctx {
+		t.Errorf("Context:\n - got: %v\n - want: %v\n", r.Context(), ctx)
+	}
+
+	var passed *http.Request
+	rp.Middleware(sdi)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed = r
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if passed == nil || passed == r {
+		t.Fatalf("Request passed to the handler:\n - got: %p\n - want: not %p\n", passed, r)
+	}
+	if p, ok := PrincipalFromRequest(passed); !ok || p.ClientId != "client_id_01" {
+		t.Errorf("Principal:\n - got: %v\n - want: %v\n", p, "client_id_01")
+	}
+	if _, ok := PrincipalFromRequest(r); ok {
+		t.Errorf("Principal of the original request:\n - got: %v\n - want: %v\n", ok, false)
+	}
+}
+
+func TestResourceProtectorUserIdSubject(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	sdi.CreateNewUser("user01", "pass01")
+	user := sdi.CreateNewUser("user02", "pass02")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid", nil)
+	ai.(*th.TestAuthInfo).SetSubject("user02_subject")
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	rp := NewResourceProtector("api.example.org")
+	rp.SetSubjectStrategy(subject.UserId())
+	p, oerr := rp.ValidateToken(context.Background(), token.GetAccessToken(),
+		&TokenValidationOptions{DataInterface: sdi})
+	if oerr != nil || p.Subject != "1" {
+		t.Errorf("Subject:\n - got: %v, %v\n - want: %v\n", p, oerr, "1")
+	}
+}
+
+func TestResourceProtectorWithScopeRules(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid read", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	rules := NewScopeRules()
+	rules.Add(ScopeRule{Pattern: "/users/{id}", Methods: []string{"GET"}, AllOf: []string{"read"}})
+	rules.Add(ScopeRule{Pattern: "/users/{id}", Methods: []string{"POST"}, AllOf: []string{"write"}})
+
+	sink := audit.NewMemorySink()
+
+	rp := NewResourceProtector("api.example.org")
+	rp.SetScopeRules(rules)
+	rp.SetAuditSink(sink)
+	ts := httptest.NewServer(testProtectedResourceMiddleware(
+		rp, sdi, http.HandlerFunc(testProtectedResourceHandler)))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", token.GetAccessToken()),
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/users/123", nil)
+	req.Header.Set("Authorization", headers["Authorization"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("failed http request: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status:\n - got: %d\n - want: %d\n", resp.StatusCode, http.StatusOK)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/users/123", nil)
+	req.Header.Set("Authorization", headers["Authorization"])
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("failed http request: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Status:\n - got: %d\n - want: %d\n", resp.StatusCode, http.StatusForbidden)
+	}
+	expected := "Bearer realm=\"api.example.org\", error=\"insufficient_scope\", error_description=\"this endpoint requires 'write' scope\", scope=\"write\""
+	if actual := resp.Header.Get("WWW-Authenticate"); actual != expected {
+		t.Errorf("WWW-Authenticate:\n - got: %v\n - want: %v\n", actual, expected)
+	}
+}
+
+func testTokenAcceptanceRequest(t *testing.T, ts *httptest.Server, method, query, body,
+	contentType, authorization string) *http.Response {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	url := ts.URL
+	if query != "" {
+		url = url + "?" + query
+	}
+	r, _ := http.NewRequest(method, url, reader)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Errorf("failed http request: %s", err)
+		return nil
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestResourceProtectorTokenAcceptance(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+	at := token.GetAccessToken()
+
+	rp := NewResourceProtector("api.example.org")
+	ts := httptest.NewServer(testProtectedResourceMiddleware(
+		rp, sdi, http.HandlerFunc(testProtectedResourceHandler)))
+	defer ts.Close()
+
+	form := "application/x-www-form-urlencoded; charset=UTF-8"
+	body := "access_token=" + at
+	query := "access_token=" + at
+
+	tests := []struct {
+		meth     CredentialAcceptanceMethod
+		method   string
+		query    string
+		body     string
+		ctype    string
+		auth     string
+		expected int
+	}{
+		// FromHeader
+		{FromHeader, "GET", "", "", "", "Bearer " + at, 200},
+		{FromHeader, "GET", "", "", "", "bearer " + at, 200},
+		{FromHeader, "GET", "", "", "", "BEARER " + at, 200},
+		{FromHeader, "GET", "", "", "", "Basic " + at, 400},
+		{FromHeader, "POST", "", body, form, "", 400},
+		{FromHeader, "GET", query, "", "", "", 400},
+		// FromHeaderAndPostBody
+		{FromHeaderAndPostBody, "GET", "", "", "", "Bearer " + at, 200},
+		{FromHeaderAndPostBody, "POST", "", body, form, "", 200},
+		{FromHeaderAndPostBody, "POST", "", body, "application/json", "", 400},
+		{FromHeaderAndPostBody, "GET", query, "", "", "", 400},
+		{FromHeaderAndPostBody, "POST", "", body, form, "Bearer " + at, 400},
+		{FromHeaderAndPostBody, "POST", "", body + "&" + body, form, "", 400},
+		// FromAll
+		{FromAll, "GET", "", "", "", "Bearer " + at, 200},
+		{FromAll, "POST", "", body, form, "", 200},
+		{FromAll, "GET", query, "", "", "", 200},
+		{FromAll, "GET", query, "", "", "Bearer " + at, 400},
+		{FromAll, "POST", query, body, form, "", 400},
+	}
+
+	for i, tt := range tests {
+		rp.AcceptAccessToken(tt.meth)
+		resp := testTokenAcceptanceRequest(t, ts, tt.method, tt.query, tt.body, tt.ctype, tt.auth)
+		if resp == nil {
+			continue
+		}
+		if resp.StatusCode != tt.expected {
+			t.Errorf("case %d: Status:\n - got: %d\n - want: %d\n", i, resp.StatusCode, tt.expected)
+		}
+	}
+}
+
+func TestResourceProtectorValidateToken(t *testing.T) {
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	ai, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid read", nil)
+	token, _ := sdi.CreateOAuthToken(ai, true, nil, nil)
+
+	rules := NewScopeRules()
+	rules.Add(ScopeRule{Pattern: "/admin/*", AllOf: []string{"admin"}})
+
+	sink := audit.NewMemorySink()
+
+	rp := NewResourceProtector("api.example.org")
+	rp.SetScopeRules(rules)
+	rp.SetAuditSink(sink)
+
+	p, oerr := rp.ValidateToken(context.Background(), token.GetAccessToken(),
+		&TokenValidationOptions{DataInterface: sdi, Method: "GET", Path: "/items"})
+	if oerr != nil {
+		t.Errorf("failed to validate token: %s", oerr)
+		return
+	}
+	if p.ClientId != "client_id_01" || p.Scope != "openid read" {
+		t.Errorf("Principal:\n - got: %v\n - want: %v\n", p, "client_id_01 / openid read")
+	}
+
+	_, oerr = rp.ValidateToken(context.Background(), token.GetAccessToken(),
+		&TokenValidationOptions{DataInterface: sdi, Method: "GET", Path: "/admin/users"})
+	if oerr == nil || oerr.Type != oer.ErrInsufficientScope {
+		t.Errorf("ValidateToken:\n - got: %v\n - want: %v\n", oerr, "insufficient_scope")
+	}
+
+	_, oerr = rp.ValidateToken(context.Background(), "unknown",
+		&TokenValidationOptions{DataInterface: sdi})
+	if oerr == nil {
+		t.Error("unknown token should be rejected")
+		return
+	}
+	challenge, code := rp.Challenge(oerr)
+	expected := "Bearer realm=\"api.example.org\", error=\"invalid_token\""
+	if challenge != expected || code != http.StatusUnauthorized {
+		t.Errorf("Challenge:\n - got: %v %d\n - want: %v %d\n",
+			challenge, code, expected, http.StatusUnauthorized)
+	}
+
+	challenge, code = rp.Challenge(oer.NewOAuthSimpleError(oer.ErrServerError))
+	if challenge != "" || code != http.StatusInternalServerError {
+		t.Errorf("Challenge:\n - got: %v %d\n - want: %v %d\n",
+			challenge, code, "", http.StatusInternalServerError)
+	}
+
+	denied := sink.FindByType(audit.AccessDenied)
+	if len(denied) != 2 || denied[0].ClientId != "client_id_01" || denied[1].ClientId != "" {
+		t.Errorf("unexpected events: %+v", denied)
+	}
+}
+
+func TestResourceProtectorValidateTokenWithoutOptions(t *testing.T) {
+	rp := NewResourceProtector("api.example.org")
+	if _, oerr := rp.ValidateToken(context.Background(), "token", nil); oerr == nil ||
+		oerr.Type != oer.ErrServerError {
+		t.Errorf("ValidateToken:\n - got: %v\n - want: %v\n", oerr, "server_error")
+	}
+}
+
+func TestBearerTokenFromAuthorization(t *testing.T) {
+	if token, oerr := BearerTokenFromAuthorization("bearer abc"); oerr != nil || token != "abc" {
+		t.Errorf("BearerTokenFromAuthorization:\n - got: %v\n - want: %v\n", token, "abc")
+	}
+	if token, oerr := BearerTokenFromAuthorization("Basic abc"); oerr != nil || token != "" {
+		t.Errorf("BearerTokenFromAuthorization:\n - got: %v\n - want: %v\n", token, "")
+	}
+	if _, oerr := BearerTokenFromAuthorization("Bearer  "); oerr == nil {
+		t.Error("empty bearer token should be rejected")
+	}
+}
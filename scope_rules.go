@@ -0,0 +1,181 @@
+package goidc
+
+import (
+	"fmt"
+	"strings"
+
+	oer "github.com/lyokato/goidc/oauth_error"
+)
+
+type (
+	// ScopeRule describes what an access_token needs for the requests
+	// matched to the Pattern and Methods.
+	//
+	// Pattern is a slash-separated path. A segment like '{id}' matches any
+	// single segment, and '*' at the end matches the rest of the path.
+	//   "/users/{id}", "/admin/*"
+	ScopeRule struct {
+		Pattern string
+		// empty means any method
+		Methods []string
+		// all of them are required
+		AllOf []string
+		// at least one of them is required
+		AnyOf []string
+		// at least one of them is required, empty means any ACR
+		ACRValues []string
+	}
+
+	// ScopeRules finds the first rule matched to the request,
+	// in the order they are added.
+	ScopeRules struct {
+		rules []*compiledScopeRule
+	}
+
+	compiledScopeRule struct {
+		rule     *ScopeRule
+		segments []string
+		wildcard bool
+	}
+)
+
+func NewScopeRules() *ScopeRules {
+	return &ScopeRules{
+		rules: make([]*compiledScopeRule, 0),
+	}
+}
+
+func (sr *ScopeRules) Add(rule ScopeRule) error {
+	if !strings.HasPrefix(rule.Pattern, "/") {
+		return fmt.Errorf("pattern should start with '/': %s", rule.Pattern)
+	}
+	segments := splitPath(rule.Pattern)
+	wildcard := false
+	for i, s := range segments {
+		if s == "*" {
+			if i != len(segments)-1 {
+				return fmt.Errorf("'*' is allowed only at the end of pattern: %s", rule.Pattern)
+			}
+			wildcard = true
+			segments = segments[:i]
+		}
+	}
+	methods := make([]string, len(rule.Methods))
+	for i, m := range rule.Methods {
+		methods[i] = strings.ToUpper(m)
+	}
+	rule.Methods = methods
+	sr.rules = append(sr.rules, &compiledScopeRule{
+		rule:     &rule,
+		segments: segments,
+		wildcard: wildcard,
+	})
+	return nil
+}
+
+// Match returns nil if no rule is matched.
+func (sr *ScopeRules) Match(method, path string) *ScopeRule {
+	segments := splitPath(path)
+	for _, c := range sr.rules {
+		if c.match(strings.ToUpper(method), segments) {
+			return c.rule
+		}
+	}
+	return nil
+}
+
+// Check returns nil when the principal satisfies the matched rule,
+// or there is no rule for the request.
+func (sr *ScopeRules) Check(method, path string, p *Principal) *oer.OAuthError {
+	rule := sr.Match(method, path)
+	if rule == nil {
+		return nil
+	}
+	return rule.Check(p)
+}
+
+func (rule *ScopeRule) Check(p *Principal) *oer.OAuthError {
+	for _, s := range rule.AllOf {
+		if !p.HasScope(s) {
+			return oer.NewInsufficientScopeError(
+				fmt.Sprintf("this endpoint requires '%s' scope", s),
+				rule.requiredScope())
+		}
+	}
+	if len(rule.AnyOf) > 0 {
+		found := false
+		for _, s := range rule.AnyOf {
+			if p.HasScope(s) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			required := strings.Join(rule.AnyOf, " ")
+			return oer.NewInsufficientScopeError(
+				fmt.Sprintf("this endpoint requires one of '%s' scope", required),
+				rule.requiredScope())
+		}
+	}
+	if len(rule.ACRValues) > 0 {
+		found := false
+		for _, acr := range rule.ACRValues {
+			if p.ACR == acr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return oer.NewInsufficientUserAuthenticationError(
+				"this endpoint requires stronger authentication",
+				strings.Join(rule.ACRValues, " "))
+		}
+	}
+	return nil
+}
+
+// requiredScope is used for 'scope' attribute of WWW-Authenticate.
+func (rule *ScopeRule) requiredScope() string {
+	list := make([]string, 0, len(rule.AllOf)+len(rule.AnyOf))
+	list = append(list, rule.AllOf...)
+	list = append(list, rule.AnyOf...)
+	return strings.Join(list, " ")
+}
+
+func (c *compiledScopeRule) match(method string, segments []string) bool {
+	if len(c.rule.Methods) > 0 {
+		found := false
+		for _, m := range c.rule.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.wildcard {
+		if len(segments) < len(c.segments) {
+			return false
+		}
+	} else if len(segments) != len(c.segments) {
+		return false
+	}
+	for i, s := range c.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
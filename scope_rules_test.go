@@ -0,0 +1,68 @@
+package goidc
+
+import (
+	"testing"
+
+	oer "github.com/lyokato/goidc/oauth_error"
+)
+
+func TestScopeRulesMatch(t *testing.T) {
+	rules := NewScopeRules()
+	rules.Add(ScopeRule{Pattern: "/users/{id}", Methods: []string{"get"}, AllOf: []string{"read"}})
+	rules.Add(ScopeRule{Pattern: "/users/{id}", AllOf: []string{"write"}})
+	rules.Add(ScopeRule{Pattern: "/admin/*", AllOf: []string{"admin"}})
+
+	testScopeRuleMatch(t, rules, "GET", "/users/123", "read")
+	testScopeRuleMatch(t, rules, "PUT", "/users/123", "write")
+	testScopeRuleMatch(t, rules, "GET", "/admin", "admin")
+	testScopeRuleMatch(t, rules, "GET", "/admin/users/123", "admin")
+	testScopeRuleMatch(t, rules, "GET", "/users", "")
+	testScopeRuleMatch(t, rules, "GET", "/users/123/items", "")
+
+	if err := rules.Add(ScopeRule{Pattern: "/a/*/b"}); err == nil {
+		t.Error("'*' in the middle should be rejected")
+	}
+	if err := rules.Add(ScopeRule{Pattern: "users"}); err == nil {
+		t.Error("pattern without leading slash should be rejected")
+	}
+}
+
+func testScopeRuleMatch(t *testing.T, rules *ScopeRules, method, path, expected string) {
+	rule := rules.Match(method, path)
+	actual := ""
+	if rule != nil {
+		actual = rule.AllOf[0]
+	}
+	if actual != expected {
+		t.Errorf("Match %s %s:\n - got: %v\n - want: %v\n", method, path, actual, expected)
+	}
+}
+
+func TestScopeRuleCheck(t *testing.T) {
+	p := &Principal{Scope: "openid read", ACR: "urn:example:pwd"}
+
+	rule := &ScopeRule{AllOf: []string{"read"}, AnyOf: []string{"write", "admin"}}
+	err := rule.Check(p)
+	if err == nil || err.Type != oer.ErrInsufficientScope {
+		t.Errorf("any-of scope should be required: %v", err)
+		return
+	}
+	if err.Scope != "read write admin" {
+		t.Errorf("Scope:\n - got: %v\n - want: %v\n", err.Scope, "read write admin")
+	}
+
+	rule = &ScopeRule{AnyOf: []string{"read", "admin"}}
+	if err := rule.Check(p); err != nil {
+		t.Errorf("one of any-of scope is enough: %v", err)
+	}
+
+	rule = &ScopeRule{AllOf: []string{"read"}, ACRValues: []string{"urn:example:mfa"}}
+	err = rule.Check(p)
+	if err == nil || err.Type != oer.ErrInsufficientUserAuthentication {
+		t.Errorf("ACR should be required: %v", err)
+		return
+	}
+	if err.ACRValues != "urn:example:mfa" {
+		t.Errorf("ACRValues:\n - got: %v\n - want: %v\n", err.ACRValues, "urn:example:mfa")
+	}
+}
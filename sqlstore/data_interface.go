@@ -0,0 +1,387 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/record"
+)
+
+const (
+	authInfoColumns = `id, user_id, client_id, subject, scope, authorization_details,
+		authorized_at, acr, active`
+	authSessionColumns = `code, auth_id, auth_time, id_token_expires_in, redirect_uri,
+		code_verifier, expires_in, nonce, resources, created_at`
+	tokenColumns = `auth_id, access_token, access_token_expires_in, refreshed_at,
+		refresh_token, refresh_token_expires_in, created_at, resources, audience,
+		authorization_details`
+)
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// storeError returns ErrFailed for sql.ErrNoRows, and ErrServerError for the others.
+func storeError(message string, err error) *bridge.Error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	return bridge.WrapError(bridge.ErrServerError, message, err)
+}
+
+func (s *Store) Issuer() string {
+	return s.issuer
+}
+
+func (s *Store) FindClientById(ctx context.Context, clientId string) (bridge.Client, *bridge.Error) {
+	cached, version := s.clients.Get(clientId, s.now())
+	if cached != nil {
+		return cached, nil
+	}
+	var data string
+	err := s.db.QueryRowContext(ctx,
+		s.dialect.rebind(`SELECT data FROM clients WHERE id = ?`), clientId).Scan(&data)
+	if err != nil {
+		return nil, storeError("failed to find client", err)
+	}
+	c := &record.Client{}
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "broken client", err)
+	}
+	if err := c.Init(); err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "broken client", err)
+	}
+	s.clients.Put(c, version, s.now())
+	return c, nil
+}
+
+func scanAuthSession(row scanner) (*record.AuthSession, error) {
+	sess := &record.AuthSession{}
+	var resources sql.NullString
+	err := row.Scan(&sess.Code, &sess.AuthId, &sess.AuthTime, &sess.IdTokenExpiresIn,
+		&sess.RedirectURI, &sess.CodeVerifier, &sess.ExpiresIn, &sess.Nonce,
+		&resources, &sess.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if sess.Resources, err = decodeList(resources); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *Store) FindAuthSessionByCode(ctx context.Context, code string) (bridge.AuthSession, *bridge.Error) {
+	sess, err := scanAuthSession(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+authSessionColumns+` FROM auth_sessions WHERE code = ? AND expires_at > ?`),
+		code, s.now()))
+	if err != nil {
+		return nil, storeError("failed to find session", err)
+	}
+	return sess, nil
+}
+
+func scanAuthInfo(row scanner) (*record.AuthInfo, error) {
+	i := &record.AuthInfo{}
+	var details sql.NullString
+	err := row.Scan(&i.Id, &i.UserId, &i.ClientId, &i.Subject, &i.Scope, &details,
+		&i.AuthorizedAt, &i.ACR, &i.Active)
+	if err != nil {
+		return nil, err
+	}
+	if i.AuthorizationDetails, err = decodeDetails(details); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *Store) FindActiveAuthInfoById(ctx context.Context, id int64) (bridge.AuthInfo, *bridge.Error) {
+	i, err := scanAuthInfo(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+authInfoColumns+` FROM auth_infos WHERE id = ? AND active = ?`), id, true))
+	if err != nil {
+		return nil, storeError("failed to find auth info", err)
+	}
+	return i, nil
+}
+
+func (s *Store) FindAuthInfoByUserIdAndClientId(ctx context.Context, uid int64,
+	clientId string) (bridge.AuthInfo, *bridge.Error) {
+	i, err := scanAuthInfo(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+authInfoColumns+` FROM auth_infos WHERE user_id = ? AND client_id = ?`),
+		uid, clientId))
+	if err != nil {
+		return nil, storeError("failed to find auth info", err)
+	}
+	return i, nil
+}
+
+func scanToken(row scanner) (*record.OAuthToken, error) {
+	t := &record.OAuthToken{}
+	var rt, resources, audience, details sql.NullString
+	err := row.Scan(&t.AuthId, &t.AccessToken, &t.AccessTokenExpiresIn, &t.RefreshedAt,
+		&rt, &t.RefreshTokenExpiresIn, &t.CreatedAt, &resources, &audience, &details)
+	if err != nil {
+		return nil, err
+	}
+	t.RefreshToken = rt.String
+	if t.Resources, err = decodeList(resources); err != nil {
+		return nil, err
+	}
+	if t.Audience, err = decodeList(audience); err != nil {
+		return nil, err
+	}
+	if t.AuthorizationDetails, err = decodeDetails(details); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *Store) FindOAuthTokenByAccessToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	t, err := scanToken(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+tokenColumns+` FROM oauth_tokens WHERE access_token = ?`), token))
+	if err != nil {
+		return nil, storeError("failed to find token", err)
+	}
+	return t, nil
+}
+
+func (s *Store) FindOAuthTokenByRefreshToken(ctx context.Context, token string) (bridge.OAuthToken, *bridge.Error) {
+	t, err := scanToken(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+tokenColumns+` FROM oauth_tokens WHERE refresh_token = ?`), token))
+	if err != nil {
+		return nil, storeError("failed to find token", err)
+	}
+	return t, nil
+}
+
+func (s *Store) CreateOAuthToken(ctx context.Context, info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	t, err := s.policy.NewOAuthToken(info, onTokenEndpoint, resources, details, s.now())
+	if err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "failed to generate token", err)
+	}
+	encoded, err := encodeDetails(t.AuthorizationDetails)
+	if err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "broken authorization_details", err)
+	}
+	_, err = s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO oauth_tokens (`+tokenColumns+`, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		t.AuthId, t.AccessToken, t.AccessTokenExpiresIn, t.RefreshedAt,
+		nullable(t.RefreshToken), t.RefreshTokenExpiresIn, t.CreatedAt,
+		encodeList(t.Resources), encodeList(t.Audience), encoded, t.ExpiresAt())
+	if err != nil {
+		return nil, storeError("failed to create token", err)
+	}
+	return t, nil
+}
+
+// RefreshAccessToken updates the row only when it still has the tokens
+// the caller found, so that only one of the concurrent requests succeeds.
+func (s *Store) RefreshAccessToken(ctx context.Context, info bridge.AuthInfo,
+	token bridge.OAuthToken, audience []string,
+	details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+
+	var c bridge.Client
+	if found, err := s.FindClientById(ctx, info.GetClientId()); err == nil {
+		c = found
+	} else if err.Type() != bridge.ErrFailed {
+		return nil, err
+	}
+
+	var refreshed *record.OAuthToken
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		t, err := scanToken(tx.QueryRowContext(ctx, s.dialect.rebind(
+			`SELECT `+tokenColumns+` FROM oauth_tokens WHERE access_token = ?`),
+			token.GetAccessToken()))
+		if err != nil {
+			return err
+		}
+		if t.RefreshToken != token.GetRefreshToken() {
+			return sql.ErrNoRows
+		}
+		if err := s.policy.Refresh(t, s.policy.ShouldRotate(c), audience, details, s.now()); err != nil {
+			return err
+		}
+		encoded, err := encodeDetails(t.AuthorizationDetails)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE oauth_tokens SET access_token = ?, access_token_expires_in = ?,
+			refreshed_at = ?, refresh_token = ?, audience = ?, authorization_details = ?,
+			expires_at = ?
+			WHERE access_token = ? AND refresh_token = ?`),
+			t.AccessToken, t.AccessTokenExpiresIn, t.RefreshedAt, nullable(t.RefreshToken),
+			encodeList(t.Audience), encoded, t.ExpiresAt(),
+			token.GetAccessToken(), token.GetRefreshToken())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n != 1 {
+			return sql.ErrNoRows
+		}
+		refreshed = t
+		return nil
+	})
+	if err != nil {
+		return nil, storeError("failed to refresh token", err)
+	}
+	return refreshed, nil
+}
+
+func (s *Store) FindUserId(ctx context.Context, username, password string) (int64, *bridge.Error) {
+	var uid int64
+	var hash string
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT id, password_hash FROM users WHERE username = ?`), username).Scan(&uid, &hash)
+	if err != nil {
+		return -1, storeError("failed to find user", err)
+	}
+	matched, verr := clientsecret.Verify(hash, password)
+	if verr != nil {
+		return -1, bridge.WrapError(bridge.ErrServerError, "broken password hash", verr)
+	}
+	if !matched {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return uid, nil
+}
+
+func (s *Store) CreateOrUpdateAuthInfo(ctx context.Context, uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
+	encoded, err := encodeDetails(details)
+	if err != nil {
+		return nil, bridge.WrapError(bridge.ErrServerError, "broken authorization_details", err)
+	}
+	u, err := s.findUser(ctx, `id = ?`, uid)
+	if err != nil {
+		return nil, storeError("failed to find user", err)
+	}
+	i, err := scanAuthInfo(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`INSERT INTO auth_infos (user_id, client_id, subject, scope, authorization_details,
+			authorized_at, active)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET
+			subject = excluded.subject, scope = excluded.scope,
+			authorization_details = excluded.authorization_details,
+			authorized_at = excluded.authorized_at, active = excluded.active
+		RETURNING `+authInfoColumns),
+		uid, clientId, s.policy.Subject(u), scope, encoded, s.now(), true))
+	if err != nil {
+		return nil, storeError("failed to save auth info", err)
+	}
+	return i, nil
+}
+
+func (s *Store) CreateAuthSession(ctx context.Context, info bridge.AuthInfo,
+	session *authorization.Session) *bridge.Error {
+	sess := s.policy.NewAuthSession(info, session, s.now())
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO auth_sessions (`+authSessionColumns+`, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		sess.Code, sess.AuthId, sess.AuthTime, sess.IdTokenExpiresIn, sess.RedirectURI,
+		sess.CodeVerifier, sess.ExpiresIn, sess.Nonce, encodeList(sess.Resources),
+		sess.CreatedAt, sess.ExpiresAt())
+	if err != nil {
+		return bridge.WrapError(bridge.ErrServerError, "failed to create session", err)
+	}
+	return nil
+}
+
+// DisableSession deletes the session in a statement, and fails when
+// it has already been deleted, so that the code is redeemed only once.
+func (s *Store) DisableSession(ctx context.Context, sess bridge.AuthSession) *bridge.Error {
+	err := s.execOne(ctx, `DELETE FROM auth_sessions WHERE code = ?`, sess.GetCode())
+	if err == ErrNotFound {
+		return bridge.NewError(bridge.ErrFailed)
+	} else if err != nil {
+		return bridge.WrapError(bridge.ErrServerError, "failed to disable session", err)
+	}
+	return nil
+}
+
+// findUser returns the user without the password hash.
+func (s *Store) findUser(ctx context.Context, where string, arg interface{}) (*record.User, error) {
+	u := &record.User{}
+	var sub sql.NullString
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT id, username, subject FROM users WHERE `+where), arg).Scan(&u.Id, &u.Username, &sub)
+	if err != nil {
+		return nil, err
+	}
+	u.Subject = sub.String
+	return u, nil
+}
+
+func (s *Store) FindUserIdBySubject(ctx context.Context, sub string) (int64, *bridge.Error) {
+	u, err := s.findUser(ctx, `subject = ?`, sub)
+	if errors.Is(err, sql.ErrNoRows) {
+		var uid int64
+		err = s.db.QueryRowContext(ctx, s.dialect.rebind(
+			`SELECT user_id FROM recorded_subjects WHERE subject = ?`), sub).Scan(&uid)
+		if err == nil {
+			return uid, nil
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		if id, perr := strconv.ParseInt(sub, 10, 64); perr == nil {
+			u, err = s.findUser(ctx, `id = ?`, id)
+		}
+	}
+	if err != nil {
+		return -1, storeError("failed to find user", err)
+	}
+	if s.policy.Subject(u) != sub {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return u.Id, nil
+}
+
+func (s *Store) RecordSubject(ctx context.Context, uid int64, sub string) *bridge.Error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO recorded_subjects (subject, user_id) SELECT ?, id FROM users WHERE id = ?
+		ON CONFLICT (subject) DO NOTHING`), sub, uid)
+	if err != nil {
+		return bridge.WrapError(bridge.ErrServerError, "failed to record subject", err)
+	}
+	return nil
+}
+
+func (s *Store) RecordAssertionClaims(ctx context.Context, clientId, jti string,
+	issuedAt, expiredAt int64) *bridge.Error {
+	if jti == "" {
+		return nil
+	}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`DELETE FROM assertion_claims WHERE client_id = ? AND jti = ? AND expired_at <= ?`),
+			clientId, jti, s.now()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO assertion_claims (client_id, jti, issued_at, expired_at)
+			VALUES (?, ?, ?, ?) ON CONFLICT (client_id, jti) DO NOTHING`),
+			clientId, jti, issuedAt, expiredAt)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		return storeError("failed to record assertion claims", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package sqlstore
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect absorbs the differences of the databases.
+// The queries are written with '?' and rebound for the dialect.
+type Dialect struct {
+	Name string
+	// primary key column which is numbered automatically
+	autoIncrement string
+	numbered      bool
+}
+
+var (
+	SQLite   = &Dialect{Name: "sqlite", autoIncrement: "INTEGER PRIMARY KEY AUTOINCREMENT"}
+	Postgres = &Dialect{Name: "postgres", autoIncrement: "BIGSERIAL PRIMARY KEY", numbered: true}
+)
+
+// rebind replaces '?' with '$1', '$2'... for the dialect which uses numbered placeholders.
+func (d *Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$")
+			b.WriteString(strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
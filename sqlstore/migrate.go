@@ -0,0 +1,132 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrations are applied in order, and never modified once released.
+// {{id}} is replaced with the auto-numbered primary key of the dialect.
+var migrations = []migration{
+	{1, []string{
+		`CREATE TABLE users (
+			id            {{id}},
+			username      TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE clients (
+			id            TEXT PRIMARY KEY,
+			owner_user_id BIGINT NOT NULL,
+			data          TEXT NOT NULL
+		)`,
+		`CREATE TABLE auth_infos (
+			id                    {{id}},
+			user_id               BIGINT NOT NULL,
+			client_id             TEXT NOT NULL,
+			subject               TEXT NOT NULL,
+			scope                 TEXT NOT NULL,
+			authorization_details TEXT,
+			authorized_at         BIGINT NOT NULL,
+			acr                   TEXT NOT NULL DEFAULT '',
+			active                BOOLEAN NOT NULL,
+			UNIQUE (user_id, client_id)
+		)`,
+		`CREATE TABLE auth_sessions (
+			code                TEXT PRIMARY KEY,
+			auth_id             BIGINT NOT NULL,
+			auth_time           BIGINT NOT NULL,
+			id_token_expires_in BIGINT NOT NULL,
+			redirect_uri        TEXT NOT NULL,
+			code_verifier       TEXT NOT NULL,
+			expires_in          BIGINT NOT NULL,
+			nonce               TEXT NOT NULL,
+			resources           TEXT,
+			created_at          BIGINT NOT NULL,
+			expires_at          BIGINT NOT NULL
+		)`,
+		`CREATE INDEX auth_sessions_expires_at ON auth_sessions (expires_at)`,
+		`CREATE TABLE oauth_tokens (
+			id                       {{id}},
+			auth_id                  BIGINT NOT NULL,
+			access_token             TEXT NOT NULL UNIQUE,
+			access_token_expires_in  BIGINT NOT NULL,
+			refreshed_at             BIGINT NOT NULL,
+			refresh_token            TEXT UNIQUE,
+			refresh_token_expires_in BIGINT NOT NULL,
+			created_at               BIGINT NOT NULL,
+			resources                TEXT,
+			audience                 TEXT,
+			expires_at               BIGINT NOT NULL
+		)`,
+		`CREATE INDEX oauth_tokens_expires_at ON oauth_tokens (expires_at)`,
+		`CREATE TABLE assertion_claims (
+			client_id  TEXT NOT NULL,
+			jti        TEXT NOT NULL,
+			issued_at  BIGINT NOT NULL,
+			expired_at BIGINT NOT NULL,
+			PRIMARY KEY (client_id, jti)
+		)`,
+		`CREATE INDEX assertion_claims_expired_at ON assertion_claims (expired_at)`,
+	}},
+	// the users created before this keep the decimal ID as 'sub'
+	{2, []string{
+		`ALTER TABLE users ADD COLUMN subject TEXT`,
+		`CREATE UNIQUE INDEX users_subject ON users (subject)`,
+	}},
+	// 'sub' recorded by RecordSubject, like the pairwise ones
+	{3, []string{
+		`CREATE TABLE recorded_subjects (
+			subject TEXT PRIMARY KEY,
+			user_id BIGINT NOT NULL
+		)`,
+		`CREATE INDEX recorded_subjects_user_id ON recorded_subjects (user_id)`,
+	}},
+	// authorization_details narrowed by the token request
+	{4, []string{
+		`ALTER TABLE oauth_tokens ADD COLUMN authorization_details TEXT`,
+	}},
+}
+
+// Migrate creates the tables, or applies the migrations not applied yet.
+// Each migration runs in its own transaction.
+func (s *Store) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("sqlstore: failed to create schema_migrations: %s", err)
+	}
+	current := 0
+	row := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("sqlstore: failed to read schema version: %s", err)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.apply(ctx, m); err != nil {
+			return fmt.Errorf("sqlstore: migration %d failed: %s", m.version, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) apply(ctx context.Context, m migration) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, stmt := range m.statements {
+			stmt = strings.Replace(stmt, "{{id}}", s.dialect.autoIncrement, -1)
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx,
+			s.dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), m.version)
+		return err
+	})
+}
@@ -0,0 +1,249 @@
+// Package sqlstore provides bridge.ContextDataInterface on database/sql.
+// SQLite and PostgreSQL are supported, import the driver in the application.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+)
+
+var _ bridge.ContextDataInterface = (*Store)(nil)
+
+const DefaultClientCacheTTL = time.Minute
+
+var (
+	ErrDuplicated = errors.New("sqlstore: already exists")
+	ErrNotFound   = errors.New("sqlstore: not found")
+)
+
+type Store struct {
+	db          *sql.DB
+	dialect     *Dialect
+	issuer      string
+	policy      *record.Policy
+	hasher      clientsecret.Hasher
+	timeBuilder io.TimeBuilder
+	clients     *record.ClientCache
+}
+
+// New returns the store on db, call Migrate before use.
+func New(db *sql.DB, dialect *Dialect, issuer string) *Store {
+	return &Store{
+		db:          db,
+		dialect:     dialect,
+		issuer:      issuer,
+		policy:      record.DefaultPolicy(),
+		hasher:      clientsecret.Argon2id(),
+		timeBuilder: io.NowBuilder(),
+		clients:     newClientCache(DefaultClientCacheTTL),
+	}
+}
+
+func (s *Store) SetPolicy(p *record.Policy) {
+	s.policy = p
+}
+
+// SetPasswordHasher sets the hasher for the passwords of the users
+// created after this, clientsecret.Argon2id by default.
+func (s *Store) SetPasswordHasher(h clientsecret.Hasher) {
+	s.hasher = h
+}
+
+// SetClientCacheTTL sets how long the clients are cached, DefaultClientCacheTTL by default.
+// The cache is cleared by RegisterClient and RemoveClient of this store, but not by the
+// other servers sharing the database, so they see the update after this.
+// Set 0 to disable the cache.
+func (s *Store) SetClientCacheTTL(ttl time.Duration) {
+	s.clients = newClientCache(ttl)
+}
+
+func newClientCache(ttl time.Duration) *record.ClientCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return &record.ClientCache{TTL: int64(ttl / time.Second)}
+}
+
+func (s *Store) SetTimeBuilder(builder io.TimeBuilder) {
+	s.timeBuilder = builder
+}
+
+func (s *Store) now() int64 {
+	return s.timeBuilder().Unix()
+}
+
+func (s *Store) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateUser registers the user with the hashed password.
+func (s *Store) CreateUser(ctx context.Context, username, password string) (*record.User, error) {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := record.NewSubject()
+	if err != nil {
+		return nil, err
+	}
+	u := &record.User{Username: username, Subject: sub, PasswordHash: hash}
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx,
+			s.dialect.rebind(`SELECT COUNT(*) FROM users WHERE username = ?`),
+			username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrDuplicated
+		}
+		return tx.QueryRowContext(ctx,
+			s.dialect.rebind(`INSERT INTO users (username, subject, password_hash)
+				VALUES (?, ?, ?) RETURNING id`),
+			username, sub, hash).Scan(&u.Id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Store) RemoveUser(ctx context.Context, uid int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`DELETE FROM recorded_subjects WHERE user_id = ?`), uid); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM users WHERE id = ?`), uid)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// RegisterClient stores c, replacing the one with the same ID.
+func (s *Store) RegisterClient(ctx context.Context, c *record.Client) error {
+	if err := c.Clone().Init(); err != nil {
+		return err
+	}
+	defer s.clients.Remove(c.Id)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO clients (id, owner_user_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET owner_user_id = excluded.owner_user_id, data = excluded.data`),
+		c.Id, c.OwnerUserId, string(data))
+	return err
+}
+
+func (s *Store) RemoveClient(ctx context.Context, clientId string) error {
+	defer s.clients.Remove(clientId)
+	return s.execOne(ctx, `DELETE FROM clients WHERE id = ?`, clientId)
+}
+
+func (s *Store) execOne(ctx context.Context, query string, args ...interface{}) error {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Evict removes the expired sessions, tokens and assertion claims,
+// and returns the number of them. Call it periodically.
+func (s *Store) Evict(ctx context.Context) (int64, error) {
+	now := s.now()
+	var total int64
+	for _, query := range []string{
+		`DELETE FROM auth_sessions WHERE expires_at <= ?`,
+		`DELETE FROM oauth_tokens WHERE expires_at <= ?`,
+		`DELETE FROM assertion_claims WHERE expired_at <= ?`,
+	} {
+		res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), now)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+func encodeList(list []string) sql.NullString {
+	if list == nil {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(list)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeList(v sql.NullString) ([]string, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(v.String), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func encodeDetails(details []authorization.Detail) (sql.NullString, error) {
+	if details == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(details)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func decodeDetails(v sql.NullString) ([]authorization.Detail, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	var details []authorization.Detail
+	if err := json.Unmarshal([]byte(v.String), &details); err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+func nullable(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
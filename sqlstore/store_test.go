@@ -0,0 +1,137 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/record"
+	"github.com/lyokato/goidc/record/storetest"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3",
+		filepath.Join(t.TempDir(), "goidc.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *storetest.Store {
+		s := New(openTestDB(t), SQLite, "http://example.org/")
+		s.SetPasswordHasher(clientsecret.Bcrypt(bcrypt.MinCost))
+		ctx := context.Background()
+		if err := s.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate: %s", err)
+		}
+		return &storetest.Store{
+			DataInterface:  bridge.BindDataInterface(ctx, s),
+			SetPolicy:      s.SetPolicy,
+			SetTimeBuilder: s.SetTimeBuilder,
+			CreateUser: func(username, password string) (*record.User, error) {
+				return s.CreateUser(ctx, username, password)
+			},
+			RemoveUser: func(uid int64) error {
+				return s.RemoveUser(ctx, uid)
+			},
+			RegisterClient: func(c *record.Client) error {
+				return s.RegisterClient(ctx, c)
+			},
+			RemoveClient: func(clientId string) error {
+				return s.RemoveClient(ctx, clientId)
+			},
+			Evict: func() (int64, error) {
+				return s.Evict(ctx)
+			},
+		}
+	})
+}
+
+func TestStoreMigrate(t *testing.T) {
+	s := New(openTestDB(t), SQLite, "http://example.org/")
+	s.SetPasswordHasher(clientsecret.Bcrypt(bcrypt.MinCost))
+	ctx := context.Background()
+
+	// the user created on the first version
+	if _, err := s.db.ExecContext(ctx,
+		`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatalf("schema_migrations: %s", err)
+	}
+	if err := s.apply(ctx, migrations[0]); err != nil {
+		t.Fatalf("apply: %s", err)
+	}
+	hash, _ := s.hasher.Hash("pass01")
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (username, password_hash) VALUES (?, ?)`, "user01", hash); err != nil {
+		t.Fatalf("insert user: %s", err)
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	// already applied
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate twice: %s", err)
+	}
+
+	uid, err := s.FindUserId(ctx, "user01", "pass01")
+	if err != nil {
+		t.Fatalf("FindUserId:\n - got: %v\n - want: %v\n", err, nil)
+	}
+	s.RegisterClient(ctx, &record.Client{Id: "client_id_01"})
+	info, _ := s.CreateOrUpdateAuthInfo(ctx, uid, "client_id_01", "openid", nil)
+	if info.GetSubject() != strconv.FormatInt(uid, 10) {
+		t.Errorf("Subject of the old user:\n - got: %v\n - want: %v\n", info.GetSubject(), uid)
+	}
+	if found, err := s.FindUserIdBySubject(ctx, info.GetSubject()); err != nil || found != uid {
+		t.Errorf("FindUserIdBySubject:\n - got: %v, %v\n - want: %v\n", found, err, uid)
+	}
+	// the new users get the random one
+	u, _ := s.CreateUser(ctx, "user02", "pass02")
+	if u.Subject == "" {
+		t.Errorf("Subject of the new user:\n - got: %v\n - want: %v\n", u.Subject, "random one")
+	}
+}
+
+func TestStoreClientCache(t *testing.T) {
+	s := New(openTestDB(t), SQLite, "http://example.org/")
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000))
+	ctx := context.Background()
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	s.RegisterClient(ctx, &record.Client{Id: "client_id_01"})
+
+	first, _ := s.FindClientById(ctx, "client_id_01")
+	if c, _ := s.FindClientById(ctx, "client_id_01"); c != first {
+		t.Errorf("Cached client:\n - got: %p\n - want: %p\n", c, first)
+	}
+
+	// updated by another server sharing the database
+	s.db.ExecContext(ctx, `DELETE FROM clients WHERE id = ?`, "client_id_01")
+	if c, _ := s.FindClientById(ctx, "client_id_01"); c != first {
+		t.Errorf("Client before TTL:\n - got: %p\n - want: %p\n", c, first)
+	}
+	s.SetTimeBuilder(io.FixedUnixTimeBuilder(1000 + int64(DefaultClientCacheTTL/time.Second)))
+	if _, err := s.FindClientById(ctx, "client_id_01"); err == nil {
+		t.Errorf("Client after TTL:\n - got: %v\n - want: %v\n", err, bridge.ErrFailed)
+	}
+
+	s.SetClientCacheTTL(0)
+	s.RegisterClient(ctx, &record.Client{Id: "client_id_01"})
+	first, _ = s.FindClientById(ctx, "client_id_01")
+	if c, _ := s.FindClientById(ctx, "client_id_01"); c == first {
+		t.Errorf("Client without cache:\n - got: %p\n - want: not %p\n", c, first)
+	}
+}
@@ -0,0 +1,53 @@
+package subject
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const DefaultFetchTimeout = 10 * time.Second
+
+type (
+	// SectorIdentifierFetcher retrieves the JSON array of redirect URIs
+	// published at 'sector_identifier_uri'.
+	SectorIdentifierFetcher interface {
+		Fetch(uri string) ([]string, error)
+	}
+
+	HTTPSectorIdentifierFetcher struct {
+		client *http.Client
+	}
+)
+
+func NewHTTPSectorIdentifierFetcher() *HTTPSectorIdentifierFetcher {
+	return &HTTPSectorIdentifierFetcher{
+		client: &http.Client{Timeout: DefaultFetchTimeout},
+	}
+}
+
+func (f *HTTPSectorIdentifierFetcher) SetHTTPClient(client *http.Client) {
+	f.client = client
+}
+
+func (f *HTTPSectorIdentifierFetcher) Fetch(uri string) ([]string, error) {
+	resp, err := f.client.Get(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch 'sector_identifier_uri': %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("'sector_identifier_uri' returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read 'sector_identifier_uri': %s", err)
+	}
+	var uris []string
+	if err := json.Unmarshal(body, &uris); err != nil {
+		return nil, fmt.Errorf("'sector_identifier_uri' isn't a JSON array of strings: %s", err)
+	}
+	return uris, nil
+}
@@ -0,0 +1,287 @@
+package subject
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/io"
+)
+
+const (
+	TypePublic   = "public"
+	TypePairwise = "pairwise"
+	// public as well, but the 'sub' isn't AuthInfo.GetSubject()
+	TypeUserId = "user_id"
+)
+
+const (
+	DefaultSectorCacheTTL = 24 * time.Hour
+	// failures are kept shortly, so that an unavailable host
+	// isn't asked on every request.
+	sectorErrorTTL = time.Minute
+)
+
+type (
+	// Strategy decides which 'sub' value a client sees for a local user,
+	// and resolves the value back to the local user.
+	// Subject records the value with sdi when FindUserId needs it.
+	Strategy interface {
+		Type() string
+		Subject(sdi bridge.DataInterface, c bridge.Client, info bridge.AuthInfo) (string, error)
+		FindUserId(sdi bridge.DataInterface, c bridge.Client, sub string) (int64, *bridge.Error)
+	}
+
+	publicStrategy struct{}
+
+	userIdStrategy struct{}
+
+	PairwiseStrategy struct {
+		salt        []byte
+		fetcher     SectorIdentifierFetcher
+		ttl         time.Duration
+		timeBuilder io.TimeBuilder
+
+		mu      sync.Mutex
+		sectors map[string]*sectorEntry
+	}
+
+	// sectorEntry is the sector resolved from 'sector_identifier_uri'.
+	sectorEntry struct {
+		uri       string
+		sector    string
+		err       error
+		expiresAt time.Time
+	}
+)
+
+var (
+	public = &publicStrategy{}
+	userId = &userIdStrategy{}
+)
+
+// Public returns the default strategy, which uses AuthInfo.GetSubject() as is.
+func Public() Strategy {
+	return public
+}
+
+func (s *publicStrategy) Type() string {
+	return TypePublic
+}
+
+func (s *publicStrategy) Subject(sdi bridge.DataInterface, c bridge.Client, info bridge.AuthInfo) (string, error) {
+	return info.GetSubject(), nil
+}
+
+func (s *publicStrategy) FindUserId(sdi bridge.DataInterface, c bridge.Client,
+	sub string) (int64, *bridge.Error) {
+	return sdi.FindUserIdBySubject(sub)
+}
+
+// UserId returns a public strategy which uses the decimal local user ID as 'sub'.
+// Use it only when the IDs are never reused, and can be exposed to the clients.
+func UserId() Strategy {
+	return userId
+}
+
+func (s *userIdStrategy) Type() string {
+	return TypeUserId
+}
+
+func (s *userIdStrategy) Subject(sdi bridge.DataInterface, c bridge.Client, info bridge.AuthInfo) (string, error) {
+	return strconv.FormatInt(info.GetUserId(), 10), nil
+}
+
+func (s *userIdStrategy) FindUserId(sdi bridge.DataInterface, c bridge.Client,
+	sub string) (int64, *bridge.Error) {
+	uid, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil || uid < 0 {
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return uid, nil
+}
+
+// Pairwise returns a strategy which generates
+// different 'sub' for each sector identifier.
+// OpenID Connect Core 1.0 8.1. Pairwise Identifier Algorithm
+func Pairwise(salt string) *PairwiseStrategy {
+	return &PairwiseStrategy{
+		salt:        []byte(salt),
+		fetcher:     NewHTTPSectorIdentifierFetcher(),
+		ttl:         DefaultSectorCacheTTL,
+		timeBuilder: io.NowBuilder(),
+		sectors:     make(map[string]*sectorEntry),
+	}
+}
+
+func (s *PairwiseStrategy) SetFetcher(fetcher SectorIdentifierFetcher) {
+	s.fetcher = fetcher
+}
+
+// SetSectorCacheTTL sets how long the sector fetched from
+// 'sector_identifier_uri' is used, DefaultSectorCacheTTL by default.
+func (s *PairwiseStrategy) SetSectorCacheTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
+
+func (s *PairwiseStrategy) SetTimeBuilder(builder io.TimeBuilder) {
+	s.timeBuilder = builder
+}
+
+// ValidateClient fetches 'sector_identifier_uri' of c, checks it
+// includes all the redirect URIs, and caches the sector.
+// Call it when the client is registered or updated.
+func (s *PairwiseStrategy) ValidateClient(c bridge.Client) error {
+	s.Refresh(c.GetId())
+	_, err := s.SectorIdentifier(c)
+	return err
+}
+
+// Refresh drops the cached sector of the client,
+// so that it's fetched again on the next use.
+func (s *PairwiseStrategy) Refresh(clientId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sectors, clientId)
+}
+
+func (s *PairwiseStrategy) Type() string {
+	return TypePairwise
+}
+
+// Subject records the generated 'sub' with RecordSubject,
+// so that FindUserIdBySubject of the store resolves it.
+func (s *PairwiseStrategy) Subject(sdi bridge.DataInterface, c bridge.Client,
+	info bridge.AuthInfo) (string, error) {
+	sub, err := s.subject(c, info.GetUserId())
+	if err != nil {
+		return "", err
+	}
+	if serr := sdi.RecordSubject(info.GetUserId(), sub); serr != nil {
+		return "", serr
+	}
+	return sub, nil
+}
+
+func (s *PairwiseStrategy) subject(c bridge.Client, uid int64) (string, error) {
+	sector, err := s.SectorIdentifier(c)
+	if err != nil {
+		return "", err
+	}
+	return s.hash(sector, uid), nil
+}
+
+// FindUserId resolves 'sub' recorded by Subject,
+// and rejects the one issued for another sector.
+func (s *PairwiseStrategy) FindUserId(sdi bridge.DataInterface, c bridge.Client,
+	sub string) (int64, *bridge.Error) {
+	uid, err := sdi.FindUserIdBySubject(sub)
+	if err != nil {
+		return -1, err
+	}
+	expected, serr := s.subject(c, uid)
+	if serr != nil {
+		return -1, bridge.WrapError(bridge.ErrServerError,
+			"failed to compute pairwise subject", serr)
+	}
+	if expected != sub {
+		// this subject is issued for another sector
+		return -1, bridge.NewError(bridge.ErrFailed)
+	}
+	return uid, nil
+}
+
+// SectorIdentifier returns the host component of 'sector_identifier_uri'
+// if the client registered it, otherwise the host of its redirect URIs.
+// The fetched sector is cached for each client, and the last one is kept
+// while the host is unavailable.
+func (s *PairwiseStrategy) SectorIdentifier(c bridge.Client) (string, error) {
+
+	uris := c.GetRedirectURIs()
+
+	siu := c.GetSectorIdentifierURI()
+	if siu != "" {
+		now := s.timeBuilder()
+		s.mu.Lock()
+		cached := s.sectors[c.GetId()]
+		s.mu.Unlock()
+		if cached != nil && cached.uri == siu && now.Before(cached.expiresAt) {
+			return cached.sector, cached.err
+		}
+
+		entry := &sectorEntry{uri: siu, expiresAt: now.Add(s.ttl)}
+		entry.sector, entry.err = s.fetchSector(siu, uris)
+		if entry.err != nil {
+			entry.expiresAt = now.Add(sectorErrorTTL)
+			if cached != nil && cached.uri == siu && cached.err == nil {
+				entry.sector, entry.err = cached.sector, nil
+			}
+		}
+		s.mu.Lock()
+		s.sectors[c.GetId()] = entry
+		s.mu.Unlock()
+		return entry.sector, entry.err
+	}
+
+	host := ""
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("invalid redirect URI: %s", uri)
+		}
+		if host == "" {
+			host = u.Host
+		} else if host != u.Host {
+			return "", errors.New("client has multiple redirect hosts without 'sector_identifier_uri'")
+		}
+	}
+	if host == "" {
+		return "", errors.New("client has no redirect URI")
+	}
+	return host, nil
+}
+
+func (s *PairwiseStrategy) fetchSector(siu string, uris []string) (string, error) {
+	u, err := url.Parse(siu)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid 'sector_identifier_uri': %s", siu)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("'sector_identifier_uri' must use https: %s", siu)
+	}
+	listed, err := s.fetcher.Fetch(siu)
+	if err != nil {
+		return "", err
+	}
+	if !includeAll(listed, uris) {
+		return "", errors.New("'sector_identifier_uri' doesn't include all registered redirect URIs")
+	}
+	return u.Host, nil
+}
+
+func (s *PairwiseStrategy) hash(sector string, uid int64) string {
+	h := sha256.New()
+	h.Write([]byte(sector))
+	h.Write([]byte(strconv.FormatInt(uid, 10)))
+	h.Write(s.salt)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func includeAll(list, targets []string) bool {
+	existanceMap := make(map[string]bool, 0)
+	for _, v := range list {
+		existanceMap[v] = true
+	}
+	for _, v := range targets {
+		if _, exists := existanceMap[v]; !exists {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package subject
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/clientsecret"
+	"github.com/lyokato/goidc/memstore"
+	th "github.com/lyokato/goidc/test_helper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testFetcher struct {
+	uris    []string
+	err     error
+	fetched int
+}
+
+func (f *testFetcher) Fetch(uri string) ([]string, error) {
+	f.fetched++
+	return f.uris, f.err
+}
+
+func TestPublicStrategy(t *testing.T) {
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	c := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, c.GetId(), "openid", nil)
+	info.(*th.TestAuthInfo).SetSubject("user01_subject")
+
+	actual, err := Public().Subject(sdi, c, info)
+	if err != nil {
+		t.Errorf("failed to generate subject: %s", err)
+		return
+	}
+	if actual != "user01_subject" {
+		t.Errorf("Subject:\n - got: %v\n - want: %v\n", actual, "user01_subject")
+	}
+	uid, serr := Public().FindUserId(sdi, c, "user01")
+	if serr != nil || uid != user.Id {
+		t.Errorf("FindUserId:\n - got: %v, %v\n - want: %v\n", uid, serr, user.Id)
+	}
+}
+
+func TestUserIdStrategy(t *testing.T) {
+	sdi := th.NewTestStore()
+	sdi.CreateNewUser("user01", "pass01")
+	user := sdi.CreateNewUser("user02", "pass02")
+	c := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, c.GetId(), "openid", nil)
+	info.(*th.TestAuthInfo).SetSubject("user02_subject")
+
+	if UserId().Type() != TypeUserId {
+		t.Errorf("Type:\n - got: %v\n - want: %v\n", UserId().Type(), TypeUserId)
+	}
+	actual, _ := UserId().Subject(sdi, c, info)
+	if actual != "1" {
+		t.Errorf("Subject:\n - got: %v\n - want: %v\n", actual, "1")
+	}
+	if uid, err := UserId().FindUserId(sdi, c, "1"); err != nil || uid != user.Id {
+		t.Errorf("FindUserId:\n - got: %v, %v\n - want: %v\n", uid, err, user.Id)
+	}
+	if _, err := UserId().FindUserId(sdi, c, "user02"); err == nil {
+		t.Errorf("FindUserId by username:\n - got: %v\n - want: %v\n", err, "ErrFailed")
+	}
+}
+
+func TestPairwiseStrategy(t *testing.T) {
+	c1 := th.NewTestClient(0, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback", "RS256", nil, "")
+	c2 := th.NewTestClient(0, "client_id_02", "client_secret_02",
+		"https://client2.example.org/callback", "RS256", nil, "")
+	c3 := th.NewTestClient(0, "client_id_03", "client_secret_03",
+		"https://client1.example.org/other_callback", "RS256", nil, "")
+
+	s := Pairwise("salt")
+
+	sub1, err := s.subject(c1, 10)
+	if err != nil {
+		t.Errorf("failed to generate subject: %s", err)
+		return
+	}
+	sub2, _ := s.subject(c2, 10)
+	sub3, _ := s.subject(c3, 10)
+	if sub1 == sub2 {
+		t.Error("subjects for different sectors should be different")
+	}
+	if sub1 != sub3 {
+		t.Errorf("subjects for same sector should be same:\n - got: %v\n - want: %v\n", sub3, sub1)
+	}
+	other, _ := Pairwise("other_salt").subject(c1, 10)
+	if sub1 == other {
+		t.Error("subjects with different salt should be different")
+	}
+}
+
+func TestPairwiseSectorIdentifierURI(t *testing.T) {
+	c := th.NewTestClient(0, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback", "RS256", nil, "")
+	c.SetSectorIdentifierURI("https://sector.example.org/uris.json")
+
+	s := Pairwise("salt")
+
+	s.SetFetcher(&testFetcher{uris: []string{"https://client1.example.org/callback"}})
+	if err := s.ValidateClient(c); err != nil {
+		t.Errorf("failed to validate client: %s", err)
+		return
+	}
+	sector, _ := s.SectorIdentifier(c)
+	if sector != "sector.example.org" {
+		t.Errorf("SectorIdentifier:\n - got: %v\n - want: %v\n", sector, "sector.example.org")
+	}
+
+	s.SetFetcher(&testFetcher{uris: []string{"https://client2.example.org/callback"}})
+	if err := s.ValidateClient(c); err == nil {
+		t.Error("redirect URI not listed in 'sector_identifier_uri' should be rejected")
+	}
+
+	s.SetFetcher(&testFetcher{err: errors.New("unreachable")})
+	if err := s.ValidateClient(c); err == nil {
+		t.Error("fetch failure should be returned")
+	}
+
+	c.SetSectorIdentifierURI("http://sector.example.org/uris.json")
+	if err := s.ValidateClient(c); err == nil {
+		t.Error("non-https 'sector_identifier_uri' should be rejected")
+	}
+}
+
+func TestPairwiseSectorCache(t *testing.T) {
+	c := th.NewTestClient(0, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback", "RS256", nil, "")
+	c.SetSectorIdentifierURI("https://sector.example.org/uris.json")
+
+	now := time.Unix(1000, 0)
+	s := Pairwise("salt")
+	s.SetSectorCacheTTL(time.Hour)
+	s.SetTimeBuilder(func() time.Time { return now })
+	f := &testFetcher{uris: []string{"https://client1.example.org/callback"}}
+	s.SetFetcher(f)
+
+	s.ValidateClient(c)
+	for i := 0; i < 3; i++ {
+		s.SectorIdentifier(c)
+	}
+	if f.fetched != 1 {
+		t.Errorf("Fetched:\n - got: %v\n - want: %v\n", f.fetched, 1)
+	}
+
+	// the last sector is kept while the host is unavailable
+	now = now.Add(time.Hour)
+	f.err = errors.New("unreachable")
+	if sector, err := s.SectorIdentifier(c); err != nil || sector != "sector.example.org" {
+		t.Errorf("SectorIdentifier:\n - got: %v, %v\n - want: %v\n", sector, err, "sector.example.org")
+	}
+	s.SectorIdentifier(c)
+	if f.fetched != 2 {
+		t.Errorf("Fetched while unavailable:\n - got: %v\n - want: %v\n", f.fetched, 2)
+	}
+
+	// an unknown client doesn't fetch on every request either
+	other := th.NewTestClient(0, "client_id_02", "client_secret_02",
+		"https://client2.example.org/callback", "RS256", nil, "")
+	other.SetSectorIdentifierURI("https://sector.example.org/uris.json")
+	s.SectorIdentifier(other)
+	if _, err := s.SectorIdentifier(other); err == nil {
+		t.Error("fetch failure should be returned")
+	}
+	if f.fetched != 3 {
+		t.Errorf("Fetched for failure:\n - got: %v\n - want: %v\n", f.fetched, 3)
+	}
+
+	f.err = nil
+	s.Refresh(c.GetId())
+	s.SectorIdentifier(c)
+	if f.fetched != 4 {
+		t.Errorf("Fetched after Refresh:\n - got: %v\n - want: %v\n", f.fetched, 4)
+	}
+}
+
+func TestPairwiseFindUserId(t *testing.T) {
+	ms := memstore.New("http://example.org/")
+	ms.SetPasswordHasher(clientsecret.Bcrypt(bcrypt.MinCost))
+	user, _ := ms.CreateUser("user01", "pass01")
+	store := bridge.BindDataInterface(context.Background(), ms)
+	c1 := th.NewTestClient(user.Id, "client_id_01", "client_secret_01",
+		"https://client1.example.org/callback", "RS256", nil, "")
+	c2 := th.NewTestClient(user.Id, "client_id_02", "client_secret_02",
+		"https://client2.example.org/callback", "RS256", nil, "")
+
+	s := Pairwise("salt")
+	info, _ := store.CreateOrUpdateAuthInfo(user.Id, c1.GetId(), "openid", nil)
+	if _, err := s.FindUserId(store, c1, "unknown"); err == nil {
+		t.Error("subject never issued should be rejected")
+	}
+	sub, err := s.Subject(store, c1, info)
+	if err != nil {
+		t.Errorf("failed to generate subject: %s", err)
+		return
+	}
+
+	uid, serr := s.FindUserId(store, c1, sub)
+	if serr != nil {
+		t.Error("failed to find user id by subject")
+		return
+	}
+	if uid != user.Id {
+		t.Errorf("FindUserId:\n - got: %v\n - want: %v\n", uid, user.Id)
+	}
+
+	if _, err := s.FindUserId(store, c2, sub); err == nil {
+		t.Error("subject issued for another sector should be rejected")
+	}
+}
@@ -1,13 +1,17 @@
 package test_helper
 
+import "github.com/lyokato/goidc/authorization"
+
 type (
 	TestAuthInfo struct {
 		id           int64
 		clientId     string
 		userId       int64
 		scope        string
+		details      []authorization.Detail
 		subject      string
 		authorizedAt int64
+		acr          string
 
 		Enabled bool
 	}
@@ -25,6 +29,10 @@ func (i *TestAuthInfo) GetScope() string {
 	return i.scope
 }
 
+func (i *TestAuthInfo) GetAuthorizationDetails() []authorization.Detail {
+	return i.details
+}
+
 func (i *TestAuthInfo) GetUserId() int64 {
 	return i.userId
 }
@@ -33,10 +41,22 @@ func (i *TestAuthInfo) GetSubject() string {
 	return i.subject
 }
 
+func (i *TestAuthInfo) SetSubject(sub string) {
+	i.subject = sub
+}
+
 func (i *TestAuthInfo) GetAuthorizedAt() int64 {
 	return i.authorizedAt
 }
 
+func (i *TestAuthInfo) SetACR(acr string) {
+	i.acr = acr
+}
+
+func (i *TestAuthInfo) GetACR() string {
+	return i.acr
+}
+
 func (i *TestAuthInfo) IsActive() bool {
 	return true
 }
@@ -9,6 +9,7 @@ type (
 		expiresIn    int64
 		codeVerifier string
 		nonce        string
+		resources    []string
 
 		Enabled bool
 	}
@@ -50,3 +51,7 @@ func (s *TestAuthSession) GetRedirectURI() string {
 func (s *TestAuthSession) GetNonce() string {
 	return s.nonce
 }
+
+func (s *TestAuthSession) GetResources() []string {
+	return s.resources
+}
@@ -1,26 +1,38 @@
 package test_helper
 
 import (
+	"github.com/lyokato/goidc/clientsecret"
 	"github.com/lyokato/goidc/flow"
 	"github.com/lyokato/goidc/prompt"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// cheap hasher to keep the tests fast
+var testSecretHasher = clientsecret.Bcrypt(bcrypt.MinCost)
+
 type (
 	TestClient struct {
 		id           string
 		ownerId      int64
 		secret       string
+		secrets      []*clientsecret.Secret
+		authMethod   string
 		redirectURI  string
+		sectorURI    string
 		idTokenAlg   string
 		idTokenKeyId string
 		idTokenKey   interface{}
+		encAlg       string
+		encEnc       string
+		encKey       interface{}
 		grantTypes   map[string]bool
+		resources    map[string]bool
 		Enabled      bool
 	}
 )
 
 func NewTestClient(ownerId int64, id, secret, redirectURI, alg string, key interface{}, keyId string) *TestClient {
-	return &TestClient{
+	c := &TestClient{
 		ownerId:      ownerId,
 		id:           id,
 		secret:       secret,
@@ -29,8 +41,28 @@ func NewTestClient(ownerId int64, id, secret, redirectURI, alg string, key inter
 		idTokenKey:   key,
 		idTokenKeyId: keyId,
 		grantTypes:   make(map[string]bool, 0),
+		resources:    make(map[string]bool, 0),
+		secrets:      make([]*clientsecret.Secret, 0),
 		Enabled:      true,
 	}
+	c.AddSecret(secret, 0)
+	return c
+}
+
+// AddSecret registers another secret, as rotation does.
+func (c *TestClient) AddSecret(secret string, expiresAt int64) {
+	s, err := clientsecret.New(testSecretHasher, secret, expiresAt)
+	if err != nil {
+		panic(err)
+	}
+	c.secrets = append(c.secrets, s)
+}
+
+// ExpireSecrets sets expiresAt to all the registered secrets.
+func (c *TestClient) ExpireSecrets(expiresAt int64) {
+	for _, s := range c.secrets {
+		s.ExpiresAt = expiresAt
+	}
 }
 
 func (c *TestClient) AllowToUseGrantType(gt string) {
@@ -54,6 +86,31 @@ func (c *TestClient) CanUseRedirectURI(url string) bool {
 	return (c.redirectURI == url)
 }
 
+func (c *TestClient) AllowToUseResource(resource string) {
+	c.resources[resource] = true
+}
+
+func (c *TestClient) CanUseResource(resource string) bool {
+	allowed, exists := c.resources[resource]
+	if exists {
+		return allowed
+	} else {
+		return false
+	}
+}
+
+func (c *TestClient) GetRedirectURIs() []string {
+	return []string{c.redirectURI}
+}
+
+func (c *TestClient) SetSectorIdentifierURI(uri string) {
+	c.sectorURI = uri
+}
+
+func (c *TestClient) GetSectorIdentifierURI() string {
+	return c.sectorURI
+}
+
 func (c *TestClient) CanUseScope(flowType flow.FlowType, scope string) bool {
 	return true
 }
@@ -66,8 +123,16 @@ func (c *TestClient) GetId() string {
 	return c.id
 }
 
-func (c *TestClient) MatchSecret(secret string) bool {
-	return c.secret == secret
+func (c *TestClient) GetClientSecrets() []*clientsecret.Secret {
+	return c.secrets
+}
+
+func (c *TestClient) SetTokenEndpointAuthMethod(method string) {
+	c.authMethod = method
+}
+
+func (c *TestClient) GetTokenEndpointAuthMethod() string {
+	return c.authMethod
 }
 
 func (c *TestClient) GetIdTokenAlg() string {
@@ -82,6 +147,24 @@ func (c *TestClient) GetIdTokenKey() interface{} {
 	return c.idTokenKey
 }
 
+func (c *TestClient) SetIdTokenEncryption(alg, enc string, key interface{}) {
+	c.encAlg = alg
+	c.encEnc = enc
+	c.encKey = key
+}
+
+func (c *TestClient) GetIdTokenEncryptedResponseAlg() string {
+	return c.encAlg
+}
+
+func (c *TestClient) GetIdTokenEncryptedResponseEnc() string {
+	return c.encEnc
+}
+
+func (c *TestClient) GetIdTokenEncryptionKey() interface{} {
+	return c.encKey
+}
+
 func (c *TestClient) GetNoConsentPromptPolicy() prompt.NoConsentPromptPolicy {
 	return prompt.NoConsentPromptPolicyForceConsent
 }
@@ -1,5 +1,7 @@
 package test_helper
 
+import "github.com/lyokato/goidc/authorization"
+
 type (
 	TestOAuthToken struct {
 		authId int64
@@ -11,12 +13,16 @@ type (
 		refreshToken          string
 		refreshTokenExpiresIn int64
 		createdAt             int64
+
+		resources []string
+		audience  []string
+		details   []authorization.Detail
 	}
 )
 
 func NewTestOAuthToken(authId int64, accessToken string, accessTokenExpiresIn, refreshedAt int64,
 	refreshToken string, refreshTokenExpiresIn, createdAt int64) *TestOAuthToken {
-	return &TestOAuthToken{authId, accessToken, accessTokenExpiresIn, refreshedAt, refreshToken, refreshTokenExpiresIn, createdAt}
+	return &TestOAuthToken{authId, accessToken, accessTokenExpiresIn, refreshedAt, refreshToken, refreshTokenExpiresIn, createdAt, nil, nil, nil}
 }
 
 func (t *TestOAuthToken) GetAuthId() int64 {
@@ -46,3 +52,15 @@ func (t *TestOAuthToken) GetRefreshedAt() int64 {
 func (t *TestOAuthToken) GetCreatedAt() int64 {
 	return t.createdAt
 }
+
+func (t *TestOAuthToken) GetResources() []string {
+	return t.resources
+}
+
+func (t *TestOAuthToken) GetAudience() []string {
+	return t.audience
+}
+
+func (t *TestOAuthToken) GetAuthorizationDetails() []authorization.Detail {
+	return t.details
+}
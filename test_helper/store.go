@@ -23,6 +23,7 @@ type (
 		userIdPod     int64
 		infoIdPod     int64
 		users         map[int64]*TestUser
+		subjects      map[string]int64
 		clients       map[string]*TestClient
 		infos         map[int64]*TestAuthInfo
 		sessions      map[string]*TestAuthSession
@@ -54,6 +55,7 @@ tpgdYZY2kFpD7Nv0TxlmCsXf4JL/+Vd7pFtUuZVdNpfy
 		userIdPod:     0,
 		infoIdPod:     0,
 		users:         make(map[int64]*TestUser, 0),
+		subjects:      make(map[string]int64, 0),
 		clients:       make(map[string]*TestClient, 0),
 		infos:         make(map[int64]*TestAuthInfo, 0),
 		sessions:      make(map[string]*TestAuthSession, 0),
@@ -68,6 +70,11 @@ func (s *TestStore) CreateNewUser(name, pass string) *TestUser {
 	return u
 }
 
+func (s *TestStore) RecordSubject(uid int64, sub string) *bridge.Error {
+	s.subjects[sub] = uid
+	return nil
+}
+
 func (s *TestStore) CreateNewClient(ownerId int64, id, secret, redirectURI string) *TestClient {
 	c := NewTestClient(ownerId, id, secret, redirectURI, "RS256", s.privKey, "my_service_key_id")
 	s.clients[c.GetId()] = c
@@ -83,11 +90,13 @@ func (s *TestStore) CreateAuthSession(info bridge.AuthInfo, session *authorizati
 		expiresIn:    session.ExpiresIn,
 		codeVerifier: session.CodeVerifier,
 		nonce:        session.Nonce,
+		resources:    session.Resources,
 	}
 	return nil
 }
 
-func (s *TestStore) CreateOrUpdateAuthInfo(uid int64, clientId, scope string) (bridge.AuthInfo, *bridge.Error) {
+func (s *TestStore) CreateOrUpdateAuthInfo(uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
 
 	i, exists := s.findAuthInfoByUserAndClient(uid, clientId)
 	if !exists {
@@ -103,6 +112,7 @@ func (s *TestStore) CreateOrUpdateAuthInfo(uid int64, clientId, scope string) (b
 	}
 	i.subject = fmt.Sprintf("%d", uid)
 	i.scope = scope
+	i.details = details
 	return i, nil
 }
 
@@ -126,6 +136,7 @@ func (s *TestStore) ClearAll() {
 	s.ClearAuthData()
 	s.userIdPod = 0
 	s.users = make(map[int64]*TestUser, 0)
+	s.subjects = make(map[string]int64, 0)
 	s.clients = make(map[string]*TestClient, 0)
 }
 
@@ -195,7 +206,8 @@ func (s *TestStore) DisableSession(sess bridge.AuthSession) *bridge.Error {
 	return nil
 }
 
-func (s *TestStore) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool) (bridge.OAuthToken, *bridge.Error) {
+func (s *TestStore) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool, resources []string,
+	details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
 	avalue := fmt.Sprintf("ACCESS_TOKEN_%d", info.GetId())
 	rvalue := fmt.Sprintf("REFRESH_TOKEN_%d", info.GetId())
 	if !scope.IncludeOfflineAccess(info.GetScope()) {
@@ -203,6 +215,9 @@ func (s *TestStore) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool)
 	}
 	t := NewTestOAuthToken(info.GetId(), avalue, 60*60*24, time.Now().Unix(),
 		rvalue, 60*60*24*30, time.Now().Unix())
+	t.resources = resources
+	t.audience = resources
+	t.details = details
 	s.accessTokenes[t.GetAccessToken()] = t
 	return t, nil
 }
@@ -212,6 +227,9 @@ func (s *TestStore) RecordAssertionClaims(sub, jti string, iat, exp int64) *brid
 }
 
 func (s *TestStore) FindUserIdBySubject(sub string) (int64, *bridge.Error) {
+	if uid, exists := s.subjects[sub]; exists {
+		return uid, nil
+	}
 	for _, u := range s.users {
 		if u.Username == sub {
 			return u.Id, nil
@@ -220,12 +238,19 @@ func (s *TestStore) FindUserIdBySubject(sub string) (int64, *bridge.Error) {
 	return -1, bridge.NewError(bridge.ErrFailed)
 }
 
-func (s *TestStore) RefreshAccessToken(info bridge.AuthInfo, old bridge.OAuthToken) (bridge.OAuthToken, *bridge.Error) {
+func (s *TestStore) RefreshAccessToken(info bridge.AuthInfo, old bridge.OAuthToken, audience []string,
+	details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
 	oldToken := old.GetAccessToken()
 	token, _ := s.accessTokenes[oldToken]
 	token.accessToken = token.accessToken + ":R"
 	token.accessTokenExpiresIn = 60 * 60 * 24
 	token.refreshedAt = time.Now().Unix()
+	token.audience = audience
+	token.details = details
+	if c, exists := s.clients[info.GetClientId()]; exists &&
+		c.GetTokenEndpointAuthMethod() == "none" && token.refreshToken != "" {
+		token.refreshToken = token.refreshToken + ":R"
+	}
 
 	delete(s.accessTokenes, oldToken)
 	s.accessTokenes[token.accessToken] = token
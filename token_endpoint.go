@@ -3,14 +3,25 @@ package goidc
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/lyokato/goidc/assertion"
+	"github.com/lyokato/goidc/audit"
+	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
+	"github.com/lyokato/goidc/clientsecret"
 	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/id_token"
 	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/limiter"
 	"github.com/lyokato/goidc/log"
+	"github.com/lyokato/goidc/metrics"
 	oer "github.com/lyokato/goidc/oauth_error"
+	"github.com/lyokato/goidc/subject"
+	"github.com/lyokato/goidc/tracing"
 )
 
 const ClientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
@@ -33,10 +44,15 @@ type TokenEndpoint struct {
 	realm                        string
 	logger                       log.Logger
 	handlers                     map[string]grant.GrantHandlerFunc
+	config                       *grant.Config
 	errorURIBuilder              oer.OAuthErrorURIBuilder
 	clientSecretAcceptanceMethod CredentialAcceptanceMethod
 	acceptClientAssertion        bool
 	currentTime                  io.TimeBuilder
+	metrics                      metrics.Metrics
+	tracer                       tracing.Tracer
+	// clients whose broken secret is already logged
+	brokenSecretClients sync.Map
 }
 
 func (te *TokenEndpoint) AcceptClientSecret(
@@ -49,7 +65,59 @@ func (te *TokenEndpoint) AcceptClientAssertion(accept bool) {
 }
 
 func (te *TokenEndpoint) SetLogger(l log.Logger) {
-	te.logger = l
+	te.logger = log.Adapt(l)
+}
+
+func (te *TokenEndpoint) SetSubjectStrategy(strategy subject.Strategy) {
+	te.config.SubjectStrategy = strategy
+}
+
+// SetAuditSink makes the endpoint and grant handlers record security relevant events.
+func (te *TokenEndpoint) SetAuditSink(sink audit.Sink) {
+	te.config.AuditSink = sink
+}
+
+// SetMetrics makes the endpoint report requests, DataInterface calls and tokens to m.
+func (te *TokenEndpoint) SetMetrics(m metrics.Metrics) {
+	te.metrics = m
+}
+
+// SetTracer makes the endpoint start a span for each request,
+// and the child spans for DataInterface calls.
+func (te *TokenEndpoint) SetTracer(t tracing.Tracer) {
+	te.tracer = t
+}
+
+// SetLimiter makes the endpoint lock out client_id, username and
+// source IP after repeated authentication failures.
+func (te *TokenEndpoint) SetLimiter(l limiter.Limiter) {
+	te.config.Limiter = l
+}
+
+// SetClientAssertionPolicy applies p to client_assertion,
+// see assertion.DefaultPolicy.
+func (te *TokenEndpoint) SetClientAssertionPolicy(p *assertion.Policy) {
+	te.config.ClientAssertionPolicy = p
+}
+
+// SetJWTAssertionPolicy applies p to the assertion of the JWT grant.
+func (te *TokenEndpoint) SetJWTAssertionPolicy(p *assertion.Policy) {
+	te.config.JWTAssertionPolicy = p
+}
+
+// SetIdTokenExpiresIn sets the lifetime in seconds of the id_token issued on refresh,
+// authorization.DefaultIdTokenExpiresIn by default. The one issued with the code
+// follows the AuthSession.
+func (te *TokenEndpoint) SetIdTokenExpiresIn(expiresIn int64) {
+	te.config.IdTokenExpiresIn = expiresIn
+}
+
+func (te *TokenEndpoint) SetIdTokenClaimsHook(hook id_token.ClaimsHook) {
+	te.config.IdTokenClaimsHook = hook
+}
+
+func (te *TokenEndpoint) SetAuthorizationDetailsRegistry(reg *authorization.DetailsRegistry) {
+	te.config.AuthorizationDetailsRegistry = reg
 }
 
 func (te *TokenEndpoint) SetTimeBuilder(builder io.TimeBuilder) {
@@ -67,8 +135,9 @@ func (te *TokenEndpoint) SetErrorURIBuilder(builder oer.OAuthErrorURIBuilder) {
 func NewTokenEndpoint(realm string) *TokenEndpoint {
 	return &TokenEndpoint{
 		realm:                        realm,
-		logger:                       log.NewDefaultLogger(),
+		logger:                       log.Adapt(log.NewDefaultLogger()),
 		handlers:                     make(map[string]grant.GrantHandlerFunc),
+		config:                       grant.DefaultConfig(),
 		clientSecretAcceptanceMethod: FromHeader,
 		acceptClientAssertion:        false,
 		currentTime:                  io.NowBuilder(),
@@ -80,12 +149,23 @@ func (te *TokenEndpoint) Support(handler *grant.GrantHandler) {
 }
 
 func (te *TokenEndpoint) Handler(sdi bridge.DataInterface) http.HandlerFunc {
+	return te.HandlerContext(bridge.NewContextDataInterface(sdi))
+}
+
+// HandlerContext passes the context of each request to cdi.
+func (te *TokenEndpoint) HandlerContext(cdi bridge.ContextDataInterface) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		w, r, done := observeRequest(te.metrics, te.tracer, metrics.EndpointToken, w, r)
+		defer done()
+
+		sdi := observeDataInterface(r.Context(),
+			bridge.BindDataInterface(r.Context(), cdi), te.metrics, te.tracer)
+
 		if r.Method != "POST" {
 
-			te.logger.Debug(log.TokenEndpointLog("common", log.InvalidHTTPMethod,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry("common", log.InvalidHTTPMethod,
 				map[string]string{"http_method": r.Method},
 				"http method is not POST"))
 
@@ -96,7 +176,7 @@ func (te *TokenEndpoint) Handler(sdi bridge.DataInterface) http.HandlerFunc {
 		gt := r.FormValue("grant_type")
 		if gt == "" {
 
-			te.logger.Debug(log.TokenEndpointLog("common", log.MissingParam,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry("common", log.MissingParam,
 				map[string]string{"param": "grant_type"},
 				"'grant_type' not found"))
 
@@ -106,9 +186,11 @@ func (te *TokenEndpoint) Handler(sdi bridge.DataInterface) http.HandlerFunc {
 		}
 
 		h, exists := te.handlers[gt]
-		if !exists {
+		if exists {
+			observeGrant(w, gt, "")
+		} else {
 
-			te.logger.Debug(log.TokenEndpointLog("common", log.UnsupportedGrantType,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry("common", log.UnsupportedGrantType,
 				map[string]string{"grant_type": gt},
 				"unsupported 'grant_type'"))
 
@@ -139,7 +221,17 @@ func (te *TokenEndpoint) Handler(sdi bridge.DataInterface) http.HandlerFunc {
 			}
 		}
 
-		te.logger.Debug(log.TokenEndpointLog(gt, log.NoCredential,
+		// public client sends only 'client_id' in the body
+		cid = r.PostFormValue("client_id")
+		if cid != "" && r.PostFormValue("client_secret") == "" {
+			client, ok := te.validatePublicClient(w, r, sdi, gt, cid)
+			if ok {
+				te.executeGrantHandler(w, r, sdi, client, gt, h)
+			}
+			return
+		}
+
+		te.loggerFor(r).Debug(log.TokenEndpointEntry(gt, log.NoCredential,
 			map[string]string{"grant_type": gt},
 			"credential information not found."))
 
@@ -167,7 +259,7 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 			cid = found
 		} else {
 
-			te.logger.Debug(log.TokenEndpointLog(gt,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry(gt,
 				log.MissingParam,
 				map[string]string{"assertion": ca},
 				"'sub' not found in assertion"))
@@ -183,7 +275,7 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 
 			if serr.Type() == bridge.ErrFailed {
 
-				te.logger.Info(log.TokenEndpointLog(gt,
+				te.loggerFor(r).Info(log.TokenEndpointEntry(gt,
 					log.NoEnabledClient,
 					map[string]string{
 						"method":    "FindClientById",
@@ -196,7 +288,7 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 
 			} else if serr.Type() == bridge.ErrUnsupported {
 
-				te.logger.Error(log.TokenEndpointLog(gt,
+				te.loggerFor(r).Error(log.TokenEndpointEntry(gt,
 					log.InterfaceUnsupported,
 					map[string]string{"method": "FindClientById"},
 					"the method returns 'unsupported' error."))
@@ -205,22 +297,22 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 
 			} else {
 
-				te.logger.Warn(log.TokenEndpointLog(gt,
+				te.loggerFor(r).Warn(log.TokenEndpointEntry(gt,
 					log.InterfaceServerError,
 					map[string]string{
 						"method":    "FindClientById",
 						"assertion": ca,
 						"client_id": cid,
 					},
-					"interface returned ServerError"))
+					fmt.Sprintf("interface returned error: %s", serr)))
 
-				return nil, oer.NewOAuthSimpleError(oer.ErrServerError)
+				return nil, oer.NewInterfaceError(serr)
 			}
 
 		} else {
 			if c == nil {
 
-				te.logger.Error(log.TokenEndpointLog(gt,
+				te.loggerFor(r).Error(log.TokenEndpointEntry(gt,
 					log.InterfaceError,
 					map[string]string{
 						"method":    "FindClientById",
@@ -243,11 +335,42 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 			kid = found
 		}
 
+		method := client_auth.MethodForAssertion(alg)
+		if client_auth.MethodOf(c) != method {
+
+			te.loggerFor(r).Info(log.TokenEndpointEntry(gt,
+				log.AuthenticationFailed,
+				map[string]string{
+					"client_id": c.GetId(),
+					"method":    method,
+				},
+				"'token_endpoint_auth_method' mismatch"))
+
+			return nil, oer.NewOAuthError(oer.ErrInvalidClient,
+				fmt.Sprintf("client is not allowed to use %s", method))
+		}
+
 		key := c.GetAssertionKey(alg, kid)
 
+		// HMAC key is the shared secret, and it must not be
+		// a public key published for private_key_jwt, and vice versa.
+		if _, isSecret := key.([]byte); key != nil && isSecret != client_auth.IsHMAC(alg) {
+
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt,
+				log.InterfaceError,
+				map[string]string{
+					"client_id": c.GetId(),
+					"method":    "GetAssertionKey",
+				},
+				fmt.Sprintf("returns the key which can't be used for %s", alg)))
+
+			return nil, oer.NewOAuthError(oer.ErrInvalidClient,
+				fmt.Sprintf("key for %s not found", alg))
+		}
+
 		if key == nil {
 
-			te.logger.Debug(log.TokenEndpointLog(gt,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry(gt,
 				log.MissingParam,
 				map[string]string{
 					"assertion": ca,
@@ -261,8 +384,22 @@ func (te *TokenEndpoint) validateClientByAssertion(w http.ResponseWriter,
 		}
 	})
 
-	err := assertion.HandleAssertionError(ca, t, jwt_err, gt, c, sdi, te.logger)
+	err := assertion.HandleAssertionError(ca, t, jwt_err, gt, c, sdi, te.loggerFor(r),
+		&assertion.Options{
+			AuditSink: te.config.AuditSink,
+			Policy:    te.config.ClientAssertionPolicy,
+			Now:       te.currentTime(),
+
+			ClientAuthentication: true,
+		})
 	if err != nil {
+		if err.Type != oer.ErrServerError && err.Type != oer.ErrTemporarilyUnavailable {
+			cid := ""
+			if c != nil {
+				cid = c.GetId()
+			}
+			te.recordClientAuthenticationFailure(r, gt, cid, err.Error())
+		}
 		te.fail(w, err)
 		return nil, false
 	}
@@ -274,21 +411,34 @@ func (te *TokenEndpoint) validateClientBySecret(w http.ResponseWriter,
 	r *http.Request, sdi bridge.DataInterface, gt, cid, sec string,
 	inHeader bool) (bridge.Client, bool) {
 
+	keys := []string{limiter.ClientKey(cid), limiter.ClientIPKey(limiter.SourceIP(r))}
+	if d := grant.CheckLockout(gt, te.config, te.loggerFor(r), te.currentTime(), keys...); d > 0 {
+
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.TooManyFailures,
+			map[string]string{"client_id": cid},
+			"the client is locked out."))
+
+		te.failByInvalidClientError(w, inHeader, d)
+		return nil, false
+	}
+
 	client, err := sdi.FindClientById(cid)
 
 	if err != nil {
 		if err.Type() == bridge.ErrFailed {
 
-			te.logger.Debug(log.TokenEndpointLog(gt, log.NoEnabledClient,
+			te.loggerFor(r).Debug(log.TokenEndpointEntry(gt, log.NoEnabledClient,
 				map[string]string{"method": "FindClientById", "client_id": cid},
 				"client not found."))
 
-			te.failByInvalidClientError(w, inHeader)
+			te.recordClientAuthenticationFailure(r, gt, cid, "client not found")
+			te.failByInvalidClientError(w, inHeader,
+				grant.RecordFailure(gt, te.config, te.loggerFor(r), te.currentTime(), keys...))
 			return nil, false
 
 		} else if err.Type() == bridge.ErrUnsupported {
 
-			te.logger.Error(log.TokenEndpointLog(gt, log.InterfaceUnsupported,
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt, log.InterfaceUnsupported,
 				map[string]string{"method": "FindClientById"},
 				"the method returns 'unsupported' error."))
 
@@ -296,17 +446,17 @@ func (te *TokenEndpoint) validateClientBySecret(w http.ResponseWriter,
 			return nil, false
 
 		} else {
-			te.logger.Warn(log.TokenEndpointLog(gt, log.InterfaceServerError,
+			te.loggerFor(r).Warn(log.TokenEndpointEntry(gt, log.InterfaceServerError,
 				map[string]string{"method": "FindClientById", "client_id": cid},
-				"interface returned ServerError"))
+				fmt.Sprintf("interface returned error: %s", err)))
 
-			te.fail(w, oer.NewOAuthSimpleError(oer.ErrServerError))
+			te.fail(w, oer.NewInterfaceError(err))
 			return nil, false
 		}
 	} else {
 		if client == nil {
 
-			te.logger.Error(log.TokenEndpointLog(gt, log.InterfaceError,
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt, log.InterfaceError,
 				map[string]string{"method": "FindClientById", "client_id": cid},
 				"the method returns (nil, nil)."))
 
@@ -314,21 +464,130 @@ func (te *TokenEndpoint) validateClientBySecret(w http.ResponseWriter,
 			return nil, false
 		}
 	}
-	if !client.MatchSecret(sec) {
+	matched, merr := clientsecret.Match(client.GetClientSecrets(), sec, te.currentTime())
+	if merr != nil {
+		// anyone can cause this with a wrong secret, so it's logged once for each client,
+		// and the request fails as the mismatch.
+		if _, logged := te.brokenSecretClients.LoadOrStore(cid, true); !logged {
+
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt, log.InterfaceError,
+				map[string]string{"method": "GetClientSecrets", "client_id": cid},
+				fmt.Sprintf("the method returns broken secret: %s", merr)))
+
+		}
+		matched = clientsecret.NotMatched
+	}
+	if matched == clientsecret.Expired {
 
-		te.logger.Info(log.TokenEndpointLog(gt, log.AuthenticationFailed,
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.AuthenticationFailed,
+			map[string]string{"client_id": cid}, "'client_secret' expired."))
+
+		te.recordClientAuthenticationFailure(r, gt, cid, "client_secret expired")
+		te.failByInvalidClientError(w, inHeader,
+			grant.RecordFailure(gt, te.config, te.loggerFor(r), te.currentTime(), keys...))
+		return nil, false
+	}
+	if matched != clientsecret.Matched {
+
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.AuthenticationFailed,
 			map[string]string{
 				"client_id":       cid,
 				"remote_addr":     r.Header.Get("REMOTE_ADDR"),
 				"x-forwarded-for": r.Header.Get("X-FORWARDED-FOR"),
 			}, "'client_secret' mismatch."))
 
-		te.failByInvalidClientError(w, inHeader)
+		te.recordClientAuthenticationFailure(r, gt, cid, "client_secret mismatch")
+		te.failByInvalidClientError(w, inHeader,
+			grant.RecordFailure(gt, te.config, te.loggerFor(r), te.currentTime(), keys...))
+		return nil, false
+	}
+	grant.RecordSuccess(gt, te.config, te.loggerFor(r), limiter.ClientKey(cid))
+
+	method := client_auth.ClientSecretPost
+	if inHeader {
+		method = client_auth.ClientSecretBasic
+	}
+	if client_auth.MethodOf(client) != method {
+
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.AuthenticationFailed,
+			map[string]string{"client_id": cid, "method": method},
+			"'token_endpoint_auth_method' mismatch."))
+
+		te.recordClientAuthenticationFailure(r, gt, cid, "token_endpoint_auth_method mismatch")
+		te.failByInvalidClientError(w, inHeader, 0)
 		return nil, false
 	}
 	if !client.CanUseGrantType(gt) {
 
-		te.logger.Info(log.TokenEndpointLog(gt, log.UnauthorizedGrantType,
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.UnauthorizedGrantType,
+			map[string]string{"client_id": cid}, "unauthorized 'grant_type'."))
+
+		te.fail(w, oer.NewOAuthSimpleError(oer.ErrUnauthorizedClient))
+		return nil, false
+	}
+
+	return client, true
+}
+
+// validatePublicClient authenticates the client with 'none' method,
+// which is allowed only for the grants in grant.AllowedForPublicClient.
+func (te *TokenEndpoint) validatePublicClient(w http.ResponseWriter,
+	r *http.Request, sdi bridge.DataInterface, gt, cid string) (bridge.Client, bool) {
+
+	client, err := sdi.FindClientById(cid)
+
+	if err != nil {
+		if err.Type() == bridge.ErrFailed {
+
+			te.loggerFor(r).Debug(log.TokenEndpointEntry(gt, log.NoEnabledClient,
+				map[string]string{"method": "FindClientById", "client_id": cid},
+				"client not found."))
+
+			te.recordClientAuthenticationFailure(r, gt, cid, "client not found")
+			te.fail(w, oer.NewOAuthSimpleError(oer.ErrInvalidClient))
+			return nil, false
+
+		} else if err.Type() == bridge.ErrUnsupported {
+
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt, log.InterfaceUnsupported,
+				map[string]string{"method": "FindClientById"},
+				"the method returns 'unsupported' error."))
+
+			te.fail(w, oer.NewOAuthSimpleError(oer.ErrServerError))
+			return nil, false
+
+		} else {
+			te.loggerFor(r).Warn(log.TokenEndpointEntry(gt, log.InterfaceServerError,
+				map[string]string{"method": "FindClientById", "client_id": cid},
+				fmt.Sprintf("interface returned error: %s", err)))
+
+			te.fail(w, oer.NewInterfaceError(err))
+			return nil, false
+		}
+	} else {
+		if client == nil {
+
+			te.loggerFor(r).Error(log.TokenEndpointEntry(gt, log.InterfaceError,
+				map[string]string{"method": "FindClientById", "client_id": cid},
+				"the method returns (nil, nil)."))
+
+			te.fail(w, oer.NewOAuthSimpleError(oer.ErrServerError))
+			return nil, false
+		}
+	}
+	if !client_auth.IsPublic(client) {
+
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.AuthenticationFailed,
+			map[string]string{"client_id": cid, "method": client_auth.None},
+			"'token_endpoint_auth_method' mismatch."))
+
+		te.recordClientAuthenticationFailure(r, gt, cid, "token_endpoint_auth_method mismatch")
+		te.fail(w, oer.NewOAuthSimpleError(oer.ErrInvalidClient))
+		return nil, false
+	}
+	if !grant.AllowedForPublicClient(gt) || !client.CanUseGrantType(gt) {
+
+		te.loggerFor(r).Info(log.TokenEndpointEntry(gt, log.UnauthorizedGrantType,
 			map[string]string{"client_id": cid}, "unauthorized 'grant_type'."))
 
 		te.fail(w, oer.NewOAuthSimpleError(oer.ErrUnauthorizedClient))
@@ -341,24 +600,56 @@ func (te *TokenEndpoint) validateClientBySecret(w http.ResponseWriter,
 func (te *TokenEndpoint) executeGrantHandler(w http.ResponseWriter,
 	r *http.Request, sdi bridge.DataInterface,
 	client bridge.Client, gt string, h grant.GrantHandlerFunc) {
-	res, oerr := h(r, client, sdi, te.logger, te.currentTime())
+	observeGrant(w, gt, client.GetId())
+	res, oerr := h(r, client, sdi, te.loggerFor(r), te.currentTime(), te.config)
 	if oerr != nil {
 		te.fail(w, oerr)
 		return
 	} else {
-		te.logger.Debug(log.TokenEndpointLog(gt, log.AccessTokenGranted,
+		te.loggerFor(r).Debug(log.TokenEndpointEntry(gt, log.AccessTokenGranted,
 			map[string]string{"client_id": client.GetId()},
 			"granted successfully"))
+		te.countToken(gt, client.GetId())
 		te.success(w, res)
 		return
 	}
 }
 
-func (te *TokenEndpoint) failByInvalidClientError(w http.ResponseWriter, inHeader bool) {
+func (te *TokenEndpoint) countToken(gt, cid string) {
+	if te.metrics == nil {
+		return
+	}
+	if gt == grant.TypeRefreshToken {
+		te.metrics.CountToken(metrics.TokenRefreshed, gt, cid)
+	} else {
+		te.metrics.CountToken(metrics.TokenIssued, gt, cid)
+	}
+}
+
+func (te *TokenEndpoint) recordClientAuthenticationFailure(r *http.Request,
+	gt, cid, reason string) {
+	e := audit.NewEvent(audit.ClientAuthenticationFailed, te.currentTime(), audit.Failure)
+	if cid != "" {
+		e.ByClient(cid)
+		e.ClientId = cid
+	}
+	e.GrantType = gt
+	e.Reason = reason
+	audit.Record(te.config.AuditSink, te.loggerFor(r), e)
+}
+
+// failByInvalidClientError responds invalid_client,
+// with 'Retry-After' when the client is locked out.
+func (te *TokenEndpoint) failByInvalidClientError(w http.ResponseWriter, inHeader bool,
+	lockout time.Duration) {
+	err := oer.NewOAuthSimpleError(oer.ErrInvalidClient)
+	if lockout > 0 {
+		err = grant.LockoutError(oer.ErrInvalidClient, lockout)
+	}
 	if inHeader {
-		te.failWithAuthHeader(w, oer.NewOAuthSimpleError(oer.ErrInvalidClient))
+		te.failWithAuthHeader(w, err)
 	} else {
-		te.fail(w, oer.NewOAuthSimpleError(oer.ErrInvalidClient))
+		te.fail(w, err)
 	}
 }
 
@@ -414,8 +705,10 @@ func (te *TokenEndpoint) success(w http.ResponseWriter, res *grant.Response) {
 }
 
 func (te *TokenEndpoint) failWithAuthHeader(w http.ResponseWriter, err *oer.OAuthError) {
+	observeError(w, err)
 	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", te.realm))
 	setCommonResponseHeader(w)
+	err.SetRetryAfter(w.Header())
 	if err.URI == "" && te.errorURIBuilder != nil {
 		err.URI = te.errorURIBuilder(err.Type)
 	}
@@ -423,8 +716,14 @@ func (te *TokenEndpoint) failWithAuthHeader(w http.ResponseWriter, err *oer.OAut
 	w.Write(err.JSON())
 }
 
+func (te *TokenEndpoint) loggerFor(r *http.Request) log.Logger {
+	return log.ForRequest(te.logger, r)
+}
+
 func (te *TokenEndpoint) fail(w http.ResponseWriter, err *oer.OAuthError) {
+	observeError(w, err)
 	setCommonResponseHeader(w)
+	err.SetRetryAfter(w.Header())
 	if err.URI == "" && te.errorURIBuilder != nil {
 		err.URI = te.errorURIBuilder(err.Type)
 	}
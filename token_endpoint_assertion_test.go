@@ -6,7 +6,10 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/lyokato/goidc/assertion"
 	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
 	"github.com/lyokato/goidc/grant"
 	th "github.com/lyokato/goidc/test_helper"
 )
@@ -23,8 +26,9 @@ func TestTokenEndpointClientAssertion(t *testing.T) {
 	user := sdi.CreateNewUser("user01", "pass01")
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
 	client.AllowToUseGrantType("authorization_code")
+	client.SetTokenEndpointAuthMethod(client_auth.ClientSecretJWT)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -94,7 +98,7 @@ func TestTokenEndpointClientAssertion(t *testing.T) {
 		t.Errorf("failed to sign jwt, %s", err)
 	}
 
-	info, _ = sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ = sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -416,3 +420,133 @@ func TestTokenEndpointClientAssertion(t *testing.T) {
 			"error": th.NewStrMatcher("invalid_client"),
 		})
 }
+
+func TestTokenEndpointClientAssertionPolicy(t *testing.T) {
+
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+	te.AcceptClientAssertion(true)
+	te.SetClientAssertionPolicy(assertion.DefaultPolicy())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+	client.SetTokenEndpointAuthMethod(client_auth.ClientSecretJWT)
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["aud"] = "http://example.org/"
+		claims["iss"] = "client_id_01"
+		claims["sub"] = "client_id_01"
+		a, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+			SignedString(client.GetAssertionKey("", ""))
+		if err != nil {
+			t.Errorf("failed to sign jwt, %s", err)
+		}
+		return a
+	}
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		ca     string
+		code   int
+		errTyp string
+	}{
+		{"missing jti", sign(jwt.MapClaims{"iat": now, "exp": now + 60}), 400, "invalid_client"},
+		{"too long", sign(jwt.MapClaims{"jti": "jti01", "iat": now, "exp": now + 60*60}), 400, "invalid_client"},
+		{"valid", sign(jwt.MapClaims{"jti": "jti02", "iat": now, "exp": now + 60}), 200, ""},
+		{"replayed", sign(jwt.MapClaims{"jti": "jti02", "iat": now, "exp": now + 60}), 400, "invalid_client"},
+	}
+	for _, test := range tests {
+		values := map[string]string{
+			"grant_type":            "client_credentials",
+			"client_assertion":      test.ca,
+			"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+		}
+		headers := map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded; charset=UTF-8",
+		}
+		if test.code == 200 {
+			th.PostFormValueRequestWithJSONResponse(t, ts, values, headers, 200,
+				map[string]th.Matcher{})
+		} else {
+			th.TokenEndpointErrorTest(t, ts, values, headers, test.code,
+				map[string]th.Matcher{},
+				map[string]th.Matcher{"error": th.NewStrMatcher(test.errTyp)})
+		}
+	}
+}
+
+// testAssertionStore counts the calls of RecordAssertionClaims.
+type testAssertionStore struct {
+	*th.TestStore
+	recorded int
+}
+
+func (s *testAssertionStore) RecordAssertionClaims(sub, jti string, iat, exp int64) *bridge.Error {
+	s.recorded++
+	return s.TestStore.RecordAssertionClaims(sub, jti, iat, exp)
+}
+
+func TestTokenEndpointClientAssertionReplayCacheBeforeRecord(t *testing.T) {
+
+	for _, skip := range []bool{false, true} {
+		te := NewTokenEndpoint("api.example.org")
+		te.Support(grant.ClientCredentials())
+		te.AcceptClientAssertion(true)
+		policy := assertion.DefaultPolicy()
+		policy.SkipRecordAssertionClaims = skip
+		te.SetClientAssertionPolicy(policy)
+
+		sdi := th.NewTestStore()
+		user := sdi.CreateNewUser("user01", "pass01")
+		client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+		client.AllowToUseGrantType(grant.TypeClientCredentials)
+		client.SetTokenEndpointAuthMethod(client_auth.ClientSecretJWT)
+
+		store := &testAssertionStore{TestStore: sdi}
+		ts := httptest.NewServer(te.Handler(store))
+
+		now := time.Now().Unix()
+		a, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"aud": "http://example.org/",
+			"iss": "client_id_01",
+			"sub": "client_id_01",
+			"jti": "jti01",
+			"iat": now,
+			"exp": now + 60,
+		}).SignedString(client.GetAssertionKey("", ""))
+		if err != nil {
+			t.Errorf("failed to sign jwt, %s", err)
+		}
+		values := map[string]string{
+			"grant_type":            "client_credentials",
+			"client_assertion":      a,
+			"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+		}
+		headers := map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded; charset=UTF-8",
+		}
+		th.PostFormValueRequestWithJSONResponse(t, ts, values, headers, 200,
+			map[string]th.Matcher{})
+
+		// the replay is rejected by ReplayCache, and doesn't reach the store
+		th.TokenEndpointErrorTest(t, ts, values, headers, 400,
+			map[string]th.Matcher{},
+			map[string]th.Matcher{"error": th.NewStrMatcher("invalid_client")})
+		ts.Close()
+
+		expected := 1
+		if skip {
+			expected = 0
+		}
+		if store.recorded != expected {
+			t.Errorf("RecordAssertionClaims calls (skip: %v):\n - got: %v\n - want: %v\n",
+				skip, store.recorded, expected)
+		}
+	}
+}
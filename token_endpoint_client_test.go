@@ -1,12 +1,29 @@
 package goidc
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt"
+	"github.com/lyokato/goidc/audit"
+	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/basic_auth"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
 	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/metrics"
 	th "github.com/lyokato/goidc/test_helper"
+	"github.com/lyokato/goidc/tracing"
 )
 
 func TestTokenEndpointClientCredential(t *testing.T) {
@@ -66,3 +83,337 @@ func TestTokenEndpointClientCredential(t *testing.T) {
 		nil)
 
 }
+
+func TestTokenEndpointClientCredentialWithAuthorizationDetails(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+		"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+	}
+	details := `[{"actions":["initiate"],"type":"payment_initiation"}]`
+
+	// registry is not set
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":            "client_credentials",
+			"authorization_details": details,
+		},
+		headers,
+		400,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_authorization_details"),
+		})
+
+	reg := authorization.NewDetailsRegistry()
+	reg.Register("payment_initiation", nil)
+	te.SetAuthorizationDetailsRegistry(reg)
+
+	// unknown type
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":            "client_credentials",
+			"authorization_details": `[{"type":"unknown"}]`,
+		},
+		headers,
+		400,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		},
+		map[string]th.Matcher{
+			"error":             th.NewStrMatcher("invalid_authorization_details"),
+			"error_description": th.NewStrMatcher("unsupported 'type': 'unknown'"),
+		})
+
+	result := th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":            "client_credentials",
+			"authorization_details": details,
+		},
+		headers,
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	actual, _ := json.Marshal(result["authorization_details"])
+	if string(actual) != details {
+		t.Errorf("authorization_details:\n - got: %v\n - want: %v\n", string(actual), details)
+	}
+}
+
+type testUnavailableStore struct {
+	*th.TestStore
+}
+
+func (s *testUnavailableStore) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	return nil, bridge.NewTemporarilyUnavailableError(120, errors.New("connection refused"))
+}
+
+func TestTokenEndpointTemporarilyUnavailable(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	r := httptest.NewRequest("POST", "/token",
+		strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", basic_auth.Header("client_id_01", "client_secret_01"))
+
+	w := httptest.NewRecorder()
+	te.Handler(&testUnavailableStore{sdi})(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Status code:\n - got: %v\n - want: %v\n", w.Code, http.StatusServiceUnavailable)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "120" {
+		t.Errorf("Retry-After:\n - got: %v\n - want: %v\n", ra, "120")
+	}
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["error"] != "temporarily_unavailable" {
+		t.Errorf("error:\n - got: %v\n - want: %v\n", body["error"], "temporarily_unavailable")
+	}
+}
+
+func TestTokenEndpointClientCredentialWithAuditSink(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(1700000000))
+
+	sink := audit.NewMemorySink()
+	te.SetAuditSink(sink)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	for _, secret := range []string{"client_secret_01", "wrong_secret"} {
+		r := httptest.NewRequest("POST", "/token",
+			strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header("client_id_01", secret))
+		te.Handler(sdi)(httptest.NewRecorder(), r)
+	}
+
+	issued := sink.FindByType(audit.TokenIssued)
+	if len(issued) != 1 {
+		t.Errorf("token_issued:\n - got: %v\n - want: %v\n", len(issued), 1)
+		return
+	}
+	if issued[0].Actor != "client:client_id_01" || issued[0].Outcome != audit.Success ||
+		issued[0].GrantType != grant.TypeClientCredentials || issued[0].Time.Unix() != 1700000000 {
+		t.Errorf("unexpected event: %+v", issued[0])
+	}
+
+	failed := sink.FindByType(audit.ClientAuthenticationFailed)
+	if len(failed) != 1 || failed[0].ClientId != "client_id_01" || failed[0].Outcome != audit.Failure {
+		t.Errorf("unexpected events: %+v", failed)
+	}
+}
+
+func TestTokenEndpointClientCredentialWithMetrics(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+
+	reg := metrics.NewRegistry("")
+	te.SetMetrics(reg)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	for _, secret := range []string{"client_secret_01", "wrong_secret"} {
+		r := httptest.NewRequest("POST", "/token",
+			strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header("client_id_01", secret))
+		te.Handler(sdi)(httptest.NewRecorder(), r)
+	}
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+	actual := buf.String()
+	for _, expected := range []string{
+		`goidc_requests_total{endpoint="token_endpoint",grant_type="client_credentials",client_id="client_id_01",error=""} 1`,
+		`goidc_requests_total{endpoint="token_endpoint",grant_type="client_credentials",client_id="",error="invalid_client"} 1`,
+		`goidc_data_interface_duration_seconds_count{method="FindClientById",error=""} 2`,
+		`goidc_data_interface_duration_seconds_count{method="CreateOAuthToken",error=""} 1`,
+		`goidc_tokens_total{event="issued",grant_type="client_credentials",client_id="client_id_01"} 1`,
+	} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("Exposition:\n - got: %v\n - want: %v\n", actual, expected)
+		}
+	}
+}
+
+func TestTokenEndpointClientCredentialWithTracer(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+
+	tracer := tracing.NewMemoryTracer()
+	te.SetTracer(tracer)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	r := httptest.NewRequest("POST", "/token",
+		strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", basic_auth.Header("client_id_01", "client_secret_01"))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	te.Handler(sdi)(httptest.NewRecorder(), r)
+
+	found := tracer.FindByName("goidc.token_endpoint")
+	if len(found) != 1 {
+		t.Errorf("endpoint spans:\n - got: %v\n - want: %v\n", len(found), 1)
+		return
+	}
+	span := found[0]
+	if span.Context.TraceIdString() != "4bf92f3577b34da6a3ce929d0e0e4736" || !span.Ended {
+		t.Errorf("endpoint span should join the remote trace: %+v", span)
+	}
+	if span.Attributes[tracing.AttrGrantType] != grant.TypeClientCredentials ||
+		span.Attributes[tracing.AttrClientId] != "client_id_01" ||
+		span.Attributes[tracing.AttrOutcome] != tracing.OutcomeSuccess {
+		t.Errorf("unexpected attributes: %v", span.Attributes)
+	}
+
+	for _, name := range []string{"DataInterface.FindClientById", "DataInterface.CreateOAuthToken"} {
+		children := tracer.FindByName(name)
+		if len(children) != 1 || children[0].Parent.SpanId != span.Context.SpanId {
+			t.Errorf("%s should be a child of the endpoint span: %+v", name, children)
+		}
+	}
+}
+
+func TestTokenEndpointClientSecretRotation(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(1700000000))
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	// rotating: the old secret expires, and the new one is added
+	client.ExpireSecrets(1700000000)
+	client.AddSecret("client_secret_02", 0)
+
+	for secret, expected := range map[string]int{
+		"client_secret_01": http.StatusUnauthorized,
+		"client_secret_02": http.StatusOK,
+		"client_secret_03": http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("POST", "/token",
+			strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header("client_id_01", secret))
+		w := httptest.NewRecorder()
+		te.Handler(sdi)(w, r)
+
+		if w.Code != expected {
+			t.Errorf("Status code with %s:\n - got: %v\n - want: %v\n", secret, w.Code, expected)
+		}
+	}
+}
+
+func TestTokenEndpointClientAuthMethod(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.ClientCredentials())
+	te.AcceptClientSecret(FromAll)
+	te.AcceptClientAssertion(true)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"aud": "http://example.org/",
+			"iss": "client_id_01",
+			"sub": "client_id_01",
+			"exp": time.Now().Unix() + 60,
+		})
+		signed, _ := token.SignedString(key)
+		return signed
+	}
+
+	credentials := map[string]url.Values{
+		"basic": {},
+		"post":  {"client_id": {"client_id_01"}, "client_secret": {"client_secret_01"}},
+		"hmac": {
+			"client_assertion":      {sign(jwt.SigningMethodHS256, []byte("client_secret_01"))},
+			"client_assertion_type": {ClientAssertionTypeJWT},
+		},
+		"rsa": {
+			"client_assertion":      {sign(jwt.SigningMethodRS256, rsaKey)},
+			"client_assertion_type": {ClientAssertionTypeJWT},
+		},
+	}
+
+	for _, tc := range []struct {
+		method   string
+		auth     string
+		expected int
+	}{
+		{"", "basic", http.StatusOK},
+		{"", "post", http.StatusBadRequest},
+		{client_auth.ClientSecretBasic, "hmac", http.StatusBadRequest},
+		{client_auth.ClientSecretPost, "post", http.StatusOK},
+		{client_auth.ClientSecretPost, "basic", http.StatusUnauthorized},
+		{client_auth.ClientSecretJWT, "hmac", http.StatusOK},
+		{client_auth.ClientSecretJWT, "basic", http.StatusUnauthorized},
+		{client_auth.PrivateKeyJWT, "hmac", http.StatusBadRequest},
+		// the test client returns the shared secret as the key, which RS256 can't use
+		{client_auth.PrivateKeyJWT, "rsa", http.StatusBadRequest},
+		{client_auth.None, "basic", http.StatusUnauthorized},
+	} {
+		client.SetTokenEndpointAuthMethod(tc.method)
+
+		form := url.Values{"grant_type": {"client_credentials"}}
+		for k, v := range credentials[tc.auth] {
+			form[k] = v
+		}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.auth == "basic" {
+			r.Header.Set("Authorization", basic_auth.Header("client_id_01", "client_secret_01"))
+		}
+		w := httptest.NewRecorder()
+		te.Handler(sdi)(w, r)
+
+		if w.Code != tc.expected {
+			t.Errorf("Status code for '%s' with %s:\n - got: %v %s\n - want: %v\n", tc.method,
+				tc.auth, w.Code, w.Body.String(), tc.expected)
+		}
+		if tc.expected != http.StatusOK && !strings.Contains(w.Body.String(), "invalid_client") {
+			t.Errorf("Error for '%s':\n - got: %s\n - want: %v\n", tc.method,
+				w.Body.String(), "invalid_client")
+		}
+	}
+}
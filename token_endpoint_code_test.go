@@ -1,13 +1,23 @@
 package goidc
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/basic_auth"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
+	"github.com/lyokato/goidc/crypto"
 	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/jwe"
 	th "github.com/lyokato/goidc/test_helper"
 )
 
@@ -22,7 +32,7 @@ func TestTokenEndpointAuthorizationCodePKCE(t *testing.T) {
 
 	code_verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -209,7 +219,7 @@ func TestTokenEndpointAuthorizationCodeInvalidRequest(t *testing.T) {
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
 	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -320,7 +330,7 @@ func TestTokenEndpointAuthorizationCode(t *testing.T) {
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
 	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -369,6 +379,8 @@ func TestTokenEndpointAuthorizationCode(t *testing.T) {
 		AuthTime:     time.Now().Unix(),
 	})
 
+	client.SetTokenEndpointAuthMethod(client_auth.ClientSecretPost)
+
 	th.TokenEndpointSuccessTest(t, ts,
 		map[string]string{
 			"grant_type":    "authorization_code",
@@ -407,7 +419,7 @@ func TestTokenEndpointAuthorizationCodeWithoutOfflineAccess(t *testing.T) {
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
 	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -457,7 +469,7 @@ func TestTokenEndpointAuthorizationCodeWithoutOpenID(t *testing.T) {
 	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
 	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -494,3 +506,206 @@ func TestTokenEndpointAuthorizationCodeWithoutOpenID(t *testing.T) {
 		},
 		nil)
 }
+
+func TestTokenEndpointAuthorizationCodeWithEncryptedIdToken(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
+
+	encKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	client.SetIdTokenEncryption(jwe.AlgRSAOAEP, jwe.EncA128GCM, &encKey.PublicKey)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   int64(60 * 60 * 24),
+		Nonce:       "07dfa90f",
+		AuthTime:    time.Now().Unix(),
+	})
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	result := th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"code":         "code_value",
+			"redirect_uri": "http://example.org/callback",
+		},
+		map[string]string{
+			"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+			"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+		},
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	idt, _ := result["id_token"].(string)
+	signed, header, err := jwe.Decrypt(idt, encKey)
+	if err != nil {
+		t.Errorf("failed to decrypt id_token: %s", err)
+		return
+	}
+	if header.ContentType != jwe.ContentTypeJWT {
+		t.Errorf("cty:\n - got: %v\n - want: %v\n", header.ContentType, jwe.ContentTypeJWT)
+	}
+
+	pub, _ := crypto.LoadPublicKeyFromText(`-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCzFyUUfVGyMCbG7YIwgo4XdqEj
+hhgIZJ4Kr7VKwIc7F+x0DoBniO6uhU6HVxMPibxSDIGQIHoxP9HJPGF1XlEt7EMw
+ewb5Rcku33r+2QCETRmQMw68eZUZqdtgy1JFCFsFUcMwcVcfTqXU00UEevH9RFBH
+oqxJsRC0l1ybcs6o0QIDAQAB
+-----END PUBLIC KEY-----`)
+	token, err := jwt.Parse(string(signed), func(token *jwt.Token) (interface{}, error) {
+		return pub, nil
+	})
+	if err != nil {
+		t.Errorf("failed to verify nested id_token: %s", err)
+		return
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["aud"] != "client_id_01" || claims["nonce"] != "07dfa90f" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+}
+
+func TestTokenEndpointAuthorizationCodeWithIdTokenClaimsHook(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+	te.SetIdTokenClaimsHook(func(c bridge.Client, info bridge.AuthInfo,
+		r *http.Request) map[string]interface{} {
+		return map[string]interface{}{
+			"azp": c.GetId(),
+			"acr": "urn:example:loa:2",
+			"sub": "overwritten",
+		}
+	})
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   int64(60 * 60 * 24),
+		Nonce:       "07dfa90f",
+		AuthTime:    time.Now().Unix(),
+	})
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	result := th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"code":         "code_value",
+			"redirect_uri": "http://example.org/callback",
+		},
+		map[string]string{
+			"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+			"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+		},
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	idt, _ := result["id_token"].(string)
+	token, _, err := new(jwt.Parser).ParseUnverified(idt, jwt.MapClaims{})
+	if err != nil {
+		t.Errorf("failed to parse id_token: %s", err)
+		return
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["azp"] != "client_id_01" || claims["acr"] != "urn:example:loa:2" {
+		t.Errorf("claims from hook not found: %v", claims)
+	}
+	expectedSub := fmt.Sprintf("%d", user.Id)
+	if claims["sub"] != expectedSub {
+		t.Errorf("sub:\n - got: %v\n - want: %v\n", claims["sub"], expectedSub)
+	}
+}
+
+// testRedemptionStore records the calls, and lets DisableSession fail
+// as a concurrent redemption which already disabled the code.
+type testRedemptionStore struct {
+	*th.TestStore
+	disabled bool
+	calls    []string
+}
+
+func (s *testRedemptionStore) DisableSession(sess bridge.AuthSession) *bridge.Error {
+	s.calls = append(s.calls, "DisableSession")
+	if s.disabled {
+		return bridge.NewError(bridge.ErrFailed)
+	}
+	return s.TestStore.DisableSession(sess)
+}
+
+func (s *testRedemptionStore) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	s.calls = append(s.calls, "CreateOAuthToken")
+	return nil, bridge.NewTemporarilyUnavailableError(120, errors.New("connection refused"))
+}
+
+func TestTokenEndpointAuthorizationCodeDisabledBeforeTokenCreation(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile", nil)
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   int64(60 * 60 * 24),
+		AuthTime:    time.Now().Unix(),
+	})
+
+	store := &testRedemptionStore{TestStore: sdi, disabled: true}
+	ts := httptest.NewServer(te.Handler(store))
+	defer ts.Close()
+
+	values := map[string]string{
+		"grant_type":   "authorization_code",
+		"code":         "code_value",
+		"redirect_uri": "http://example.org/callback",
+	}
+	headers := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+		"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+	}
+
+	// the code is already disabled by another redemption, so no token is created
+	th.TokenEndpointErrorTest(t, ts, values, headers, 400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{"error": th.NewStrMatcher("invalid_grant")})
+	if fmt.Sprint(store.calls) != "[DisableSession]" {
+		t.Errorf("Calls:\n - got: %v\n - want: %v\n", store.calls, "[DisableSession]")
+	}
+
+	// the code is consumed even if the token creation fails
+	store.disabled = false
+	store.calls = nil
+	th.TokenEndpointErrorTest(t, ts, values, headers, 503,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{"error": th.NewStrMatcher("temporarily_unavailable")})
+	if fmt.Sprint(store.calls) != "[DisableSession CreateOAuthToken]" {
+		t.Errorf("Calls:\n - got: %v\n - want: %v\n", store.calls, "[DisableSession CreateOAuthToken]")
+	}
+	th.TokenEndpointErrorTest(t, ts, values, headers, 400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{"error": th.NewStrMatcher("invalid_grant")})
+}
@@ -1,11 +1,17 @@
 package goidc
 
 import (
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/lyokato/goidc/basic_auth"
 	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/io"
+	"github.com/lyokato/goidc/limiter"
 	th "github.com/lyokato/goidc/test_helper"
 )
 
@@ -148,3 +154,124 @@ func TestTokenEndpointPasswordInvalidRequest(t *testing.T) {
 			"error": th.NewStrMatcher("invalid_grant"),
 		})
 }
+
+func TestTokenEndpointPasswordLockout(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.Password())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(1700000000))
+	te.SetLimiter(limiter.NewMemoryLimiter(&limiter.Policy{
+		Threshold:   2,
+		BaseLockout: 30 * time.Second,
+		MaxLockout:  time.Hour,
+		Window:      time.Hour,
+	}))
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypePassword)
+
+	request := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(url.Values{
+			"grant_type": {"password"},
+			"username":   {"user01"},
+			"password":   {password},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header("client_id_01", "client_secret_01"))
+		w := httptest.NewRecorder()
+		te.Handler(sdi)(w, r)
+		return w
+	}
+
+	for i, expected := range []string{"", "30", "30"} {
+		w := request("wrong")
+		if w.Code != http.StatusBadRequest || w.Header().Get("Retry-After") != expected ||
+			!strings.Contains(w.Body.String(), "invalid_grant") {
+			t.Errorf("failure %d:\n - got: %v %q %s\n - want: %v %q\n", i, w.Code,
+				w.Header().Get("Retry-After"), w.Body.String(), http.StatusBadRequest, expected)
+		}
+	}
+
+	// the correct password is rejected during the lockout
+	w := request("pass01")
+	if w.Code != http.StatusBadRequest || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("during lockout:\n - got: %v %q\n - want: %v %q\n", w.Code,
+			w.Header().Get("Retry-After"), http.StatusBadRequest, "30")
+	}
+}
+
+func TestTokenEndpointClientLockout(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.Password())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(1700000000))
+	te.SetLimiter(limiter.NewMemoryLimiter(&limiter.Policy{
+		Threshold:   1,
+		BaseLockout: 10 * time.Second,
+		MaxLockout:  time.Hour,
+		Window:      time.Hour,
+	}))
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypePassword)
+
+	for _, secret := range []string{"wrong_secret", "client_secret_01"} {
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(url.Values{
+			"grant_type": {"password"},
+			"username":   {"user01"},
+			"password":   {"pass01"},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header("client_id_01", secret))
+		w := httptest.NewRecorder()
+		te.Handler(sdi)(w, r)
+
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Retry-After") != "10" ||
+			!strings.Contains(w.Body.String(), "invalid_client") {
+			t.Errorf("secret %s:\n - got: %v %q %s\n - want: %v %q\n", secret, w.Code,
+				w.Header().Get("Retry-After"), w.Body.String(), http.StatusUnauthorized, "10")
+		}
+	}
+}
+
+func TestTokenEndpointClientLockoutWithBrokenOrExpiredSecret(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.Password())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(1700000000))
+	te.SetLimiter(limiter.NewMemoryLimiter(&limiter.Policy{
+		Threshold:   1,
+		BaseLockout: 10 * time.Second,
+		MaxLockout:  time.Hour,
+		Window:      time.Hour,
+	}))
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	broken := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	broken.AllowToUseGrantType(grant.TypePassword)
+	broken.GetClientSecrets()[0].Hash = "$unknown$client_secret_01"
+	expired := sdi.CreateNewClient(user.Id, "client_id_02", "client_secret_02", "http://example.org/callback")
+	expired.AllowToUseGrantType(grant.TypePassword)
+	expired.ExpireSecrets(1700000000)
+
+	for _, cid := range []string{"client_id_01", "client_id_02"} {
+		secret := strings.Replace(cid, "id", "secret", 1)
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(url.Values{
+			"grant_type": {"password"},
+			"username":   {"user01"},
+			"password":   {"pass01"},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", basic_auth.Header(cid, secret))
+		w := httptest.NewRecorder()
+		te.Handler(sdi)(w, r)
+
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Retry-After") != "10" ||
+			!strings.Contains(w.Body.String(), "invalid_client") {
+			t.Errorf("client %s:\n - got: %v %q %s\n - want: %v %q\n", cid, w.Code,
+				w.Header().Get("Retry-After"), w.Body.String(), http.StatusUnauthorized, "10")
+		}
+	}
+}
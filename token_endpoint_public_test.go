@@ -0,0 +1,218 @@
+package goidc
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+	"github.com/lyokato/goidc/client_auth"
+	"github.com/lyokato/goidc/grant"
+	th "github.com/lyokato/goidc/test_helper"
+)
+
+func TestTokenEndpointPublicClient(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+	te.Support(grant.RefreshToken())
+	te.Support(grant.ClientCredentials())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "", "http://example.org/callback")
+	client.SetTokenEndpointAuthMethod(client_auth.None)
+	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
+	client.AllowToUseGrantType(grant.TypeRefreshToken)
+	client.AllowToUseGrantType(grant.TypeClientCredentials)
+
+	confidential := sdi.CreateNewClient(user.Id, "client_id_02", "client_secret_02", "http://example.org/callback")
+	confidential.AllowToUseGrantType(grant.TypeAuthorizationCode)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_without_pkce",
+		ExpiresIn:   int64(60 * 60 * 24),
+		AuthTime:    time.Now().Unix(),
+	})
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=UTF-8",
+	}
+
+	// confidential client can't omit the secret
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"client_id":    "client_id_02",
+			"code":         "code_value",
+			"redirect_uri": "http://example.org/callback",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_client"),
+		})
+
+	// grant not allowed for public clients
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type": "client_credentials",
+			"client_id":  "client_id_01",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("unauthorized_client"),
+		})
+
+	// code without PKCE
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"client_id":    "client_id_01",
+			"code":         "code_without_pkce",
+			"redirect_uri": "http://example.org/callback",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error":             th.NewStrMatcher("invalid_grant"),
+			"error_description": th.NewStrMatcher("PKCE is required for public clients"),
+		})
+
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI:  "http://example.org/callback",
+		Code:         "code_value",
+		CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+		ExpiresIn:    int64(60 * 60 * 24),
+		AuthTime:     time.Now().Unix(),
+	})
+
+	th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":            "authorization_code",
+			"client_id":             "client_id_01",
+			"code":                  "code_value",
+			"redirect_uri":          "http://example.org/callback",
+			"code_challenge_method": "S256",
+			"code_challenge":        "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		},
+		headers,
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	// refresh_token is rotated
+	th.TokenEndpointSuccessTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"client_id":     "client_id_01",
+			"refresh_token": "REFRESH_TOKEN_0",
+		},
+		headers,
+		200,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"refresh_token": th.NewStrMatcher("REFRESH_TOKEN_0:R"),
+		},
+		nil)
+
+	// and the old one can't be used anymore
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"client_id":     "client_id_01",
+			"refresh_token": "REFRESH_TOKEN_0",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_grant"),
+		})
+}
+
+// testRotatedStore still finds the token by the rotated refresh_token,
+// like the stores keeping them for the reuse detection.
+type testRotatedStore struct {
+	*th.TestStore
+	rotated   map[string]string
+	refreshed int
+}
+
+func (s *testRotatedStore) FindOAuthTokenByRefreshToken(token string) (bridge.OAuthToken, *bridge.Error) {
+	if current, exists := s.rotated[token]; exists {
+		token = current
+	}
+	return s.TestStore.FindOAuthTokenByRefreshToken(token)
+}
+
+func (s *testRotatedStore) RefreshAccessToken(info bridge.AuthInfo, old bridge.OAuthToken,
+	audience []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	s.refreshed++
+	return s.TestStore.RefreshAccessToken(info, old, audience, details)
+}
+
+func TestTokenEndpointPublicClientRotatedRefreshToken(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.RefreshToken())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "", "http://example.org/callback")
+	client.SetTokenEndpointAuthMethod(client_auth.None)
+	client.AllowToUseGrantType(grant.TypeRefreshToken)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
+	sdi.CreateOAuthToken(info, true, nil, nil)
+
+	store := &testRotatedStore{
+		TestStore: sdi,
+		rotated:   map[string]string{"REFRESH_TOKEN_ROTATED": "REFRESH_TOKEN_0"},
+	}
+	ts := httptest.NewServer(te.Handler(store))
+	defer ts.Close()
+
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"client_id":     "client_id_01",
+			"refresh_token": "REFRESH_TOKEN_ROTATED",
+		},
+		map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded; charset=UTF-8",
+		},
+		400,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_grant"),
+		})
+
+	// rejected before the new token is issued
+	if store.refreshed != 0 {
+		t.Errorf("RefreshAccessToken calls:\n - got: %v\n - want: %v\n", store.refreshed, 0)
+	}
+}
+
+func TestAllowedForPublicClient(t *testing.T) {
+	for gt, expected := range map[string]bool{
+		grant.TypeAuthorizationCode: true,
+		grant.TypeRefreshToken:      true,
+		grant.TypeDeviceCode:        true,
+		grant.TypeClientCredentials: false,
+		grant.TypePassword:          false,
+	} {
+		if actual := grant.AllowedForPublicClient(gt); actual != expected {
+			t.Errorf("AllowedForPublicClient(%s):\n - got: %v\n - want: %v\n", gt, actual, expected)
+		}
+	}
+}
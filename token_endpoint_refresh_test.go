@@ -1,6 +1,7 @@
 package goidc
 
 import (
+	"encoding/json"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/lyokato/goidc/authorization"
 	"github.com/lyokato/goidc/basic_auth"
 	"github.com/lyokato/goidc/grant"
+	"github.com/lyokato/goidc/io"
 	th "github.com/lyokato/goidc/test_helper"
 )
 
@@ -22,7 +24,7 @@ func TestTokenEndpointRefreshTokenInvalidRequest(t *testing.T) {
 	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
 	client.AllowToUseGrantType(grant.TypeRefreshToken)
 
-	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access")
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
 	sdi.CreateAuthSession(info, &authorization.Session{
 		RedirectURI:  "http://example.org/callback",
 		Code:         "code_value",
@@ -151,3 +153,236 @@ func TestTokenEndpointRefreshTokenInvalidRequest(t *testing.T) {
 		nil)
 
 }
+
+func TestTokenEndpointRefreshTokenWithResource(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.AuthorizationCode())
+	te.Support(grant.RefreshToken())
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeAuthorizationCode)
+	client.AllowToUseGrantType(grant.TypeRefreshToken)
+	client.AllowToUseResource("https://api1.example.org/")
+	client.AllowToUseResource("https://api2.example.org/")
+	client.AllowToUseResource("https://api3.example.org/")
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid profile offline_access", nil)
+	sdi.CreateAuthSession(info, &authorization.Session{
+		RedirectURI: "http://example.org/callback",
+		Code:        "code_value",
+		ExpiresIn:   int64(60 * 60 * 24),
+		Nonce:       "07dfa90f",
+		AuthTime:    time.Now().Unix(),
+		Resources:   []string{"https://api1.example.org/", "https://api2.example.org/"},
+	})
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+		"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+	}
+
+	// resource not requested at authorization endpoint
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"code":         "code_value",
+			"redirect_uri": "http://example.org/callback",
+			"resource":     "https://api3.example.org/",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_target"),
+		})
+
+	th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":   "authorization_code",
+			"code":         "code_value",
+			"redirect_uri": "http://example.org/callback",
+		},
+		headers,
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	token, _ := sdi.FindOAuthTokenByRefreshToken("REFRESH_TOKEN_0")
+	if len(token.GetAudience()) != 2 {
+		t.Errorf("Audience:\n - got: %v\n - want: %v\n", token.GetAudience(), token.GetResources())
+	}
+
+	// narrow the audience
+	th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": "REFRESH_TOKEN_0",
+			"resource":      "https://api1.example.org/",
+		},
+		headers,
+		200,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		})
+
+	token, _ = sdi.FindOAuthTokenByRefreshToken("REFRESH_TOKEN_0")
+	aud := token.GetAudience()
+	if len(aud) != 1 || aud[0] != "https://api1.example.org/" {
+		t.Errorf("Audience:\n - got: %v\n - want: %v\n", aud, "[https://api1.example.org/]")
+	}
+
+	// not granted
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": "REFRESH_TOKEN_0",
+			"resource":      "https://api3.example.org/",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_target"),
+		})
+
+	// not allowed for the client
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": "REFRESH_TOKEN_0",
+			"resource":      "https://unknown.example.org/",
+		},
+		headers,
+		400,
+		map[string]th.Matcher{
+			"Content-Type": th.NewStrMatcher("application/json; charset=UTF-8"),
+		},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_target"),
+		})
+}
+
+func TestTokenEndpointRefreshTokenNarrowingAuthorizationDetails(t *testing.T) {
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.RefreshToken())
+	reg := authorization.NewDetailsRegistry()
+	reg.Register("payment_initiation", nil)
+	reg.Register("account_information", nil)
+	te.SetAuthorizationDetailsRegistry(reg)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeRefreshToken)
+
+	granted := []authorization.Detail{
+		{"type": "payment_initiation"},
+		{"type": "account_information"},
+	}
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid offline_access", granted)
+	token, _ := sdi.CreateOAuthToken(info, true, nil, nil)
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	headers := map[string]string{
+		"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+		"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+	}
+
+	narrowed := `[{"type":"account_information"}]`
+	result := th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":            "refresh_token",
+			"refresh_token":         token.GetRefreshToken(),
+			"authorization_details": narrowed,
+		},
+		headers, 200, map[string]th.Matcher{})
+	actual, _ := json.Marshal(result["authorization_details"])
+	if string(actual) != narrowed {
+		t.Errorf("authorization_details:\n - got: %v\n - want: %v\n", string(actual), narrowed)
+	}
+
+	// the new access_token is limited to the narrowed ones
+	r := httptest.NewRequest("GET", "/resource", nil)
+	r.Header.Set("Authorization", "Bearer "+result["access_token"].(string))
+	p, ok := NewResourceProtector("api.example.org").Validate(httptest.NewRecorder(), r, sdi)
+	if !ok {
+		t.Fatalf("Validate:\n - got: %v\n - want: %v\n", ok, true)
+	}
+	actual, _ = json.Marshal(p.AuthorizationDetails)
+	if string(actual) != narrowed {
+		t.Errorf("Principal.AuthorizationDetails:\n - got: %v\n - want: %v\n", string(actual), narrowed)
+	}
+
+	// without the parameter, all the granted ones
+	result = th.PostFormValueRequestWithJSONResponse(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": token.GetRefreshToken(),
+		},
+		headers, 200, map[string]th.Matcher{})
+	actual, _ = json.Marshal(result["authorization_details"])
+	expected, _ := json.Marshal(granted)
+	if string(actual) != string(expected) {
+		t.Errorf("authorization_details:\n - got: %v\n - want: %v\n", string(actual), string(expected))
+	}
+
+	// not granted
+	th.TokenEndpointErrorTest(t, ts,
+		map[string]string{
+			"grant_type":            "refresh_token",
+			"refresh_token":         token.GetRefreshToken(),
+			"authorization_details": `[{"type":"payment_initiation","amount":"10"}]`,
+		},
+		headers, 400, map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"error": th.NewStrMatcher("invalid_authorization_details"),
+		})
+}
+
+func TestTokenEndpointRefreshTokenIdTokenExpiresIn(t *testing.T) {
+	now := time.Now().Unix()
+	te := NewTokenEndpoint("api.example.org")
+	te.Support(grant.RefreshToken())
+	te.SetTimeBuilder(io.FixedUnixTimeBuilder(now))
+	te.SetIdTokenExpiresIn(600)
+
+	sdi := th.NewTestStore()
+	user := sdi.CreateNewUser("user01", "pass01")
+	client := sdi.CreateNewClient(user.Id, "client_id_01", "client_secret_01", "http://example.org/callback")
+	client.AllowToUseGrantType(grant.TypeRefreshToken)
+
+	info, _ := sdi.CreateOrUpdateAuthInfo(user.Id, client.GetId(), "openid offline_access", nil)
+	token, _ := sdi.CreateOAuthToken(info, true, nil, nil)
+
+	ts := httptest.NewServer(te.Handler(sdi))
+	defer ts.Close()
+
+	th.TokenEndpointSuccessTest(t, ts,
+		map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": token.GetRefreshToken(),
+		},
+		map[string]string{
+			"Content-Type":  "application/x-www-form-urlencoded; charset=UTF-8",
+			"Authorization": basic_auth.Header("client_id_01", "client_secret_01"),
+		},
+		200,
+		map[string]th.Matcher{},
+		map[string]th.Matcher{},
+		map[string]th.Matcher{
+			"iat": th.NewInt64Matcher(now),
+			"exp": th.NewInt64Matcher(now + 600),
+		})
+}
@@ -0,0 +1,158 @@
+// Package tokengen generates the values of codes and tokens from crypto/rand.
+package tokengen
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+const (
+	// DefaultEntropy is bytes of the random part, 256 bits.
+	DefaultEntropy = 32
+	// MinEntropy is the smallest entropy Generate accepts, 128 bits.
+	MinEntropy = 16
+)
+
+var (
+	ErrTooLowEntropy   = fmt.Errorf("tokengen: entropy must be at least %d bytes", MinEntropy)
+	ErrUnknownEncoding = errors.New("tokengen: unknown encoding")
+)
+
+type Encoding int
+
+const (
+	// URL safe base64 without padding, the default
+	Base64URL Encoding = iota
+	// lowercase base32 without padding
+	Base32
+	// lowercase hex
+	Hex
+)
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func (e Encoding) String() string {
+	switch e {
+	case Base64URL:
+		return "base64url"
+	case Base32:
+		return "base32"
+	case Hex:
+		return "hex"
+	}
+	return "unknown"
+}
+
+func (e Encoding) encode(b []byte) (string, error) {
+	switch e {
+	case Base64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case Base32:
+		return base32Lower.EncodeToString(b), nil
+	case Hex:
+		return hex.EncodeToString(b), nil
+	}
+	return "", ErrUnknownEncoding
+}
+
+func (e Encoding) encodedLen(n int) int {
+	switch e {
+	case Base64URL:
+		return base64.RawURLEncoding.EncodedLen(n)
+	case Base32:
+		return base32Lower.EncodedLen(n)
+	case Hex:
+		return hex.EncodedLen(n)
+	}
+	return 0
+}
+
+// Generator builds the value as Prefix, the random part, and the checksum.
+// The zero value generates 256 bits base64url string.
+type Generator struct {
+	// bytes read from crypto/rand, 0 means DefaultEntropy
+	Entropy  int
+	Encoding Encoding
+	// fixed string to identify the kind of the value, like "at_",
+	// so that secret scanning tools can find the leaked ones.
+	Prefix string
+	// appends CRC32 of Prefix and the random part, so that Verify
+	// can tell the value is well-formed without asking the database.
+	Checksum bool
+}
+
+// Default returns the generator used for codes and tokens
+// when no other one is given.
+func Default() *Generator {
+	return &Generator{Entropy: DefaultEntropy, Encoding: Base64URL}
+}
+
+func (g *Generator) entropy() int {
+	if g.Entropy == 0 {
+		return DefaultEntropy
+	}
+	return g.Entropy
+}
+
+// Generate returns a new value. It fails when Entropy is less than MinEntropy,
+// so that a misconfiguration never issues guessable values.
+func (g *Generator) Generate() (string, error) {
+	if g.entropy() < MinEntropy {
+		return "", ErrTooLowEntropy
+	}
+	b := make([]byte, g.entropy())
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	body, err := g.Encoding.encode(b)
+	if err != nil {
+		return "", err
+	}
+	value := g.Prefix + body
+	if g.Checksum {
+		sum, err := g.checksum(value)
+		if err != nil {
+			return "", err
+		}
+		value += sum
+	}
+	return value, nil
+}
+
+func (g *Generator) checksum(s string) (string, error) {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE([]byte(s)))
+	return g.Encoding.encode(sum)
+}
+
+// Verify reports whether value has the form this generator makes,
+// the prefix, the length and the checksum. It doesn't tell the value is issued.
+func (g *Generator) Verify(value string) bool {
+	if !strings.HasPrefix(value, g.Prefix) {
+		return false
+	}
+	size := len(g.Prefix) + g.Encoding.encodedLen(g.entropy())
+	if g.Checksum {
+		size += g.Encoding.encodedLen(4)
+	}
+	if g.Encoding.encodedLen(1) == 0 || len(value) != size {
+		return false
+	}
+	if !g.Checksum {
+		return true
+	}
+	body := value[:size-g.Encoding.encodedLen(4)]
+	sum, err := g.checksum(body)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(value[len(body):])) == 1
+}
@@ -0,0 +1,77 @@
+package tokengen
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		gen     *Generator
+		pattern string
+	}{
+		{&Generator{}, `^[A-Za-z0-9_-]{43}$`},
+		{Default(), `^[A-Za-z0-9_-]{43}$`},
+		{&Generator{Entropy: 16, Encoding: Hex}, `^[0-9a-f]{32}$`},
+		{&Generator{Entropy: 20, Encoding: Base32, Prefix: "at_"}, `^at_[a-z2-7]{32}$`},
+		{&Generator{Encoding: Base32, Prefix: "rt_", Checksum: true}, `^rt_[a-z2-7]{52}[a-z2-7]{7}$`},
+		{&Generator{Entropy: 16, Encoding: Hex, Checksum: true}, `^[0-9a-f]{32}[0-9a-f]{8}$`},
+	}
+	for _, test := range tests {
+		v, err := test.gen.Generate()
+		if err != nil {
+			t.Fatalf("Generate:\n - got: %v\n - want: %v\n", err, nil)
+		}
+		if !regexp.MustCompile(test.pattern).MatchString(v) {
+			t.Errorf("Generated:\n - got: %v\n - want: %v\n", v, test.pattern)
+		}
+		if !test.gen.Verify(v) {
+			t.Errorf("Verify %s:\n - got: %v\n - want: %v\n", v, false, true)
+		}
+		other, _ := test.gen.Generate()
+		if other == v {
+			t.Errorf("Generated twice:\n - got: %v\n - want: different values\n", v)
+		}
+	}
+}
+
+func TestGenerateTooLowEntropy(t *testing.T) {
+	g := &Generator{Entropy: MinEntropy - 1}
+	if _, err := g.Generate(); err != ErrTooLowEntropy {
+		t.Errorf("Generate:\n - got: %v\n - want: %v\n", err, ErrTooLowEntropy)
+	}
+	g = &Generator{Encoding: Encoding(100)}
+	if _, err := g.Generate(); err != ErrUnknownEncoding {
+		t.Errorf("Generate:\n - got: %v\n - want: %v\n", err, ErrUnknownEncoding)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	g := &Generator{Prefix: "goidc_at_", Checksum: true}
+	v, _ := g.Generate()
+
+	tampered := []byte(v)
+	i := len(g.Prefix)
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	invalid := []string{
+		"",
+		strings.TrimPrefix(v, g.Prefix),
+		"goidc_rt_" + strings.TrimPrefix(v, g.Prefix),
+		v[:len(v)-1],
+		v + "A",
+		string(tampered),
+	}
+	for _, value := range invalid {
+		if g.Verify(value) {
+			t.Errorf("Verify %q:\n - got: %v\n - want: %v\n", value, true, false)
+		}
+	}
+	if (&Generator{Prefix: "goidc_at_"}).Verify(v) {
+		t.Errorf("Verify without checksum:\n - got: %v\n - want: %v\n", true, false)
+	}
+}
@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/lyokato/goidc/authorization"
+	"github.com/lyokato/goidc/bridge"
+)
+
+// TraceDataInterface returns DataInterface which starts
+// a child span of ctx for each method call.
+func TraceDataInterface(ctx context.Context, di bridge.DataInterface, t Tracer) bridge.DataInterface {
+	return &tracedDataInterface{ctx, di, t}
+}
+
+type tracedDataInterface struct {
+	ctx    context.Context
+	di     bridge.DataInterface
+	tracer Tracer
+}
+
+func (d *tracedDataInterface) start(method string) Span {
+	_, span := d.tracer.Start(d.ctx, "DataInterface."+method, String(AttrMethod, method))
+	return span
+}
+
+func (d *tracedDataInterface) Issuer() string {
+	return d.di.Issuer()
+}
+
+func (d *tracedDataInterface) FindClientById(clientId string) (bridge.Client, *bridge.Error) {
+	span := d.start("FindClientById")
+	v, err := d.di.FindClientById(clientId)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindAuthSessionByCode(code string) (bridge.AuthSession, *bridge.Error) {
+	span := d.start("FindAuthSessionByCode")
+	v, err := d.di.FindAuthSessionByCode(code)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindActiveAuthInfoById(id int64) (bridge.AuthInfo, *bridge.Error) {
+	span := d.start("FindActiveAuthInfoById")
+	v, err := d.di.FindActiveAuthInfoById(id)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindAuthInfoByUserIdAndClientId(uid int64,
+	clientId string) (bridge.AuthInfo, *bridge.Error) {
+	span := d.start("FindAuthInfoByUserIdAndClientId")
+	v, err := d.di.FindAuthInfoByUserIdAndClientId(uid, clientId)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindOAuthTokenByAccessToken(token string) (bridge.OAuthToken, *bridge.Error) {
+	span := d.start("FindOAuthTokenByAccessToken")
+	v, err := d.di.FindOAuthTokenByAccessToken(token)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindOAuthTokenByRefreshToken(token string) (bridge.OAuthToken, *bridge.Error) {
+	span := d.start("FindOAuthTokenByRefreshToken")
+	v, err := d.di.FindOAuthTokenByRefreshToken(token)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) CreateOAuthToken(info bridge.AuthInfo, onTokenEndpoint bool,
+	resources []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	span := d.start("CreateOAuthToken")
+	v, err := d.di.CreateOAuthToken(info, onTokenEndpoint, resources, details)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) RefreshAccessToken(info bridge.AuthInfo, token bridge.OAuthToken,
+	audience []string, details []authorization.Detail) (bridge.OAuthToken, *bridge.Error) {
+	span := d.start("RefreshAccessToken")
+	v, err := d.di.RefreshAccessToken(info, token, audience, details)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) FindUserId(username, password string) (int64, *bridge.Error) {
+	span := d.start("FindUserId")
+	v, err := d.di.FindUserId(username, password)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) CreateOrUpdateAuthInfo(uid int64, clientId, scope string,
+	details []authorization.Detail) (bridge.AuthInfo, *bridge.Error) {
+	span := d.start("CreateOrUpdateAuthInfo")
+	v, err := d.di.CreateOrUpdateAuthInfo(uid, clientId, scope, details)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) CreateAuthSession(info bridge.AuthInfo,
+	session *authorization.Session) *bridge.Error {
+	span := d.start("CreateAuthSession")
+	err := d.di.CreateAuthSession(info, session)
+	endWithInterfaceError(span, err)
+	return err
+}
+
+func (d *tracedDataInterface) DisableSession(sess bridge.AuthSession) *bridge.Error {
+	span := d.start("DisableSession")
+	err := d.di.DisableSession(sess)
+	endWithInterfaceError(span, err)
+	return err
+}
+
+func (d *tracedDataInterface) FindUserIdBySubject(sub string) (int64, *bridge.Error) {
+	span := d.start("FindUserIdBySubject")
+	v, err := d.di.FindUserIdBySubject(sub)
+	endWithInterfaceError(span, err)
+	return v, err
+}
+
+func (d *tracedDataInterface) RecordSubject(uid int64, sub string) *bridge.Error {
+	span := d.start("RecordSubject")
+	err := d.di.RecordSubject(uid, sub)
+	endWithInterfaceError(span, err)
+	return err
+}
+
+func (d *tracedDataInterface) RecordAssertionClaims(clientId, jti string,
+	issuedAt, expiredAt int64) *bridge.Error {
+	span := d.start("RecordAssertionClaims")
+	err := d.di.RecordAssertionClaims(clientId, jti, issuedAt, expiredAt)
+	endWithInterfaceError(span, err)
+	return err
+}
+
+// TraceAuthorizationCallbacks returns AuthorizationCallbacks which starts
+// a child span of ctx for each method call.
+func TraceAuthorizationCallbacks(ctx context.Context, cb bridge.AuthorizationCallbacks,
+	t Tracer) bridge.AuthorizationCallbacks {
+	return &tracedAuthorizationCallbacks{ctx, cb, t}
+}
+
+type tracedAuthorizationCallbacks struct {
+	ctx    context.Context
+	cb     bridge.AuthorizationCallbacks
+	tracer Tracer
+}
+
+func (c *tracedAuthorizationCallbacks) start(method string) Span {
+	_, span := c.tracer.Start(c.ctx, "AuthorizationCallbacks."+method, String(AttrMethod, method))
+	return span
+}
+
+func endWithError(span Span, err error) {
+	if err == nil {
+		span.SetAttributes(String(AttrOutcome, OutcomeSuccess))
+	} else {
+		span.SetAttributes(String(AttrOutcome, "error"))
+		span.Fail(err.Error())
+	}
+	span.End()
+}
+
+func (c *tracedAuthorizationCallbacks) ShowErrorScreen(authErrType int) {
+	span := c.start("ShowErrorScreen")
+	c.cb.ShowErrorScreen(authErrType)
+	span.End()
+}
+
+func (c *tracedAuthorizationCallbacks) ShowLoginScreen(req *authorization.Request) error {
+	span := c.start("ShowLoginScreen")
+	err := c.cb.ShowLoginScreen(req)
+	endWithError(span, err)
+	return err
+}
+
+func (c *tracedAuthorizationCallbacks) ShowConsentScreen(client bridge.Client, req *authorization.Request) error {
+	span := c.start("ShowConsentScreen")
+	err := c.cb.ShowConsentScreen(client, req)
+	endWithError(span, err)
+	return err
+}
+
+func (c *tracedAuthorizationCallbacks) ChooseLocale(locales string) (string, error) {
+	span := c.start("ChooseLocale")
+	v, err := c.cb.ChooseLocale(locales)
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) ConfirmLoginSession() (bool, error) {
+	span := c.start("ConfirmLoginSession")
+	v, err := c.cb.ConfirmLoginSession()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) RequestIsFromLogin() (bool, error) {
+	span := c.start("RequestIsFromLogin")
+	v, err := c.cb.RequestIsFromLogin()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) GetAuthTime() (int64, error) {
+	span := c.start("GetAuthTime")
+	v, err := c.cb.GetAuthTime()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) GetLoginUserId() (int64, error) {
+	span := c.start("GetLoginUserId")
+	v, err := c.cb.GetLoginUserId()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) CreateAuthorizationCode() (string, error) {
+	span := c.start("CreateAuthorizationCode")
+	v, err := c.cb.CreateAuthorizationCode()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) Continue() (*authorization.Request, error) {
+	span := c.start("Continue")
+	v, err := c.cb.Continue()
+	endWithError(span, err)
+	return v, err
+}
+
+func (c *tracedAuthorizationCallbacks) LoginUserIsMatchedToSubject(sub string) (bool, error) {
+	span := c.start("LoginUserIsMatchedToSubject")
+	v, err := c.cb.LoginUserIsMatchedToSubject(sub)
+	endWithError(span, err)
+	return v, err
+}
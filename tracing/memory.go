@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+)
+
+// RecordedSpan is a span kept by MemoryTracer.
+type RecordedSpan struct {
+	Name        string
+	Context     SpanContext
+	Parent      SpanContext
+	Attributes  map[string]string
+	Failed      bool
+	Description string
+	Ended       bool
+
+	tracer *MemoryTracer
+}
+
+// MemoryTracer keeps the spans in memory, for tests and debugging.
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{spans: make([]*RecordedSpan, 0)}
+}
+
+func (t *MemoryTracer) Start(ctx context.Context, name string,
+	attrs ...Attribute) (context.Context, Span) {
+	s := &RecordedSpan{
+		Name:       name,
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	parent, ok := SpanContextFromContext(ctx)
+	if ok && parent.IsValid() {
+		s.Parent = parent
+		s.Context.TraceId = parent.TraceId
+		s.Context.Flags = parent.Flags
+	} else {
+		rand.Read(s.Context.TraceId[:])
+		s.Context.Flags = 0x01
+	}
+	rand.Read(s.Context.SpanId[:])
+	s.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return ContextWithSpanContext(ctx, s.Context), s
+}
+
+// Spans returns the spans in the started order.
+func (t *MemoryTracer) Spans() []*RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := make([]*RecordedSpan, len(t.spans))
+	copy(spans, t.spans)
+	return spans
+}
+
+func (t *MemoryTracer) FindByName(name string) []*RecordedSpan {
+	found := make([]*RecordedSpan, 0)
+	for _, s := range t.Spans() {
+		if s.Name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func (s *RecordedSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, a := range attrs {
+		s.Attributes[a.Key] = a.Value
+	}
+}
+
+func (s *RecordedSpan) Fail(description string) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.Failed = true
+	s.Description = description
+}
+
+func (s *RecordedSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.Ended = true
+}
@@ -0,0 +1,66 @@
+// Package otel adapts OpenTelemetry tracer to tracing.Tracer.
+package otel
+
+import (
+	"context"
+
+	"github.com/lyokato/goidc/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns tracing.Tracer which starts the spans with t.
+// When ctx has no OpenTelemetry span, the remote parent
+// extracted by tracing.Extract is used.
+func NewTracer(t trace.Tracer) tracing.Tracer {
+	return &tracer{t}
+}
+
+func (t *tracer) Start(ctx context.Context, name string,
+	attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if sc, ok := tracing.SpanContextFromContext(ctx); ok && sc.IsValid() {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, toSpanContext(sc))
+		}
+	}
+	ctx, s := t.tracer.Start(ctx, name, trace.WithAttributes(toAttributes(attrs)...))
+	return ctx, &span{s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s *span) SetAttributes(attrs ...tracing.Attribute) {
+	s.span.SetAttributes(toAttributes(attrs)...)
+}
+
+func (s *span) Fail(description string) {
+	s.span.SetStatus(codes.Error, description)
+}
+
+func (s *span) End() {
+	s.span.End()
+}
+
+func toAttributes(attrs []tracing.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		kvs[i] = attribute.String(a.Key, a.Value)
+	}
+	return kvs
+}
+
+func toSpanContext(sc tracing.SpanContext) trace.SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID(sc.TraceId),
+		SpanID:     trace.SpanID(sc.SpanId),
+		TraceFlags: trace.TraceFlags(sc.Flags),
+		Remote:     sc.Remote,
+	})
+}
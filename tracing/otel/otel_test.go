@@ -0,0 +1,53 @@
+package otel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lyokato/goidc/tracing"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := NewTracer(provider.Tracer("goidc"))
+
+	header := http.Header{}
+	header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, parent := tracer.Start(tracing.Extract(context.Background(), header), "goidc.token_endpoint",
+		tracing.String(tracing.AttrEndpoint, "token_endpoint"))
+	_, child := tracer.Start(ctx, "DataInterface.FindClientById")
+	child.Fail("server_error")
+	child.End()
+	parent.SetAttributes(tracing.String(tracing.AttrOutcome, tracing.OutcomeSuccess))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Errorf("Spans:\n - got: %v\n - want: %v\n", len(spans), 2)
+		return
+	}
+	c, p := spans[0], spans[1]
+	if p.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		p.Parent.SpanID().String() != "00f067aa0ba902b7" || !p.Parent.IsRemote() {
+		t.Errorf("endpoint span should join the remote trace: %+v", p.Parent)
+	}
+	if c.Parent.SpanID() != p.SpanContext.SpanID() {
+		t.Errorf("Parent:\n - got: %v\n - want: %v\n", c.Parent.SpanID(), p.SpanContext.SpanID())
+	}
+	if c.Status.Code != codes.Error || c.Status.Description != "server_error" {
+		t.Errorf("Status:\n - got: %v\n - want: %v\n", c.Status, codes.Error)
+	}
+	attrs := make(map[string]string)
+	for _, kv := range p.Attributes {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs[tracing.AttrEndpoint] != "token_endpoint" || attrs[tracing.AttrOutcome] != "success" {
+		t.Errorf("unexpected attributes: %v", attrs)
+	}
+}
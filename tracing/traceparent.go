@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the header of W3C Trace Context.
+const TraceparentHeader = "traceparent"
+
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+	// the span is created by another process
+	Remote bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId != [16]byte{} && sc.SpanId != [8]byte{}
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&0x01 == 0x01
+}
+
+func (sc SpanContext) TraceIdString() string {
+	return hex.EncodeToString(sc.TraceId[:])
+}
+
+func (sc SpanContext) SpanIdString() string {
+	return hex.EncodeToString(sc.SpanId[:])
+}
+
+// Traceparent returns the value of 'traceparent' header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceIdString(), sc.SpanIdString(), sc.Flags)
+}
+
+// ParseTraceparent parses 'traceparent' header.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func ParseTraceparent(value string) (SpanContext, bool) {
+	sc := SpanContext{Remote: true}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return sc, false
+	}
+	// version 00 has exactly 4 fields, the later versions may add more
+	if version[0] == 0x00 && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeLowerHex(sc.TraceId[:], parts[1]) || !decodeLowerHex(sc.SpanId[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeLowerHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+func decodeLowerHex(dst []byte, s string) bool {
+	if len(s) != len(dst)*2 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type spanContextKey struct{}
+
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Extract returns ctx with the remote SpanContext in 'traceparent' header,
+// so that the spans started with it join the caller's trace.
+// Invalid header is ignored.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject sets 'traceparent' header for the span in ctx.
+func Inject(ctx context.Context, header http.Header) {
+	if sc, ok := SpanContextFromContext(ctx); ok && sc.IsValid() {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
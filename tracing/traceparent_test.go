@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(value)
+	if !ok {
+		t.Errorf("ParseTraceparent:\n - got: %v\n - want: %v\n", ok, true)
+		return
+	}
+	if sc.TraceIdString() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		sc.SpanIdString() != "00f067aa0ba902b7" || !sc.IsSampled() || !sc.Remote {
+		t.Errorf("unexpected span context: %+v", sc)
+	}
+	if sc.Traceparent() != value {
+		t.Errorf("Traceparent:\n - got: %v\n - want: %v\n", sc.Traceparent(), value)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("ParseTraceparent(%q):\n - got: %v\n - want: %v\n", invalid, ok, false)
+		}
+	}
+
+	// the later versions may have more fields
+	if _, ok := ParseTraceparent(value[2:] + "-extra"); ok {
+		t.Errorf("ParseTraceparent: missing version should be rejected")
+	}
+	if _, ok := ParseTraceparent("01" + value[2:] + "-extra"); !ok {
+		t.Errorf("ParseTraceparent: future version should be accepted")
+	}
+}
+
+func TestExtractAndMemoryTracer(t *testing.T) {
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	tracer := NewMemoryTracer()
+	ctx, parent := tracer.Start(Extract(context.Background(), header), "parent")
+	_, child := tracer.Start(ctx, "child", String(AttrMethod, "FindClientById"))
+	child.Fail("server_error")
+	child.End()
+	parent.End()
+
+	spans := tracer.Spans()
+	if len(spans) != 2 {
+		t.Errorf("Spans:\n - got: %v\n - want: %v\n", len(spans), 2)
+		return
+	}
+	if spans[0].Context.TraceIdString() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		spans[0].Parent.SpanIdString() != "00f067aa0ba902b7" {
+		t.Errorf("parent should join the remote trace: %+v", spans[0])
+	}
+	if spans[1].Parent.SpanId != spans[0].Context.SpanId ||
+		spans[1].Attributes[AttrMethod] != "FindClientById" || !spans[1].Failed || !spans[1].Ended {
+		t.Errorf("unexpected child: %+v", spans[1])
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if out.Get(TraceparentHeader) != spans[0].Context.Traceparent() {
+		t.Errorf("Inject:\n - got: %v\n - want: %v\n", out.Get(TraceparentHeader),
+			spans[0].Context.Traceparent())
+	}
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/lyokato/goidc/bridge"
+)
+
+// attribute keys set by the endpoints
+const (
+	AttrEndpoint  = "goidc.endpoint"
+	AttrGrantType = "goidc.grant_type"
+	AttrClientId  = "goidc.client_id"
+	AttrFlowType  = "goidc.flow_type"
+	AttrMethod    = "goidc.method"
+	// "success", or the error type
+	AttrOutcome = "goidc.outcome"
+
+	OutcomeSuccess = "success"
+)
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Tracer starts spans. The parent is taken from ctx,
+// which may hold a remote SpanContext set by Extract.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// Fail marks the span as failed, for errors on the provider side.
+	Fail(description string)
+	End()
+}
+
+type nopTracer struct{}
+
+type nopSpan struct{}
+
+// Nop returns Tracer which records nothing.
+func Nop() Tracer {
+	return nopTracer{}
+}
+
+func (nopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopSpan) SetAttributes(attrs ...Attribute) {}
+func (nopSpan) Fail(description string)          {}
+func (nopSpan) End()                             {}
+
+func endWithInterfaceError(span Span, err *bridge.Error) {
+	if err == nil {
+		span.SetAttributes(String(AttrOutcome, OutcomeSuccess))
+	} else {
+		span.SetAttributes(String(AttrOutcome, err.Type().String()))
+		// ErrFailed means not found or mismatch, it's not a failure of the call
+		if err.Type() != bridge.ErrFailed {
+			span.Fail(err.Error())
+		}
+	}
+	span.End()
+}